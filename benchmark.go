@@ -4,15 +4,19 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -33,15 +37,107 @@ type Provider struct {
 	Payload         []byte // JSON payload to be used for requests
 	PayloadTemplate string // String template for efficient payload generation (pre-built with placeholders)
 	RequestType     string // Type of request: "chat" or "embedding"
+	ConnectionMode  string // "warm" (keep-alive) or "cold" (new connection per request); empty means warm, unlabeled
+}
+
+// ResultName returns the name results are reported under: the provider name,
+// suffixed with the connection mode when runs are split by --connection-mode.
+func (p Provider) ResultName() string {
+	if p.ConnectionMode == "" {
+		return p.Name
+	}
+	return p.Name + "-" + p.ConnectionMode
 }
 
 // BenchmarkResult holds the aggregated metrics from a single benchmark run for a provider.
 type BenchmarkResult struct {
-	ProviderName      string          // Name of the provider benchmarked
-	Metrics           *vegeta.Metrics // Vegeta metrics (latency, success rate, etc.)
-	CPUUsage          float64         // (Currently unused) Placeholder for CPU usage metrics
-	ServerMemoryStats []ServerMemStat // Time-series data of server memory usage during the benchmark
-	DropReasons       map[string]int  // Tracks reasons for dropped or failed requests and their counts
+	ProviderName      string             // Name of the provider benchmarked
+	Metrics           *vegeta.Metrics    // Vegeta metrics (latency, success rate, etc.)
+	CPUUsage          float64            // (Currently unused) Placeholder for CPU usage metrics
+	ServerMemoryStats []ServerMemStat    // Time-series data of server memory usage during the benchmark
+	DropReasons       map[string]int     // Tracks reasons for dropped or failed requests and their counts
+	SuccessStatuses   []int              // Status codes counted as success in --users mode (empty = any 2xx)
+	Phases            *concurrent.Phases // Mean per-request latency breakdown (--users mode only)
+	ConnReusePercent  float64            // Share of responses served on a reused connection (--users mode only)
+	LeakCheck         *LeakCheckResult   // Goroutine/FD baseline vs. post-cooldown comparison (--leak-check only)
+	MBpsIn            float64            // Response body megabytes received per second
+	MBpsOut           float64            // Request body megabytes sent per second
+	ConnectionMode    string             // "warm" or "cold" when runs are split by --connection-mode
+	StageTimings      []StageTiming      // Gateway-reported per-stage timings over the run (--stage-metrics only)
+	VsBestPercent     map[string]float64 // Per comparison metric, percent difference from the best provider (multi-provider runs only)
+}
+
+// comparisonMetric is one row of the comparison matrix printed after
+// multi-provider runs, keyed like the matching results-file field.
+type comparisonMetric struct {
+	Key         string
+	Label       string
+	LowerBetter bool
+	Value       func(BenchmarkResult) float64
+	Format      func(float64) string
+}
+
+func formatMs(v float64) string { return fmt.Sprintf("%.2fms", v) }
+
+var comparisonMetrics = []comparisonMetric{
+	{"success_rate", "Success Rate", false, func(r BenchmarkResult) float64 { return 100 * r.Metrics.Success },
+		func(v float64) string { return fmt.Sprintf("%.2f%%", v) }},
+	{"throughput_rps", "Throughput", false, func(r BenchmarkResult) float64 { return r.Metrics.Throughput },
+		func(v float64) string { return fmt.Sprintf("%.2f/s", v) }},
+	{"mean_latency_ms", "Mean Latency", true, func(r BenchmarkResult) float64 { return durationMs(r.Metrics.Latencies.Mean) }, formatMs},
+	{"p50_latency_ms", "P50 Latency", true, func(r BenchmarkResult) float64 { return durationMs(r.Metrics.Latencies.P50) }, formatMs},
+	{"p99_latency_ms", "P99 Latency", true, func(r BenchmarkResult) float64 { return durationMs(r.Metrics.Latencies.P99) }, formatMs},
+	{"max_latency_ms", "Max Latency", true, func(r BenchmarkResult) float64 { return durationMs(r.Metrics.Latencies.Max) }, formatMs},
+	{"server_peak_memory_mb", "Server Peak Memory", true, func(r BenchmarkResult) float64 { return peakMemoryMB(r.ServerMemoryStats) },
+		func(v float64) string { return fmt.Sprintf("%.1f MB", v) }},
+}
+
+// LeakCheckConfig enables the post-cooldown goroutine/FD regression check.
+type LeakCheckConfig struct {
+	TolerancePercent float64 // Allowed growth over the pre-attack baseline, in percent
+	MetricsPath      string  // Path of the target's Prometheus endpoint exposing go_goroutines
+}
+
+// ResourceSnapshot is a point-in-time count of a server's goroutines and open
+// file descriptors. -1 marks a count that could not be read.
+type ResourceSnapshot struct {
+	Goroutines int
+	FDs        int
+}
+
+// LeakCheckResult compares resource counts before the attack and after cooldown.
+type LeakCheckResult struct {
+	Baseline ResourceSnapshot
+	After    ResourceSnapshot
+	Leaks    []string // Human-readable description of each count over tolerance
+	Skipped  []string // Counts not compared because a snapshot couldn't read them
+}
+
+// StageMetricsConfig names the Prometheus histograms through which the Bifrost
+// gateway reports its internal stages (queue wait, key selection, upstream
+// call, ...), keyed by the stage name used in results.
+type StageMetricsConfig struct {
+	Stages      []StageMetric
+	MetricsPath string // Path of the gateway's Prometheus endpoint
+}
+
+// StageMetric maps a stage name to the histogram reporting it.
+type StageMetric struct {
+	Name   string
+	Metric string // Histogram base name; _sum and _count are read
+}
+
+// StageTiming is the mean time the gateway spent in one stage during a run.
+type StageTiming struct {
+	Name  string
+	Mean  time.Duration
+	Count uint64 // Observations recorded during the run
+}
+
+// histogramTotals is a histogram's _sum and _count, summed across label sets.
+type histogramTotals struct {
+	Sum   float64
+	Count float64
 }
 
 // MemStat captures generic memory statistics (currently unused in active logic but defined for potential future use).
@@ -82,6 +178,13 @@ func main() {
 	rampUp := flag.Bool("ramp-up", false, "Enable gradual ramp-up of users (only with --users, requires --ramp-up-duration)")
 	rampUpDuration := flag.Int("ramp-up-duration", 0, "Duration in seconds to ramp up to target users (only with --users and --ramp-up)")
 	debug := flag.Bool("debug", false, "Enable debug mode with detailed logging and periodic status updates")
+	connectionMode := flag.String("connection-mode", "warm", "Connection reuse: 'warm' (keep-alive), 'cold' (new connection per request), or 'both' to run each provider once per mode and compare")
+	leakCheck := flag.Bool("leak-check", false, "After each run, wait out --cooldown and flag goroutine/FD counts that did not return to their pre-attack baseline")
+	leakTolerance := flag.Float64("leak-tolerance", 10, "Allowed growth in percent over the baseline before --leak-check flags a leak")
+	metricsPath := flag.String("metrics-path", "/metrics", "Path of the target's Prometheus endpoint used by --leak-check and --stage-metrics")
+	stageMetricsFlag := flag.String("stage-metrics", "", "Bifrost stage timings to report as stage=histogram pairs read from --metrics-path (e.g. 'queue_wait=my_queue_wait_seconds,upstream=my_upstream_seconds')")
+	soakSpool := flag.String("soak-spool", "", "Soak mode for long --users runs: spool per-second results to this JSON-lines file (one per provider) instead of keeping them in memory")
+	successCodesFlag := flag.String("success-codes", "", "Comma-separated HTTP status codes counted as success in --users mode (e.g. '200,429'; default: any 2xx)")
 
 	// Parse the command line flags.
 	flag.Parse()
@@ -107,6 +210,47 @@ func main() {
 		}
 	}
 
+	// Parse success status codes
+	var successCodes []int
+	if *successCodesFlag != "" {
+		if *users == 0 {
+			log.Fatalf("--success-codes can only be used with --users flag.")
+		}
+		for _, c := range strings.Split(*successCodesFlag, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(c))
+			if err != nil || code < 100 || code > 599 {
+				log.Fatalf("Invalid status code '%s' in --success-codes", c)
+			}
+			successCodes = append(successCodes, code)
+		}
+	}
+
+	if *soakSpool != "" && *users == 0 {
+		log.Fatalf("--soak-spool can only be used with --users flag.")
+	}
+
+	// Configure the leak check
+	var leakCheckConfig *LeakCheckConfig
+	if *leakCheck {
+		if *cooldown <= 0 {
+			log.Fatalf("--leak-check needs a positive --cooldown to let the server settle.")
+		}
+		leakCheckConfig = &LeakCheckConfig{TolerancePercent: *leakTolerance, MetricsPath: *metricsPath}
+	}
+
+	// Configure gateway stage timings
+	var stageMetricsConfig *StageMetricsConfig
+	if *stageMetricsFlag != "" {
+		stageMetricsConfig = &StageMetricsConfig{MetricsPath: *metricsPath}
+		for _, entry := range strings.Split(*stageMetricsFlag, ",") {
+			name, metric, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || strings.TrimSpace(name) == "" || strings.TrimSpace(metric) == "" {
+				log.Fatalf("Invalid --stage-metrics entry '%s'. Must be stage=histogram", entry)
+			}
+			stageMetricsConfig.Stages = append(stageMetricsConfig.Stages, StageMetric{Name: strings.TrimSpace(name), Metric: strings.TrimSpace(metric)})
+		}
+	}
+
 	// Validate request type
 	if *requestType != "chat" && *requestType != "embedding" {
 		log.Fatalf("Invalid request-type '%s'. Must be 'chat' or 'embedding'", *requestType)
@@ -143,8 +287,35 @@ func main() {
 		fmt.Println("No specific provider specified. Running benchmarks for all providers...")
 	}
 
+	// Split each provider into warm/cold runs if requested
+	switch *connectionMode {
+	case "warm":
+	case "cold":
+		for i := range providers {
+			providers[i].ConnectionMode = "cold"
+		}
+	case "both":
+		splitProviders := make([]Provider, 0, 2*len(providers))
+		for _, p := range providers {
+			warm, cold := p, p
+			warm.ConnectionMode, cold.ConnectionMode = "warm", "cold"
+			splitProviders = append(splitProviders, warm, cold)
+		}
+		providers = splitProviders
+	default:
+		log.Fatalf("Invalid connection-mode '%s'. Must be 'warm', 'cold', or 'both'", *connectionMode)
+	}
+
 	// Run benchmarks
-	results := runBenchmarks(providers, *rate, *users, *duration, *timeout, *cooldown, *rampUp, *rampUpDuration, *debug)
+	results := runBenchmarks(providers, *rate, *users, *duration, *timeout, *cooldown, *rampUp, *rampUpDuration, *debug, successCodes, leakCheckConfig, stageMetricsConfig, *soakSpool)
+
+	if *connectionMode == "both" {
+		printConnectionModeComparison(results)
+	}
+	if len(results) > 1 {
+		compareResults(results)
+		printComparisonMatrix(results)
+	}
 
 	// Save results
 	saveResults(results, *outputFile)
@@ -288,17 +459,19 @@ func initializeProviders(bigPayload bool, model string, suffix string, apiPath s
 	return providers
 }
 
-func runBenchmarks(providers []Provider, rate int, users int, duration int, timeout int, cooldown int, rampUp bool, rampUpDuration int, debug bool) []BenchmarkResult {
+func runBenchmarks(providers []Provider, rate int, users int, duration int, timeout int, cooldown int, rampUp bool, rampUpDuration int, debug bool, successCodes []int, leakCheck *LeakCheckConfig, stageMetrics *StageMetricsConfig, soakSpool string) []BenchmarkResult {
 	results := make([]BenchmarkResult, 0, len(providers))
 
 	for i, provider := range providers {
-		fmt.Printf("Benchmarking %s...\n", provider.Name)
+		fmt.Printf("Benchmarking %s...\n", provider.ResultName())
 
 		httpTransport := &http.Transport{
 			Proxy:               http.ProxyFromEnvironment,
 			MaxIdleConnsPerHost: 100000,
 			MaxConnsPerHost:     0,
 			IdleConnTimeout:     10 * time.Second,
+			// Cold mode forces a fresh TCP connection for every request
+			DisableKeepAlives: provider.ConnectionMode == "cold",
 			// Optionally tune TLS and other settings if needed
 		}
 
@@ -319,6 +492,39 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 		// Initialize drop reasons tracking
 		dropReasons := make(map[string]int)
 
+		// Record the resource baseline for the leak check before any load is applied
+		var leakProc *process.Process
+		var leakBaseline ResourceSnapshot
+		metricsURL := ""
+		if leakCheck != nil && provider.Port != "" {
+			p, err := getProcessByPort(provider.Port)
+			if err != nil {
+				log.Printf("Warning: leak check skipped for %s: %v", provider.ResultName(), err)
+			} else {
+				leakProc = p
+				if u, err := url.Parse(provider.Endpoint); err == nil {
+					metricsURL = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, leakCheck.MetricsPath)
+				}
+				leakBaseline = takeResourceSnapshot(leakProc, metricsURL)
+				fmt.Printf("Leak check baseline for %s: %d goroutines, %d FDs\n", provider.ResultName(), leakBaseline.Goroutines, leakBaseline.FDs)
+			}
+		}
+
+		// Snapshot the gateway's stage histograms so the run's share can be diffed out
+		stageURL := ""
+		var stageBaseline map[string]histogramTotals
+		if stageMetrics != nil && strings.EqualFold(provider.Name, "bifrost") {
+			if u, err := url.Parse(provider.Endpoint); err == nil {
+				stageURL = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, stageMetrics.MetricsPath)
+				baseline, err := scrapeHistogramTotals(stageURL, stageMetrics.Stages)
+				if err != nil {
+					log.Printf("Warning: stage timings skipped for %s: %v", provider.ResultName(), err)
+					stageURL = ""
+				}
+				stageBaseline = baseline
+			}
+		}
+
 		// Start server memory monitoring (only for localhost providers with a port)
 		if provider.Port != "" {
 			wg.Add(1)
@@ -341,18 +547,51 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 
 		// Run the benchmark based on mode
 		var metrics vegeta.Metrics
+		var successStatuses []int
+		var phases *concurrent.Phases
+		var connReusePercent float64
+		var elapsed time.Duration // Wall time the bytes were transferred over
 
 		if users > 0 {
 			// Users mode: use concurrent package to maintain N concurrent requests
-			runner := concurrent.NewRunner(httpClient, users, time.Duration(duration)*time.Second,
+			runner := concurrent.NewGenRunner(httpClient, users, time.Duration(duration)*time.Second,
 				createConcurrentTargeter(provider), debug)
 
 			// Configure ramp-up if enabled
 			if rampUp {
 				runner.WithRampUp(time.Duration(rampUpDuration) * time.Second)
 			}
+			if len(successCodes) > 0 {
+				runner.WithSuccessStatuses(successCodes...)
+			}
+			var spoolFile *os.File
+			if soakSpool != "" {
+				path := soakSpoolPath(soakSpool, provider.ResultName())
+				f, err := os.Create(path)
+				if err != nil {
+					log.Fatalf("Error creating soak spool file '%s': %v", path, err)
+				}
+				spoolFile = f
+				runner.WithSpool(f, soakMaxResults)
+				fmt.Printf("Soak mode: spooling per-second results to %s\n", path)
+			}
 
 			concurrentMetrics := runner.Run(ctx)
+			if spoolFile != nil {
+				if err := spoolFile.Close(); err != nil && concurrentMetrics.SpoolErr == nil {
+					concurrentMetrics.SpoolErr = err
+				}
+				if concurrentMetrics.SpoolErr != nil {
+					log.Printf("Warning: soak spool for %s is incomplete: %v", provider.ResultName(), concurrentMetrics.SpoolErr)
+				}
+				fmt.Printf("Soak mode: spooled %d seconds to %s\n", concurrentMetrics.SpooledSeconds, spoolFile.Name())
+			}
+			successStatuses = concurrentMetrics.SuccessStatuses
+			meanPhases := concurrentMetrics.MeanPhases()
+			phases = &meanPhases
+			if concurrentMetrics.TracedRequests > 0 {
+				connReusePercent = 100 * float64(concurrentMetrics.ReusedConns) / float64(concurrentMetrics.TracedRequests)
+			}
 
 			// Convert concurrent metrics to vegeta metrics format
 			metrics.Requests = uint64(concurrentMetrics.TotalRequests)
@@ -371,18 +610,22 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 
 			// Count status codes and failures
 			statusCodes := make(map[string]int)
-			for _, result := range concurrentMetrics.Results {
-				if result.Success {
-					statusCodes["200"]++
-				} else if result.StatusCode > 0 {
-					statusCodes[fmt.Sprintf("%d", result.StatusCode)]++
-					dropReasons[fmt.Sprintf("HTTP %d", result.StatusCode)]++
-				} else {
-					dropReasons[result.Error]++
-				}
+			for code, n := range concurrentMetrics.StatusCodes {
+				statusCodes[fmt.Sprintf("%d", code)] = n
+			}
+			for reason, n := range concurrentMetrics.FailureReasons {
+				dropReasons[reason] += n
 			}
 			metrics.StatusCodes = statusCodes
 
+			metrics.BytesIn.Total = uint64(concurrentMetrics.TotalBytesIn)
+			metrics.BytesOut.Total = uint64(concurrentMetrics.TotalBytesOut)
+			if concurrentMetrics.TotalRequests > 0 {
+				metrics.BytesIn.Mean = float64(concurrentMetrics.TotalBytesIn) / float64(concurrentMetrics.TotalRequests)
+				metrics.BytesOut.Mean = float64(concurrentMetrics.TotalBytesOut) / float64(concurrentMetrics.TotalRequests)
+			}
+			elapsed = time.Duration(duration) * time.Second
+
 			// Calculate request rate and throughput
 			metrics.Rate = float64(concurrentMetrics.TotalRequests) / float64(duration)
 			metrics.Throughput = metrics.Rate // Approximate as same as request rate
@@ -404,7 +647,7 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 				// Check if context is done
 				select {
 				case <-ctx.Done():
-					log.Printf("Attack for %s timed out", provider.Name)
+					log.Printf("Attack for %s timed out", provider.ResultName())
 					dropReasons["context_timeout"]++
 					goto EndAttack
 				default:
@@ -414,6 +657,7 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 
 		EndAttack: // Label to jump to when the attack finishes or times out
 			metrics.Close() // Finalize metrics calculation
+			elapsed = metrics.Duration + metrics.Wait
 		}
 
 		// Stop server memory monitoring and wait for it to finish (only if monitoring was started).
@@ -422,6 +666,26 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 			wg.Wait()             // Wait for monitorServerMemory to complete
 		}
 
+		var stageTimings []StageTiming
+		if stageURL != "" {
+			after, err := scrapeHistogramTotals(stageURL, stageMetrics.Stages)
+			if err != nil {
+				log.Printf("Warning: could not read stage timings for %s: %v", provider.ResultName(), err)
+			} else {
+				stageTimings = diffStageTimings(stageMetrics.Stages, stageBaseline, after)
+			}
+		}
+
+		// Leak check: drop our idle keep-alive connections so they don't count
+		// against the server, let it settle for the cooldown, then compare.
+		var leakResult *LeakCheckResult
+		if leakProc != nil {
+			httpTransport.CloseIdleConnections()
+			fmt.Printf("Leak check: waiting %d seconds before sampling %s...\n", cooldown, provider.ResultName())
+			time.Sleep(time.Duration(cooldown) * time.Second)
+			leakResult = compareResourceSnapshots(leakBaseline, takeResourceSnapshot(leakProc, metricsURL), leakCheck.TolerancePercent)
+		}
+
 		// Safely copy the collected server memory stats for this benchmark run.
 		memMutex.Lock()
 		serverMemStatsCopy := make([]ServerMemStat, len(serverMemStats))
@@ -430,16 +694,24 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 
 		// Add results
 		results = append(results, BenchmarkResult{
-			ProviderName:      provider.Name,
+			ProviderName:      provider.ResultName(),
+			ConnectionMode:    provider.ConnectionMode,
 			Metrics:           &metrics,
 			ServerMemoryStats: serverMemStatsCopy,
 			DropReasons:       dropReasons,
+			SuccessStatuses:   successStatuses,
+			Phases:            phases,
+			ConnReusePercent:  connReusePercent,
+			LeakCheck:         leakResult,
+			MBpsIn:            megabytesPerSecond(metrics.BytesIn.Total, elapsed),
+			MBpsOut:           megabytesPerSecond(metrics.BytesOut.Total, elapsed),
+			StageTimings:      stageTimings,
 		})
 
 		fmt.Println(metrics.StatusCodes) // Print status code distribution to console
 
 		// Print a summary of the benchmark results to the console.
-		fmt.Printf("Results for %s:\n", provider.Name)
+		fmt.Printf("Results for %s:\n", provider.ResultName())
 		fmt.Printf("  Requests: %d\n", metrics.Requests)
 		fmt.Printf("  Request Rate: %.2f/s\n", metrics.Rate)
 		fmt.Printf("  Success Rate: %.2f%%\n", 100.0*metrics.Success)
@@ -448,6 +720,20 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 		fmt.Printf("  P99 Latency: %s\n", metrics.Latencies.P99)
 		fmt.Printf("  Max Latency: %s\n", metrics.Latencies.Max)
 		fmt.Printf("  Throughput: %.2f/s\n", metrics.Throughput)
+		fmt.Printf("  Bandwidth: %.2f MB/s in, %.2f MB/s out (%.2f MB received, %.2f MB sent)\n",
+			megabytesPerSecond(metrics.BytesIn.Total, elapsed), megabytesPerSecond(metrics.BytesOut.Total, elapsed),
+			float64(metrics.BytesIn.Total)/(1024*1024), float64(metrics.BytesOut.Total)/(1024*1024))
+		if phases != nil {
+			fmt.Printf("  Mean TTFB: %s (DNS %s, Connect %s, TLS %s; %.1f%% reused connections)\n",
+				phases.TTFB, phases.DNS, phases.Connect, phases.TLS, connReusePercent)
+		}
+		if len(stageTimings) > 0 {
+			parts := make([]string, len(stageTimings))
+			for j, st := range stageTimings {
+				parts[j] = fmt.Sprintf("%s %s", st.Name, st.Mean)
+			}
+			fmt.Printf("  Gateway Stages (mean): %s\n", strings.Join(parts, ", "))
+		}
 
 		// Print server memory statistics summary if data was collected.
 		if len(serverMemStatsCopy) > 0 {
@@ -462,16 +748,380 @@ func runBenchmarks(providers []Provider, rate int, users int, duration int, time
 			fmt.Println("  No server memory statistics available")
 		}
 
-		// Apply cooldown period between tests (except after the last one)
-		if i < len(providers)-1 && cooldown > 0 {
+		// Apply cooldown period between tests (except after the last one, and
+		// unless the leak check already waited it out)
+		if i < len(providers)-1 && cooldown > 0 && leakProc == nil {
 			fmt.Printf("Cooling down for %d seconds...\n", cooldown)
 			time.Sleep(time.Duration(cooldown) * time.Second)
 		}
 	}
 
+	if leakCheck != nil {
+		printLeakCheckSummary(results, leakCheck.TolerancePercent)
+	}
+
 	return results
 }
 
+// soakMaxResults bounds the in-memory result sample kept in soak mode.
+const soakMaxResults = 100000
+
+// soakSpoolPath derives a provider's spool file from --soak-spool by adding
+// the result name before the extension: soak.jsonl -> soak-bifrost.jsonl.
+func soakSpoolPath(base, resultName string) string {
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-" + strings.ToLower(resultName) + ext
+}
+
+// megabytesPerSecond converts a byte count moved over elapsed into MB/s.
+func megabytesPerSecond(bytes uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1024 * 1024) / elapsed.Seconds()
+}
+
+// printConnectionModeComparison pairs each provider's warm and cold runs and
+// prints how much forcing a new connection per request costs it.
+func printConnectionModeComparison(results []BenchmarkResult) {
+	warm := make(map[string]BenchmarkResult)
+	for _, res := range results {
+		if res.ConnectionMode == "warm" {
+			warm[strings.TrimSuffix(res.ProviderName, "-warm")] = res
+		}
+	}
+
+	fmt.Println("\nWarm vs Cold Connections:")
+	for _, cold := range results {
+		if cold.ConnectionMode != "cold" {
+			continue
+		}
+		name := strings.TrimSuffix(cold.ProviderName, "-cold")
+		w, ok := warm[name]
+		if !ok {
+			continue
+		}
+		fmt.Printf("  %s:\n", name)
+		fmt.Printf("    Mean Latency: %s warm, %s cold (%+.1f%%)\n", w.Metrics.Latencies.Mean, cold.Metrics.Latencies.Mean,
+			percentChange(float64(w.Metrics.Latencies.Mean), float64(cold.Metrics.Latencies.Mean)))
+		// --users runs don't compute percentiles
+		if w.Metrics.Latencies.P99 > 0 || cold.Metrics.Latencies.P99 > 0 {
+			fmt.Printf("    P99 Latency: %s warm, %s cold (%+.1f%%)\n", w.Metrics.Latencies.P99, cold.Metrics.Latencies.P99,
+				percentChange(float64(w.Metrics.Latencies.P99), float64(cold.Metrics.Latencies.P99)))
+		}
+		fmt.Printf("    Throughput: %.2f/s warm, %.2f/s cold (%+.1f%%)\n", w.Metrics.Throughput, cold.Metrics.Throughput,
+			percentChange(w.Metrics.Throughput, cold.Metrics.Throughput))
+		fmt.Printf("    Success Rate: %.2f%% warm, %.2f%% cold\n", 100*w.Metrics.Success, 100*cold.Metrics.Success)
+	}
+}
+
+// durationMs converts d to fractional milliseconds.
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// peakMemoryMB returns the highest sampled server RSS in MB (0 when memory
+// wasn't sampled).
+func peakMemoryMB(stats []ServerMemStat) float64 {
+	var peak uint64
+	for _, stat := range stats {
+		peak = max(peak, stat.RSS)
+	}
+	return float64(peak) / (1024 * 1024)
+}
+
+// ranks reports whether res competes on m. A provider with no successful
+// requests only competes on success rate, so that its fast failures don't
+// win the latency rows.
+func (m comparisonMetric) ranks(res BenchmarkResult) bool {
+	return m.Key == "success_rate" || res.Metrics.Success > 0
+}
+
+// comparable reports whether the competing results have values for m. Server
+// memory is missing for providers whose process couldn't be found, and a
+// metric that is zero for everyone wasn't measured, like the P50/P99
+// latencies of --users runs. A zero success rate is a real result.
+func (m comparisonMetric) comparable(results []BenchmarkResult) bool {
+	n, measured := 0, false
+	for _, res := range results {
+		if !m.ranks(res) {
+			continue
+		}
+		v := m.Value(res)
+		if m.Key == "server_peak_memory_mb" && v == 0 {
+			return false
+		}
+		measured = measured || v != 0 || m.Key == "success_rate"
+		n++
+	}
+	return n > 0 && measured
+}
+
+// best returns the best value of m across the competing results.
+func (m comparisonMetric) best(results []BenchmarkResult) float64 {
+	best, found := 0.0, false
+	for _, res := range results {
+		if !m.ranks(res) {
+			continue
+		}
+		if v := m.Value(res); !found || (m.LowerBetter && v < best) || (!m.LowerBetter && v > best) {
+			best, found = v, true
+		}
+	}
+	return best
+}
+
+// compareResults fills each result's VsBestPercent: its difference from the
+// best provider on every comparison metric, 0 for the best. Latency and memory
+// differences are positive, throughput and success rate ones negative.
+func compareResults(results []BenchmarkResult) {
+	for i := range results {
+		results[i].VsBestPercent = make(map[string]float64)
+	}
+	for _, m := range comparisonMetrics {
+		if !m.comparable(results) {
+			continue
+		}
+		best := m.best(results)
+		for i := range results {
+			if m.ranks(results[i]) {
+				results[i].VsBestPercent[m.Key] = percentChange(best, m.Value(results[i]))
+			}
+		}
+	}
+}
+
+// printComparisonMatrix prints the comparison metrics side by side, one
+// column per provider, marking the best value with * and every other cell
+// with its difference from it. Providers without a successful request show
+// n/a outside the success rate row.
+func printComparisonMatrix(results []BenchmarkResult) {
+	fmt.Println("\nComparison (* = best, others relative to best):")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	header := []string{""}
+	for _, res := range results {
+		header = append(header, res.ProviderName)
+	}
+	fmt.Fprintf(tw, "  %s\t\n", strings.Join(header, "\t"))
+	for _, m := range comparisonMetrics {
+		if !m.comparable(results) {
+			continue
+		}
+		row := []string{m.Label}
+		for _, res := range results {
+			diff, ok := res.VsBestPercent[m.Key]
+			switch {
+			case !ok:
+				row = append(row, "n/a")
+			case diff == 0:
+				row = append(row, m.Format(m.Value(res))+" *")
+			default:
+				row = append(row, fmt.Sprintf("%s (%+.1f%%)", m.Format(m.Value(res)), diff))
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t\n", strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// percentChange returns the change from before to after in percent (0 when
+// before is 0).
+func percentChange(before, after float64) float64 {
+	if before == 0 {
+		return 0
+	}
+	return (after - before) / before * 100
+}
+
+// takeResourceSnapshot reads the open FD count of the server process and, when
+// metricsURL is set, its goroutine count from the go_goroutines gauge.
+func takeResourceSnapshot(p *process.Process, metricsURL string) ResourceSnapshot {
+	snap := ResourceSnapshot{Goroutines: -1, FDs: -1}
+	if fds, err := p.NumFDs(); err == nil {
+		snap.FDs = int(fds)
+	} else {
+		log.Printf("Warning: could not read FD count: %v", err)
+	}
+	if metricsURL != "" {
+		if n, err := scrapeGoroutines(metricsURL); err == nil {
+			snap.Goroutines = n
+		} else {
+			log.Printf("Warning: could not read goroutine count from %s: %v", metricsURL, err)
+		}
+	}
+	return snap
+}
+
+// scrapeGoroutines fetches a Prometheus text endpoint and returns the value of
+// the go_goroutines gauge exported by the Go client library's default collector.
+func scrapeGoroutines(metricsURL string) (int, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "go_goroutines" {
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid go_goroutines value %q", fields[1])
+			}
+			return int(v), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("go_goroutines not found")
+}
+
+// scrapeHistogramTotals fetches a Prometheus text endpoint and sums the _sum
+// and _count series of each stage's histogram across all label sets.
+func scrapeHistogramTotals(metricsURL string, stages []StageMetric) (map[string]histogramTotals, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	totals := make(map[string]histogramTotals, len(stages))
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Lines are `name{labels} value [timestamp]`; label values may hold spaces
+		series, rest := line, ""
+		if i := strings.IndexByte(line, '{'); i >= 0 {
+			series = line[:i]
+			if j := strings.LastIndexByte(line, '}'); j > i {
+				rest = line[j+1:]
+			}
+		} else {
+			series, rest, _ = strings.Cut(line, " ")
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, stage := range stages {
+			var isSum bool
+			switch series {
+			case stage.Metric + "_sum":
+				isSum = true
+			case stage.Metric + "_count":
+			default:
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s", fields[0], series)
+			}
+			t := totals[stage.Metric]
+			if isSum {
+				t.Sum += v
+			} else {
+				t.Count += v
+			}
+			totals[stage.Metric] = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, stage := range stages {
+		if _, ok := totals[stage.Metric]; !ok {
+			return nil, fmt.Errorf("histogram %s not found", stage.Metric)
+		}
+	}
+	return totals, nil
+}
+
+// diffStageTimings turns before/after histogram totals into the mean time per
+// stage over the run. Histograms are taken to be in seconds unless the metric
+// name ends in _ms or _milliseconds.
+func diffStageTimings(stages []StageMetric, before, after map[string]histogramTotals) []StageTiming {
+	timings := make([]StageTiming, 0, len(stages))
+	for _, stage := range stages {
+		count := after[stage.Metric].Count - before[stage.Metric].Count
+		sum := after[stage.Metric].Sum - before[stage.Metric].Sum
+		timing := StageTiming{Name: stage.Name}
+		if count > 0 {
+			unit := float64(time.Second)
+			if strings.HasSuffix(stage.Metric, "_ms") || strings.HasSuffix(stage.Metric, "_milliseconds") {
+				unit = float64(time.Millisecond)
+			}
+			timing.Mean = time.Duration(sum / count * unit)
+			timing.Count = uint64(count)
+		}
+		timings = append(timings, timing)
+	}
+	return timings
+}
+
+// leakCheckMinSlack is the smallest absolute growth the leak check tolerates,
+// so small baselines aren't flagged for a stray timer goroutine or socket.
+const leakCheckMinSlack = 5
+
+// compareResourceSnapshots flags every count that ended more than
+// tolerancePercent (at least leakCheckMinSlack) above its baseline. Counts
+// unreadable in either snapshot are not compared.
+func compareResourceSnapshots(baseline, after ResourceSnapshot, tolerancePercent float64) *LeakCheckResult {
+	result := &LeakCheckResult{Baseline: baseline, After: after}
+	check := func(name string, before, now int) {
+		if before < 0 || now < 0 {
+			result.Skipped = append(result.Skipped, name)
+			return
+		}
+		limit := before + max(int(float64(before)*tolerancePercent/100), leakCheckMinSlack)
+		if now > limit {
+			result.Leaks = append(result.Leaks, fmt.Sprintf("%s grew from %d to %d (limit %d)", name, before, now, limit))
+		}
+	}
+	check("goroutines", baseline.Goroutines, after.Goroutines)
+	check("FDs", baseline.FDs, after.FDs)
+	return result
+}
+
+// printLeakCheckSummary prints the dedicated leak-check section for all
+// providers that were checked.
+func printLeakCheckSummary(results []BenchmarkResult, tolerancePercent float64) {
+	fmt.Printf("\nLeak Check (tolerance %.0f%%):\n", tolerancePercent)
+	for _, res := range results {
+		if res.LeakCheck == nil {
+			fmt.Printf("  %s: not checked\n", res.ProviderName)
+			continue
+		}
+		lc := res.LeakCheck
+		status := "OK"
+		switch {
+		case len(lc.Leaks) > 0:
+			status = "LEAK SUSPECTED"
+		case len(lc.Skipped) > 0:
+			status = "INCOMPLETE, " + strings.Join(lc.Skipped, " and ") + " not checked"
+		}
+		fmt.Printf("  %s: %s (goroutines %d -> %d, FDs %d -> %d)\n", res.ProviderName, status,
+			lc.Baseline.Goroutines, lc.After.Goroutines, lc.Baseline.FDs, lc.After.FDs)
+		for _, leak := range lc.Leaks {
+			fmt.Printf("    - %s\n", leak)
+		}
+	}
+}
+
 // getProcessByPort finds a process listening on the specified TCP port.
 // It iterates through system network connections to find a listening process
 // matching the given port number and returns a process.Process object for it.
@@ -601,19 +1251,12 @@ func createTargeter(provider Provider) vegeta.Targeter {
 }
 
 // createConcurrentTargeter creates a request generator function for the concurrent package.
-// It returns a closure that generates HTTP requests with dynamically updated payloads.
-func createConcurrentTargeter(provider Provider) func() (concurrent.Request, error) {
-	var requestCounter int64
-	var counterMutex sync.Mutex
-
-	return func() (concurrent.Request, error) {
-		// Get next message index
-		counterMutex.Lock()
-		requestCounter++
-		counterMutex.Unlock()
-
+// It returns a closure that generates HTTP requests with dynamically updated payloads;
+// the runner's sequence number (1-based here, like the Vegeta targeter) fills #{request_index}.
+func createConcurrentTargeter(provider Provider) concurrent.GenFunc {
+	return func(gc concurrent.GenContext) (concurrent.Request, error) {
 		// Use string templating for efficient payload generation
-		updatedPayload := strings.ReplaceAll(provider.PayloadTemplate, "#{request_index}", fmt.Sprintf("%d", requestCounter))
+		updatedPayload := strings.ReplaceAll(provider.PayloadTemplate, "#{request_index}", fmt.Sprintf("%d", gc.Seq+1))
 		updatedPayload = strings.ReplaceAll(updatedPayload, "#{timestamp}", time.Now().Format(time.RFC3339))
 
 		// Build headers
@@ -654,20 +1297,46 @@ func createConcurrentTargeter(provider Provider) func() (concurrent.Request, err
 // combined results back to the file. Latency values are converted to milliseconds,
 // and memory values to megabytes for the output.
 func saveResults(results []BenchmarkResult, outputFile string) {
+	type LatencyBreakdown struct {
+		DNSMs            float64 `json:"dns_ms"`
+		ConnectMs        float64 `json:"connect_ms"`
+		TLSMs            float64 `json:"tls_ms"`
+		TTFBMs           float64 `json:"ttfb_ms"`
+		ConnReusePercent float64 `json:"conn_reuse_percent"`
+	}
+	type SerializableLeakCheck struct {
+		BaselineGoroutines int      `json:"baseline_goroutines"` // -1 when unavailable
+		AfterGoroutines    int      `json:"after_goroutines"`
+		BaselineFDs        int      `json:"baseline_fds"`
+		AfterFDs           int      `json:"after_fds"`
+		LeakSuspected      *bool    `json:"leak_suspected"` // null when a count wasn't checked and the rest were fine
+		Leaks              []string `json:"leaks,omitempty"`
+		NotChecked         []string `json:"not_checked,omitempty"`
+	}
 	type SerializableResult struct {
-		Requests           uint64         `json:"requests"`
-		Rate               float64        `json:"rate"`
-		SuccessRate        float64        `json:"success_rate"`
-		MeanLatencyMs      float64        `json:"mean_latency_ms"`
-		P50LatencyMs       float64        `json:"p50_latency_ms"`
-		P99LatencyMs       float64        `json:"p99_latency_ms"`
-		MaxLatencyMs       float64        `json:"max_latency_ms"`
-		ThroughputRPS      float64        `json:"throughput_rps"`
-		Timestamp          string         `json:"timestamp"`
-		StatusCodeCounts   map[string]int `json:"status_code_counts"`
-		ServerPeakMemoryMB float64        `json:"server_peak_memory_mb"` // Peak server RSS memory during benchmark
-		ServerAvgMemoryMB  float64        `json:"server_avg_memory_mb"`  // Average server RSS memory during benchmark
-		DropReasons        map[string]int `json:"drop_reasons"`          // Counts of reasons for dropped/failed requests
+		Requests           uint64                 `json:"requests"`
+		Rate               float64                `json:"rate"`
+		SuccessRate        float64                `json:"success_rate"`
+		MeanLatencyMs      float64                `json:"mean_latency_ms"`
+		P50LatencyMs       float64                `json:"p50_latency_ms"`
+		P99LatencyMs       float64                `json:"p99_latency_ms"`
+		MaxLatencyMs       float64                `json:"max_latency_ms"`
+		ThroughputRPS      float64                `json:"throughput_rps"`
+		Timestamp          string                 `json:"timestamp"`
+		StatusCodeCounts   map[string]int         `json:"status_code_counts"`
+		ServerPeakMemoryMB float64                `json:"server_peak_memory_mb"`       // Peak server RSS memory during benchmark
+		ServerAvgMemoryMB  float64                `json:"server_avg_memory_mb"`        // Average server RSS memory during benchmark
+		DropReasons        map[string]int         `json:"drop_reasons"`                // Counts of reasons for dropped/failed requests
+		SuccessStatuses    []int                  `json:"success_statuses,omitempty"`  // Status codes counted as success (omitted = any 2xx)
+		LatencyBreakdown   *LatencyBreakdown      `json:"latency_breakdown,omitempty"` // Mean per-request phases (--users mode only)
+		LeakCheck          *SerializableLeakCheck `json:"leak_check,omitempty"`        // Goroutine/FD regression check (--leak-check only)
+		ConnectionMode     string                 `json:"connection_mode,omitempty"`   // "warm" or "cold" (--connection-mode only)
+		BytesIn            uint64                 `json:"bytes_in"`                    // Total response body bytes received
+		BytesOut           uint64                 `json:"bytes_out"`                   // Total request body bytes sent
+		MBPerSecIn         float64                `json:"mb_per_sec_in"`               // Response bandwidth in MB/s
+		MBPerSecOut        float64                `json:"mb_per_sec_out"`              // Request bandwidth in MB/s
+		GatewayStagesMs    map[string]float64     `json:"gateway_stages_ms,omitempty"` // Mean per-stage gateway time (--stage-metrics only)
+		VsBestPercent      map[string]float64     `json:"vs_best_percent,omitempty"`   // Percent difference from the best provider per metric (multi-provider runs only)
 	}
 
 	// Create a map with provider names as keys
@@ -709,6 +1378,40 @@ func saveResults(results []BenchmarkResult, outputFile string) {
 			avgMem = float64(totalMem) / float64(len(res.ServerMemoryStats)) / (1024 * 1024)
 		}
 
+		var breakdown *LatencyBreakdown
+		if res.Phases != nil {
+			breakdown = &LatencyBreakdown{
+				DNSMs:            float64(res.Phases.DNS) / float64(time.Millisecond),
+				ConnectMs:        float64(res.Phases.Connect) / float64(time.Millisecond),
+				TLSMs:            float64(res.Phases.TLS) / float64(time.Millisecond),
+				TTFBMs:           float64(res.Phases.TTFB) / float64(time.Millisecond),
+				ConnReusePercent: res.ConnReusePercent,
+			}
+		}
+
+		var leakCheck *SerializableLeakCheck
+		if lc := res.LeakCheck; lc != nil {
+			leakCheck = &SerializableLeakCheck{
+				BaselineGoroutines: lc.Baseline.Goroutines,
+				AfterGoroutines:    lc.After.Goroutines,
+				BaselineFDs:        lc.Baseline.FDs,
+				AfterFDs:           lc.After.FDs,
+				Leaks:              lc.Leaks,
+				NotChecked:         lc.Skipped,
+			}
+			if suspected := len(lc.Leaks) > 0; suspected || len(lc.Skipped) == 0 {
+				leakCheck.LeakSuspected = &suspected
+			}
+		}
+
+		var gatewayStages map[string]float64
+		if len(res.StageTimings) > 0 {
+			gatewayStages = make(map[string]float64, len(res.StageTimings))
+			for _, st := range res.StageTimings {
+				gatewayStages[st.Name] = float64(st.Mean) / float64(time.Millisecond)
+			}
+		}
+
 		resultsMap[strings.ToLower(res.ProviderName)] = SerializableResult{
 			Requests:           res.Metrics.Requests,
 			Rate:               res.Metrics.Rate,
@@ -723,6 +1426,16 @@ func saveResults(results []BenchmarkResult, outputFile string) {
 			ServerPeakMemoryMB: float64(peakMem) / (1024 * 1024),
 			ServerAvgMemoryMB:  avgMem,
 			DropReasons:        res.DropReasons,
+			SuccessStatuses:    res.SuccessStatuses,
+			LatencyBreakdown:   breakdown,
+			LeakCheck:          leakCheck,
+			ConnectionMode:     res.ConnectionMode,
+			BytesIn:            res.Metrics.BytesIn.Total,
+			BytesOut:           res.Metrics.BytesOut.Total,
+			MBPerSecIn:         res.MBpsIn,
+			MBPerSecOut:        res.MBpsOut,
+			GatewayStagesMs:    gatewayStages,
+			VsBestPercent:      res.VsBestPercent,
 		}
 	}
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// setCPUAffinity pins every thread of the process to cpus, like `taskset -a`.
+// sched_setaffinity only affects one thread, and the Go runtime already runs
+// several, so each entry of /proc/self/task is pinned in turn; threads started
+// later inherit the mask from the thread that creates them. Passes repeat
+// until one finds no thread it hasn't pinned yet.
+func setCPUAffinity(cpus []int) error {
+	var mask [16]uint64 // 1024 CPUs, the glibc cpu_set_t size
+	for _, cpu := range cpus {
+		if cpu >= len(mask)*64 {
+			return fmt.Errorf("CPU %d out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+
+	pinned := make(map[int]bool)
+	for {
+		tasks, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		progress := false
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil || pinned[tid] {
+				continue
+			}
+			_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+			if errno != 0 && errno != syscall.ESRCH { // ESRCH: thread exited meanwhile
+				return fmt.Errorf("sched_setaffinity(%d): %w", tid, errno)
+			}
+			pinned[tid] = true
+			progress = true
+		}
+		if !progress {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// setCPUAffinity is only implemented on Linux.
+func setCPUAffinity(cpus []int) error {
+	return errors.New("--cpus is only supported on Linux")
+}
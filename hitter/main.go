@@ -3,30 +3,60 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"math/bits"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/bytedance/sonic"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+	"gopkg.in/yaml.v3"
 )
 
 type ChatRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
-	Stream      bool      `json:"stream,omitempty"`
+	Model               string          `json:"model"`
+	Messages            []Message       `json:"messages"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	Temperature         float64         `json:"temperature,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	ReasoningEffort     string          `json:"reasoning_effort,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	Tools               []any           `json:"tools,omitempty"`
+	ToolChoice          any             `json:"tool_choice,omitempty"`
 }
 
 type Message struct {
@@ -34,14 +64,35 @@ type Message struct {
 	Content string `json:"content"`
 }
 
+// EmbeddingRequest is the /v1/embeddings body of --mix traffic.
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// ResponsesRequest is the /v1/responses body of --mix traffic, with the
+// conversation sent as input messages.
+type ResponsesRequest struct {
+	Model           string    `json:"model"`
+	Input           []Message `json:"input"`
+	MaxOutputTokens int       `json:"max_output_tokens,omitempty"`
+	Temperature     float64   `json:"temperature,omitempty"`
+	Stream          bool      `json:"stream,omitempty"`
+}
+
 // Multimodal request shapes used when an attachment (e.g. --pdf) is supplied.
 // Content becomes an array of typed parts instead of a plain string.
 type MultiModalRequest struct {
-	Model       string              `json:"model"`
-	Messages    []MultiModalMessage `json:"messages"`
-	MaxTokens   int                 `json:"max_tokens,omitempty"`
-	Temperature float64             `json:"temperature,omitempty"`
-	Stream      bool                `json:"stream,omitempty"`
+	Model               string              `json:"model"`
+	Messages            []MultiModalMessage `json:"messages"`
+	MaxTokens           int                 `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                 `json:"max_completion_tokens,omitempty"`
+	Temperature         float64             `json:"temperature,omitempty"`
+	Stream              bool                `json:"stream,omitempty"`
+	ReasoningEffort     string              `json:"reasoning_effort,omitempty"`
+	ResponseFormat      *ResponseFormat     `json:"response_format,omitempty"`
+	Tools               []any               `json:"tools,omitempty"`
+	ToolChoice          any                 `json:"tool_choice,omitempty"`
 }
 
 type MultiModalMessage struct {
@@ -50,9 +101,10 @@ type MultiModalMessage struct {
 }
 
 type ContentPart struct {
-	Type string    `json:"type"`
-	Text string    `json:"text,omitempty"`
-	File *FilePart `json:"file,omitempty"`
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	File     *FilePart     `json:"file,omitempty"`
+	ImageURL *ImageURLPart `json:"image_url,omitempty"`
 }
 
 // FilePart mirrors Bifrost's OpenAI "file" content block (ChatInputFile).
@@ -61,19 +113,199 @@ type FilePart struct {
 	Filename string `json:"filename,omitempty"`
 }
 
+// ImageURLPart mirrors OpenAI's "image_url" content block. URL carries a
+// base64 data URL in image mode.
+type ImageURLPart struct {
+	URL string `json:"url"`
+}
+
+// ResponseFormat mirrors OpenAI's response_format request parameter.
+type ResponseFormat struct {
+	Type       string          `json:"type"`
+	JSONSchema *JSONSchemaSpec `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaSpec is the json_schema block of a "json_schema" response format.
+type JSONSchemaSpec struct {
+	Name   string         `json:"name"`
+	Strict bool           `json:"strict"`
+	Schema map[string]any `json:"schema"`
+}
+
+// answerSchema is the structured-output schema sent with --response-format json_schema.
+var answerSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"answer":     map[string]any{"type": "string"},
+		"confidence": map[string]any{"type": "number"},
+	},
+	"required":             []string{"answer", "confidence"},
+	"additionalProperties": false,
+}
+
 type Config struct {
-	URL         string
-	RPS         int
-	Duration    time.Duration
-	Models      []string
-	Providers   []string
-	MaxTokens   int
-	Temperature float64
-	Verbose     bool
-	Stream      bool
-	VirtualKey  string
-	PDFPath     string
-	Prompt      string
+	ConfigPath   string
+	URL          string
+	RPS          int
+	Arrival      string
+	Profile      string
+	MaxInflight  int
+	Senders      int
+	Load         loadProfile
+	Users        int
+	ThinkTime    thinkTime
+	Turns        int
+	MaxHistory   int
+	Duration     time.Duration
+	Requests     int
+	Models       []string
+	Providers    []string
+	MaxTokens    int
+	TokenDist    tokenDist
+	Temperature  float64
+	Verbose      bool
+	Seed         int64
+	Stream       bool
+	VirtualKey   string
+	PDFPath      string
+	Prompt       string
+	PromptsPath  string
+	ImageKB      int
+	ImagePercent int
+
+	// Keys from --virtual-keys, rotated through one per request or, with
+	// KeyPerUser, one per virtual user.
+	VirtualKeysPath string
+	VirtualKeys     []string
+	KeyPerUser      bool
+
+	// Newer OpenAI request parameters, each sent on a share of requests.
+	MaxCompletionTokensPercent int
+	ReasoningEffort            string
+	ReasoningEffortPercent     int
+	ResponseFormat             string
+	ResponseFormatPercent      int
+
+	// Function calling: a tools array from a JSON file and the tool_choice
+	// responses are validated against.
+	ToolsPath  string
+	ToolChoice string
+
+	// Check every 200 response's shape, content and usage, counting
+	// responses that fail as errors.
+	Validate bool
+
+	// Targets are the --url targets: one normally, several for a comparison
+	// run that tags every result with its target. Requests alternate
+	// between them, or are spread by weight with --target-weights. URL is
+	// the first target's.
+	Targets       []*target
+	TargetWeights bool
+
+	// Traffic mix across endpoints (empty = chat completions only), or
+	// with Mode "embeddings" embeddings only, and the embeddings payload:
+	// EmbeddingInputTokens of synthetic text per input, or corpus prompts
+	// if 0. Each target holds the URL every endpoint is sent to.
+	Mode                 string
+	Mix                  []endpointShare
+	EmbeddingModels      []string
+	EmbeddingBatch       int
+	EmbeddingInputTokens int
+
+	// Shifts in the traffic at set offsets into the run, in order; before
+	// the first one the flags above apply.
+	TrafficPhases []trafficPhase
+
+	// Traffic replay: the requests recorded in ReplayPath, sent on their
+	// original schedule sped up ReplaySpeed times instead of generated ones.
+	ReplayPath  string
+	ReplaySpeed float64
+
+	// Scheduling of the hitter itself, to keep it off the gateway's cores.
+	GOMAXPROCS int
+	CPUs       []int
+
+	// Where connections go when the listener isn't the URL's host:port, e.g. a
+	// sidecar gateway on a Unix socket. The URL still sets path and Host.
+	UnixSocket string
+	DialAddr   string
+	HostHeader string
+
+	// Connection pool and transport tuning, and request timeouts.
+	MaxIdleConnsPerHost int
+	Conns               int
+	DisableKeepAlive    bool
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	RequestTimeout      time.Duration
+	StreamIdleTimeout   time.Duration
+
+	// Content encodings: gzip or identity for request bodies, and the one
+	// advertised for responses.
+	RequestEncoding string
+	AcceptEncoding  string
+
+	// HTTP version and TLS settings of the target.
+	Protocol       string
+	Insecure       bool
+	CACert         string
+	ClientCert     string
+	ClientKey      string
+	tlsClientCerts []tls.Certificate
+	tlsRootCAs     *x509.CertPool
+
+	// Extra request headers from repeated --header flags.
+	Headers []headerTemplate
+
+	// Failure capture: the request and response of a sample of failed
+	// requests are written to CaptureDir, up to CaptureMax files.
+	CaptureDir     string
+	CapturePercent int
+	CaptureMax     int
+
+	// SLO assertions checked at the end of the run; a violation makes the
+	// hitter exit non-zero. Zero values are unchecked.
+	SLOP50     time.Duration
+	SLOP95     time.Duration
+	SLOP99     time.Duration
+	SLOTTFTP99 time.Duration
+	SLOSuccess float64
+	SLOMinRPS  float64
+
+	// Goal-seeking mode: search for the highest rate meeting the SLOs.
+	FindMax bool
+
+	// Stop the run early once more than AbortErrorRate percent of the
+	// requests completed over the last AbortWindow failed (0 = never).
+	AbortErrorRate float64
+	AbortWindow    time.Duration
+
+	// How long to wait for requests still in flight once sending stops
+	// before cancelling them (0 = wait for all of them).
+	DrainTimeout time.Duration
+
+	// Prometheus export: a local /metrics listener and/or periodic pushes
+	// to a Pushgateway.
+	MetricsAddr  string
+	PushURL      string
+	PushJob      string
+	PushInterval time.Duration
+
+	// JSON results file written at the end of the run (empty = none).
+	OutputPath string
+
+	// Run metadata from --tag, copied into the results file.
+	Tags tagList
+
+	// Per-request results in vegeta's result encoding (empty = none; "-" =
+	// stdout), for vegeta report and vegeta plot.
+	VegetaOutput   string
+	VegetaEncoding string
+
+	// Client-side retries of 429 and 5xx responses with exponential backoff.
+	Retries         int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
 }
 
 // Prebuilt request bodies, populated once at startup when --pdf is set so the
@@ -82,14 +314,462 @@ type Config struct {
 var (
 	prebuiltBodies [][]byte
 	prebuiltLabels []string
+	prebuiltGzip   [][]byte // with --request-encoding gzip
 )
 
+// Tool definitions loaded once at startup when --tools is set: the tools
+// array sent with every request, the function names a tool call may use, and
+// the tool_choice to send (nil = omitted).
+var (
+	toolDefs   []any
+	toolNames  map[string]bool
+	toolChoice any
+)
+
+// replayRecords are the recorded requests of --replay in the order they are
+// sent; request n of the run sends record n.
+var replayRecords []replayRecord
+
+// vegetaOut receives one vegeta result per request when --vegeta-output is
+// set; nil means off.
+var vegetaOut *vegetaWriter
+
+// imagePart holds the "image_url" member of the synthetic PNG content block,
+// marshaled once at startup when --image-kb is set; nil means image mode is
+// off. Requests are marshaled with imagePartStub in its place and the
+// multi-KB data URL is spliced in afterwards rather than re-encoded.
+var imagePart []byte
+
+const imagePartStub = `"image_url":{"url":""}`
+
 type Stats struct {
 	totalRequests   int64
 	successRequests int64
 	errorRequests   int64
+
+	// Failed requests by class: "HTTP <status>" for error responses, or a
+	// transport class from errorClass. Updated through recordError.
+	errorsMu     sync.Mutex
+	errorClasses map[string]int64
+
+	// Client-side connection churn, collected through httptrace.
+	newConns      int64
+	reusedConns   int64
+	http1Resps    int64
+	http2Resps    int64
+	dnsLookups    int64
+	dnsErrors     int64
+	dnsTimeNanos  int64
+	dialTimeNanos int64
+
+	// Latency of successful requests split by phase, indexed like
+	// phaseNames.
+	phases [len(phaseNames)]*latencyHistogram
+
+	// Tool-calling outcomes with --tools: valid responses that called at
+	// least one tool, the calls they made, and responses whose tool calls
+	// failed validation.
+	toolResponses    int64
+	toolCalls        int64
+	invalidToolCalls int64
+
+	// 200 responses that failed --validate.
+	invalidResponses int64
+
+	// Latency distributions of successful requests: end to end (body or
+	// stream fully read), and for streams the time to the first chunk and
+	// the gaps between consecutive chunks.
+	latency    *latencyHistogram
+	ttft       *latencyHistogram
+	interChunk *latencyHistogram
+
+	// Streaming throughput of completed streams: generation time from the
+	// first chunk to the last, data chunks per stream, and output tokens,
+	// taken from a usage frame where the stream sends one (usageStreams) and
+	// counted as one per content chunk otherwise.
+	streamDuration *latencyHistogram
+	streamChunks   *countHistogram
+	outputTokens   int64
+	usageStreams   int64
+
+	// When the run started sending, which --phase offsets count from.
+	start time.Time
+
+	// Coordinated omission: how late each open-loop request started after
+	// its scheduled send time, and the latency of successful ones measured
+	// from that scheduled time instead of their actual start.
+	schedLag         *latencyHistogram
+	correctedLatency *latencyHistogram
+
+	// Body sizes of successful responses, as read after any transparent
+	// decompression, and their total.
+	respBytes      *countHistogram
+	respBytesTotal int64
+
+	// Compression: request bodies before and after --request-encoding gzip
+	// and the time spent compressing them, and the successful responses
+	// that came gzip-encoded along with the wire size of all successful ones.
+	reqBytesRaw   int64
+	reqBytesWire  int64
+	compressNanos int64
+	gzipResponses int64
+	respWireBytes int64
+
+	// The max_tokens limits of chat requests, to check them against
+	// --max-tokens-dist.
+	maxTokens *countHistogram
+
+	// Open-loop backpressure: requests currently in flight (tracked for
+	// --users too, for the drain), the most there have been at once, and
+	// arrivals skipped because --max-inflight was reached. The last* fields
+	// hold values from the previous periodic report and are owned by the
+	// stats printer.
+	inflight     int64
+	peakInflight int64
+	skipped      int64
+	lastInflight int64
+	lastSkipped  int64
+	lastBacklog  float64
+
+	// End-of-run drain: requests in flight when sending stopped, those
+	// cancelled at --drain-timeout, and how long the drain took. Set by
+	// main once the drain is over, or with unfinished, the requests left in
+	// flight, when a second interrupt cuts it short.
+	drainInflight int64
+	drainCanceled int64
+	drainTime     time.Duration
+	unfinished    int64
+
+	// Retry accounting: HTTP attempts across all requests, requests that
+	// were retried, how many of those ended in success or still failed with
+	// a retryable status, and the time retries added before the final
+	// attempt (failed attempts plus backoff).
+	attempts          int64
+	retriedRequests   int64
+	recoveredRequests int64
+	exhaustedRequests int64
+	retryOverhead     *latencyHistogram
+
+	// Failures written to --capture-dir so far.
+	captured int64
+
+	// Per-second time series for --output; nil without it.
+	series *timeSeries
+
+	// Per-endpoint breakdown with --mix, keyed by endpoint name; fixed
+	// before the run starts.
+	endpoints map[string]*endpointStats
+
+	// Per-target breakdown with several --url targets, keyed by target
+	// name; fixed before the run starts.
+	targets map[string]*targetStats
+
+	// Per-key counts with --virtual-keys, in the file's order.
+	keys []*keyStats
+}
+
+// keyStats counts one --virtual-keys key's requests.
+type keyStats struct {
+	total       int64
+	success     int64
+	rateLimited int64
+}
+
+// targetStats counts one target's share of a multi-target run.
+type targetStats struct {
+	total   int64
+	success int64
+	errors  int64
+	latency *latencyHistogram
+	ttft    *latencyHistogram
+}
+
+// endpointStats counts one endpoint's share of a --mix run.
+type endpointStats struct {
+	total   int64
+	success int64
+	latency *latencyHistogram
+}
+
+// recordError counts one failed request under class.
+func (s *Stats) recordError(class string) {
+	atomic.AddInt64(&s.errorRequests, 1)
+	if s.series != nil {
+		s.series.recordError()
+	}
+	s.errorsMu.Lock()
+	s.errorClasses[class]++
+	s.errorsMu.Unlock()
+}
+
+// errorBreakdown returns a snapshot of the error counts by class.
+func (s *Stats) errorBreakdown() map[string]int64 {
+	s.errorsMu.Lock()
+	defer s.errorsMu.Unlock()
+	return maps.Clone(s.errorClasses)
+}
+
+func newStats(config *Config) *Stats {
+	stats := &Stats{
+		errorClasses:   make(map[string]int64),
+		latency:        newLatencyHistogram(),
+		ttft:           newLatencyHistogram(),
+		interChunk:     newLatencyHistogram(),
+		streamDuration: newLatencyHistogram(),
+		streamChunks:   newCountHistogram(),
+		maxTokens:      newCountHistogram(),
+		respBytes:      newCountHistogramUpTo(maxTrackedBytes),
+		retryOverhead:  newLatencyHistogram(),
+
+		schedLag:         newLatencyHistogram(),
+		correctedLatency: newLatencyHistogram(),
+	}
+	for i := range stats.phases {
+		stats.phases[i] = newLatencyHistogram()
+	}
+	if mix := mixEndpoints(config); len(mix) > 0 {
+		stats.endpoints = make(map[string]*endpointStats, len(mix))
+		for _, share := range mix {
+			stats.endpoints[share.name] = &endpointStats{latency: newLatencyHistogram()}
+		}
+	}
+	for range config.VirtualKeys {
+		stats.keys = append(stats.keys, &keyStats{})
+	}
+	if len(config.Targets) > 1 {
+		stats.targets = make(map[string]*targetStats, len(config.Targets))
+		for _, t := range config.Targets {
+			stats.targets[t.name] = &targetStats{latency: newLatencyHistogram(), ttft: newLatencyHistogram()}
+		}
+	}
+	return stats
+}
+
+// Latencies are tracked from 1µs up to maxTrackedLatency with
+// latencyDigits significant digits; slower samples are clamped to the
+// maximum. The histogram's size depends only on these bounds, not on the
+// number of samples, so memory stays flat however long the run.
+const (
+	maxTrackedLatency = 10 * time.Minute
+	latencyDigits     = 3
+)
+
+// latencyHistogram is an HdrHistogram of durations in microseconds, guarded
+// for concurrent use, with a count of the samples it clamped.
+type latencyHistogram struct {
+	mu      sync.Mutex
+	h       *hdrhistogram.Histogram
+	clamped int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{h: hdrhistogram.New(1, maxTrackedLatency.Microseconds(), latencyDigits)}
+}
+
+// record adds samples to the histogram under a single lock.
+func (l *latencyHistogram) record(ds ...time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range ds {
+		l.add(d, 1)
+	}
+}
+
+// recordCounts adds the samples of a sampleCounts under a single lock.
+func (l *latencyHistogram) recordCounts(counts sampleCounts) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for d, n := range counts {
+		l.add(d, n)
+	}
+}
+
+// add records n samples of d; l.mu must be held.
+func (l *latencyHistogram) add(d time.Duration, n int64) {
+	if d > maxTrackedLatency {
+		l.clamped += n
+	}
+	_ = l.h.RecordValues(min(max(d.Microseconds(), 1), maxTrackedLatency.Microseconds()), n)
+}
+
+// sampleCounts buffers durations before they go into a latencyHistogram, as
+// counts per value rounded to the precision the histogram keeps anyway. Its
+// size grows with the spread of the values rather than their number, so a
+// stream of many thousand chunks doesn't hold a sample per chunk.
+type sampleCounts map[time.Duration]int64
+
+// add counts d, dropping the microsecond bits below the 11 significant bits
+// an HdrHistogram of latencyDigits (3) decimal digits distinguishes, since
+// 2×10³ < 2¹¹.
+func (c sampleCounts) add(d time.Duration) {
+	us := max(d.Microseconds(), 1)
+	shift := max(bits.Len64(uint64(us))-11, 0)
+	c[time.Duration(us>>shift<<shift)*time.Microsecond]++
+}
+
+// reset returns the summary of the samples so far and clears the histogram.
+// Samples recorded between the two may be lost; callers that need every
+// sample serialize recording and reset themselves.
+func (l *latencyHistogram) reset() latencySummary {
+	s := l.summary()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.h.Reset()
+	l.clamped = 0
+	return s
+}
+
+// latencySummary is a snapshot of the latency histogram.
+type latencySummary struct {
+	count                         int64
+	mean                          time.Duration
+	p50, p90, p95, p99, p999, max time.Duration
+	clamped                       int64
+}
+
+func (l *latencyHistogram) summary() latencySummary {
+	at := func(q float64) time.Duration { return time.Duration(l.h.ValueAtQuantile(q)) * time.Microsecond }
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return latencySummary{
+		count: l.h.TotalCount(),
+		mean:  time.Duration(l.h.Mean() * float64(time.Microsecond)).Truncate(time.Microsecond),
+		p50:   at(50),
+		p90:   at(90),
+		p95:   at(95),
+		p99:   at(99),
+		p999:  at(99.9),
+		max:   time.Duration(l.h.Max()) * time.Microsecond,
+
+		clamped: l.clamped,
+	}
+}
+
+// String renders the summary as one line of the final report.
+func (l latencySummary) String() string {
+	return fmt.Sprintf("mean %s | p50 %s | p90 %s | p95 %s | p99 %s | p99.9 %s | max %s",
+		l.mean, l.p50, l.p90, l.p95, l.p99, l.p999, l.max)
+}
+
+// countHistogram is an HdrHistogram of per-request counts, such as chunks
+// per stream or response bytes, guarded for concurrent use.
+type countHistogram struct {
+	mu    sync.Mutex
+	h     *hdrhistogram.Histogram
+	limit int64
+}
+
+// Counts are tracked up to maxTrackedCount, and byte sizes up to
+// maxTrackedBytes; larger samples are clamped.
+const (
+	maxTrackedCount = 1_000_000
+	maxTrackedBytes = 1 << 30
+)
+
+func newCountHistogram() *countHistogram {
+	return newCountHistogramUpTo(maxTrackedCount)
+}
+
+func newCountHistogramUpTo(limit int64) *countHistogram {
+	return &countHistogram{h: hdrhistogram.New(1, limit, 3), limit: limit}
+}
+
+func (c *countHistogram) record(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.h.RecordValue(min(max(n, 1), c.limit))
+}
+
+// countSummary is a snapshot of a count histogram.
+type countSummary struct {
+	count                   int64
+	mean                    float64
+	min, p50, p90, p99, max int64
+}
+
+func (c *countHistogram) summary() countSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return countSummary{
+		count: c.h.TotalCount(),
+		mean:  c.h.Mean(),
+		min:   c.h.Min(),
+		p50:   c.h.ValueAtQuantile(50),
+		p90:   c.h.ValueAtQuantile(90),
+		p99:   c.h.ValueAtQuantile(99),
+		max:   c.h.Max(),
+	}
+}
+
+func (c countSummary) String() string {
+	return fmt.Sprintf("mean %.1f | p50 %d | p90 %d | p99 %d | max %d", c.mean, c.p50, c.p90, c.p99, c.max)
+}
+
+// bytesString renders the summary as byte sizes.
+func (c countSummary) bytesString() string {
+	return fmt.Sprintf("min %s | mean %s | p50 %s | p90 %s | p99 %s | max %s", formatBytes(c.min), formatBytes(int64(c.mean)),
+		formatBytes(c.p50), formatBytes(c.p90), formatBytes(c.p99), formatBytes(c.max))
+}
+
+// formatBytes renders n bytes with a 1024-based unit.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// gzipWriters recycles gzip writers, whose compression state is large, across
+// --request-encoding gzip requests.
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// gzipBody returns data gzip-compressed at the default level.
+func gzipBody(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(&buf)
+	zw.Write(data)
+	zw.Close()
+	gzipWriters.Put(zw)
+	return buf.Bytes()
+}
+
+// gunzipReader decompresses a gzip-encoded response body. The gzip header is
+// only read on the first Read, so a broken one surfaces as a read error like
+// any other.
+type gunzipReader struct {
+	r  io.Reader
+	zr *gzip.Reader
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, err
+		}
+		g.zr = zr
+	}
+	return g.zr.Read(p)
 }
 
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// prompts is the built-in corpus, used with equal weights when --prompts isn't
+// set.
 var prompts = []string{
 	"Explain quantum computing in simple terms.",
 	"Write a short story about a robot learning to paint.",
@@ -113,129 +793,3022 @@ var prompts = []string{
 	"What are the phases of the moon?",
 }
 
-var httpClient = &http.Client{Timeout: 30 * time.Second}
-
-func main() {
-	config := parseFlags()
+// promptEntry is one conversation of the prompt corpus, picked with
+// probability proportional to its weight.
+type promptEntry struct {
+	Messages []Message
+	Weight   float64
+}
 
-	log.Printf("🚀 Starting Load Test")
-	log.Printf("   URL: %s", config.URL)
-	log.Printf("   RPS: %d", config.RPS)
-	log.Printf("   Duration: %s", config.Duration)
-	log.Printf("   Models: %v", config.Models)
-	log.Printf("   Providers: %v", config.Providers)
-	log.Printf("   Stream: %v", config.Stream)
+// promptCorpus is the conversations requests draw from; cumWeights holds the
+// running total of their weights for weighted picks.
+var (
+	promptCorpus []promptEntry
+	cumWeights   []float64
+)
 
-	// Attachment mode: pre-encode the PDF into reusable request bodies.
-	if config.PDFPath != "" {
-		buildPDFBodies(config)
+// setPromptCorpus installs entries as the corpus requests draw from.
+func setPromptCorpus(entries []promptEntry) {
+	promptCorpus = entries
+	cumWeights = make([]float64, len(entries))
+	var total float64
+	for i, e := range entries {
+		total += e.Weight
+		cumWeights[i] = total
 	}
+}
 
-	stats := &Stats{}
+// pickPrompt returns the messages of a weighted random corpus entry.
+func pickPrompt(rng *rand.Rand) []Message {
+	r := rng.Float64() * cumWeights[len(cumWeights)-1]
+	i := sort.Search(len(cumWeights), func(i int) bool { return cumWeights[i] > r })
+	return promptCorpus[min(i, len(promptCorpus)-1)].Messages
+}
 
-	// Setup signal handling
-	ctx, cancel := context.WithCancel(context.Background())
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+// builtinPromptCorpus wraps the built-in prompts as single-message, equally
+// weighted entries.
+func builtinPromptCorpus() []promptEntry {
+	entries := make([]promptEntry, len(prompts))
+	for i, p := range prompts {
+		entries[i] = promptEntry{Messages: []Message{{Role: "user", Content: p}}, Weight: 1}
+	}
+	return entries
+}
 
-	go func() {
-		<-sigChan
-		log.Println("\n📊 Stopping load test...")
-		cancel()
-	}()
+// promptLine is one line of a --prompts file: either a single user prompt or
+// a full conversation, with an optional weight (default 1).
+type promptLine struct {
+	Prompt   string    `json:"prompt"`
+	Messages []Message `json:"messages"`
+	Weight   *float64  `json:"weight"`
+}
 
-	// Start load test
-	startTime := time.Now()
-	endTime := startTime.Add(config.Duration)
+// loadVirtualKeys reads one virtual key per line, skipping blank lines and
+// # comments.
+func loadVirtualKeys(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keys, nil
+}
 
-	// Rate limiter
-	ticker := time.NewTicker(time.Second / time.Duration(config.RPS))
-	defer ticker.Stop()
+// keyReportLimit caps the rate-limited keys listed in the final statistics.
+const keyReportLimit = 10
 
-	// Basic stats printer every 10 seconds
-	statsTicker := time.NewTicker(10 * time.Second)
-	defer statsTicker.Stop()
+// keyLabel shortens a virtual key for the report, keeping its prefix and
+// last four characters.
+func keyLabel(key string) string {
+	if len(key) <= 12 {
+		return "…" + key[len(key)-min(len(key), 4):]
+	}
+	return key[:6] + "…" + key[len(key)-4:]
+}
 
-	var wg sync.WaitGroup
+// loadPromptCorpus reads a JSONL prompt corpus, one promptLine per non-blank
+// line, e.g.
+//
+//	{"prompt": "What is the capital of France?", "weight": 5}
+//	{"messages": [{"role": "system", "content": "Be terse."}, {"role": "user", "content": "Hi"}]}
+func loadPromptCorpus(path string) ([]promptEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-statsTicker.C:
-				printBasicStats(stats, time.Since(startTime))
+	var entries []promptEntry
+	var total float64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var line promptLine
+		if err := sonic.Unmarshal(raw, &line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		entry := promptEntry{Messages: line.Messages, Weight: 1}
+		switch {
+		case line.Prompt != "" && len(line.Messages) > 0:
+			return nil, fmt.Errorf("line %d: set either prompt or messages, not both", lineNum)
+		case line.Prompt != "":
+			entry.Messages = []Message{{Role: "user", Content: line.Prompt}}
+		case len(line.Messages) == 0:
+			return nil, fmt.Errorf("line %d: needs a prompt or messages", lineNum)
+		}
+		for _, m := range entry.Messages {
+			if m.Role == "" || m.Content == "" {
+				return nil, fmt.Errorf("line %d: every message needs a role and content", lineNum)
 			}
 		}
-	}()
-
-	requestCount := 0
-	for {
-		select {
-		case <-ctx.Done():
-			goto cleanup
-		case <-ticker.C:
-			if time.Now().After(endTime) {
-				goto cleanup
+		if line.Weight != nil {
+			if *line.Weight < 0 {
+				return nil, fmt.Errorf("line %d: weight must not be negative", lineNum)
 			}
-
-			wg.Add(1)
-			go func(reqNum int) {
-				defer wg.Done()
-				makeRequest(ctx, config, stats, reqNum)
-			}(requestCount)
-			requestCount++
+			entry.Weight = *line.Weight
 		}
+		entries = append(entries, entry)
+		total += entry.Weight
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || total <= 0 {
+		return nil, fmt.Errorf("no entries with a positive weight")
+	}
+	return entries, nil
+}
 
-cleanup:
-	log.Println("⏳ Waiting for remaining requests to complete...")
-	wg.Wait()
+// replayRecord is one request of a --replay log, ready to send: its offset
+// from the first recorded request, the path and headers it was sent with, and
+// its body with the endpoint, model and stream flag read from it.
+type replayRecord struct {
+	offset   time.Duration
+	path     string
+	header   http.Header
+	body     []byte
+	endpoint string
+	model    string
+	stream   bool
+	inputs   int // of an embeddings request
+}
 
-	totalDuration := time.Since(startTime)
-	log.Printf("\n✅ Load test completed in %s", totalDuration)
-	printFinalStats(stats, totalDuration)
+// replayLine is one line of a --replay file. The body is the JSON request
+// body, or a string holding it.
+type replayLine struct {
+	OffsetMS  *float64          `json:"offset_ms"`
+	Timestamp string            `json:"timestamp"`
+	Path      string            `json:"path"`
+	Headers   map[string]string `json:"headers"`
+	Body      json.RawMessage   `json:"body"`
 }
 
-func parseFlags() *Config {
-	config := &Config{}
+// replaySkipHeaders are recorded headers the hitter sets itself or that
+// belong to the original connection rather than the request.
+var replaySkipHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+}
 
-	flag.StringVar(&config.URL, "url", "http://localhost:8080/v1/chat/completions", "Target URL")
-	flag.IntVar(&config.RPS, "rps", 100, "Requests per second")
-	flag.DurationVar(&config.Duration, "duration", 60*time.Second, "Test duration")
-	flag.IntVar(&config.MaxTokens, "max-tokens", 150, "Max tokens per request")
-	flag.Float64Var(&config.Temperature, "temperature", 0.7, "Temperature for requests")
-	flag.BoolVar(&config.Verbose, "verbose", false, "Verbose logging")
-	flag.BoolVar(&config.Stream, "stream", false, "Enable streaming responses")
-	flag.StringVar(&config.VirtualKey, "virtual-key", "", "Virtual key to use for requests")
-	flag.StringVar(&config.PDFPath, "pdf", "", "Path to a PDF file to attach as a multimodal 'file' content block (enables attachment mode)")
-	flag.StringVar(&config.Prompt, "prompt", "", "Override the user prompt text (defaults to a random prompt, or a fixed summarize prompt in --pdf mode)")
+// loadReplay reads a JSONL traffic log for --replay, one replayLine per
+// non-blank line, timed either by offset_ms from the start of the recording
+// or by an RFC 3339 timestamp, e.g.
+//
+//	{"offset_ms": 0, "path": "/v1/chat/completions", "headers": {"x-team": "search"}, "body": {"model": "gpt-4o", "messages": [...]}}
+//	{"timestamp": "2025-06-01T12:00:00.250Z", "body": "{\"model\": \"gpt-4o-mini\", ...}"}
+//
+// The records come back sorted by time, with offsets counted from the
+// earliest one.
+func loadReplay(path string) ([]replayRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	modelsFlag := flag.String("models", "gpt-4,gpt-4o,gpt-4o-mini,gpt-4.1,gpt-5", "Comma-separated list of models")
-	providersFlag := flag.String("providers", "", "Comma-separated list of providers")
+	var records []replayRecord
+	var times []time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var line replayLine
+		if err := sonic.Unmarshal(raw, &line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		rec := replayRecord{path: line.Path, header: http.Header{}, endpoint: "chat"}
+		switch {
+		case line.OffsetMS != nil && line.Timestamp != "":
+			return nil, fmt.Errorf("line %d: set either offset_ms or timestamp, not both", lineNum)
+		case line.OffsetMS != nil:
+			if *line.OffsetMS < 0 {
+				return nil, fmt.Errorf("line %d: offset_ms must not be negative", lineNum)
+			}
+			rec.offset = time.Duration(*line.OffsetMS * float64(time.Millisecond))
+		case line.Timestamp != "":
+			t, err := time.Parse(time.RFC3339Nano, line.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			times = append(times, t)
+		default:
+			return nil, fmt.Errorf("line %d: needs an offset_ms or a timestamp", lineNum)
+		}
+		if len(times) > 0 && len(times) != len(records)+1 {
+			return nil, fmt.Errorf("line %d: time every line by offset_ms or every line by timestamp", lineNum)
+		}
 
-	flag.Parse()
+		rec.body = line.Body
+		if len(line.Body) > 0 && line.Body[0] == '"' {
+			var s string
+			if err := sonic.Unmarshal(line.Body, &s); err != nil {
+				return nil, fmt.Errorf("line %d: body: %v", lineNum, err)
+			}
+			rec.body = []byte(s)
+		}
+		var fields struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+			Input  any    `json:"input"`
+		}
+		if len(rec.body) == 0 || sonic.Unmarshal(rec.body, &fields) != nil {
+			return nil, fmt.Errorf("line %d: body must be a JSON object or a string holding one", lineNum)
+		}
+		rec.model, rec.stream, rec.inputs = fields.Model, fields.Stream, 1
+		// A list of strings or of token arrays is a batch; a single token
+		// array is one input.
+		if inputs, ok := fields.Input.([]any); ok && len(inputs) > 0 {
+			if _, tokens := inputs[0].(float64); !tokens {
+				rec.inputs = len(inputs)
+			}
+		}
 
-	// Parse models and providers
-	if *modelsFlag != "" {
-		config.Models = parseCommaSeparated(*modelsFlag)
+		if line.Path != "" {
+			if !strings.HasPrefix(line.Path, "/") {
+				return nil, fmt.Errorf("line %d: path %q must start with /", lineNum, line.Path)
+			}
+			endpointPath, _, _ := strings.Cut(line.Path, "?")
+			for name, suffix := range endpointPaths {
+				if strings.HasSuffix(endpointPath, suffix) {
+					rec.endpoint = name
+				}
+			}
+		}
+		for k, v := range line.Headers {
+			if !replaySkipHeaders[http.CanonicalHeaderKey(k)] {
+				rec.header.Set(k, v)
+			}
+		}
+		records = append(records, rec)
 	}
-	if *providersFlag != "" {
-		config.Providers = parseCommaSeparated(*providersFlag)
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no requests")
 	}
 
-	// Validation
-	if config.RPS <= 0 {
-		log.Fatal("RPS must be greater than 0")
+	if len(times) > 0 {
+		first := slices.MinFunc(times, time.Time.Compare)
+		for i, t := range times {
+			records[i].offset = t.Sub(first)
+		}
+	} else {
+		first := slices.MinFunc(records, func(a, b replayRecord) int { return cmp.Compare(a.offset, b.offset) }).offset
+		for i := range records {
+			records[i].offset -= first
+		}
 	}
-	if config.Duration <= 0 {
+	slices.SortStableFunc(records, func(a, b replayRecord) int { return cmp.Compare(a.offset, b.offset) })
+	return records, nil
+}
+
+// replayLoad is the rate the replay schedule sends at, second by second, as
+// a load profile for the periodic report, the metrics and the backpressure
+// check. It drops to zero once the log runs out.
+func replayLoad(records []replayRecord, speed float64) loadProfile {
+	var load loadProfile
+	for _, rec := range records {
+		second := int(float64(rec.offset) / speed / float64(time.Second))
+		for len(load) <= second {
+			load = append(load, loadSegment{duration: time.Second})
+		}
+		load[second].from++
+		load[second].to++
+	}
+	return append(load, loadSegment{})
+}
+
+// logLevel is how much the hitter logs, set with --log-level. Warnings and
+// errors are logged at every level.
+type logLevel int
+
+const (
+	levelQuiet   logLevel = iota // only the --output path, on stdout
+	levelSummary                 // the final statistics and SLOs
+	levelInfo                    // the settings, progress and periodic statistics
+	levelDebug                   // a line per request
+)
+
+var logLevelNames = [...]string{"quiet", "summary", "info", "debug"}
+
+// verbosity is the run's --log-level, set by parseFlags.
+var verbosity = levelInfo
+
+// logAt logs like log.Printf when --log-level is at least level.
+func logAt(level logLevel, format string, args ...any) {
+	if verbosity >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// httpClient is built by main from the transport flags; see newHTTPClient.
+var httpClient *http.Client
+
+// newHTTPClient returns a client whose transport applies the connection pool
+// flags, with connections dialed to --unix-socket or --dial-addr instead of
+// the URL's host when either is set.
+func newHTTPClient(config *Config) *http.Client {
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if config.UnixSocket != "" || config.DialAddr != "" {
+		network, addr := "tcp", config.DialAddr
+		if config.UnixSocket != "" {
+			network, addr = "unix", config.UnixSocket
+		}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+		RootCAs:            config.tlsRootCAs,
+		Certificates:       config.tlsClientCerts,
+	}
+	// auto leaves Go's defaults: HTTP/2 when an https target offers it via
+	// ALPN, HTTP/1.1 otherwise.
+	var protocols http.Protocols
+	switch config.Protocol {
+	case "http1":
+		protocols.SetHTTP1(true)
+		transport.Protocols = &protocols
+	case "h2":
+		protocols.SetHTTP2(true)
+		transport.Protocols = &protocols
+	case "h2c":
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = &protocols
+	}
+	transport.DisableKeepAlives = config.DisableKeepAlive
+	transport.MaxConnsPerHost = config.Conns
+	// With a connection cap and no explicit idle limit, keep every capped
+	// connection in the pool rather than Go's default of 2 per host.
+	if idle := config.MaxIdleConnsPerHost; idle > 0 || config.Conns > 0 {
+		if idle == 0 {
+			idle = config.Conns
+		}
+		transport.MaxIdleConnsPerHost = idle
+		transport.MaxIdleConns = max(transport.MaxIdleConns, idle)
+	}
+	return &http.Client{Timeout: config.RequestTimeout, Transport: transport}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		compareResults(os.Args[2:])
+		return
+	}
+	config := parseFlags()
+	applyScheduling(config)
+	httpClient = newHTTPClient(config)
+
+	if verbosity >= levelInfo {
+		printStartup(config)
+	}
+
+	setPromptCorpus(builtinPromptCorpus())
+	if config.PromptsPath != "" {
+		entries, err := loadPromptCorpus(config.PromptsPath)
+		if err != nil {
+			log.Fatalf("Failed to load prompts %q: %v", config.PromptsPath, err)
+		}
+		setPromptCorpus(entries)
+		logAt(levelInfo, "💬 Loaded %d prompt(s) from %s", len(entries), config.PromptsPath)
+	}
+
+	if config.ToolsPath != "" {
+		loadTools(config)
+	}
+
+	if config.VirtualKeysPath != "" {
+		keys, err := loadVirtualKeys(config.VirtualKeysPath)
+		if err != nil {
+			log.Fatalf("Failed to load virtual keys %q: %v", config.VirtualKeysPath, err)
+		}
+		config.VirtualKeys = keys
+		assignment := "one per request"
+		if config.KeyPerUser {
+			assignment = "one per user"
+		}
+		logAt(levelInfo, "🔑 Loaded %d virtual key(s) from %s, %s", len(keys), config.VirtualKeysPath, assignment)
+		if config.KeyPerUser && len(keys) > config.Users {
+			log.Printf("⚠️  Only the first %d of the %d virtual keys are used, one per --users worker", config.Users, len(keys))
+		}
+	}
+
+	if config.VegetaOutput != "" {
+		w, err := newVegetaWriter(config.VegetaOutput, config.VegetaEncoding)
+		if err != nil {
+			log.Fatalf("Failed to open --vegeta-output: %v", err)
+		}
+		vegetaOut = w
+	}
+
+	if config.CaptureDir != "" {
+		if err := os.MkdirAll(config.CaptureDir, 0o755); err != nil {
+			log.Fatalf("Failed to create capture directory %q: %v", config.CaptureDir, err)
+		}
+	}
+
+	// Attachment mode: pre-encode the PDF into reusable request bodies.
+	if config.PDFPath != "" {
+		buildPDFBodies(config)
+	}
+	// Image mode: render the synthetic image once and share it across requests.
+	if config.ImageKB > 0 {
+		imagePart = buildImagePart(buildSyntheticImage(config.ImageKB, newRand(config, streamImage)))
+	}
+
+	stats := newStats(config)
+
+	// Setup signal handling
+	ctx, cancel := context.WithCancel(context.Background())
+	// The first signal only stops sending, so the requests in flight still
+	// finish and count; the results are marked partial. A second one closes
+	// secondSignal to report without waiting for the rest of the drain.
+	sendCtx, stopSending := context.WithCancel(ctx)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	var interrupted atomic.Bool
+	secondSignal := make(chan struct{})
+
+	go func() {
+		<-sigChan
+		interrupted.Store(true)
+		logAt(levelInfo, "\n📊 Stopping load test... (interrupt again to skip the drain)")
+		stopSending()
+		<-sigChan
+		close(secondSignal)
+	}()
+
+	if config.FindMax {
+		if !findMaxThroughput(sendCtx, config) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Start load test
+	startTime := time.Now()
+	stats.start = startTime
+	endTime := startTime.Add(config.Duration)
+	if config.Requests > 0 {
+		// The run ends once the last request has been sent instead.
+		endTime = startTime.Add(math.MaxInt64)
+	}
+	for i, ph := range config.TrafficPhases {
+		_, settings, _ := strings.Cut(ph.spec, ":")
+		t := time.AfterFunc(ph.at, func() {
+			if sendCtx.Err() == nil {
+				logAt(levelInfo, "🔀 Phase %d: %s", i+1, settings)
+			}
+		})
+		defer t.Stop()
+	}
+
+	var aborted atomic.Bool
+	if config.AbortErrorRate > 0 {
+		go watchErrorRate(ctx, config, stats, func() {
+			aborted.Store(true)
+			cancel()
+		})
+	}
+
+	stopSeries := func() {}
+	if config.OutputPath != "" {
+		stats.series = &timeSeries{latency: newLatencyHistogram()}
+		stopSeries = stats.series.run(stats)
+	}
+
+	// Basic stats printer every 10 seconds
+	statsTicker := time.NewTicker(10 * time.Second)
+	defer statsTicker.Stop()
+
+	if verbosity >= levelInfo {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-statsTicker.C:
+					printBasicStats(config, stats, time.Since(startTime))
+				}
+			}
+		}()
+	}
+
+	// Prometheus export
+	metrics := func(w io.Writer) { writeMetrics(w, config, stats, time.Since(startTime)) }
+	if config.MetricsAddr != "" {
+		serveMetrics(config.MetricsAddr, metrics)
+	}
+	if config.PushURL != "" {
+		go pushMetricsEvery(ctx, config, metrics)
+	}
+
+	// Requests get their own context so that the drain can cancel the
+	// stragglers without stopping anything else.
+	reqCtx, cancelRequests := context.WithCancelCause(ctx)
+	defer cancelRequests(nil)
+
+	// report prints the final statistics and writes the result files once,
+	// either after the drain or when a second signal cuts it short.
+	var totalDuration time.Duration
+	var reportOnce sync.Once
+	report := func(stopReason string) {
+		reportOnce.Do(func() {
+			totalDuration = time.Since(startTime)
+			stopSeries()
+			switch stopReason {
+			case "":
+				logAt(levelSummary, "\n✅ Load test completed in %s", totalDuration)
+			case "aborted":
+				log.Printf("\n🛑 Load test aborted after %s", totalDuration)
+			default:
+				log.Printf("\n🛑 Load test %s after %s, results are partial", stopReason, totalDuration)
+			}
+			if verbosity >= levelSummary {
+				printFinalStats(config, stats, totalDuration)
+			}
+			if vegetaOut != nil {
+				if err := vegetaOut.close(); err != nil {
+					log.Printf("⚠️  Failed to write vegeta results to %s: %v", config.VegetaOutput, err)
+				} else if config.VegetaOutput != "-" {
+					logAt(levelSummary, "💾 Vegeta results written to %s (%d results, %s encoding)", config.VegetaOutput, vegetaOut.count, config.VegetaEncoding)
+				}
+			}
+			if config.OutputPath != "" {
+				if err := writeResults(config, stats, startTime, totalDuration, stopReason); err != nil {
+					log.Printf("⚠️  Failed to write results to %s: %v", config.OutputPath, err)
+				} else if verbosity > levelQuiet {
+					log.Printf("💾 Results written to %s", config.OutputPath)
+				} else if config.VegetaOutput != "-" {
+					// The one line a quiet run prints, for scripts to pick
+					// the results up from.
+					fmt.Println(config.OutputPath)
+				}
+			}
+		})
+	}
+	go func() {
+		<-secondSignal
+		n := atomic.LoadInt64(&stats.inflight)
+		atomic.StoreInt64(&stats.unfinished, n)
+		log.Printf("\n🛑 Interrupted again, skipping the drain with %d request(s) still in flight", n)
+		report("interrupted during drain")
+		os.Exit(130)
+	}()
+
+	var wg sync.WaitGroup
+	if config.Users > 0 {
+		runUsers(sendCtx, reqCtx, config, stats, endTime, &wg)
+	} else if config.ReplayPath != "" {
+		runReplay(sendCtx, reqCtx, config, stats, &wg)
+	} else {
+		runOpenLoop(sendCtx, reqCtx, config, stats, endTime, &wg)
+	}
+	drain(config, stats, &wg, cancelRequests)
+
+	switch {
+	case interrupted.Load():
+		report("interrupted")
+	case aborted.Load():
+		report("aborted")
+	default:
+		report("")
+	}
+	if config.PushURL != "" {
+		if err := pushMetrics(config, metrics); err != nil {
+			log.Printf("⚠️  Final Pushgateway push failed: %v", err)
+		}
+	}
+	if !checkSLOs(config, stats, totalDuration) || aborted.Load() || interrupted.Load() {
+		os.Exit(1)
+	}
+}
+
+// printStartup logs the settings of the run before it starts.
+func printStartup(config *Config) {
+	log.Printf("🚀 Starting Load Test")
+	if config.ConfigPath != "" {
+		log.Printf("   Scenario: %s", config.ConfigPath)
+	}
+	if len(config.Targets) > 1 {
+		mode := "alternating"
+		if config.TargetWeights {
+			mode = "weighted"
+		}
+		log.Printf("   Targets: %d, %s", len(config.Targets), mode)
+		for _, t := range config.Targets {
+			line := fmt.Sprintf("   Target %s: %s", t.name, t.url)
+			if config.TargetWeights {
+				line += fmt.Sprintf(" (weight %d)", t.weight)
+			}
+			log.Print(line)
+		}
+	} else {
+		log.Printf("   URL: %s", config.URL)
+	}
+	if config.UnixSocket != "" {
+		log.Printf("   Unix socket: %s", config.UnixSocket)
+	}
+	if config.DialAddr != "" {
+		log.Printf("   Dial address: %s", config.DialAddr)
+	}
+	if config.HostHeader != "" {
+		log.Printf("   Host header: %s", config.HostHeader)
+	}
+	if config.Protocol != "auto" {
+		log.Printf("   Protocol: %s", config.Protocol)
+	}
+	if config.Insecure {
+		log.Printf("   TLS verification: disabled (--insecure)")
+	}
+	if config.ClientCert != "" {
+		log.Printf("   Client certificate: %s", config.ClientCert)
+	}
+	if config.DisableKeepAlive {
+		log.Printf("   Connections: new per request (keep-alive disabled)")
+	} else if config.Conns > 0 || config.MaxIdleConnsPerHost > 0 {
+		limit := "unlimited"
+		if config.Conns > 0 {
+			limit = strconv.Itoa(config.Conns)
+		}
+		log.Printf("   Connections: %s per host, %d idle per host kept",
+			limit, httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost)
+	}
+	timeout := "none"
+	if config.RequestTimeout > 0 {
+		timeout = config.RequestTimeout.String()
+	}
+	if config.StreamIdleTimeout > 0 {
+		timeout += fmt.Sprintf(", stream idle %s", config.StreamIdleTimeout)
+	}
+	log.Printf("   Request timeout: %s", timeout)
+	log.Printf("   Encoding: %s requests, accepting %s responses", config.RequestEncoding, config.AcceptEncoding)
+	if config.Retries > 0 {
+		log.Printf("   Retries: %d on 429/5xx (backoff %s, max %s)", config.Retries, config.RetryBackoff, config.RetryMaxBackoff)
+	}
+	for _, h := range config.Headers {
+		log.Printf("   Header: %s: %s", h.key, h.raw)
+	}
+	if config.AbortErrorRate > 0 {
+		log.Printf("   Abort: error rate above %g%% over %s", config.AbortErrorRate, config.AbortWindow)
+	}
+	if len(config.Tags) > 0 {
+		log.Printf("   Tags: %s", &config.Tags)
+	}
+	if config.DrainTimeout > 0 {
+		log.Printf("   Drain timeout: %s", config.DrainTimeout)
+	} else {
+		log.Printf("   Drain timeout: none")
+	}
+	if config.CaptureDir != "" {
+		log.Printf("   Capture: %d%% of failures to %s (at most %d)", config.CapturePercent, config.CaptureDir, config.CaptureMax)
+	}
+	if config.Users > 0 {
+		log.Printf("   Users: %d (closed loop, think time %s)", config.Users, &config.ThinkTime)
+		if config.Turns > 0 {
+			history := "unlimited history"
+			if config.MaxHistory > 0 {
+				history = fmt.Sprintf("history capped at %d messages", config.MaxHistory)
+			}
+			log.Printf("   Conversations: %d turns, %s", config.Turns, history)
+		}
+	} else if config.ReplayPath != "" {
+		log.Printf("   Replay: %s at %gx speed", config.ReplayPath, config.ReplaySpeed)
+	} else if config.Profile != "" {
+		log.Printf("   Profile: %s (%s arrivals)", config.Load, config.Arrival)
+	} else if config.FindMax {
+		log.Printf("   Find max: trials from %d RPS (%s arrivals)", config.RPS, config.Arrival)
+	} else {
+		log.Printf("   RPS: %d (%s arrivals)", config.RPS, config.Arrival)
+	}
+	if config.MaxInflight > 0 {
+		log.Printf("   Max in-flight: %d", config.MaxInflight)
+	}
+	if config.Senders > 1 && config.Users == 0 {
+		log.Printf("   Senders: %d, each pacing 1/%d of the rate", config.Senders, config.Senders)
+	}
+	if config.Requests > 0 {
+		log.Printf("   Requests: %d", config.Requests)
+	} else {
+		log.Printf("   Duration: %s", config.Duration)
+	}
+	if config.ReplayPath != "" {
+		streams := 0
+		for _, rec := range replayRecords {
+			if rec.stream {
+				streams++
+			}
+		}
+		last := replayRecords[len(replayRecords)-1].offset
+		log.Printf("   Recorded: %d requests, %d streaming, spanning %s (%s at this speed)",
+			len(replayRecords), streams, last.Truncate(time.Millisecond),
+			time.Duration(float64(last)/config.ReplaySpeed).Truncate(time.Millisecond))
+	} else {
+		log.Printf("   Models: %v", config.Models)
+		log.Printf("   Providers: %v", config.Providers)
+		log.Printf("   Stream: %v", config.Stream)
+	}
+	if config.Mode == "embeddings" {
+		inputs := "prompts from the corpus"
+		if config.EmbeddingInputTokens > 0 {
+			inputs = fmt.Sprintf("~%d tokens of synthetic text", config.EmbeddingInputTokens)
+		}
+		log.Printf("   Mode: embeddings -> %s, models %v, %d inputs per request of %s",
+			config.Targets[0].endpointURLs["embeddings"], config.EmbeddingModels, config.EmbeddingBatch, inputs)
+	}
+	if config.Seed != 0 {
+		log.Printf("   Seed: %d", config.Seed)
+	}
+	for _, share := range config.Mix {
+		dest := config.Targets[0].endpointURLs[share.name]
+		if len(config.Targets) > 1 {
+			dest = endpointPaths[share.name]
+		}
+		log.Printf("   Mix: %d%% %s -> %s", share.percent, share.name, dest)
+	}
+	for i, ph := range config.TrafficPhases {
+		_, settings, _ := strings.Cut(ph.spec, ":")
+		log.Printf("   Phase %d at %s: %s", i+1, ph.at, settings)
+	}
+	if len(config.CPUs) > 0 {
+		log.Printf("   CPUs: %v", config.CPUs)
+	}
+	log.Printf("   GOMAXPROCS: %d", runtime.GOMAXPROCS(0))
+	if config.TokenDist.kind != "" {
+		log.Printf("   max_tokens: %s", &config.TokenDist)
+	}
+	if config.MaxCompletionTokensPercent > 0 {
+		log.Printf("   max_completion_tokens: %d%% of requests", config.MaxCompletionTokensPercent)
+	}
+	if config.ReasoningEffort != "" {
+		log.Printf("   reasoning_effort: %s on %d%% of requests", config.ReasoningEffort, config.ReasoningEffortPercent)
+	}
+	if config.ResponseFormat != "" {
+		log.Printf("   response_format: %s on %d%% of requests", config.ResponseFormat, config.ResponseFormatPercent)
+	}
+}
+
+// drain waits for the requests still in flight once sending has stopped,
+// for up to --drain-timeout, then cancels the rest with errDrainTimeout so
+// they are counted under their own error class rather than cut off.
+func drain(config *Config, stats *Stats, wg *sync.WaitGroup, cancelRequests context.CancelCauseFunc) {
+	start := time.Now()
+	inflight := atomic.LoadInt64(&stats.inflight)
+	atomic.StoreInt64(&stats.drainInflight, inflight)
+	if config.DrainTimeout > 0 {
+		logAt(levelInfo, "⏳ Draining %d in-flight requests (up to %s)...", inflight, config.DrainTimeout)
+	} else {
+		logAt(levelInfo, "⏳ Draining %d in-flight requests...", inflight)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if config.DrainTimeout > 0 {
+		timer := time.NewTimer(config.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		canceled := atomic.LoadInt64(&stats.inflight)
+		atomic.StoreInt64(&stats.drainCanceled, canceled)
+		log.Printf("⚠️  %d requests still in flight after the %s drain timeout; cancelling them",
+			canceled, config.DrainTimeout)
+		cancelRequests(errDrainTimeout)
+		<-done
+	}
+	stats.drainTime = time.Since(start)
+}
+
+// watchErrorRate calls abort once the share of failed requests among those
+// that completed over the last --abort-window exceeds --abort-on-error-rate.
+// It checks once a second and only after a full window has passed, and a
+// window needs abortMinRequests completions, so a slow start or a handful
+// of early failures can't trip it.
+func watchErrorRate(ctx context.Context, config *Config, stats *Stats, abort func()) {
+	const abortMinRequests = 10
+	type sample struct {
+		at              time.Time
+		success, errors int64
+	}
+	start := time.Now()
+	samples := []sample{{at: start}}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cur := sample{now, atomic.LoadInt64(&stats.successRequests), atomic.LoadInt64(&stats.errorRequests)}
+			samples = append(samples, cur)
+			// Keep the newest sample at least a window old as the baseline.
+			for len(samples) > 1 && now.Sub(samples[1].at) >= config.AbortWindow {
+				samples = samples[1:]
+			}
+			if now.Sub(start) < config.AbortWindow {
+				continue
+			}
+			base := samples[0]
+			failed := cur.errors - base.errors
+			completed := failed + cur.success - base.success
+			if completed < abortMinRequests {
+				continue
+			}
+			if rate := float64(failed) / float64(completed) * 100; rate > config.AbortErrorRate {
+				log.Printf("\n🛑 Aborting: %.1f%% of the %d requests completed in the last %s failed (limit %g%%)",
+					rate, completed, config.AbortWindow, config.AbortErrorRate)
+				abort()
+				return
+			}
+		}
+	}
+}
+
+// timeSeries buckets request outcomes by the second they completed in, for
+// --output. Only the current second is kept as a histogram; at the end of
+// each second it is reduced to a timeSeriesPoint and reset.
+type timeSeries struct {
+	mu        sync.Mutex
+	latency   *latencyHistogram
+	success   int64
+	errors    int64
+	lastTotal int64
+	points    []timeSeriesPoint
+}
+
+// timeSeriesPoint is one second of the run. Second counts from 1, for the
+// second ending at that offset from the start; latencies are of the
+// successful requests that completed in it and are 0 when there were none.
+type timeSeriesPoint struct {
+	Second  int     `json:"second"`
+	Started int64   `json:"started"`
+	Success int64   `json:"success"`
+	Errors  int64   `json:"errors"`
+	P50Ms   float64 `json:"p50_ms"`
+	P90Ms   float64 `json:"p90_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+func (t *timeSeries) recordSuccess(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.success++
+	t.latency.record(d)
+}
+
+func (t *timeSeries) recordError() {
+	t.mu.Lock()
+	t.errors++
+	t.mu.Unlock()
+}
+
+// flush closes the current second. total is the number of requests started
+// so far.
+func (t *timeSeries) flush(total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.latency.reset()
+	t.points = append(t.points, timeSeriesPoint{
+		Second:  len(t.points) + 1,
+		Started: total - t.lastTotal,
+		Success: t.success,
+		Errors:  t.errors,
+		P50Ms:   milliseconds(l.p50),
+		P90Ms:   milliseconds(l.p90),
+		P99Ms:   milliseconds(l.p99),
+		MaxMs:   milliseconds(l.max),
+	})
+	t.success, t.errors, t.lastTotal = 0, 0, total
+}
+
+// run flushes a point every second until the returned stop function is
+// called, which flushes the final, possibly partial, second.
+func (t *timeSeries) run(stats *Stats) (stop func()) {
+	ticker := time.NewTicker(time.Second)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				t.flush(atomic.LoadInt64(&stats.totalRequests))
+				return
+			case <-ticker.C:
+				t.flush(atomic.LoadInt64(&stats.totalRequests))
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+	}
+}
+
+// milliseconds converts d to fractional milliseconds for the results file.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// runResult is the --output file: the run's settings, its final statistics
+// and the per-second time series.
+type runResult struct {
+	URL            string            `json:"url"`
+	StartedAt      string            `json:"started_at"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	DurationSec    float64           `json:"duration_sec"`
+	Partial        bool              `json:"partial,omitempty"`
+	StopReason     string            `json:"stop_reason,omitempty"`
+	RPS            int               `json:"rps,omitempty"`
+	Profile        string            `json:"profile,omitempty"`
+	Replay         string            `json:"replay,omitempty"`
+	ReplaySpeed    float64           `json:"replay_speed,omitempty"`
+	Users          int               `json:"users,omitempty"`
+	Stream         bool              `json:"stream"`
+	Models         []string          `json:"models"`
+	Providers      []string          `json:"providers,omitempty"`
+	TotalRequests  int64             `json:"total_requests"`
+	Successful     int64             `json:"successful"`
+	Errors         int64             `json:"errors"`
+	Unfinished     int64             `json:"unfinished,omitempty"`
+	SuccessRate    float64           `json:"success_rate"`
+	AverageRPS     float64           `json:"average_rps"`
+	Latency        *latencyResult    `json:"latency,omitempty"`
+	TTFT           *latencyResult    `json:"ttft,omitempty"`
+	ResponseBytes  *bytesResult      `json:"response_bytes,omitempty"`
+	ErrorBreakdown map[string]int64  `json:"error_breakdown,omitempty"`
+	Targets        []targetResult    `json:"targets,omitempty"`
+	VirtualKeys    []keyResult       `json:"virtual_keys,omitempty"`
+	TimeSeries     []timeSeriesPoint `json:"timeseries"`
+
+	// Phases splits successful requests' latency, keyed by lowercased
+	// phase name.
+	Phases map[string]*latencyResult `json:"phases,omitempty"`
+
+	// Open-loop scheduling: how late requests started, and the latency
+	// measured from their scheduled send times.
+	SchedulerLag     *latencyResult `json:"scheduler_lag,omitempty"`
+	CorrectedLatency *latencyResult `json:"corrected_latency,omitempty"`
+
+	// Quantiles states how accurate the latency quantiles are.
+	Quantiles quantileAccuracy `json:"quantiles"`
+
+	// TrafficPhases are the --phase values the traffic shifted by.
+	TrafficPhases []string `json:"traffic_phases,omitempty"`
+}
+
+// quantileAccuracy describes the HdrHistograms the results file's latency
+// quantiles come from. Each keeps counts in buckets no wider than a
+// relative_error share of their values between min_ms and max_ms, so its
+// memory_bytes are fixed by those bounds rather than growing with the run.
+// clamped counts successful requests slower than max_ms, recorded as max_ms.
+type quantileAccuracy struct {
+	Method            string  `json:"method"`
+	SignificantDigits int     `json:"significant_digits"`
+	RelativeError     float64 `json:"relative_error"`
+	MinMs             float64 `json:"min_ms"`
+	MaxMs             float64 `json:"max_ms"`
+	MemoryBytes       int     `json:"memory_bytes"`
+	Clamped           int64   `json:"clamped"`
+}
+
+// keyResult is one --virtual-keys key's counts, with the key shortened.
+type keyResult struct {
+	Key           string `json:"key"`
+	TotalRequests int64  `json:"total_requests"`
+	Successful    int64  `json:"successful"`
+	RateLimited   int64  `json:"rate_limited"`
+}
+
+// targetResult is one target's share of a multi-target run.
+type targetResult struct {
+	Name          string         `json:"name"`
+	URL           string         `json:"url"`
+	Weight        int            `json:"weight,omitempty"`
+	TotalRequests int64          `json:"total_requests"`
+	Successful    int64          `json:"successful"`
+	Errors        int64          `json:"errors"`
+	SuccessRate   float64        `json:"success_rate"`
+	Latency       *latencyResult `json:"latency,omitempty"`
+	TTFT          *latencyResult `json:"ttft,omitempty"`
+}
+
+// bytesResult summarizes response body sizes in bytes.
+type bytesResult struct {
+	Total int64   `json:"total"`
+	Min   int64   `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   int64   `json:"p50"`
+	P90   int64   `json:"p90"`
+	P99   int64   `json:"p99"`
+	Max   int64   `json:"max"`
+}
+
+// latencyResult is a latencySummary in milliseconds.
+type latencyResult struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	P999Ms float64 `json:"p999_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+func newLatencyResult(l latencySummary) *latencyResult {
+	if l.count == 0 {
+		return nil
+	}
+	return &latencyResult{
+		Count:  l.count,
+		MeanMs: milliseconds(l.mean),
+		P50Ms:  milliseconds(l.p50),
+		P90Ms:  milliseconds(l.p90),
+		P95Ms:  milliseconds(l.p95),
+		P99Ms:  milliseconds(l.p99),
+		P999Ms: milliseconds(l.p999),
+		MaxMs:  milliseconds(l.max),
+	}
+}
+
+// newBytesResult converts a body size summary; nil if nothing was recorded.
+func newBytesResult(b countSummary, total int64) *bytesResult {
+	if b.count == 0 {
+		return nil
+	}
+	return &bytesResult{Total: total, Min: b.min, Mean: b.mean, P50: b.p50, P90: b.p90, P99: b.p99, Max: b.max}
+}
+
+// writeResults writes the --output file.
+func writeResults(config *Config, stats *Stats, start time.Time, duration time.Duration, stopReason string) error {
+	total := atomic.LoadInt64(&stats.totalRequests)
+	success := atomic.LoadInt64(&stats.successRequests)
+	result := runResult{
+		URL:            config.URL,
+		StartedAt:      start.UTC().Format(time.RFC3339),
+		Tags:           config.Tags,
+		DurationSec:    duration.Seconds(),
+		StopReason:     stopReason,
+		Profile:        config.Profile,
+		Users:          config.Users,
+		Stream:         config.Stream,
+		Models:         config.Models,
+		Providers:      config.Providers,
+		TotalRequests:  total,
+		Successful:     success,
+		Errors:         atomic.LoadInt64(&stats.errorRequests),
+		Unfinished:     atomic.LoadInt64(&stats.unfinished),
+		AverageRPS:     float64(total) / duration.Seconds(),
+		Latency:        newLatencyResult(stats.latency.summary()),
+		ResponseBytes:  newBytesResult(stats.respBytes.summary(), atomic.LoadInt64(&stats.respBytesTotal)),
+		TTFT:           newLatencyResult(stats.ttft.summary()),
+		ErrorBreakdown: stats.errorBreakdown(),
+		TimeSeries:     stats.series.points,
+
+		SchedulerLag:     newLatencyResult(stats.schedLag.summary()),
+		CorrectedLatency: newLatencyResult(stats.correctedLatency.summary()),
+
+		Quantiles: quantileAccuracy{
+			Method:            "hdr_histogram",
+			SignificantDigits: latencyDigits,
+			RelativeError:     math.Pow10(-latencyDigits),
+			MinMs:             milliseconds(time.Microsecond),
+			MaxMs:             milliseconds(maxTrackedLatency),
+			MemoryBytes:       stats.latency.h.ByteSize(),
+			Clamped:           stats.latency.summary().clamped,
+		},
+	}
+	for _, ph := range config.TrafficPhases {
+		result.TrafficPhases = append(result.TrafficPhases, ph.spec)
+	}
+	if config.ReplayPath != "" {
+		result.Replay, result.ReplaySpeed = config.ReplayPath, config.ReplaySpeed
+	} else if config.Users == 0 && config.Profile == "" {
+		result.RPS = config.RPS
+	}
+	// An aborted run stopped on purpose; only interrupted ones are partial.
+	result.Partial = stopReason != "" && stopReason != "aborted"
+	if total > 0 {
+		result.SuccessRate = float64(success) / float64(total) * 100
+	}
+	for i, name := range phaseNames {
+		if l := newLatencyResult(stats.phases[i].summary()); l != nil {
+			if result.Phases == nil {
+				result.Phases = make(map[string]*latencyResult, len(phaseNames))
+			}
+			result.Phases[strings.ToLower(name)] = l
+		}
+	}
+	for _, t := range config.Targets {
+		ts := stats.targets[t.name]
+		if ts == nil {
+			continue
+		}
+		tr := targetResult{
+			Name:          t.name,
+			URL:           t.url,
+			TotalRequests: atomic.LoadInt64(&ts.total),
+			Successful:    atomic.LoadInt64(&ts.success),
+			Errors:        atomic.LoadInt64(&ts.errors),
+			Latency:       newLatencyResult(ts.latency.summary()),
+			TTFT:          newLatencyResult(ts.ttft.summary()),
+		}
+		if config.TargetWeights {
+			tr.Weight = t.weight
+		}
+		if tr.TotalRequests > 0 {
+			tr.SuccessRate = float64(tr.Successful) / float64(tr.TotalRequests) * 100
+		}
+		result.Targets = append(result.Targets, tr)
+	}
+	for i, ks := range stats.keys {
+		result.VirtualKeys = append(result.VirtualKeys, keyResult{
+			Key:           keyLabel(config.VirtualKeys[i]),
+			TotalRequests: atomic.LoadInt64(&ks.total),
+			Successful:    atomic.LoadInt64(&ks.success),
+			RateLimited:   atomic.LoadInt64(&ks.rateLimited),
+		})
+	}
+	data, err := sonic.ConfigStd.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.OutputPath, append(data, '\n'), 0o644)
+}
+
+// compareSignificance is the |t| or |z| from which compare calls a change
+// significant, about 95% confidence; compareMinSeconds is the fewest
+// time-series seconds a run needs for its latency and throughput changes to
+// be tested at all.
+const (
+	compareSignificance = 2.0
+	compareMinSeconds   = 5
+)
+
+// compareResults implements "hitter compare BASE NEW": it reads two --output
+// files and prints how the second run differs from the first, with a hint
+// whether each change stands out from the run-to-run noise. Latency and
+// throughput changes are tested with Welch's t-test over the per-second
+// time series, success rate with a two-proportion z-test over all requests.
+func compareResults(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hitter compare BASE.json NEW.json\n\nCompares two --output results files.\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	base, err := readResults(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	next, err := readResults(fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("📊 RUN COMPARISON")
+	for _, r := range []struct {
+		label, path string
+		result      *runResult
+	}{{"Base", fs.Arg(0), base}, {"New", fs.Arg(1), next}} {
+		log.Printf("   %-5s %s (%s, started %s, %.1fs, %d requests)",
+			r.label+":", r.path, r.result.URL, r.result.StartedAt, r.result.DurationSec, r.result.TotalRequests)
+		if len(r.result.Tags) > 0 {
+			tags := tagList(r.result.Tags)
+			log.Printf("   %-5s Tags: %s", "", &tags)
+		}
+		if r.result.Partial {
+			log.Printf("   ⚠️  %s is a partial run (%s), so its numbers may not be comparable", r.label, r.result.StopReason)
+		}
+	}
+	log.Printf("   %-13s %12s %12s %10s  %s", "Metric", "Base", "New", "Change", "Significance")
+
+	latency := func(label string, quantile func(*latencyResult) float64, series func(timeSeriesPoint) float64) {
+		if base.Latency == nil || next.Latency == nil {
+			log.Printf("   %-13s %12s %12s %10s  %s", label, "-", "-", "-", "n/a (no successful requests)")
+			return
+		}
+		a, b := quantile(base.Latency), quantile(next.Latency)
+		t, ok := welchT(latencySeries(base, series), latencySeries(next, series))
+		log.Printf("   %-13s %12s %12s %10s  %s", label, fmt.Sprintf("%.1fms", a), fmt.Sprintf("%.1fms", b),
+			percentChange(a, b), significanceHint("t", t, ok, b < a))
+	}
+	latency("p50 latency", func(l *latencyResult) float64 { return l.P50Ms }, func(p timeSeriesPoint) float64 { return p.P50Ms })
+	latency("p99 latency", func(l *latencyResult) float64 { return l.P99Ms }, func(p timeSeriesPoint) float64 { return p.P99Ms })
+
+	z, ok := proportionZ(base.Successful, base.TotalRequests, next.Successful, next.TotalRequests)
+	log.Printf("   %-13s %12s %12s %10s  %s", "Success rate",
+		fmt.Sprintf("%.2f%%", base.SuccessRate), fmt.Sprintf("%.2f%%", next.SuccessRate),
+		fmt.Sprintf("%+.2fpp", next.SuccessRate-base.SuccessRate), significanceHint("z", z, ok, next.SuccessRate > base.SuccessRate))
+
+	t, ok := welchT(throughputSeries(base), throughputSeries(next))
+	log.Printf("   %-13s %12s %12s %10s  %s", "Throughput",
+		fmt.Sprintf("%.1f rps", base.AverageRPS), fmt.Sprintf("%.1f rps", next.AverageRPS),
+		percentChange(base.AverageRPS, next.AverageRPS), significanceHint("t", t, ok, next.AverageRPS > base.AverageRPS))
+}
+
+// readResults reads an --output results file.
+func readResults(path string) (*runResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var result runResult
+	if err := sonic.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &result, nil
+}
+
+// latencySeries returns one latency quantile of every full second with
+// successful requests. The last second is partial and left out.
+func latencySeries(r *runResult, quantile func(timeSeriesPoint) float64) []float64 {
+	var values []float64
+	for i, p := range r.TimeSeries {
+		if p.Success > 0 && i < len(r.TimeSeries)-1 {
+			values = append(values, quantile(p))
+		}
+	}
+	return values
+}
+
+// throughputSeries returns the requests started in every full second.
+func throughputSeries(r *runResult) []float64 {
+	var values []float64
+	for i, p := range r.TimeSeries {
+		if i < len(r.TimeSeries)-1 {
+			values = append(values, float64(p.Started))
+		}
+	}
+	return values
+}
+
+// welchT returns Welch's t statistic for the difference between the means of
+// b and a, and false when either has fewer than compareMinSeconds values.
+func welchT(a, b []float64) (float64, bool) {
+	if len(a) < compareMinSeconds || len(b) < compareMinSeconds {
+		return 0, false
+	}
+	meanVar := func(x []float64) (float64, float64) {
+		var sum, sq float64
+		for _, v := range x {
+			sum += v
+		}
+		mean := sum / float64(len(x))
+		for _, v := range x {
+			sq += (v - mean) * (v - mean)
+		}
+		return mean, sq / float64(len(x)-1)
+	}
+	ma, va := meanVar(a)
+	mb, vb := meanVar(b)
+	return standardized(mb-ma, math.Sqrt(va/float64(len(a))+vb/float64(len(b)))), true
+}
+
+// proportionZ returns the two-proportion z statistic for the change from
+// successA of totalA to successB of totalB, and false without requests.
+func proportionZ(successA, totalA, successB, totalB int64) (float64, bool) {
+	if totalA == 0 || totalB == 0 {
+		return 0, false
+	}
+	pa, pb := float64(successA)/float64(totalA), float64(successB)/float64(totalB)
+	pooled := float64(successA+successB) / float64(totalA+totalB)
+	return standardized(pb-pa, math.Sqrt(pooled*(1-pooled)*(1/float64(totalA)+1/float64(totalB)))), true
+}
+
+// standardized divides diff by its standard error; a difference without any
+// noise at all is infinitely significant.
+func standardized(diff, se float64) float64 {
+	switch {
+	case diff == 0:
+		return 0
+	case se == 0:
+		return math.Inf(int(math.Copysign(1, diff)))
+	}
+	return diff / se
+}
+
+// percentChange formats the change from a to b as a signed percentage.
+func percentChange(a, b float64) string {
+	if a == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (b-a)/a*100)
+}
+
+// significanceHint labels a test statistic: within noise below
+// compareSignificance, otherwise better or worse.
+func significanceHint(name string, stat float64, ok, improved bool) string {
+	switch {
+	case !ok:
+		return "n/a (too few samples)"
+	case math.Abs(stat) < compareSignificance:
+		return fmt.Sprintf("within noise (%s=%.2f)", name, stat)
+	case improved:
+		return fmt.Sprintf("✅ better (%s=%.2f)", name, stat)
+	}
+	return fmt.Sprintf("⚠️  worse (%s=%.2f)", name, stat)
+}
+
+// Goal-seeking search bounds: stop once the gap between the highest passing
+// and lowest failing rate is within findMaxPrecision of the passing one, or
+// after findMaxTrials trials, pausing findMaxCooldown between trials so one
+// trial's backlog doesn't leak into the next.
+const (
+	findMaxPrecision = 0.05
+	findMaxTrials    = 12
+	findMaxCooldown  = 5 * time.Second
+)
+
+// findMaxThroughput searches for the highest constant open-loop rate at which
+// every --slo-* assertion holds. Each trial runs at one rate for --duration
+// with fresh statistics. The rate doubles from --rps until a trial fails, then
+// the search bisects between the highest passing and lowest failing rates.
+// It returns whether any rate passed.
+func findMaxThroughput(ctx context.Context, config *Config) bool {
+	best, worst := 0, 0 // highest passing and lowest failing rate; 0 = none yet
+	rate := config.RPS
+	for trial := 1; trial <= findMaxTrials && rate > 0 && ctx.Err() == nil; trial++ {
+		if trial > 1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(findMaxCooldown):
+			}
+		}
+
+		tc := *config
+		tc.RPS, tc.Load = rate, constantLoad(rate)
+		stats := newStats(&tc)
+		start := time.Now()
+		var wg sync.WaitGroup
+		runOpenLoop(ctx, ctx, &tc, stats, start.Add(config.Duration), &wg)
+		wg.Wait()
+		if ctx.Err() != nil {
+			logAt(levelInfo, "🔎 Trial %d at %d RPS interrupted", trial, rate)
+			break
+		}
+
+		passed := true
+		var results []string
+		for _, c := range sloChecks(&tc, stats, time.Since(start)) {
+			mark := "✅"
+			if !c.ok {
+				mark, passed = "❌", false
+			}
+			results = append(results, fmt.Sprintf("%s %s (%s)", mark, c.name, c.actual))
+		}
+		logAt(levelInfo, "🔎 Trial %d at %d RPS: %s", trial, rate, strings.Join(results, " | "))
+
+		if passed {
+			best = rate
+		} else {
+			worst = rate
+		}
+		switch {
+		case worst == 0:
+			rate *= 2
+		case float64(worst-best) <= max(1, float64(best)*findMaxPrecision):
+			rate = 0
+		default:
+			rate = (best + worst) / 2
+		}
+	}
+
+	logAt(levelSummary, "\n🏁 GOAL-SEEKING RESULT")
+	switch {
+	case best == 0:
+		logAt(levelSummary, "   No tested rate met the SLOs (lowest tried: %d RPS)", worst)
+		return false
+	case worst == 0:
+		logAt(levelSummary, "   Maximum sustainable throughput: at least %d RPS (no tested rate broke the SLOs)", best)
+	default:
+		logAt(levelSummary, "   Maximum sustainable throughput: %d RPS (SLOs broke at %d RPS)", best, worst)
+	}
+	return true
+}
+
+// sloCheck is the outcome of one --slo-* assertion.
+type sloCheck struct {
+	name   string
+	ok     bool
+	actual string
+}
+
+// sloChecks evaluates every --slo-* assertion that is set against stats.
+// Latency SLOs on a run without successful requests count as violated.
+func sloChecks(config *Config, stats *Stats, duration time.Duration) []sloCheck {
+	var checks []sloCheck
+	latencyCheck := func(name string, limit, actual time.Duration, count int64) {
+		if limit > 0 {
+			checks = append(checks, sloCheck{fmt.Sprintf("%s <= %s", name, limit), count > 0 && actual <= limit, actual.String()})
+		}
+	}
+	l, t := stats.latency.summary(), stats.ttft.summary()
+	latencyCheck("p50", config.SLOP50, l.p50, l.count)
+	latencyCheck("p95", config.SLOP95, l.p95, l.count)
+	latencyCheck("p99", config.SLOP99, l.p99, l.count)
+	latencyCheck("TTFT p99", config.SLOTTFTP99, t.p99, t.count)
+
+	total := atomic.LoadInt64(&stats.totalRequests)
+	if config.SLOSuccess > 0 {
+		var rate float64
+		if total > 0 {
+			rate = float64(atomic.LoadInt64(&stats.successRequests)) / float64(total) * 100
+		}
+		checks = append(checks, sloCheck{fmt.Sprintf("success >= %g%%", config.SLOSuccess), rate >= config.SLOSuccess, fmt.Sprintf("%.2f%%", rate)})
+	}
+	if config.SLOMinRPS > 0 {
+		rps := float64(total) / duration.Seconds()
+		checks = append(checks, sloCheck{fmt.Sprintf("average RPS >= %g", config.SLOMinRPS), rps >= config.SLOMinRPS, fmt.Sprintf("%.1f", rps)})
+	}
+	return checks
+}
+
+// checkSLOs reports each --slo-* assertion against the final statistics and
+// returns whether all of them held.
+func checkSLOs(config *Config, stats *Stats, duration time.Duration) bool {
+	checks := sloChecks(config, stats, duration)
+	if len(checks) == 0 {
+		return true
+	}
+
+	logAt(levelSummary, "\n🎯 SLOs")
+	violated := 0
+	for _, c := range checks {
+		mark := "✅"
+		if !c.ok {
+			mark = "❌"
+			violated++
+		}
+		logAt(levelSummary, "   %s %s (actual %s)", mark, c.name, c.actual)
+	}
+	if violated > 0 {
+		log.Printf("❌ %d of %d SLOs violated", violated, len(checks))
+		return false
+	}
+	logAt(levelSummary, "✅ All %d SLOs met", len(checks))
+	return true
+}
+
+// metricsClient sends Pushgateway pushes, apart from the load-generating
+// client so they never show up in its connection stats.
+var metricsClient = &http.Client{Timeout: 10 * time.Second}
+
+// serveMetrics exposes the hitter's metrics at http://addr/metrics for the
+// length of the run.
+func serveMetrics(addr string, metrics func(io.Writer)) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("--metrics-addr: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics(w)
+	})
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("⚠️  Metrics server stopped: %v", err)
+		}
+	}()
+	logAt(levelInfo, "📡 Serving metrics on http://%s/metrics", ln.Addr())
+}
+
+// pushMetricsEvery pushes the metrics to the Pushgateway every
+// --push-interval until ctx is done; main pushes the final values.
+func pushMetricsEvery(ctx context.Context, config *Config, metrics func(io.Writer)) {
+	ticker := time.NewTicker(config.PushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pushMetrics(config, metrics); err != nil {
+				log.Printf("⚠️  Pushgateway push failed: %v", err)
+			}
+		}
+	}
+}
+
+// pushMetrics replaces the --push-job group on the Pushgateway with the
+// current metrics.
+func pushMetrics(config *Config, metrics func(io.Writer)) error {
+	var body bytes.Buffer
+	metrics(&body)
+	target := strings.TrimSuffix(config.PushURL, "/") + "/metrics/job/" + url.PathEscape(config.PushJob)
+	req, err := http.NewRequest(http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := metricsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return nil
+}
+
+// writeMetrics renders the run's counters, gauges and latency summaries in
+// the Prometheus text format. Quantiles cover the whole run so far, like the
+// periodic stats line; rate() over the counters gives per-interval values.
+func writeMetrics(w io.Writer, config *Config, stats *Stats, elapsed time.Duration) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	summary := func(name, help string, l latencySummary) {
+		metric(name, "summary", help)
+		for _, q := range []struct {
+			label string
+			value time.Duration
+		}{{"0.5", l.p50}, {"0.9", l.p90}, {"0.95", l.p95}, {"0.99", l.p99}, {"0.999", l.p999}} {
+			fmt.Fprintf(w, "%s{quantile=%q} %g\n", name, q.label, q.value.Seconds())
+		}
+		fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, l.mean.Seconds()*float64(l.count), name, l.count)
+	}
+
+	metric("hitter_requests_total", "counter", "Requests started.")
+	fmt.Fprintf(w, "hitter_requests_total %d\n", atomic.LoadInt64(&stats.totalRequests))
+	metric("hitter_requests_completed_total", "counter", "Requests finished, by outcome.")
+	fmt.Fprintf(w, "hitter_requests_completed_total{result=\"success\"} %d\n", atomic.LoadInt64(&stats.successRequests))
+	fmt.Fprintf(w, "hitter_requests_completed_total{result=\"error\"} %d\n", atomic.LoadInt64(&stats.errorRequests))
+	metric("hitter_errors_total", "counter", "Failed requests, by error class.")
+	breakdown := stats.errorBreakdown()
+	for _, class := range slices.Sorted(maps.Keys(breakdown)) {
+		fmt.Fprintf(w, "hitter_errors_total{class=%q} %d\n", class, breakdown[class])
+	}
+	if len(stats.targets) > 0 {
+		metric("hitter_target_requests_completed_total", "counter", "Requests finished, by --url target and outcome.")
+		for _, t := range config.Targets {
+			ts := stats.targets[t.name]
+			fmt.Fprintf(w, "hitter_target_requests_completed_total{target=%q,result=\"success\"} %d\n", t.name, atomic.LoadInt64(&ts.success))
+			fmt.Fprintf(w, "hitter_target_requests_completed_total{target=%q,result=\"error\"} %d\n", t.name, atomic.LoadInt64(&ts.errors))
+		}
+	}
+	metric("hitter_attempts_total", "counter", "HTTP attempts, including retries.")
+	fmt.Fprintf(w, "hitter_attempts_total %d\n", atomic.LoadInt64(&stats.attempts))
+	metric("hitter_connections_total", "counter", "Connections obtained for requests, by whether they were reused.")
+	fmt.Fprintf(w, "hitter_connections_total{reused=\"false\"} %d\n", atomic.LoadInt64(&stats.newConns))
+	fmt.Fprintf(w, "hitter_connections_total{reused=\"true\"} %d\n", atomic.LoadInt64(&stats.reusedConns))
+	if config.Users == 0 {
+		metric("hitter_target_rps", "gauge", "Open-loop target request rate.")
+		fmt.Fprintf(w, "hitter_target_rps %g\n", config.Load.rateAt(elapsed))
+		metric("hitter_requests_in_flight", "gauge", "Open-loop requests in flight.")
+		fmt.Fprintf(w, "hitter_requests_in_flight %d\n", atomic.LoadInt64(&stats.inflight))
+		metric("hitter_skipped_arrivals_total", "counter", "Open-loop arrivals skipped at --max-inflight.")
+		fmt.Fprintf(w, "hitter_skipped_arrivals_total %d\n", atomic.LoadInt64(&stats.skipped))
+	}
+	summary("hitter_request_duration_seconds", "End-to-end latency of successful requests.", stats.latency.summary())
+	if l := stats.correctedLatency.summary(); l.count > 0 {
+		summary("hitter_corrected_request_duration_seconds", "Latency of successful open-loop requests from their scheduled send time.", l)
+		summary("hitter_scheduler_lag_seconds", "Delay of open-loop requests past their scheduled send time.", stats.schedLag.summary())
+	}
+	if t := stats.ttft.summary(); t.count > 0 {
+		summary("hitter_ttft_seconds", "Time to first stream chunk of successful streams.", t)
+	}
+	if streams(config) {
+		metric("hitter_output_tokens_total", "counter", "Output tokens of completed streams, from usage frames or content chunks.")
+		fmt.Fprintf(w, "hitter_output_tokens_total %d\n", atomic.LoadInt64(&stats.outputTokens))
+	}
+	metric("hitter_response_bytes_total", "counter", "Body bytes of successful responses.")
+	fmt.Fprintf(w, "hitter_response_bytes_total %d\n", atomic.LoadInt64(&stats.respBytesTotal))
+}
+
+// runOpenLoop starts requests at the configured load until endTime, whether
+// or not earlier ones have finished, so a slow target piles up requests in
+// flight instead of lowering the offered load. Arrivals are evenly spaced, or
+// with --arrival poisson, a Poisson process: independent, exponentially
+// distributed gaps averaging 1/RPS, which bunches requests the way
+// independent clients do. With --profile the rate follows the profile.
+// Sending stops when ctx is done; the requests themselves run under reqCtx.
+// With --senders the schedule is split across that many goroutines, each
+// pacing an equal share of the rate, and runOpenLoop returns once all of
+// them have stopped.
+func runOpenLoop(ctx, reqCtx context.Context, config *Config, stats *Stats, endTime time.Time, wg *sync.WaitGroup) {
+	start := time.Now()
+	var senders sync.WaitGroup
+	for sender := range config.Senders {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			sendOpenLoop(ctx, reqCtx, config, stats, start, endTime, wg, sender)
+		}()
+	}
+	senders.Wait()
+}
+
+// sendOpenLoop is one --senders goroutine of runOpenLoop. Sender i of n sends
+// requests i, i+n, i+2n, ... at 1/n of the rate. With constant spacing its
+// arrivals are offset by i/n of a step, so together the senders interleave
+// into the same evenly spaced schedule a single sender would keep. With
+// Poisson arrivals each sender draws its own gaps, and the merged arrivals
+// are again a Poisson process at the full rate.
+func sendOpenLoop(ctx, reqCtx context.Context, config *Config, stats *Stats, start, endTime time.Time, wg *sync.WaitGroup, sender int) {
+	shares := float64(config.Senders)
+
+	// The n-th request goes out once the profile's cumulative expected
+	// arrivals reach the n-th threshold: consecutive integers for constant
+	// spacing, sums of unit exponentials for Poisson. Scheduling against the
+	// integral keeps the long-run rate on target when a wake-up runs late
+	// and lets the rate change between two arrivals.
+	nextStep := func() float64 { return 1 }
+	threshold := float64(sender) / shares
+	if config.Arrival == "poisson" {
+		stream := int64(streamArrivals)
+		if sender > 0 {
+			stream = streamSenders - int64(sender)
+		}
+		nextStep = newRand(config, stream).ExpFloat64
+		threshold = nextStep()
+	}
+
+	// Sleeps are capped so a rising rate is picked up promptly even when
+	// the current one is low or zero.
+	const maxWait = 50 * time.Millisecond
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	requestCount := sender
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if time.Now().After(endTime) {
+				return
+			}
+
+			if config.Requests > 0 && requestCount >= config.Requests {
+				return
+			}
+
+			elapsed := time.Since(start)
+			arrivals := config.Load.arrivalsBy(elapsed) / shares
+			rate := config.Load.rateAt(elapsed) / shares
+			for arrivals >= threshold && (config.Requests == 0 || requestCount < config.Requests) {
+				// The arrival was due when the expected arrivals crossed
+				// its threshold, which at the current rate was
+				// (arrivals-threshold)/rate ago; a late wake-up shows up as
+				// scheduler lag rather than vanishing from the latency.
+				scheduled := start.Add(elapsed)
+				if rate > 0 {
+					behind := time.Duration((arrivals - threshold) / rate * float64(time.Second))
+					scheduled = start.Add(elapsed - min(behind, elapsed))
+				}
+				threshold += nextStep()
+				sendArrival(reqCtx, config, stats, wg, requestCount, scheduled)
+				requestCount += config.Senders
+			}
+
+			wait := maxWait
+			if rate > 0 {
+				wait = min(wait, time.Duration((threshold-arrivals)/rate*float64(time.Second)))
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// sendArrival starts open-loop request reqNum, due at scheduled, without
+// waiting for it to finish. At --max-inflight the arrival is skipped rather
+// than delayed, so the shortfall shows up in the stats instead of quietly
+// stretching the schedule.
+func sendArrival(reqCtx context.Context, config *Config, stats *Stats, wg *sync.WaitGroup, reqNum int, scheduled time.Time) {
+	inflight := atomic.LoadInt64(&stats.inflight)
+	if config.MaxInflight > 0 && inflight >= int64(config.MaxInflight) {
+		atomic.AddInt64(&stats.skipped, 1)
+		return
+	}
+	inflight = atomic.AddInt64(&stats.inflight, 1)
+	if inflight > atomic.LoadInt64(&stats.peakInflight) {
+		atomic.StoreInt64(&stats.peakInflight, inflight)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer atomic.AddInt64(&stats.inflight, -1)
+		makeRequest(reqCtx, config, stats, reqNum, -1, nil, scheduled)
+	}()
+}
+
+// runReplay sends the --replay records in the open loop, each at its
+// recorded offset divided by --replay-speed, until the log runs out or
+// --duration is over. Each send is timed from the start of the run rather
+// than from the previous one, so a late wake-up doesn't push back the rest
+// of the log.
+func runReplay(ctx, reqCtx context.Context, config *Config, stats *Stats, wg *sync.WaitGroup) {
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for reqNum, rec := range replayRecords {
+		offset := time.Duration(float64(rec.offset) / config.ReplaySpeed)
+		if offset > config.Duration {
+			return
+		}
+		scheduled := start.Add(offset)
+		timer.Reset(time.Until(scheduled))
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		sendArrival(reqCtx, config, stats, wg, reqNum, scheduled)
+	}
+}
+
+// loadSegment is one stretch of a load profile, over which the target rate
+// moves linearly from from to to requests per second. The last segment of a
+// profile has no duration and holds its rate until the run ends.
+type loadSegment struct {
+	duration time.Duration
+	from, to float64
+}
+
+// loadProfile is the open-loop target rate over the run: a constant --rps,
+// or a ramp, steps or a spike from --profile.
+type loadProfile []loadSegment
+
+// constantLoad holds rps for the whole run.
+func constantLoad(rps int) loadProfile {
+	return loadProfile{{from: float64(rps), to: float64(rps)}}
+}
+
+// rateAt returns the target rate, in requests per second, at elapsed.
+func (p loadProfile) rateAt(elapsed time.Duration) float64 {
+	for i, seg := range p {
+		if i == len(p)-1 || elapsed < seg.duration {
+			if seg.duration == 0 {
+				return seg.to
+			}
+			return seg.from + (seg.to-seg.from)*min(elapsed.Seconds()/seg.duration.Seconds(), 1)
+		}
+		elapsed -= seg.duration
+	}
+	return 0
+}
+
+// arrivalsBy returns the number of requests the profile expects by elapsed:
+// the integral of its rate from the start of the run.
+func (p loadProfile) arrivalsBy(elapsed time.Duration) float64 {
+	var total float64
+	for i, seg := range p {
+		if i == len(p)-1 || elapsed < seg.duration {
+			return total + (seg.from+p[i:].rateAt(elapsed))/2*elapsed.Seconds()
+		}
+		total += (seg.from + seg.to) / 2 * seg.duration.Seconds()
+		elapsed -= seg.duration
+	}
+	return total
+}
+
+// String renders the profile as its segments, e.g.
+// "0→500 rps over 1m0s, then 500 rps".
+func (p loadProfile) String() string {
+	parts := make([]string, 0, len(p))
+	for i, seg := range p {
+		switch {
+		case i == len(p)-1:
+			parts = append(parts, fmt.Sprintf("then %g rps", seg.to))
+		case seg.from == seg.to:
+			parts = append(parts, fmt.Sprintf("%g rps for %s", seg.from, seg.duration))
+		default:
+			parts = append(parts, fmt.Sprintf("%g→%g rps over %s", seg.from, seg.to, seg.duration))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseLoadProfile parses --profile:
+//
+//	ramp:FROM-TOrps/DURATION     linear ramp, then hold TO
+//	step:R1,R2,...,RN/DURATION   each rate for DURATION, then hold RN
+//	spike[:PEAKrps/DURATION]     rps with a burst at PEAK in the middle of
+//	                             the run (default 5×rps for 10s)
+//
+// The "rps" suffix on rates is optional. Once a profile's phases are over, its
+// final rate holds until --duration ends.
+func parseLoadProfile(spec string, rps int, runDuration time.Duration) (loadProfile, error) {
+	kind, args, _ := strings.Cut(spec, ":")
+	parseRate := func(s string) (float64, error) {
+		r, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "rps"), 64)
+		if err != nil || r < 0 {
+			return 0, fmt.Errorf("invalid rate %q", s)
+		}
+		return r, nil
+	}
+	parseRatesAndDuration := func() (string, time.Duration, error) {
+		rates, dur, ok := strings.Cut(args, "/")
+		if !ok {
+			return "", 0, fmt.Errorf("%s needs a /DURATION", kind)
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("invalid duration %q", dur)
+		}
+		return rates, d, nil
+	}
+
+	switch kind {
+	case "ramp":
+		rates, d, err := parseRatesAndDuration()
+		if err != nil {
+			return nil, err
+		}
+		fromStr, toStr, ok := strings.Cut(rates, "-")
+		if !ok {
+			return nil, fmt.Errorf("ramp needs FROM-TO rates, got %q", rates)
+		}
+		from, err := parseRate(fromStr)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseRate(toStr)
+		if err != nil {
+			return nil, err
+		}
+		return loadProfile{{duration: d, from: from, to: to}, {from: to, to: to}}, nil
+	case "step":
+		rates, d, err := parseRatesAndDuration()
+		if err != nil {
+			return nil, err
+		}
+		var p loadProfile
+		for _, s := range strings.Split(rates, ",") {
+			r, err := parseRate(s)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, loadSegment{duration: d, from: r, to: r})
+		}
+		last := p[len(p)-1]
+		return append(p, loadSegment{from: last.to, to: last.to}), nil
+	case "spike":
+		peak, d := float64(5*rps), 10*time.Second
+		if args != "" {
+			peakStr, dur, err := parseRatesAndDuration()
+			if err != nil {
+				return nil, err
+			}
+			if peak, err = parseRate(peakStr); err != nil {
+				return nil, err
+			}
+			d = dur
+		}
+		base := float64(rps)
+		before := max(runDuration-d, 0) / 2
+		return loadProfile{
+			{duration: before, from: base, to: base},
+			{duration: d, from: peak, to: peak},
+			{from: base, to: base},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown profile %q (want ramp, step or spike)", kind)
+	}
+}
+
+// thinkTime is --think-time: a base pause, drawn uniformly from
+// base±jitter for every pause when jitter is set.
+type thinkTime struct {
+	base, jitter time.Duration
+}
+
+func (t *thinkTime) String() string {
+	if t.jitter == 0 {
+		return t.base.String()
+	}
+	return t.base.String() + "±" + t.jitter.String()
+}
+
+// Set parses a duration with an optional jitter: "500ms", "500ms±200ms" or,
+// for keyboards without ±, "500ms+-200ms". The jitter can't exceed the base,
+// so pauses never go negative.
+func (t *thinkTime) Set(v string) error {
+	base, jitter, found := strings.Cut(v, "±")
+	if !found {
+		base, jitter, found = strings.Cut(v, "+-")
+	}
+	b, err := time.ParseDuration(strings.TrimSpace(base))
+	if err != nil || b < 0 {
+		return fmt.Errorf("invalid duration %q", base)
+	}
+	var j time.Duration
+	if found {
+		j, err = time.ParseDuration(strings.TrimSpace(jitter))
+		if err != nil || j < 0 {
+			return fmt.Errorf("invalid jitter %q", jitter)
+		}
+		if j > b {
+			return fmt.Errorf("jitter %s exceeds the base pause %s", j, b)
+		}
+	}
+	t.base, t.jitter = b, j
+	return nil
+}
+
+// next returns the length of one pause.
+func (t *thinkTime) next() time.Duration {
+	if t.jitter == 0 {
+		return t.base
+	}
+	return t.base - t.jitter + time.Duration(rand.Int63n(int64(2*t.jitter)+1))
+}
+
+// tokenDist is --max-tokens-dist, the distribution max_tokens is drawn from
+// for every request. The zero value is --max-tokens ±25, at least 10.
+type tokenDist struct {
+	spec         string
+	kind         string
+	lo, hi       int
+	mean, stddev float64
+	values       []int
+	weights      []int
+	totalWeight  int
+}
+
+func (d *tokenDist) String() string { return d.spec }
+
+// Set parses "uniform:MIN-MAX", "normal:MEAN,STDDEV" or
+// "weighted:VALUE=WEIGHT,...", with relative weights.
+func (d *tokenDist) Set(v string) error {
+	kind, args, _ := strings.Cut(v, ":")
+	next := tokenDist{spec: v, kind: kind}
+	switch kind {
+	case "uniform":
+		lo, hi, ok := strings.Cut(args, "-")
+		a, errLo := strconv.Atoi(lo)
+		b, errHi := strconv.Atoi(hi)
+		if !ok || errLo != nil || errHi != nil || a < 1 || b < a {
+			return fmt.Errorf("uniform needs MIN-MAX with 1 <= MIN <= MAX, got %q", args)
+		}
+		next.lo, next.hi = a, b
+	case "normal":
+		mean, stddev, ok := strings.Cut(args, ",")
+		m, errMean := strconv.ParseFloat(mean, 64)
+		sd, errSD := strconv.ParseFloat(stddev, 64)
+		if !ok || errMean != nil || errSD != nil || m < 1 || sd < 0 {
+			return fmt.Errorf("normal needs MEAN,STDDEV with MEAN >= 1 and STDDEV >= 0, got %q", args)
+		}
+		next.mean, next.stddev = m, sd
+	case "weighted":
+		for _, pair := range strings.Split(args, ",") {
+			value, weight, ok := strings.Cut(pair, "=")
+			n, errValue := strconv.Atoi(strings.TrimSpace(value))
+			w, errWeight := strconv.Atoi(strings.TrimSpace(weight))
+			if !ok || errValue != nil || errWeight != nil || n < 1 || w < 1 {
+				return fmt.Errorf("weighted needs VALUE=WEIGHT pairs of positive integers, got %q", pair)
+			}
+			next.values, next.weights = append(next.values, n), append(next.weights, w)
+			next.totalWeight += w
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q; use uniform, normal or weighted", kind)
+	}
+	*d = next
+	return nil
+}
+
+// sample draws max_tokens for one request. base is --max-tokens, which only
+// the default distribution uses. Normal draws below 1 are raised to 1.
+func (d *tokenDist) sample(rng *rand.Rand, base int) int {
+	switch d.kind {
+	case "uniform":
+		return d.lo + rng.Intn(d.hi-d.lo+1)
+	case "normal":
+		return max(int(math.Round(d.mean+rng.NormFloat64()*d.stddev)), 1)
+	case "weighted":
+		r := rng.Intn(d.totalWeight)
+		for i, w := range d.weights {
+			if r < w {
+				return d.values[i]
+			}
+			r -= w
+		}
+		return d.values[len(d.values)-1]
+	}
+	return max(base+rng.Intn(50)-25, 10)
+}
+
+// runUsers starts --users workers that each send a request, wait for its
+// response, pause for --think-time, and repeat until endTime. Throughput then
+// follows the target's latency, as with real interactive clients. With
+// --turns, each worker carries its conversation from one request to the next.
+// As in the open loop, ctx stops sending and reqCtx governs the requests.
+func runUsers(ctx, reqCtx context.Context, config *Config, stats *Stats, endTime time.Time, wg *sync.WaitGroup) {
+	var requestCount atomic.Int64
+	// With --requests, each request claims a number first, and the user
+	// that claims the last one closes sent.
+	var sent chan struct{}
+	if config.Requests > 0 {
+		sent = make(chan struct{})
+	}
+	for user := range config.Users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var sess *session
+			if config.Turns > 0 {
+				sess = &session{turns: config.Turns, maxHistory: config.MaxHistory}
+			}
+			for ctx.Err() == nil && time.Now().Before(endTime) {
+				reqNum := int(requestCount.Add(1) - 1)
+				if config.Requests > 0 && reqNum >= config.Requests {
+					return
+				}
+				if reqNum == config.Requests-1 {
+					close(sent)
+				}
+				atomic.AddInt64(&stats.inflight, 1)
+				makeRequest(reqCtx, config, stats, reqNum, user, sess, time.Time{})
+				atomic.AddInt64(&stats.inflight, -1)
+				if pause := config.ThinkTime.next(); pause > 0 {
+					select {
+					case <-ctx.Done():
+					case <-time.After(pause):
+					}
+				}
+			}
+		}()
+	}
+	// Return once the run is over, like the open loop, so the caller's
+	// wait covers the users' last requests.
+	select {
+	case <-ctx.Done():
+	case <-sent:
+	case <-time.After(time.Until(endTime)):
+	}
+}
+
+// endpointShare is one entry of --mix: an endpoint and the percentage of
+// requests sent to it.
+type endpointShare struct {
+	name    string
+	percent int
+}
+
+// endpointPaths are the --mix endpoints and the path each replaces the
+// /chat/completions suffix of --url with.
+var endpointPaths = map[string]string{
+	"chat":       "/chat/completions",
+	"embeddings": "/embeddings",
+	"responses":  "/responses",
+}
+
+// parseMix parses --mix, e.g. "chat=70,embeddings=20,responses=10". The
+// percentages must add up to 100.
+func parseMix(s string) ([]endpointShare, error) {
+	var mix []endpointShare
+	total := 0
+	for _, part := range parseCommaSeparated(s) {
+		name, pct, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not ENDPOINT=PERCENT", part)
+		}
+		if _, known := endpointPaths[name]; !known {
+			return nil, fmt.Errorf("unknown endpoint %q (want chat, embeddings or responses)", name)
+		}
+		p, err := strconv.Atoi(pct)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid percentage %q for %s", pct, name)
+		}
+		mix = append(mix, endpointShare{name: name, percent: p})
+		total += p
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("percentages add up to %d, not 100", total)
+	}
+	return mix, nil
+}
+
+// endpointURLs derives each --mix endpoint's URL from --url, which must end
+// in /chat/completions, e.g. .../v1/chat/completions -> .../v1/embeddings.
+func endpointURLs(target string, mix []endpointShare) (map[string]string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	base, ok := strings.CutSuffix(u.Path, endpointPaths["chat"])
+	if !ok {
+		return nil, fmt.Errorf("--url path %q does not end in %s", u.Path, endpointPaths["chat"])
+	}
+	urls := make(map[string]string, len(mix))
+	for _, share := range mix {
+		eu := *u
+		eu.Path = base + endpointPaths[share.name]
+		urls[share.name] = eu.String()
+	}
+	return urls, nil
+}
+
+// trafficPhase is one --phase: from its offset into the run, the mix,
+// models, providers and share of streaming requests it shifts the traffic
+// to. spec is the --phase value as given.
+type trafficPhase struct {
+	at            time.Duration
+	spec          string
+	mix           []endpointShare
+	models        []string
+	providers     []string
+	streamPercent int
+}
+
+// parsePhases parses the --phase values, each AT:SETTING=VALUE;... with AT
+// an offset into the run, e.g. "5m:mix=chat=30,embeddings=70;stream-percent=50".
+// The settings are mix, models, providers and stream-percent; those a phase
+// leaves out keep their value from the phase before, the first one's from
+// the flags, where --stream means a stream-percent of 100.
+func parsePhases(specs []string, config *Config) ([]trafficPhase, error) {
+	prev := trafficPhase{mix: config.Mix, models: config.Models, providers: config.Providers}
+	if config.Stream {
+		prev.streamPercent = 100
+	}
+	phases := make([]trafficPhase, 0, len(specs))
+	for _, spec := range specs {
+		at, settings, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not AT:SETTING=VALUE;...", spec)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(at))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q: the offset must be a positive duration", spec)
+		}
+		if len(phases) > 0 && d <= phases[len(phases)-1].at {
+			return nil, fmt.Errorf("%q: phases must be given in order of their offsets", spec)
+		}
+		ph := prev
+		ph.at, ph.spec = d, spec
+		for _, setting := range strings.Split(settings, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+			if !ok {
+				return nil, fmt.Errorf("%q: %q is not SETTING=VALUE", spec, setting)
+			}
+			switch name {
+			case "mix":
+				if ph.mix, err = parseMix(value); err != nil {
+					return nil, fmt.Errorf("%q: mix: %v", spec, err)
+				}
+			case "models":
+				if ph.models = parseCommaSeparated(value); len(ph.models) == 0 {
+					return nil, fmt.Errorf("%q: models must not be empty", spec)
+				}
+			case "providers":
+				ph.providers = parseCommaSeparated(value)
+			case "stream-percent":
+				if ph.streamPercent, err = strconv.Atoi(value); err != nil || ph.streamPercent < 0 || ph.streamPercent > 100 {
+					return nil, fmt.Errorf("%q: stream-percent must be between 0 and 100", spec)
+				}
+			default:
+				return nil, fmt.Errorf("%q: unknown setting %q (want mix, models, providers or stream-percent)", spec, name)
+			}
+		}
+		phases = append(phases, ph)
+		prev = ph
+	}
+	return phases, nil
+}
+
+// phaseAt returns the --phase in effect elapsed into the run, or nil before
+// the first one.
+func phaseAt(config *Config, elapsed time.Duration) *trafficPhase {
+	i := sort.Search(len(config.TrafficPhases), func(i int) bool { return config.TrafficPhases[i].at > elapsed })
+	if i == 0 {
+		return nil
+	}
+	return &config.TrafficPhases[i-1]
+}
+
+// mixEndpoints lists the endpoints of --mix and of every --phase mix, once
+// each, to set up their URLs and statistics.
+func mixEndpoints(config *Config) []endpointShare {
+	var all []endpointShare
+	add := func(mix []endpointShare) {
+		for _, share := range mix {
+			if !slices.ContainsFunc(all, func(s endpointShare) bool { return s.name == share.name }) {
+				all = append(all, share)
+			}
+		}
+	}
+	add(config.Mix)
+	for _, ph := range config.TrafficPhases {
+		add(ph.mix)
+	}
+	if len(all) > 0 && len(config.Mix) == 0 {
+		// Until the first phase with a mix, everything goes to chat.
+		add([]endpointShare{{name: "chat", percent: 100}})
+	}
+	return all
+}
+
+// streams reports whether any request of the run may stream: with --stream,
+// or a --phase with a stream-percent.
+func streams(config *Config) bool {
+	return config.Stream || slices.ContainsFunc(config.TrafficPhases, func(ph trafficPhase) bool { return ph.streamPercent > 0 })
+}
+
+// target is one --url: its label, its URL, its --target-weights weight,
+// and with --mix, the URL each endpoint is sent to.
+type target struct {
+	name         string
+	url          string
+	origin       string // scheme://host of url, which --replay paths go to
+	weight       int
+	endpointURLs map[string]string
+}
+
+// parseTargets parses the --url values, each a URL optionally labelled as
+// NAME=URL, and --target-weights. Unlabelled targets are named after their
+// host, or after their whole URL when two share a host.
+func parseTargets(specs []string, weightsSpec string) ([]*target, error) {
+	targets := make([]*target, 0, len(specs))
+	hosts := map[string]int{}
+	for _, spec := range specs {
+		t := &target{url: spec}
+		if name, rest, ok := strings.Cut(spec, "="); ok && !strings.ContainsAny(name, ":/?") {
+			t.name, t.url = name, rest
+		}
+		u, err := url.Parse(t.url)
+		if err != nil {
+			return nil, fmt.Errorf("--url: %v", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("--url: %q is not an http or https URL", t.url)
+		}
+		t.origin = u.Scheme + "://" + u.Host
+		hosts[u.Host]++
+		targets = append(targets, t)
+	}
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if t.name == "" {
+			u, _ := url.Parse(t.url)
+			t.name = u.Host
+			if hosts[u.Host] > 1 {
+				t.name = t.url
+			}
+		}
+		if seen[t.name] {
+			return nil, fmt.Errorf("--url: duplicate target %q; label targets as NAME=URL", t.name)
+		}
+		seen[t.name] = true
+	}
+
+	if weightsSpec == "" {
+		return targets, nil
+	}
+	if len(targets) < 2 {
+		return nil, errors.New("--target-weights needs several --url targets")
+	}
+	weights := parseCommaSeparated(weightsSpec)
+	if len(weights) != len(targets) {
+		return nil, fmt.Errorf("--target-weights has %d weights for %d targets", len(weights), len(targets))
+	}
+	for i, w := range weights {
+		n, err := strconv.Atoi(w)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("--target-weights: %q is not a positive integer", w)
+		}
+		targets[i].weight = n
+	}
+	return targets, nil
+}
+
+// pickTarget picks the target of one request: the next one in turn, or with
+// --target-weights one rolled by weight.
+func pickTarget(config *Config, rng *rand.Rand, reqNum int) *target {
+	if len(config.Targets) == 1 {
+		return config.Targets[0]
+	}
+	if !config.TargetWeights {
+		return config.Targets[reqNum%len(config.Targets)]
+	}
+	sum := 0
+	for _, t := range config.Targets {
+		sum += t.weight
+	}
+	r := rng.Intn(sum)
+	for _, t := range config.Targets {
+		if r < t.weight {
+			return t
+		}
+		r -= t.weight
+	}
+	return config.Targets[len(config.Targets)-1]
+}
+
+// syntheticWords are common English words of about one token each, the
+// vocabulary of --embedding-input-tokens inputs.
+var syntheticWords = strings.Fields(`the of and to in is that for it as with was on be at by this had not are
+but from or have an they which one you were her all she there would their we him been has when who will more
+no if out so said what up its about into than them can only other new some could time these two may then do
+first any my now such like our over man me even most made after also did many before must through back years
+where much your way well down should because each just those people how too little state good very make world
+still own see men work long get here between both life being under never day same another know while last
+might us great old year off come since against go came right used take three`)
+
+// syntheticText returns about tokens tokens of random words.
+func syntheticText(rng *rand.Rand, tokens int) string {
+	var b strings.Builder
+	for i := range tokens {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(syntheticWords[rng.Intn(len(syntheticWords))])
+	}
+	return b.String()
+}
+
+// pickEndpoint rolls the endpoint for one request; "chat" without --mix.
+func pickEndpoint(config *Config, rng *rand.Rand) string {
+	if config.Mode == "embeddings" {
+		return "embeddings"
+	}
+	if len(config.Mix) == 0 {
+		return "chat"
+	}
+	r := rng.Intn(100)
+	for _, share := range config.Mix {
+		if r < share.percent {
+			return share.name
+		}
+		r -= share.percent
+	}
+	return config.Mix[len(config.Mix)-1].name
+}
+
+// buildEndpointBody marshals the body of a non-chat --mix request: a batch of
+// corpus prompts to embed, or a Responses API call with a corpus
+// conversation as input. It returns the body and the model it targets.
+func buildEndpointBody(config *Config, rng *rand.Rand, reqNum int, endpoint, provider string) ([]byte, string, error) {
+	var payload any
+	var model string
+	switch endpoint {
+	case "embeddings":
+		model = config.EmbeddingModels[rng.Intn(len(config.EmbeddingModels))]
+		if provider != "" {
+			model = provider + "/" + model
+		}
+		inputs := make([]string, config.EmbeddingBatch)
+		for i := range inputs {
+			if config.EmbeddingInputTokens > 0 {
+				inputs[i] = syntheticText(rng, config.EmbeddingInputTokens)
+				continue
+			}
+			messages := pickPrompt(rng)
+			inputs[i] = expandPlaceholders(messages[len(messages)-1].Content, rng, reqNum)
+		}
+		payload = EmbeddingRequest{Model: model, Input: inputs}
+	case "responses":
+		model = config.Models[rng.Intn(len(config.Models))]
+		if provider != "" {
+			model = provider + "/" + model
+		}
+		messages := pickPrompt(rng)
+		if config.Prompt != "" {
+			messages = []Message{{Role: "user", Content: config.Prompt}}
+		}
+		payload = ResponsesRequest{
+			Model:           model,
+			Input:           expandMessages(messages, rng, reqNum),
+			MaxOutputTokens: config.TokenDist.sample(rng, config.MaxTokens),
+			Temperature:     config.Temperature + (rng.Float64()-0.5)*0.2,
+			Stream:          config.Stream,
+		}
+	}
+	body, err := sonic.Marshal(payload)
+	return body, model, err
+}
+
+// session is one user's conversation in multi-turn mode. Every request sends
+// the history so far plus a new user turn, and a successful reply is appended
+// to it; after turns replies the conversation starts over. A failed request
+// leaves the history as it was, so the turn is retried with a new prompt.
+type session struct {
+	turns      int
+	maxHistory int
+
+	turn    int
+	history []Message
+	pending []Message
+}
+
+// messages returns what to send for the next turn. fresh is a conversation
+// picked from the prompt corpus: it opens a new conversation as is, and later
+// turns take its last message as the next user turn.
+func (s *session) messages(fresh []Message) []Message {
+	if s.turn == 0 {
+		s.pending = slices.Clone(fresh)
+	} else {
+		s.pending = append(s.context(), fresh[len(fresh)-1])
+	}
+	return s.pending
+}
+
+// context returns a copy of the history, trimmed to the newest maxHistory
+// messages when set. A leading system message is always kept, and the kept
+// turns start at a user message.
+func (s *session) context() []Message {
+	h := s.history
+	if s.maxHistory == 0 || len(h) <= s.maxHistory {
+		return slices.Clone(h)
+	}
+	var system []Message
+	if h[0].Role == "system" {
+		system, h = h[:1], h[1:]
+	}
+	h = h[min(len(h)+len(system)-s.maxHistory, len(h)):]
+	for len(h) > 0 && h[0].Role != "user" {
+		h = h[1:]
+	}
+	return append(slices.Clone(system), h...)
+}
+
+// reply records the assistant's answer to the pending turn.
+func (s *session) reply(content string) {
+	s.history = s.pending
+	if content != "" {
+		s.history = append(s.history, Message{Role: "assistant", Content: content})
+	}
+	s.turn++
+	if s.turn == s.turns {
+		s.turn, s.history = 0, nil
+	}
+}
+
+func parseFlags() *Config {
+	config := &Config{}
+
+	urlFlags := urlList{urls: []string{"http://localhost:8080/v1/chat/completions"}}
+	flag.Var(&urlFlags, "url", "Target URL, optionally labelled as NAME=URL; repeat to compare several targets within one run")
+	targetWeightsFlag := flag.String("target-weights", "", "Comma-separated weights of the --url targets, e.g. 70,30, to spread requests at random instead of alternating between them (empty = alternate)")
+	flag.IntVar(&config.RPS, "rps", 100, "Requests per second")
+	flag.StringVar(&config.Arrival, "arrival", "constant", "Open-loop arrival pattern at --rps: constant (evenly spaced) or poisson (exponential inter-arrival times)")
+	flag.StringVar(&config.Profile, "profile", "", "Open-loop load profile instead of a constant --rps: ramp:FROM-TOrps/DUR, step:R1,R2,.../DUR or spike[:PEAKrps/DUR] (empty = constant --rps)")
+	flag.IntVar(&config.MaxInflight, "max-inflight", 0, "Open-loop cap on requests in flight; arrivals beyond it are skipped and reported instead of sent (0 = unlimited)")
+	flag.IntVar(&config.Senders, "senders", 1, "Open-loop sender goroutines the request schedule is split across, each pacing an equal share of the rate; raise it when one sender can't keep up, typically above 5-10k RPS")
+	flag.StringVar(&config.ReplayPath, "replay", "", "JSONL traffic log to replay instead of generating requests: each line's body, path and headers sent at its recorded offset_ms or timestamp (empty = off)")
+	flag.Float64Var(&config.ReplaySpeed, "replay-speed", 1, "Speed-up of the --replay schedule, e.g. 2 to send the log at twice its recorded rate")
+	flag.IntVar(&config.Users, "users", 0, "Closed-loop mode: number of virtual users, each sending its next request only after the previous one finished (replaces --rps; 0 = open loop at --rps)")
+	flag.Var(&config.ThinkTime, "think-time", "Pause each --users worker takes between a response and its next request, optionally with uniform jitter, e.g. 500ms or 500ms±200ms")
+	flag.IntVar(&config.Turns, "turns", 0, "Multi-turn mode with --users: user turns per conversation, each request resending the history so far (0 = single-shot requests)")
+	flag.IntVar(&config.MaxHistory, "max-history", 0, "Most prior messages a --turns request resends, dropping the oldest turns first but keeping a leading system message (0 = unlimited)")
+	flag.DurationVar(&config.Duration, "duration", 60*time.Second, "Test duration")
+	flag.IntVar(&config.Requests, "requests", 0, "Send exactly this many requests, then wait for them and exit, instead of running for --duration (0 = run for --duration)")
+	flag.IntVar(&config.MaxTokens, "max-tokens", 150, "Max tokens per request")
+	flag.Var(&config.TokenDist, "max-tokens-dist", "Distribution of max_tokens per request instead of --max-tokens ±25: uniform:MIN-MAX, normal:MEAN,STDDEV or weighted:VALUE=WEIGHT,..., e.g. weighted:64=5,256=3,1024=1")
+	flag.Float64Var(&config.Temperature, "temperature", 0.7, "Temperature for requests")
+	logLevelFlag := flag.String("log-level", "info", "How much to log: quiet (warnings and errors only, plus the --output path on stdout), summary (the final statistics), info (the settings and periodic statistics too) or debug (a line per request too)")
+	verboseFlag := flag.Bool("verbose", false, "Log every request; shorthand for --log-level debug")
+	quietFlag := flag.Bool("quiet", false, "Shorthand for --log-level quiet, for scripts: only warnings and errors, and the --output path on stdout")
+	flag.Int64Var(&config.Seed, "seed", 0, "Seed for request randomization (model, provider, prompt, max_tokens, temperature, ...), so runs with the same seed send the same request sequence (0 = random)")
+	flag.BoolVar(&config.Stream, "stream", false, "Enable streaming responses")
+	flag.StringVar(&config.VirtualKey, "virtual-key", "", "Virtual key to use for requests")
+	flag.StringVar(&config.VirtualKeysPath, "virtual-keys", "", "File of virtual keys, one per line, to rotate through instead of a single --virtual-key")
+	keyAssignmentFlag := flag.String("key-assignment", "request", "How --virtual-keys are handed out: request (the next key for every request) or user (one key per --users worker)")
+	flag.StringVar(&config.PDFPath, "pdf", "", "Path to a PDF file to attach as a multimodal 'file' content block (enables attachment mode)")
+	flag.StringVar(&config.Prompt, "prompt", "", "Override the user prompt text (defaults to a random prompt, or a fixed summarize prompt in --pdf mode)")
+	flag.StringVar(&config.PromptsPath, "prompts", "", "JSONL prompt corpus to draw requests from instead of the built-in prompts: one {\"prompt\": ...} or {\"messages\": [...]} object per line, with an optional \"weight\"")
+	flag.IntVar(&config.ImageKB, "image-kb", 0, "Approximate size in KB of a synthetic PNG attached as an 'image_url' content block (0 = disabled)")
+	flag.IntVar(&config.ImagePercent, "image-percent", 100, "Percentage of requests (0-100) that carry the synthetic image when --image-kb is set")
+
+	flag.IntVar(&config.MaxCompletionTokensPercent, "max-completion-tokens-percent", 0, "Percentage of requests (0-100) that send max_completion_tokens instead of max_tokens")
+	flag.StringVar(&config.ReasoningEffort, "reasoning-effort", "", "reasoning_effort to send (minimal, low, medium or high; empty = never)")
+	flag.IntVar(&config.ReasoningEffortPercent, "reasoning-effort-percent", 100, "Percentage of requests (0-100) that carry --reasoning-effort")
+	flag.StringVar(&config.ResponseFormat, "response-format", "", "response_format type to send (text, json_object or json_schema; empty = never)")
+	flag.IntVar(&config.ResponseFormatPercent, "response-format-percent", 100, "Percentage of requests (0-100) that carry --response-format")
+	flag.StringVar(&config.CaptureDir, "capture-dir", "", "Directory to write the full request and response of failed requests to (empty = off)")
+	flag.IntVar(&config.CapturePercent, "capture-percent", 100, "Percentage of failed requests (0-100) captured when --capture-dir is set")
+	flag.IntVar(&config.CaptureMax, "capture-max", 100, "Maximum number of failures written to --capture-dir")
+	flag.BoolVar(&config.Validate, "validate", false, "Check that every 200 response parses as the endpoint's schema, has non-empty content and coherent usage; failures count as errors")
+	flag.StringVar(&config.ToolsPath, "tools", "", "JSON file with an OpenAI tools array to send with every request; tool_calls in responses are validated against it")
+	flag.StringVar(&config.ToolChoice, "tool-choice", "", "tool_choice to send with --tools: auto, none, required, or a function name to force (empty = omitted)")
+
+	flag.IntVar(&config.GOMAXPROCS, "gomaxprocs", 0, "GOMAXPROCS for the hitter (0 = Go default, or the number of --cpus when pinned)")
+	cpusFlag := flag.String("cpus", "", "CPUs to pin the hitter to, taskset-style (e.g. '0-3' or '0,2,4-5'; Linux only; empty = no pinning)")
+
+	flag.StringVar(&config.UnixSocket, "unix-socket", "", "Path of a Unix domain socket to send requests over instead of dialing the --url host; the URL still sets path and Host header")
+	flag.StringVar(&config.DialAddr, "dial-addr", "", "host:port to connect to instead of the --url host, keeping the URL's Host header and TLS server name (like curl --connect-to)")
+	flag.StringVar(&config.HostHeader, "host-header", "", "Host header to send instead of the --url host (empty = the URL's host)")
+	flag.DurationVar(&config.SLOP50, "slo-p50", 0, "Fail the run (exit 1) if the p50 latency of successful requests exceeds this (0 = unchecked)")
+	flag.DurationVar(&config.SLOP95, "slo-p95", 0, "Fail the run if the p95 latency exceeds this (0 = unchecked)")
+	flag.DurationVar(&config.SLOP99, "slo-p99", 0, "Fail the run if the p99 latency exceeds this (0 = unchecked)")
+	flag.DurationVar(&config.SLOTTFTP99, "slo-ttft-p99", 0, "Fail the run if the p99 time to first token of --stream runs exceeds this (0 = unchecked)")
+	flag.Float64Var(&config.SLOSuccess, "slo-success", 0, "Fail the run if the success rate, in percent, is below this (0 = unchecked)")
+	flag.Float64Var(&config.SLOMinRPS, "slo-min-rps", 0, "Fail the run if the average RPS is below this (0 = unchecked)")
+	abortErrorRateFlag := flag.String("abort-on-error-rate", "", "Stop the run early when the error rate over --abort-window exceeds this percentage, e.g. 20% (empty = never)")
+	flag.DurationVar(&config.AbortWindow, "abort-window", 10*time.Second, "Sliding window --abort-on-error-rate is measured over")
+	flag.DurationVar(&config.DrainTimeout, "drain-timeout", 60*time.Second, "How long to wait for in-flight requests once sending stops before cancelling them (0 = wait for all)")
+	flag.BoolVar(&config.FindMax, "find-max", false, "Goal-seeking mode: run --duration trials at rising constant rates from --rps, bisecting to the highest rate that meets every --slo-* assertion")
+	flag.StringVar(&config.OutputPath, "output", "", "JSON file to write the run's final statistics and per-second time series to (empty = none)")
+	flag.Var(&config.Tags, "tag", "Run metadata as KEY=VALUE, repeatable, stored in the --output file, e.g. --tag gateway=v1.2.0 --tag git_sha=abc123")
+	flag.StringVar(&config.VegetaOutput, "vegeta-output", "", "File to write every request's result to in vegeta's result encoding, for vegeta report and vegeta plot; - for stdout (empty = none)")
+	flag.StringVar(&config.VegetaEncoding, "vegeta-encoding", "gob", "Encoding of --vegeta-output: gob (vegeta attack's default), json, or csv")
+	flag.StringVar(&config.MetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on at /metrics during the run, e.g. :9091 (empty = off)")
+	flag.StringVar(&config.PushURL, "pushgateway", "", "Prometheus Pushgateway URL to push metrics to every --push-interval and at the end of the run (empty = off)")
+	flag.StringVar(&config.PushJob, "push-job", "hitter", "Pushgateway job name the metrics are grouped under")
+	flag.DurationVar(&config.PushInterval, "push-interval", 10*time.Second, "How often to push metrics to --pushgateway")
+	flag.IntVar(&config.Retries, "retries", 0, "Retries per request on 429 and 5xx responses, with exponential backoff (0 = no retries)")
+	flag.DurationVar(&config.RetryBackoff, "retry-backoff", 100*time.Millisecond, "Backoff before the first retry, doubling on each further retry, with jitter")
+	flag.DurationVar(&config.RetryMaxBackoff, "retry-max-backoff", 5*time.Second, "Upper bound on a single retry backoff, including one asked for by Retry-After")
+	flag.IntVar(&config.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "Idle keep-alive connections kept per host for reuse (0 = Go's default of 2, or --conns when set)")
+	flag.IntVar(&config.Conns, "conns", 0, "Maximum connections per host, dialing and in use; requests beyond it wait for a free connection (0 = unlimited)")
+	flag.BoolVar(&config.DisableKeepAlive, "disable-keepalive", false, "Open a new connection for every request instead of reusing idle ones")
+	flag.DurationVar(&config.DialTimeout, "dial-timeout", 30*time.Second, "Timeout for establishing a connection")
+	flag.DurationVar(&config.TLSHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake of https targets")
+	flag.DurationVar(&config.RequestTimeout, "timeout", 30*time.Second, "Deadline for each HTTP attempt, from sending the request to reading the whole body or stream (0 = none)")
+	flag.DurationVar(&config.StreamIdleTimeout, "stream-idle-timeout", 0, "With --stream, fail a stream that sends no data for this long, however long the stream as a whole may take (0 = off)")
+	flag.StringVar(&config.RequestEncoding, "request-encoding", "identity", "Content encoding of request bodies: identity or gzip (sent with Content-Encoding: gzip)")
+	flag.StringVar(&config.AcceptEncoding, "accept-encoding", "gzip", "Accept-Encoding to send: gzip (responses are decompressed by the hitter, with wire and decoded sizes reported) or identity")
+	flag.StringVar(&config.Protocol, "protocol", "auto", "HTTP version: auto (HTTP/2 if an https target negotiates it, else HTTP/1.1), http1, h2 (HTTP/2 over TLS only) or h2c (HTTP/2 over cleartext with prior knowledge)")
+	flag.BoolVar(&config.Insecure, "insecure", false, "Skip TLS certificate verification of https targets")
+	flag.StringVar(&config.CACert, "ca-cert", "", "PEM file of CA certificates to trust for https targets, in place of the system roots")
+	flag.StringVar(&config.ClientCert, "client-cert", "", "PEM client certificate for mutual TLS (requires --client-key)")
+	flag.StringVar(&config.ClientKey, "client-key", "", "PEM private key of --client-cert")
+	var headerFlags headerList
+	flag.Var(&headerFlags, "header", "Extra request header as \"Key: Value\", repeatable; values may use {{uuid}}, {{request}} (1-based), {{model}}, {{endpoint}}, {{timestamp}} (Unix ms) and {{pick:a,b,c}} placeholders, as well as the #{...} prompt placeholders")
+
+	var phaseFlags phaseList
+	flag.Var(&phaseFlags, "phase", "Shift the traffic at an offset into the run as AT:SETTING=VALUE;..., repeatable; settings: mix, models, providers and stream-percent, e.g. 5m:mix=chat=30,embeddings=70;stream-percent=50")
+	mixFlag := flag.String("mix", "", "Traffic mix across endpoints as ENDPOINT=PERCENT pairs adding up to 100, e.g. chat=70,embeddings=20,responses=10; endpoints: chat, embeddings, responses (empty = chat only)")
+	embeddingModelsFlag := flag.String("embedding-models", "text-embedding-3-small,text-embedding-3-large", "Comma-separated list of models for --mix embeddings requests")
+	flag.IntVar(&config.EmbeddingBatch, "embedding-batch", 1, "Number of inputs per embeddings request")
+	flag.IntVar(&config.EmbeddingInputTokens, "embedding-input-tokens", 0, "Approximate tokens of synthetic text per embeddings input (0 = prompts from the corpus)")
+	flag.StringVar(&config.Mode, "mode", "chat", "Traffic to generate: chat (chat completions, or the --mix) or embeddings (/v1/embeddings only, with the vector count of every response checked)")
+
+	modelsFlag := flag.String("models", "gpt-4,gpt-4o,gpt-4o-mini,gpt-4.1,gpt-5", "Comma-separated list of models")
+	providersFlag := flag.String("providers", "", "Comma-separated list of providers")
+
+	flag.StringVar(&config.ConfigPath, "config", "", "YAML scenario file of flag settings (keys are flag names; nested maps join with '-', e.g. slo: {p99: 500ms}); flags on the command line take precedence")
+	flag.Parse()
+	if config.ConfigPath != "" {
+		if err := applyScenario(config.ConfigPath); err != nil {
+			log.Fatalf("--config %s: %v", config.ConfigPath, err)
+		}
+	}
+
+	switch {
+	case *verboseFlag && *quietFlag:
+		log.Fatal("--verbose and --quiet are mutually exclusive")
+	case *verboseFlag:
+		*logLevelFlag = "debug"
+	case *quietFlag:
+		*logLevelFlag = "quiet"
+	}
+	level := slices.Index(logLevelNames[:], *logLevelFlag)
+	if level < 0 {
+		log.Fatalf("--log-level must be quiet, summary, info or debug, got %q", *logLevelFlag)
+	}
+	verbosity = logLevel(level)
+	config.Verbose = verbosity >= levelDebug
+
+	// Parse models and providers
+	if *modelsFlag != "" {
+		config.Models = parseCommaSeparated(*modelsFlag)
+	}
+	if *providersFlag != "" {
+		config.Providers = parseCommaSeparated(*providersFlag)
+	}
+	config.EmbeddingModels = parseCommaSeparated(*embeddingModelsFlag)
+	seenHeaders := map[string]bool{}
+	for _, h := range headerFlags {
+		t, err := parseHeaderTemplate(h)
+		if err != nil {
+			log.Fatalf("--header %q: %v", h, err)
+		}
+		t.replace = !seenHeaders[t.key]
+		seenHeaders[t.key] = true
+		config.Headers = append(config.Headers, t)
+	}
+	targets, err := parseTargets(urlFlags.urls, *targetWeightsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Targets, config.URL, config.TargetWeights = targets, targets[0].url, *targetWeightsFlag != ""
+	if len(targets) > 1 {
+		switch {
+		case config.UnixSocket != "" || config.DialAddr != "" || config.HostHeader != "":
+			log.Fatal("--unix-socket, --dial-addr and --host-header apply to a single --url and cannot be combined with several")
+		case config.FindMax:
+			log.Fatal("--find-max searches one target and cannot be combined with several --url targets")
+		}
+	}
+	if *mixFlag != "" {
+		mix, err := parseMix(*mixFlag)
+		if err != nil {
+			log.Fatalf("--mix: %v", err)
+		}
+		for _, t := range config.Targets {
+			urls, err := endpointURLs(t.url, mix)
+			if err != nil {
+				log.Fatalf("--mix: %v", err)
+			}
+			t.endpointURLs = urls
+		}
+		config.Mix = mix
+	}
+	switch config.Mode {
+	case "chat":
+	case "embeddings":
+		switch {
+		case len(config.Mix) > 0:
+			log.Fatal("--mode embeddings cannot be combined with --mix")
+		case config.Stream || config.Turns > 0 || config.ToolsPath != "" || config.PDFPath != "" || config.ImageKB > 0:
+			log.Fatal("--mode embeddings cannot be combined with --stream, --turns, --tools, --pdf or --image-kb")
+		}
+		// An --url of the embeddings endpoint is used as is; a chat
+		// completions one has its path replaced, as with --mix.
+		for _, t := range config.Targets {
+			if strings.HasSuffix(t.url, endpointPaths["embeddings"]) {
+				t.endpointURLs = map[string]string{"embeddings": t.url}
+				continue
+			}
+			urls, err := endpointURLs(t.url, []endpointShare{{name: "embeddings", percent: 100}})
+			if err != nil {
+				log.Fatalf("--mode embeddings: %v", err)
+			}
+			t.endpointURLs = urls
+		}
+	default:
+		log.Fatal("--mode must be chat or embeddings")
+	}
+	if *cpusFlag != "" {
+		cpus, err := parseCPUList(*cpusFlag)
+		if err != nil {
+			log.Fatalf("--cpus: %v", err)
+		}
+		config.CPUs = cpus
+	}
+
+	// Validation
+	if config.RPS <= 0 {
+		log.Fatal("RPS must be greater than 0")
+	}
+	if config.Users < 0 {
+		log.Fatal("--users must not be negative")
+	}
+	if config.MaxInflight < 0 {
+		log.Fatal("--max-inflight must not be negative")
+	}
+	if config.RequestEncoding != "identity" && config.RequestEncoding != "gzip" {
+		log.Fatalf("--request-encoding must be identity or gzip, got %q", config.RequestEncoding)
+	}
+	if config.AcceptEncoding != "identity" && config.AcceptEncoding != "gzip" {
+		log.Fatalf("--accept-encoding must be identity or gzip, got %q", config.AcceptEncoding)
+	}
+	if config.Senders < 1 {
+		log.Fatal("--senders must be at least 1")
+	}
+	if config.Arrival != "constant" && config.Arrival != "poisson" {
+		log.Fatal("--arrival must be constant or poisson")
+	}
+	if config.Turns < 0 || config.MaxHistory < 0 {
+		log.Fatal("--turns and --max-history must not be negative")
+	}
+	if config.Turns > 0 && config.Users == 0 {
+		log.Fatal("--turns requires --users")
+	}
+	if config.Turns > 0 && config.PDFPath != "" {
+		log.Fatal("--turns cannot be combined with --pdf")
+	}
+	durationSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "duration" {
+			durationSet = true
+		}
+		switch {
+		case (f.Name == "rps" || f.Name == "arrival" || f.Name == "senders") && config.ReplayPath != "":
+			log.Fatalf("--%s cannot be combined with --replay, which sends on the recorded schedule", f.Name)
+		case f.Name == "replay-speed" && config.ReplayPath == "":
+			log.Fatal("--replay-speed requires --replay")
+		case f.Name == "rps" && config.Users > 0:
+			log.Fatal("--rps cannot be combined with --users")
+		case f.Name == "max-tokens" && config.TokenDist.kind != "":
+			log.Fatal("--max-tokens cannot be combined with --max-tokens-dist")
+		case f.Name == "think-time" && config.Users == 0:
+			log.Fatal("--think-time requires --users")
+		case f.Name == "max-history" && config.Turns == 0:
+			log.Fatal("--max-history requires --turns")
+		case f.Name == "arrival" && config.Users > 0:
+			log.Fatal("--arrival applies to --rps and cannot be combined with --users")
+		case f.Name == "senders" && config.Users > 0:
+			log.Fatal("--senders applies to the open loop and cannot be combined with --users, where every user sends on its own")
+		case f.Name == "max-inflight" && config.Users > 0:
+			log.Fatal("--max-inflight applies to the open loop and cannot be combined with --users, which already caps requests in flight")
+		case f.Name == "profile" && config.Users > 0:
+			log.Fatal("--profile cannot be combined with --users")
+		case f.Name == "log-level" && (*verboseFlag || *quietFlag):
+			log.Fatal("--log-level cannot be combined with --verbose or --quiet")
+		case f.Name == "duration" && config.Requests > 0:
+			log.Fatal("--requests replaces --duration; set only one of them")
+		case f.Name == "rps" && (strings.HasPrefix(config.Profile, "ramp") || strings.HasPrefix(config.Profile, "step")):
+			log.Fatal("--rps cannot be combined with a ramp or step --profile, which sets its own rates")
+		}
+	})
+	if config.Duration <= 0 {
 		log.Fatal("Duration must be greater than 0")
 	}
-	if len(config.Models) == 0 {
-		config.Models = []string{"gpt-4", "gpt-4o", "gpt-4o-mini", "gpt-4.1", "gpt-5"}
+	if config.Requests < 0 {
+		log.Fatal("--requests must not be negative")
+	}
+	if config.Requests > 0 && (config.Profile != "" || config.FindMax) {
+		log.Fatal("--requests cannot be combined with --profile or --find-max, which are timed")
+	}
+	if config.ReplayPath != "" {
+		switch {
+		case config.Users > 0 || config.Profile != "" || config.Requests > 0 || config.FindMax:
+			log.Fatal("--replay cannot be combined with --users, --profile, --requests or --find-max")
+		case len(config.Mix) > 0 || config.Mode != "chat" || config.Turns > 0:
+			log.Fatal("--replay sends the recorded endpoints and cannot be combined with --mix, --mode or --turns")
+		case config.PDFPath != "" || config.ImageKB > 0 || config.ToolsPath != "" || config.Prompt != "" || config.PromptsPath != "":
+			log.Fatal("--replay sends the recorded bodies and cannot be combined with --pdf, --image-kb, --tools, --prompt or --prompts")
+		case config.ReplaySpeed <= 0:
+			log.Fatal("--replay-speed must be greater than 0")
+		}
+		records, err := loadReplay(config.ReplayPath)
+		if err != nil {
+			log.Fatalf("Failed to load --replay %q: %v", config.ReplayPath, err)
+		}
+		replayRecords = records
+		// Without --duration the run lasts as long as the log; --stream
+		// follows each recorded body.
+		if !durationSet {
+			config.Duration = time.Duration(float64(records[len(records)-1].offset) / config.ReplaySpeed)
+		}
+		config.Stream = slices.ContainsFunc(records, func(r replayRecord) bool { return r.stream })
+	}
+	config.Load = constantLoad(config.RPS)
+	if config.ReplayPath != "" {
+		config.Load = replayLoad(replayRecords, config.ReplaySpeed)
+	}
+	if config.Profile != "" {
+		load, err := parseLoadProfile(config.Profile, config.RPS, config.Duration)
+		if err != nil {
+			log.Fatalf("--profile: %v", err)
+		}
+		config.Load = load
+	}
+	if config.GOMAXPROCS < 0 {
+		log.Fatal("--gomaxprocs must not be negative")
+	}
+	if len(config.Models) == 0 {
+		config.Models = []string{"gpt-4", "gpt-4o", "gpt-4o-mini", "gpt-4.1", "gpt-5"}
+	}
+	if config.ImageKB < 0 {
+		log.Fatal("--image-kb must not be negative")
+	}
+	if config.ImagePercent < 0 || config.ImagePercent > 100 {
+		log.Fatal("--image-percent must be between 0 and 100")
+	}
+	if config.CapturePercent < 0 || config.CapturePercent > 100 {
+		log.Fatal("--capture-percent must be between 0 and 100")
+	}
+	if config.CaptureMax < 1 {
+		log.Fatal("--capture-max must be at least 1")
+	}
+	if config.ImageKB > 0 && config.PDFPath != "" {
+		log.Fatal("--image-kb cannot be combined with --pdf")
+	}
+	if config.ToolChoice != "" && config.ToolsPath == "" {
+		log.Fatal("--tool-choice requires --tools")
+	}
+	if config.ToolsPath != "" && config.PDFPath != "" {
+		log.Fatal("--tools cannot be combined with --pdf")
+	}
+	if len(config.Mix) > 0 && (config.PDFPath != "" || config.Turns > 0) {
+		log.Fatal("--mix cannot be combined with --pdf or --turns")
+	}
+	if len(phaseFlags) > 0 {
+		switch {
+		case config.ReplayPath != "" || config.FindMax:
+			log.Fatal("--phase cannot be combined with --replay or --find-max")
+		case config.Mode != "chat" || config.PDFPath != "":
+			log.Fatal("--phase cannot be combined with --mode embeddings or --pdf")
+		}
+		phases, err := parsePhases(phaseFlags, config)
+		if err != nil {
+			log.Fatalf("--phase: %v", err)
+		}
+		last := phases[len(phases)-1].at
+		if config.Requests == 0 && last >= config.Duration {
+			log.Fatalf("--phase: the last phase starts at %s, not within the %s run", last, config.Duration)
+		}
+		config.TrafficPhases = phases
+		if mix := mixEndpoints(config); len(mix) > 0 {
+			if config.Turns > 0 {
+				log.Fatal("--phase: a mix cannot be combined with --turns")
+			}
+			// Every endpoint any phase sends to needs its URL up front.
+			for _, t := range config.Targets {
+				urls, err := endpointURLs(t.url, mix)
+				if err != nil {
+					log.Fatalf("--phase: %v", err)
+				}
+				t.endpointURLs = urls
+			}
+		}
+	}
+	if len(config.EmbeddingModels) == 0 || config.EmbeddingBatch <= 0 {
+		log.Fatal("--embedding-models must not be empty and --embedding-batch must be greater than 0")
+	}
+	if config.EmbeddingInputTokens < 0 {
+		log.Fatal("--embedding-input-tokens must not be negative")
+	}
+	if config.PromptsPath != "" && (config.Prompt != "" || config.PDFPath != "") {
+		log.Fatal("--prompts cannot be combined with --prompt or --pdf")
+	}
+	if config.VirtualKeysPath != "" && config.VirtualKey != "" {
+		log.Fatal("--virtual-keys cannot be combined with --virtual-key")
+	}
+	switch *keyAssignmentFlag {
+	case "request":
+	case "user":
+		if config.Users == 0 {
+			log.Fatal("--key-assignment user needs --users")
+		}
+		config.KeyPerUser = true
+	default:
+		log.Fatal("--key-assignment must be request or user")
+	}
+	for name, pct := range map[string]int{
+		"--max-completion-tokens-percent": config.MaxCompletionTokensPercent,
+		"--reasoning-effort-percent":      config.ReasoningEffortPercent,
+		"--response-format-percent":       config.ResponseFormatPercent,
+	} {
+		if pct < 0 || pct > 100 {
+			log.Fatalf("%s must be between 0 and 100", name)
+		}
+	}
+	switch config.ReasoningEffort {
+	case "", "minimal", "low", "medium", "high":
+	default:
+		log.Fatal("--reasoning-effort must be minimal, low, medium or high")
+	}
+	switch config.ResponseFormat {
+	case "", "text", "json_object", "json_schema":
+	default:
+		log.Fatal("--response-format must be text, json_object or json_schema")
+	}
+	for _, h := range config.Headers {
+		if h.key == "Host" && config.HostHeader != "" {
+			log.Fatal("--header \"Host: ...\" cannot be combined with --host-header")
+		}
+	}
+	if config.SLOP50 < 0 || config.SLOP95 < 0 || config.SLOP99 < 0 || config.SLOTTFTP99 < 0 || config.SLOMinRPS < 0 {
+		log.Fatal("--slo-* values must not be negative")
+	}
+	if config.SLOSuccess < 0 || config.SLOSuccess > 100 {
+		log.Fatal("--slo-success must be between 0 and 100")
+	}
+	if config.SLOTTFTP99 > 0 && !streams(config) {
+		log.Fatal("--slo-ttft-p99 requires --stream")
+	}
+	if *abortErrorRateFlag != "" {
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(*abortErrorRateFlag), "%"), 64)
+		if err != nil || rate <= 0 || rate > 100 {
+			log.Fatalf("--abort-on-error-rate must be a percentage above 0 and at most 100, got %q", *abortErrorRateFlag)
+		}
+		config.AbortErrorRate = rate
+	}
+	if config.AbortWindow <= 0 {
+		log.Fatal("--abort-window must be greater than 0")
+	}
+	if config.DrainTimeout < 0 {
+		log.Fatal("--drain-timeout must not be negative")
+	}
+	if config.FindMax {
+		switch {
+		case config.SLOP50 == 0 && config.SLOP95 == 0 && config.SLOP99 == 0 && config.SLOTTFTP99 == 0 && config.SLOSuccess == 0:
+			log.Fatal("--find-max needs at least one of --slo-p50, --slo-p95, --slo-p99, --slo-ttft-p99 or --slo-success")
+		case config.SLOMinRPS > 0:
+			log.Fatal("--slo-min-rps cannot be combined with --find-max, which searches for the rate itself")
+		case config.Users > 0 || config.Profile != "":
+			log.Fatal("--find-max runs constant open-loop trials and cannot be combined with --users or --profile")
+		case config.MetricsAddr != "" || config.PushURL != "" || config.OutputPath != "" || config.VegetaOutput != "":
+			log.Fatal("--find-max cannot be combined with --metrics-addr, --pushgateway, --output or --vegeta-output")
+		case config.AbortErrorRate > 0:
+			log.Fatal("--abort-on-error-rate cannot be combined with --find-max, whose trials are expected to fail")
+		case verbosity == levelQuiet:
+			log.Fatal("--find-max reports its result in the log; use --log-level summary instead of quiet")
+		}
+	}
+	switch config.VegetaEncoding {
+	case "gob", "json", "csv":
+	default:
+		log.Fatalf("--vegeta-encoding must be gob, json or csv, got %q", config.VegetaEncoding)
+	}
+	if config.PushURL != "" && (config.PushInterval <= 0 || config.PushJob == "") {
+		log.Fatal("--push-interval must be greater than 0 and --push-job must not be empty")
+	}
+	if config.Retries < 0 {
+		log.Fatal("--retries must not be negative")
+	}
+	if config.RetryBackoff <= 0 || config.RetryMaxBackoff < config.RetryBackoff {
+		log.Fatal("--retry-backoff must be greater than 0 and no larger than --retry-max-backoff")
+	}
+	if config.MaxIdleConnsPerHost < 0 || config.Conns < 0 {
+		log.Fatal("--max-idle-conns-per-host and --conns must not be negative")
+	}
+	if config.DialTimeout <= 0 || config.TLSHandshakeTimeout <= 0 {
+		log.Fatal("--dial-timeout and --tls-handshake-timeout must be greater than 0")
+	}
+	if config.RequestTimeout < 0 || config.StreamIdleTimeout < 0 {
+		log.Fatal("--timeout and --stream-idle-timeout must not be negative")
+	}
+	if config.StreamIdleTimeout > 0 && !streams(config) {
+		log.Fatal("--stream-idle-timeout requires --stream")
+	}
+	if config.DisableKeepAlive && config.MaxIdleConnsPerHost > 0 {
+		log.Fatal("--max-idle-conns-per-host cannot be combined with --disable-keepalive")
+	}
+	switch config.Protocol {
+	case "auto", "http1":
+	case "h2":
+		for _, t := range config.Targets {
+			if !strings.HasPrefix(t.url, "https://") {
+				log.Fatal("--protocol h2 needs an https --url; use h2c for cleartext HTTP/2")
+			}
+		}
+	case "h2c":
+		for _, t := range config.Targets {
+			if !strings.HasPrefix(t.url, "http://") {
+				log.Fatal("--protocol h2c needs an http --url; use h2 for HTTP/2 over TLS")
+			}
+		}
+	default:
+		log.Fatal("--protocol must be auto, http1, h2 or h2c")
+	}
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		log.Fatal("--client-cert and --client-key must be given together")
+	}
+	if config.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			log.Fatalf("--client-cert: %v", err)
+		}
+		config.tlsClientCerts = []tls.Certificate{cert}
+	}
+	if config.CACert != "" {
+		pem, err := os.ReadFile(config.CACert)
+		if err != nil {
+			log.Fatalf("--ca-cert: %v", err)
+		}
+		config.tlsRootCAs = x509.NewCertPool()
+		if !config.tlsRootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("--ca-cert: no PEM certificates in %s", config.CACert)
+		}
+	}
+	if config.UnixSocket != "" && config.DialAddr != "" {
+		log.Fatal("--unix-socket cannot be combined with --dial-addr")
+	}
+	if config.DialAddr != "" {
+		if _, _, err := net.SplitHostPort(config.DialAddr); err != nil {
+			log.Fatalf("--dial-addr: %v", err)
+		}
 	}
 	if len(config.Providers) == 0 {
-		log.Println("At least one provider must be specified, sending request without provider")
+		logAt(levelInfo, "At least one provider must be specified, sending request without provider")
 	}
 
 	return config
@@ -251,7 +3824,7 @@ func buildPDFBodies(config *Config) {
 	}
 	b64 := base64.StdEncoding.EncodeToString(data)
 	dataURL := "data:application/pdf;base64," + b64
-	log.Printf("📎 Loaded PDF %s: %d bytes raw, %d bytes base64", config.PDFPath, len(data), len(b64))
+	logAt(levelInfo, "📎 Loaded PDF %s: %d bytes raw, %d bytes base64", config.PDFPath, len(data), len(b64))
 
 	prompt := config.Prompt
 	if prompt == "" {
@@ -292,7 +3865,175 @@ func buildPDFBodies(config *Config) {
 			prebuiltLabels = append(prebuiltLabels, model)
 		}
 	}
-	log.Printf("📦 Prebuilt %d PDF request body/bodies, ~%d MB each", len(prebuiltBodies), len(prebuiltBodies[0])/(1024*1024))
+	logAt(levelInfo, "📦 Prebuilt %d PDF request body/bodies, ~%d MB each", len(prebuiltBodies), len(prebuiltBodies[0])/(1024*1024))
+	if config.RequestEncoding == "gzip" {
+		for _, body := range prebuiltBodies {
+			prebuiltGzip = append(prebuiltGzip, gzipBody(body))
+		}
+		logAt(levelInfo, "📦 Compressed them to ~%d MB each", len(prebuiltGzip[0])/(1024*1024))
+	}
+}
+
+// loadTools reads the --tools file, a JSON array of OpenAI tool definitions,
+// and resolves --tool-choice against the function names it declares.
+func loadTools(config *Config) {
+	data, err := os.ReadFile(config.ToolsPath)
+	if err != nil {
+		log.Fatalf("Failed to read tools %q: %v", config.ToolsPath, err)
+	}
+	var defs []struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := sonic.Unmarshal(data, &defs); err != nil {
+		log.Fatalf("Failed to parse tools %q: %v", config.ToolsPath, err)
+	}
+	if err := sonic.Unmarshal(data, &toolDefs); err != nil {
+		log.Fatalf("Failed to parse tools %q: %v", config.ToolsPath, err)
+	}
+	if len(defs) == 0 {
+		log.Fatalf("Tools file %q declares no tools", config.ToolsPath)
+	}
+	toolNames = make(map[string]bool, len(defs))
+	for i, d := range defs {
+		if d.Type != "function" || d.Function.Name == "" {
+			log.Fatalf("Tool %d in %q needs \"type\": \"function\" and a function name", i, config.ToolsPath)
+		}
+		toolNames[d.Function.Name] = true
+	}
+
+	switch config.ToolChoice {
+	case "":
+	case "auto", "none", "required":
+		toolChoice = config.ToolChoice
+	default:
+		if !toolNames[config.ToolChoice] {
+			log.Fatalf("--tool-choice %q is not a function declared in %q", config.ToolChoice, config.ToolsPath)
+		}
+		toolChoice = map[string]any{"type": "function", "function": map[string]any{"name": config.ToolChoice}}
+	}
+	logAt(levelInfo, "🔧 Loaded %d tool(s) from %s", len(defs), config.ToolsPath)
+}
+
+// validateToolCalls checks a response's tool calls against --tools and
+// --tool-choice: every call must name a declared function and carry JSON
+// arguments, a required or forced choice must produce a call (of the forced
+// function), and "none" must produce none.
+func validateToolCalls(config *Config, calls []toolCall) error {
+	forced := ""
+	switch config.ToolChoice {
+	case "", "auto":
+	case "none":
+		if len(calls) > 0 {
+			return fmt.Errorf("%d tool call(s) despite tool_choice none", len(calls))
+		}
+	default:
+		if len(calls) == 0 {
+			return fmt.Errorf("no tool calls despite tool_choice %s", config.ToolChoice)
+		}
+		if config.ToolChoice != "required" {
+			forced = config.ToolChoice
+		}
+	}
+	for _, c := range calls {
+		switch {
+		case !toolNames[c.Function.Name]:
+			return fmt.Errorf("call to undeclared function %q", c.Function.Name)
+		case forced != "" && c.Function.Name != forced:
+			return fmt.Errorf("call to %q instead of the forced %q", c.Function.Name, forced)
+		case !sonic.Valid([]byte(c.Function.Arguments)):
+			return fmt.Errorf("%s arguments are not valid JSON: %q", c.Function.Name, c.Function.Arguments)
+		}
+	}
+	return nil
+}
+
+// buildSyntheticImage renders a square random-noise PNG of roughly kb kilobytes
+// and returns it as a base64 data URL. Noise doesn't compress, so the encoded
+// size tracks the pixel count closely (4 bytes per RGBA pixel).
+func buildSyntheticImage(kb int, rng *rand.Rand) string {
+	side := int(math.Sqrt(float64(kb*1024) / 4))
+	if side < 1 {
+		side = 1
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rng.Intn(256))
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(&buf, img); err != nil {
+		log.Fatalf("Failed to encode synthetic image: %v", err)
+	}
+	b64 := base64.StdEncoding.EncodeToString(buf.Bytes())
+	logAt(levelInfo, "🖼️  Generated synthetic PNG %dx%d: %d bytes raw, %d bytes base64", side, side, buf.Len(), len(b64))
+	return "data:image/png;base64," + b64
+}
+
+// buildImagePart marshals the image_url member for dataURL once, in the same
+// form sonic writes it, so it can replace imagePartStub in a request body.
+func buildImagePart(dataURL string) []byte {
+	part, err := sonic.Marshal(ImageURLPart{URL: dataURL})
+	if err != nil {
+		log.Fatalf("Failed to marshal synthetic image: %v", err)
+	}
+	return append([]byte(`"image_url":`), part...)
+}
+
+// spliceImage swaps the empty image_url stub in body for the prebuilt image
+// part. The stub can only occur unescaped as JSON structure, and the image
+// part is the first one in the body, so the first match is the right one.
+func spliceImage(body []byte) []byte {
+	return bytes.Replace(body, []byte(imagePartStub), imagePart, 1)
+}
+
+// parseCPUList parses a taskset-style CPU list such as "0-3,6" into sorted,
+// de-duplicated CPU numbers.
+func parseCPUList(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range parseCommaSeparated(s) {
+		loStr, hiStr, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(loStr)
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.Atoi(hiStr)
+		}
+		if err != nil || lo < 0 || hi < lo {
+			return nil, fmt.Errorf("invalid CPU list entry %q", part)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			seen[cpu] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("no CPUs in %q", s)
+	}
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// applyScheduling pins the process to --cpus and sets GOMAXPROCS. The runtime
+// sizes GOMAXPROCS from the CPUs available at startup, so after pinning it is
+// lowered to the pinned count unless --gomaxprocs says otherwise.
+func applyScheduling(config *Config) {
+	if len(config.CPUs) > 0 {
+		if err := setCPUAffinity(config.CPUs); err != nil {
+			log.Fatalf("Failed to pin to CPUs %v: %v", config.CPUs, err)
+		}
+		if config.GOMAXPROCS == 0 {
+			config.GOMAXPROCS = len(config.CPUs)
+		}
+	}
+	if config.GOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(config.GOMAXPROCS)
+	}
 }
 
 func parseCommaSeparated(s string) []string {
@@ -306,130 +4047,1203 @@ func parseCommaSeparated(s string) []string {
 	return result
 }
 
-func makeRequest(ctx context.Context, config *Config, stats *Stats, reqNum int) {
+// applyScenario sets flags from a --config YAML file. Keys are flag names,
+// and keys of a nested map are joined to their parent's with "-", so
+// slo: {p99: 500ms} sets --slo-p99. A list sets a repeatable flag (--header)
+// once per item and is joined with commas for any other flag; a map under a
+// flag name, such as mix: {chat: 70, embeddings: 30}, becomes comma-separated
+// key=value pairs. Flags given on the command line are left as they are.
+func applyScenario(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	if root.Content[0].Kind != yaml.MappingNode {
+		return errors.New("the top level must be a map of settings")
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return applyScenarioMap(root.Content[0], "", explicit)
+}
+
+func applyScenarioMap(node *yaml.Node, prefix string, explicit map[string]bool) error {
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := prefix + key.Value
+		f := flag.Lookup(name)
+		switch {
+		case f == nil && value.Kind == yaml.MappingNode:
+			if err := applyScenarioMap(value, name+"-", explicit); err != nil {
+				return err
+			}
+			continue
+		case f == nil:
+			return fmt.Errorf("line %d: unknown setting %q", key.Line, name)
+		case name == "config":
+			return fmt.Errorf("line %d: a scenario can't load another one", key.Line)
+		case explicit[name]:
+			continue
+		}
+
+		var values []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			values = []string{value.Value}
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if _, ok := f.Value.(*phaseList); ok && item.Kind == yaml.MappingNode {
+					v, err := scenarioPhase(item)
+					if err != nil {
+						return fmt.Errorf("line %d: %s: %v", item.Line, name, err)
+					}
+					values = append(values, v)
+					continue
+				}
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: %s: list items must be plain values", item.Line, name)
+				}
+				values = append(values, item.Value)
+			}
+			switch f.Value.(type) {
+			case *headerList, *urlList, *tagList, *phaseList:
+			default:
+				values = []string{strings.Join(values, ",")}
+			}
+		case yaml.MappingNode:
+			pairs := make([]string, 0, len(value.Content)/2)
+			for j := 0; j < len(value.Content); j += 2 {
+				pairs = append(pairs, value.Content[j].Value+"="+value.Content[j+1].Value)
+			}
+			values = []string{strings.Join(pairs, ",")}
+			if _, ok := f.Value.(*tagList); ok {
+				// Tag values may contain commas.
+				values = pairs
+			}
+		default:
+			return fmt.Errorf("line %d: %s: unsupported value", value.Line, name)
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("line %d: %s: invalid value %q: %v", value.Line, name, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// scenarioPhase turns an item of a scenario's phase list into a --phase
+// value, e.g. {at: 5m, mix: {chat: 30, embeddings: 70}, stream-percent: 50}
+// into "5m:mix=chat=30,embeddings=70;stream-percent=50". Lists and mappings
+// are written as with any other setting.
+func scenarioPhase(node *yaml.Node) (string, error) {
+	var at string
+	var settings []string
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		var items []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			items = []string{value.Value}
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				items = append(items, item.Value)
+			}
+		case yaml.MappingNode:
+			for j := 0; j < len(value.Content); j += 2 {
+				items = append(items, value.Content[j].Value+"="+value.Content[j+1].Value)
+			}
+		default:
+			return "", fmt.Errorf("line %d: %s: unsupported value", value.Line, key.Value)
+		}
+		if key.Value == "at" {
+			at = value.Value
+			continue
+		}
+		settings = append(settings, key.Value+"="+strings.Join(items, ","))
+	}
+	if at == "" {
+		return "", fmt.Errorf("line %d: a phase needs an at offset", node.Line)
+	}
+	return at + ":" + strings.Join(settings, ";"), nil
+}
+
+// urlList collects repeated --url flags. The first one replaces the default
+// target.
+type urlList struct {
+	urls []string
+	set  bool
+}
+
+func (u *urlList) String() string { return strings.Join(u.urls, ", ") }
+
+func (u *urlList) Set(v string) error {
+	if !u.set {
+		u.urls, u.set = nil, true
+	}
+	u.urls = append(u.urls, v)
+	return nil
+}
+
+// tagList collects repeated --tag flags. A later tag overrides an earlier
+// one with the same key.
+type tagList map[string]string
+
+func (t *tagList) String() string {
+	pairs := make([]string, 0, len(*t))
+	for _, k := range slices.Sorted(maps.Keys(*t)) {
+		pairs = append(pairs, k+"="+(*t)[k])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (t *tagList) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("%q is not KEY=VALUE", v)
+	}
+	if *t == nil {
+		*t = make(tagList)
+	}
+	(*t)[key] = strings.TrimSpace(value)
+	return nil
+}
+
+// headerList collects repeated --header flags.
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerList) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
+// phaseList collects repeated --phase flags.
+type phaseList []string
+
+func (p *phaseList) String() string { return strings.Join(*p, ", ") }
+
+func (p *phaseList) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+// headerTemplate is a parsed --header: its canonical key and a value made of
+// literal text and placeholders, rendered anew for every request. replace is
+// set on the first --header for a key, which overrides the hitter's own
+// header of that name; later ones for the same key add values.
+type headerTemplate struct {
+	key     string
+	raw     string
+	parts   []headerPart
+	replace bool
+}
+
+// headerPart is literal text (placeholder empty) or a placeholder, with the
+// choices of a pick.
+type headerPart struct {
+	text        string
+	placeholder string
+	choices     []string
+}
+
+// parseHeaderTemplate parses "Key: Value", splitting the value at {{...}}
+// placeholders.
+func parseHeaderTemplate(s string) (headerTemplate, error) {
+	key, value, ok := strings.Cut(s, ":")
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return headerTemplate{}, fmt.Errorf("want \"Key: Value\"")
+	}
+	t := headerTemplate{key: http.CanonicalHeaderKey(key), raw: value}
+	for value != "" {
+		before, rest, found := strings.Cut(value, "{{")
+		if before != "" {
+			t.parts = append(t.parts, headerPart{text: before})
+		}
+		if !found {
+			break
+		}
+		name, after, closed := strings.Cut(rest, "}}")
+		if !closed {
+			return headerTemplate{}, fmt.Errorf("unclosed placeholder")
+		}
+		part := headerPart{placeholder: strings.TrimSpace(name)}
+		switch part.placeholder {
+		case "uuid", "request", "model", "endpoint", "timestamp":
+		default:
+			choices, isPick := strings.CutPrefix(part.placeholder, "pick:")
+			if !isPick || len(parseCommaSeparated(choices)) == 0 {
+				return headerTemplate{}, fmt.Errorf("unknown placeholder {{%s}}", part.placeholder)
+			}
+			part.placeholder, part.choices = "pick", parseCommaSeparated(choices)
+		}
+		t.parts = append(t.parts, part)
+		value = after
+	}
+	return t, nil
+}
+
+// render returns the header value for one request.
+func (t headerTemplate) render(rng *rand.Rand, reqNum int, model, endpoint string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.text)
+		case "uuid":
+			b.WriteString(randomUUID(rng))
+		case "request":
+			b.WriteString(strconv.Itoa(reqNum + 1))
+		case "model":
+			b.WriteString(model)
+		case "endpoint":
+			b.WriteString(endpoint)
+		case "timestamp":
+			b.WriteString(strconv.FormatInt(time.Now().UnixMilli(), 10))
+		case "pick":
+			b.WriteString(p.choices[rng.Intn(len(p.choices))])
+		}
+	}
+	return b.String()
+}
+
+// expandPlaceholders replaces the #{...} placeholders that benchmark.go also
+// uses in prompts: #{request_index} (the request number, 1-based as in
+// benchmark.go), #{timestamp} (the current time, RFC 3339), #{uuid} (a random
+// UUID) and #{rand N} (a random integer in [0, N)). Anything else in #{...},
+// like Ruby interpolation in a code prompt, is left as it is. Header values
+// are expanded too, after their {{...}} placeholders are rendered.
+func expandPlaceholders(s string, rng *rand.Rand, reqNum int) string {
+	if !strings.Contains(s, "#{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "#{")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(s[:start])
+		if value, ok := placeholderValue(s[start+2:end], rng, reqNum); ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(s[start : end+1])
+		}
+		s = s[end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func placeholderValue(name string, rng *rand.Rand, reqNum int) (string, bool) {
+	switch name {
+	case "request_index":
+		return strconv.Itoa(reqNum + 1), true
+	case "timestamp":
+		return time.Now().Format(time.RFC3339), true
+	case "uuid":
+		return randomUUID(rng), true
+	}
+	if n, ok := strings.CutPrefix(name, "rand "); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(n)); err == nil && n > 0 {
+			return strconv.Itoa(rng.Intn(n)), true
+		}
+	}
+	return "", false
+}
+
+// expandMessages returns messages with placeholders expanded, copying them
+// only when one has any, since corpus entries are shared between requests.
+func expandMessages(messages []Message, rng *rand.Rand, reqNum int) []Message {
+	if !slices.ContainsFunc(messages, func(m Message) bool { return strings.Contains(m.Content, "#{") }) {
+		return messages
+	}
+	expanded := slices.Clone(messages)
+	for i := range expanded {
+		expanded[i].Content = expandPlaceholders(expanded[i].Content, rng, reqNum)
+	}
+	return expanded
+}
+
+// retryableStatus reports whether --retries applies to a response status.
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryDelay returns the backoff before retry number attempt (1-based):
+// --retry-backoff doubled per earlier retry, capped at --retry-max-backoff,
+// and jittered to between half and all of that so retries don't arrive in
+// lockstep. A Retry-After header in seconds takes precedence, up to the cap.
+func retryDelay(config *Config, attempt int, retryAfter string) time.Duration {
+	if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+		return min(time.Duration(secs)*time.Second, config.RetryMaxBackoff)
+	}
+	d := config.RetryMaxBackoff
+	if shift := attempt - 1; shift < 32 {
+		d = min(config.RetryBackoff<<shift, config.RetryMaxBackoff)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// splitMix64 is a SplitMix64 rand.Source64: a single word of state, so
+// a generator per request is cheap.
+type splitMix64 uint64
+
+func (s *splitMix64) Uint64() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+func (s *splitMix64) Int63() int64    { return int64(s.Uint64() >> 1) }
+func (s *splitMix64) Seed(seed int64) { *s = splitMix64(seed) }
+
+// Streams of newRand besides the per-request ones, which are numbered by
+// request from 0. Below streamSenders come the Poisson arrivals of the
+// --senders after the first, which uses streamArrivals.
+const (
+	streamArrivals = -1 - iota
+	streamImage
+	streamSenders
+)
+
+// newRand returns the generator for one stream of a run's randomness: a
+// request's choices, or a startup or scheduling stream. With --seed each
+// stream is derived from the seed and its number alone, so request N makes
+// the same choices in every run with that seed, whatever order requests
+// finish in. Without it, streams are seeded randomly.
+func newRand(config *Config, stream int64) *rand.Rand {
+	if config.Seed == 0 {
+		src := splitMix64(rand.Uint64())
+		return rand.New(&src)
+	}
+	src := splitMix64(uint64(config.Seed))
+	src = splitMix64(src.Uint64() ^ uint64(stream)*0xd1b54a32d192ed03)
+	return rand.New(&src)
+}
+
+// randomUUID returns a random (version 4) UUID string.
+func randomUUID(rng *rand.Rand) string {
+	var u [16]byte
+	binary.LittleEndian.PutUint64(u[:8], rng.Uint64())
+	binary.LittleEndian.PutUint64(u[8:], rng.Uint64())
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// makeRequest sends one chat request and records its outcome. sess is the
+// user's conversation in multi-turn mode, nil otherwise.
+func makeRequest(ctx context.Context, config *Config, stats *Stats, reqNum, user int, sess *session, scheduled time.Time) {
 	atomic.AddInt64(&stats.totalRequests, 1)
+	rng := newRand(config, int64(reqNum))
+	// A --phase shifts what is sent from its offset on.
+	if ph := phaseAt(config, time.Since(stats.start)); ph != nil {
+		c := *config
+		c.Mix, c.Models, c.Providers = ph.mix, ph.models, ph.providers
+		c.Stream = rng.Intn(100) < ph.streamPercent
+		config = &c
+	}
+	endpoint := pickEndpoint(config, rng)
+	// A --replay request sends its recorded request as is.
+	var rec *replayRecord
+	if replayRecords != nil {
+		rec = &replayRecords[reqNum]
+		endpoint = rec.endpoint
+	}
+	streaming := config.Stream && endpoint != "embeddings"
+	if rec != nil {
+		streaming = rec.stream && endpoint != "embeddings"
+	}
+	es := stats.endpoints[endpoint]
+	if es != nil {
+		atomic.AddInt64(&es.total, 1)
+	}
+	tgt := pickTarget(config, rng, reqNum)
+	ts := stats.targets[tgt.name]
+	if ts != nil {
+		atomic.AddInt64(&ts.total, 1)
+	}
+	// hit is the --vegeta-output record of this request, written when the
+	// request ends; it takes the first error class as its error.
+	var hit *vegeta.Result
+	recordError := func(class string) {
+		stats.recordError(class)
+		if ts != nil {
+			atomic.AddInt64(&ts.errors, 1)
+		}
+		if hit != nil && hit.Error == "" {
+			hit.Error = class
+		}
+	}
+	virtualKey := config.VirtualKey
+	var ks *keyStats
+	if n := len(config.VirtualKeys); n > 0 {
+		i := reqNum % n
+		if config.KeyPerUser {
+			i = user % n
+		}
+		virtualKey, ks = config.VirtualKeys[i], stats.keys[i]
+		atomic.AddInt64(&ks.total, 1)
+	}
 
-	var jsonData []byte
+	var jsonData, wireBody []byte
 	var model string
 	provider := ""
 
-	if len(prebuiltBodies) > 0 {
+	if rec != nil {
+		jsonData, model = rec.body, rec.model
+	} else if len(prebuiltBodies) > 0 {
 		// Attachment mode: reuse a pre-encoded body (no per-request marshaling).
-		idx := rand.Intn(len(prebuiltBodies))
+		idx := rng.Intn(len(prebuiltBodies))
 		jsonData = prebuiltBodies[idx]
 		model = prebuiltLabels[idx]
+		if prebuiltGzip != nil {
+			wireBody = prebuiltGzip[idx]
+		}
+	} else if endpoint != "chat" {
+		if len(config.Providers) > 0 {
+			provider = config.Providers[rng.Intn(len(config.Providers))]
+		}
+		var err error
+		jsonData, model, err = buildEndpointBody(config, rng, reqNum, endpoint, provider)
+		if err != nil {
+			recordError("marshal")
+			if config.Verbose {
+				log.Printf("[%d] JSON marshal error: %v", reqNum, err)
+			}
+			return
+		}
 	} else {
 		// Random selection
 		if len(config.Providers) > 0 {
-			provider = config.Providers[rand.Intn(len(config.Providers))]
+			provider = config.Providers[rng.Intn(len(config.Providers))]
 		}
-		model = config.Models[rand.Intn(len(config.Models))]
+		model = config.Models[rng.Intn(len(config.Models))]
 
-		// Random prompt selection
-		prompt := prompts[rand.Intn(len(prompts))]
+		// Weighted random conversation from the prompt corpus
+		messages := pickPrompt(rng)
 		if config.Prompt != "" {
-			prompt = config.Prompt
+			messages = []Message{{Role: "user", Content: config.Prompt}}
+		}
+		messages = expandMessages(messages, rng, reqNum)
+		if sess != nil {
+			messages = sess.messages(messages)
 		}
 
 		// Add some variation to token usage
-		maxTokens := config.MaxTokens + rand.Intn(50) - 25 // ±25 tokens variation
-		if maxTokens < 10 {
-			maxTokens = 10
-		}
+		maxTokens := config.TokenDist.sample(rng, config.MaxTokens)
+		stats.maxTokens.record(int64(maxTokens))
 
 		if provider != "" {
 			model = provider + "/" + model
 		}
 
 		request := ChatRequest{
-			Model: model,
-			Messages: []Message{
-				{
-					Role:    "user",
-					Content: prompt,
-				},
-			},
+			Model:       model,
+			Messages:    messages,
 			MaxTokens:   maxTokens,
-			Temperature: config.Temperature + (rand.Float64()-0.5)*0.2, // ±0.1 variation
+			Temperature: config.Temperature + (rng.Float64()-0.5)*0.2, // ±0.1 variation
 			Stream:      config.Stream,
 		}
+		applyModernParams(config, rng, &request)
+		if toolDefs != nil {
+			request.Tools, request.ToolChoice = toolDefs, toolChoice
+		}
+
+		// Image mode: swap in a multimodal body for the configured share of
+		// requests, with the image attached to the last message. The part is
+		// marshaled as an empty stub and the data URL spliced in below.
+		var payload any = request
+		withImage := imagePart != nil && rng.Intn(100) < config.ImagePercent
+		if withImage {
+			mmMessages := make([]MultiModalMessage, len(messages))
+			for i, m := range messages {
+				mmMessages[i] = MultiModalMessage{Role: m.Role, Content: []ContentPart{{Type: "text", Text: m.Content}}}
+			}
+			last := &mmMessages[len(mmMessages)-1]
+			last.Content = append(last.Content, ContentPart{Type: "image_url", ImageURL: &ImageURLPart{}})
+			payload = MultiModalRequest{
+				Model:               request.Model,
+				Messages:            mmMessages,
+				MaxTokens:           request.MaxTokens,
+				MaxCompletionTokens: request.MaxCompletionTokens,
+				Temperature:         request.Temperature,
+				Stream:              request.Stream,
+				ReasoningEffort:     request.ReasoningEffort,
+				ResponseFormat:      request.ResponseFormat,
+				Tools:               request.Tools,
+				ToolChoice:          request.ToolChoice,
+			}
+		}
 
 		var err error
-		jsonData, err = sonic.Marshal(request)
+		jsonData, err = sonic.Marshal(payload)
 		if err != nil {
-			atomic.AddInt64(&stats.errorRequests, 1)
+			recordError("marshal")
 			if config.Verbose {
 				log.Printf("[%d] JSON marshal error: %v", reqNum, err)
 			}
 			return
 		}
+		if withImage {
+			jsonData = spliceImage(jsonData)
+		}
+	}
+
+	target := tgt.url
+	if u, ok := tgt.endpointURLs[endpoint]; ok {
+		target = u
+	}
+	if rec != nil && rec.path != "" {
+		target = tgt.origin + rec.path
+	}
+
+	// --request-encoding gzip compresses the body before the clock starts,
+	// so latency only covers the target's side of the compression.
+	if config.RequestEncoding == "gzip" && wireBody == nil {
+		start := time.Now()
+		wireBody = gzipBody(jsonData)
+		atomic.AddInt64(&stats.compressNanos, int64(time.Since(start)))
+	}
+	if wireBody == nil {
+		wireBody = jsonData
+	}
+	atomic.AddInt64(&stats.reqBytesRaw, int64(len(jsonData)))
+	atomic.AddInt64(&stats.reqBytesWire, int64(len(wireBody)))
+
+	// A sampled request keeps a copy of its response body so it can be
+	// written to --capture-dir if the request fails.
+	capturing := config.CaptureDir != "" && rand.Intn(100) < config.CapturePercent
+
+	// With --stream-idle-timeout the request gets its own context, which
+	// the idle timer cancels with errStreamIdle.
+	var cancelIdle context.CancelCauseFunc
+	if config.StreamIdleTimeout > 0 && streaming {
+		ctx, cancelIdle = context.WithCancelCause(ctx)
+		defer cancelIdle(nil)
 	}
 
 	startTime := time.Now()
+	// An open-loop request is due at its scheduled time; the time it lost
+	// to the hitter falling behind counts toward its corrected latency.
+	var lag time.Duration
+	if !scheduled.IsZero() {
+		lag = max(startTime.Sub(scheduled), 0)
+		stats.schedLag.record(lag)
+	}
+	if vegetaOut != nil {
+		hit = &vegeta.Result{
+			Attack:    tgt.name,
+			Seq:       uint64(reqNum),
+			Timestamp: startTime,
+			BytesOut:  uint64(len(wireBody)),
+			Method:    "POST",
+			URL:       target,
+		}
+		defer func() {
+			hit.Latency = time.Since(startTime)
+			vegetaOut.write(hit)
+		}()
+	}
 
 	// Create HTTP request (bytes.NewReader shares the prebuilt slice without copying)
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", config.URL, bytes.NewReader(jsonData))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(wireBody))
 	if err != nil {
-		atomic.AddInt64(&stats.errorRequests, 1)
+		recordError("request creation")
 		if config.Verbose {
 			log.Printf("[%d] Request creation error: %v", reqNum, err)
 		}
-		return
+		return
+	}
+
+	phases := &requestPhases{}
+	httpReq = httpReq.WithContext(httptrace.WithClientTrace(httpReq.Context(), connTrace(stats, phases)))
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	if rec != nil {
+		for k, v := range rec.header {
+			httpReq.Header[k] = v
+		}
+	}
+	if config.RequestEncoding == "gzip" {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	// Setting Accept-Encoding keeps net/http from decompressing on its own,
+	// so the wire size of gzip responses stays visible.
+	httpReq.Header.Set("Accept-Encoding", config.AcceptEncoding)
+	if config.HostHeader != "" {
+		httpReq.Host = config.HostHeader
+	}
+	if virtualKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+virtualKey)
+	}
+	for _, h := range config.Headers {
+		value := expandPlaceholders(h.render(rng, reqNum, model, endpoint), rng, reqNum)
+		switch {
+		case h.key == "Host":
+			httpReq.Host = value
+		case h.replace:
+			httpReq.Header.Set(h.key, value)
+		default:
+			httpReq.Header.Add(h.key, value)
+		}
+	}
+
+	// Make request, retrying 429 and 5xx responses up to --retries times.
+	// Each attempt resends the same body and headers.
+	var resp *http.Response
+	attempts := 0
+	attemptStart := startTime
+attempt:
+	for {
+		req := httpReq
+		if attempts > 0 {
+			attemptStart = time.Now()
+			req = httpReq.Clone(httpReq.Context())
+			req.Body, _ = httpReq.GetBody()
+			phases.reset()
+		}
+		attempts++
+		atomic.AddInt64(&stats.attempts, 1)
+		resp, err = httpClient.Do(req)
+		if err != nil || attempts > config.Retries || !retryableStatus(resp.StatusCode) {
+			break
+		}
+		delay := retryDelay(config, attempts, resp.Header.Get("Retry-After"))
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if config.Verbose {
+			log.Printf("[%d] %d, retrying in %s", reqNum, resp.StatusCode, delay.Truncate(time.Millisecond))
+		}
+		select {
+		case <-ctx.Done():
+			resp, err = nil, ctx.Err()
+			break attempt
+		case <-time.After(delay):
+		}
 	}
-
-	// Set headers
-	httpReq.Header.Set("Content-Type", "application/json")
-	if config.VirtualKey != "" {
-		httpReq.Header.Set("Authorization", "Bearer "+config.VirtualKey)
+	if attempts > 1 {
+		atomic.AddInt64(&stats.retriedRequests, 1)
+		stats.retryOverhead.record(attemptStart.Sub(startTime))
 	}
-
-	// Make request
-	resp, err := httpClient.Do(httpReq)
 	latency := time.Since(startTime)
 
+	if err == nil {
+		if resp.ProtoMajor == 2 {
+			atomic.AddInt64(&stats.http2Resps, 1)
+		} else {
+			atomic.AddInt64(&stats.http1Resps, 1)
+		}
+	}
 	if err != nil {
-		atomic.AddInt64(&stats.errorRequests, 1)
+		recordError(errorClass(ctx, err))
 		if config.Verbose {
 			log.Printf("[%d] HTTP request error: %v", reqNum, err)
 		}
+		if capturing {
+			captureFailure(config, stats, reqNum, httpReq, jsonData, nil, nil, fmt.Sprintf("HTTP request error: %v", err))
+		}
 		return
 	}
 	defer resp.Body.Close()
 
+	// counted sees the decoded body, wire the bytes as received.
+	counted := &countingReader{r: resp.Body}
+	wire := counted
+	gzipped := strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip")
+	if gzipped {
+		wire = &countingReader{r: resp.Body}
+		counted = &countingReader{r: &gunzipReader{r: wire}}
+	}
+	if hit != nil {
+		hit.Code = uint16(resp.StatusCode)
+		// Runs before the deferred write above.
+		defer func() { hit.BytesIn = uint64(wire.n) }()
+	}
+	var body io.Reader = counted
+	var respBody bytes.Buffer
+	if capturing {
+		body = io.TeeReader(counted, &respBody)
+	}
+	fail := func(reason string) {
+		if capturing {
+			captureFailure(config, stats, reqNum, httpReq, jsonData, resp, respBody.Bytes(), reason)
+		}
+	}
+
 	if resp.StatusCode == 200 {
-		// If streaming, read the stream to completion
-		if config.Stream {
-			if err := readStream(resp.Body, config.Verbose, reqNum); err != nil {
-				atomic.AddInt64(&stats.errorRequests, 1)
+		// The reply is only decoded when a conversation, --tools or
+		// --validate needs it.
+		var reply *replyCollector
+		if config.Validate || (endpoint == "chat" && (sess != nil || toolDefs != nil)) {
+			reply = &replyCollector{}
+		}
+		var data []byte
+		var ttft time.Duration
+
+		// If streaming, read the stream to completion (embeddings never stream)
+		if streaming {
+			if cancelIdle != nil {
+				idle := time.AfterFunc(config.StreamIdleTimeout, func() { cancelIdle(errStreamIdle) })
+				defer idle.Stop()
+				body = &idleReader{r: body, timer: idle, timeout: config.StreamIdleTimeout}
+			}
+			var err error
+			ttft, err = readStream(body, startTime, stats, reply)
+			if err != nil {
+				recordError(errorClass(ctx, err))
 				if config.Verbose {
 					log.Printf("[%d] Stream read error: %v", reqNum, err)
 				}
+				fail(fmt.Sprintf("Stream read error: %v", err))
 				return
 			}
 		} else {
 			// For non-streaming, just read the body to completion
-			_, err := io.ReadAll(resp.Body)
+			var err error
+			data, err = io.ReadAll(body)
 			if err != nil {
-				atomic.AddInt64(&stats.errorRequests, 1)
+				recordError(errorClass(ctx, err))
 				if config.Verbose {
 					log.Printf("[%d] Response read error: %v", reqNum, err)
 				}
+				fail(fmt.Sprintf("Response read error: %v", err))
+				return
+			}
+			if reply != nil {
+				reply.addBody(data)
+			}
+		}
+		if config.Validate || config.Mode == "embeddings" {
+			inputs := config.EmbeddingBatch
+			if rec != nil {
+				inputs = rec.inputs
+			}
+			if err := validateResponse(endpoint, streaming, inputs, reply, data); err != nil {
+				atomic.AddInt64(&stats.invalidResponses, 1)
+				recordError("invalid response")
+				if config.Verbose {
+					log.Printf("[%d] Invalid response: %v", reqNum, err)
+				}
+				fail(fmt.Sprintf("Invalid response: %v", err))
+				return
+			}
+		}
+		if toolDefs != nil && endpoint == "chat" {
+			if err := validateToolCalls(config, reply.toolCalls); err != nil {
+				atomic.AddInt64(&stats.invalidToolCalls, 1)
+				recordError("invalid tool calls")
+				if config.Verbose {
+					log.Printf("[%d] Invalid tool calls: %v", reqNum, err)
+				}
+				fail(fmt.Sprintf("Invalid tool calls: %v", err))
 				return
 			}
+			if len(reply.toolCalls) > 0 {
+				atomic.AddInt64(&stats.toolResponses, 1)
+				atomic.AddInt64(&stats.toolCalls, int64(len(reply.toolCalls)))
+			}
+		}
+		latency = time.Since(startTime)
+		stats.latency.record(latency)
+		if !scheduled.IsZero() {
+			stats.correctedLatency.record(latency + lag)
+		}
+		stats.respBytes.record(counted.n)
+		phases.record(stats, time.Now())
+		atomic.AddInt64(&stats.respBytesTotal, counted.n)
+		atomic.AddInt64(&stats.respWireBytes, wire.n)
+		if gzipped {
+			atomic.AddInt64(&stats.gzipResponses, 1)
+		}
+		if stats.series != nil {
+			stats.series.recordSuccess(latency)
 		}
 		atomic.AddInt64(&stats.successRequests, 1)
+		if attempts > 1 {
+			atomic.AddInt64(&stats.recoveredRequests, 1)
+		}
+		if es != nil {
+			es.latency.record(latency)
+			atomic.AddInt64(&es.success, 1)
+		}
+		if ks != nil {
+			atomic.AddInt64(&ks.success, 1)
+		}
+		if ts != nil {
+			ts.latency.record(latency)
+			if ttft > 0 {
+				ts.ttft.record(ttft)
+			}
+			atomic.AddInt64(&ts.success, 1)
+		}
+		if sess != nil {
+			sess.reply(reply.content.String())
+		}
 	} else {
-		atomic.AddInt64(&stats.errorRequests, 1)
+		recordError(fmt.Sprintf("HTTP %d", resp.StatusCode))
+		if ks != nil && resp.StatusCode == http.StatusTooManyRequests {
+			atomic.AddInt64(&ks.rateLimited, 1)
+		}
+		if config.Retries > 0 && retryableStatus(resp.StatusCode) {
+			atomic.AddInt64(&stats.exhaustedRequests, 1)
+		}
+		if capturing {
+			io.Copy(io.Discard, body)
+			fail(fmt.Sprintf("HTTP %d", resp.StatusCode))
+		}
 	}
 
 	// Log verbose output
 	if config.Verbose {
-		log.Printf("[%d] %s (%s) -> %d in %dms",
-			reqNum, model, provider, resp.StatusCode, latency.Milliseconds())
+		label := endpoint
+		if ts != nil {
+			label = tgt.name + " " + endpoint
+		}
+		log.Printf("[%d] %s %s (%s) -> %d in %dms",
+			reqNum, label, model, provider, resp.StatusCode, latency.Milliseconds())
+	}
+}
+
+// vegetaWriter encodes per-request results with vegeta's own encoders, so
+// the file reads like the output of vegeta attack. Requests finish on many
+// goroutines, hence the lock.
+type vegetaWriter struct {
+	mu    sync.Mutex
+	file  *os.File
+	buf   *bufio.Writer
+	enc   vegeta.Encoder
+	err   error
+	count int64
+}
+
+func newVegetaWriter(path, encoding string) (*vegetaWriter, error) {
+	file := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	w := &vegetaWriter{file: file, buf: bufio.NewWriter(file)}
+	switch encoding {
+	case "json":
+		w.enc = vegeta.NewJSONEncoder(w.buf)
+	case "csv":
+		w.enc = vegeta.NewCSVEncoder(w.buf)
+	default:
+		w.enc = vegeta.NewEncoder(w.buf)
+	}
+	return w, nil
+}
+
+// write encodes one result. The first error is kept for close to report and
+// later results are dropped.
+func (w *vegetaWriter) write(r *vegeta.Result) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	if w.err = w.enc.Encode(r); w.err == nil {
+		w.count++
+	}
+}
+
+// close flushes the buffered results and closes the file.
+func (w *vegetaWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); w.err == nil {
+		w.err = err
+	}
+	if w.file != os.Stdout {
+		if err := w.file.Close(); w.err == nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+// errDrainTimeout is the cause the request context is cancelled with when
+// --drain-timeout runs out.
+var errDrainTimeout = errors.New("drain timeout")
+
+// errStreamIdle is the cause a stream's context is cancelled with when it
+// sends nothing for --stream-idle-timeout.
+var errStreamIdle = errors.New("stream idle timeout")
+
+// idleReader restarts timer with every read that returns data, so the timer
+// only fires once the stream has been quiet for timeout.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// errorClass buckets a transport or body read error into a coarse class for
+// the error breakdown.
+func errorClass(ctx context.Context, err error) string {
+	// net/http reports the cancellation cause for the request itself, but
+	// a body read may still see a plain context.Canceled.
+	if errors.Is(err, errDrainTimeout) || errors.Is(err, context.Canceled) && context.Cause(ctx) == errDrainTimeout {
+		return "drain timeout"
+	}
+	if errors.Is(err, errStreamIdle) || errors.Is(err, context.Canceled) && context.Cause(ctx) == errStreamIdle {
+		return "stream idle timeout"
+	}
+	var dnsErr *net.DNSError
+	var flateErr flate.CorruptInputError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum), errors.As(err, &flateErr):
+		return "decompress"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		// net/http replaces the RecordHeaderError of a plain-HTTP server
+		// with an unwrapped error.
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	return "other"
+}
+
+// captureFailure writes one failed request, and the response if there was
+// one, to a new file in --capture-dir in HTTP/1.1 wire format, with the
+// failure reason on the first line. The Authorization header is redacted.
+// Once --capture-max files have been written, further failures are dropped.
+func captureFailure(config *Config, stats *Stats, reqNum int, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, reason string) {
+	n := atomic.AddInt64(&stats.captured, 1)
+	if n > int64(config.CaptureMax) {
+		atomic.AddInt64(&stats.captured, -1)
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n# request %d at %s\n\n", reason, reqNum, time.Now().Format(time.RFC3339Nano))
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	header := req.Header.Clone()
+	if header.Get("Authorization") != "" {
+		header.Set("Authorization", "[redacted]")
+	}
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(reqBody)
+	if resp != nil {
+		fmt.Fprintf(&buf, "\n\n%s %s\r\n", resp.Proto, resp.Status)
+		resp.Header.Write(&buf)
+		buf.WriteString("\r\n")
+		buf.Write(respBody)
+	}
+	buf.WriteString("\n")
+
+	path := filepath.Join(config.CaptureDir, fmt.Sprintf("failure-%04d.http", n))
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		log.Printf("⚠️  Failed to capture request %d: %v", reqNum, err)
+	}
+}
+
+// connTrace counts, per request, whether the transport dialed a new connection
+// or reused a pooled one, and how long any DNS lookup and dial took. The
+// start times live in phases, under its lock: with several addresses to try,
+// the transport dials them from concurrent goroutines.
+func connTrace(stats *Stats, phases *requestPhases) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { phases.mark(phaseDNS, time.Now(), true) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			took := phases.finish(phaseDNS, time.Now())
+			atomic.AddInt64(&stats.dnsLookups, 1)
+			atomic.AddInt64(&stats.dnsTimeNanos, int64(took))
+			if info.Err != nil {
+				atomic.AddInt64(&stats.dnsErrors, 1)
+			}
+		},
+		ConnectStart: func(_, addr string) { phases.dialStart(addr, time.Now()) },
+		ConnectDone: func(_, addr string, err error) {
+			if took := phases.dialDone(addr, time.Now(), err == nil); err == nil {
+				atomic.AddInt64(&stats.dialTimeNanos, int64(took))
+			}
+		},
+		TLSHandshakeStart: func() { phases.mark(phaseTLS, time.Now(), true) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				phases.mark(phaseTLS, time.Now(), false)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&stats.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&stats.newConns, 1)
+			}
+			phases.mark(phaseSend, time.Now(), true)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				now := time.Now()
+				phases.mark(phaseSend, now, false)
+				phases.mark(phaseTTFB, now, true)
+			}
+		},
+		GotFirstResponseByte: func() {
+			now := time.Now()
+			phases.mark(phaseTTFB, now, false)
+			phases.mark(phaseBody, now, true)
+		},
+	}
+}
+
+// Latency phases: DNS lookup, TCP connect and TLS handshake, which only new
+// connections go through; writing the request once a connection is in hand;
+// waiting for the first response byte, which is the time spent in the
+// gateway and upstream; and reading the rest of the body.
+const (
+	phaseDNS = iota
+	phaseConnect
+	phaseTLS
+	phaseSend
+	phaseTTFB
+	phaseBody
+)
+
+var phaseNames = [...]string{"DNS", "Connect", "TLS", "Send", "TTFB", "Body"}
+
+// requestPhases collects the start and end of each phase of one attempt,
+// and when each dial in progress started, by address. httptrace may call in
+// from the transport's dialing goroutines, hence the lock.
+type requestPhases struct {
+	mu         sync.Mutex
+	start, end [len(phaseNames)]time.Time
+	dials      map[string]time.Time
+}
+
+func (p *requestPhases) mark(phase int, at time.Time, start bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if start {
+		p.start[phase] = at
+	} else {
+		p.end[phase] = at
+	}
+}
+
+// finish ends phase at at and returns how long it took.
+func (p *requestPhases) finish(phase int, at time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.end[phase] = at
+	return at.Sub(p.start[phase])
+}
+
+// dialStart records the start of a dial to addr. The connect phase starts
+// with the first of them.
+func (p *requestPhases) dialStart(addr string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dials == nil {
+		p.dials = make(map[string]time.Time)
+	}
+	p.dials[addr] = at
+	if p.start[phaseConnect].IsZero() {
+		p.start[phaseConnect] = at
+	}
+}
+
+// dialDone returns how long the dial to addr took. A successful one ends the
+// connect phase.
+func (p *requestPhases) dialDone(addr string, at time.Time, ok bool) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start, found := p.dials[addr]
+	delete(p.dials, addr)
+	if ok {
+		p.end[phaseConnect] = at
+	}
+	if !found {
+		return 0
+	}
+	return at.Sub(start)
+}
+
+// reset forgets the phases of a previous attempt before a retry.
+func (p *requestPhases) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start, p.end = [len(phaseNames)]time.Time{}, [len(phaseNames)]time.Time{}
+}
+
+// record adds every completed phase to the stats, with the body read
+// ending at done.
+func (p *requestPhases) record(stats *Stats, done time.Time) {
+	p.mark(phaseBody, done, false)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range phaseNames {
+		if !p.start[i].IsZero() && !p.end[i].IsZero() && !p.end[i].Before(p.start[i]) {
+			stats.phases[i].record(p.end[i].Sub(p.start[i]))
+		}
+	}
+}
+
+// applyModernParams rolls each newer-parameter toggle independently, so a run
+// exercises every combination of legacy and modern fields a gateway may see.
+func applyModernParams(config *Config, rng *rand.Rand, req *ChatRequest) {
+	if rng.Intn(100) < config.MaxCompletionTokensPercent {
+		req.MaxCompletionTokens, req.MaxTokens = req.MaxTokens, 0
+	}
+	if config.ReasoningEffort != "" && rng.Intn(100) < config.ReasoningEffortPercent {
+		req.ReasoningEffort = config.ReasoningEffort
+	}
+	if config.ResponseFormat != "" && rng.Intn(100) < config.ResponseFormatPercent {
+		req.ResponseFormat = &ResponseFormat{Type: config.ResponseFormat}
+		if config.ResponseFormat == "json_schema" {
+			req.ResponseFormat.JSONSchema = &JSONSchemaSpec{Name: "answer", Strict: true, Schema: answerSchema}
+		}
 	}
 }
 
-func printBasicStats(stats *Stats, elapsed time.Duration) {
+func printBasicStats(config *Config, stats *Stats, elapsed time.Duration) {
 	total := atomic.LoadInt64(&stats.totalRequests)
 	success := atomic.LoadInt64(&stats.successRequests)
 
@@ -440,29 +5254,339 @@ func printBasicStats(stats *Stats, elapsed time.Duration) {
 
 	currentRPS := float64(total) / elapsed.Seconds()
 
-	log.Printf("📈 [%s] Requests: %d | Success: %.1f%% | RPS: %.1f",
+	line := fmt.Sprintf("📈 [%s] Requests: %d | Success: %.1f%% | RPS: %.1f",
 		elapsed.Truncate(time.Second), total, successRate, currentRPS)
+	if config.Profile != "" || config.ReplayPath != "" {
+		line += fmt.Sprintf(" | Target: %.0f", config.Load.rateAt(elapsed))
+	}
+	if config.Retries > 0 && total > 0 {
+		line += fmt.Sprintf(" | Attempts: %.2fx", float64(atomic.LoadInt64(&stats.attempts))/float64(total))
+	}
+	inflight := atomic.LoadInt64(&stats.inflight)
+	if config.Users == 0 {
+		line += fmt.Sprintf(" | In-flight: %d", inflight)
+	}
+	if l := stats.latency.summary(); l.count > 0 {
+		line += fmt.Sprintf(" | p50: %s | p99: %s", l.p50, l.p99)
+	}
+	if t := stats.ttft.summary(); t.count > 0 {
+		line += fmt.Sprintf(" | TTFT p50: %s | Tok/s: %.0f", t.p50, float64(atomic.LoadInt64(&stats.outputTokens))/elapsed.Seconds())
+	}
+	log.Print(line)
+
+	if config.Users == 0 {
+		checkBackpressure(config, stats, elapsed, inflight)
+	}
+}
+
+// maxSchedulerLag is the p99 scheduler lag above which the final statistics
+// warn that the hitter itself couldn't keep to its schedule.
+const maxSchedulerLag = 10 * time.Millisecond
+
+// checkBackpressure warns, once per periodic report, when the open loop can't
+// keep up with its schedule: arrivals were skipped at --max-inflight, or the
+// requests in flight are piling up. By Little's law, requests in flight over
+// the target rate is roughly the latency a new arrival faces; a backlog that
+// grew by more than a quarter, and by more than a second's worth of arrivals,
+// since the last report means responses lag further behind the offered load
+// rather than the load having simply risen.
+func checkBackpressure(config *Config, stats *Stats, elapsed time.Duration, inflight int64) {
+	skipped := atomic.LoadInt64(&stats.skipped)
+	newlySkipped := skipped - stats.lastSkipped
+	var backlog float64
+	rate := config.Load.rateAt(elapsed)
+	if rate > 0 {
+		backlog = float64(inflight) / rate
+	}
+	growing := stats.lastBacklog > 0 && backlog > stats.lastBacklog*1.25 && float64(inflight-stats.lastInflight) > rate
+	stats.lastSkipped, stats.lastInflight, stats.lastBacklog = skipped, inflight, backlog
+
+	switch {
+	case newlySkipped > 0:
+		log.Printf("⚠️  Backpressure: skipped %d arrivals with %d in flight (--max-inflight); the target rate is not being sustained",
+			newlySkipped, config.MaxInflight)
+	case growing:
+		log.Printf("⚠️  Backpressure: %d requests in flight (%.1fs of arrivals) and growing; responses are falling behind the target rate",
+			inflight, backlog)
+	}
+}
+
+// chatCompletion is the part of a chat completion response, or of a stream
+// chunk, that multi-turn mode and --tools read back.
+type chatCompletion struct {
+	Choices []struct {
+		Message replyMessage `json:"message"`
+		Delta   replyMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *chatUsage `json:"usage"`
+}
+
+// chatUsage is the usage block of chat completions and embeddings.
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type replyMessage struct {
+	Content   string     `json:"content"`
+	ToolCalls []toolCall `json:"tool_calls"`
+}
+
+// toolCall is one entry of tool_calls. In stream deltas, Index ties the
+// fragments of a call together: the first carries its name and later ones
+// continue its arguments.
+type toolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// replyCollector assembles the first choice's content and tool calls from a
+// response body or from stream chunks. For --validate it also notes the
+// shape of what it saw: data chunks read, bodies or chunks that weren't JSON,
+// whether any carried choices, the last usage block, and whether a stream
+// ended with [DONE].
+type replyCollector struct {
+	content   strings.Builder
+	toolCalls []toolCall
+
+	chunks    int
+	malformed int
+	choices   bool
+	usage     *chatUsage
+	done      bool
+}
+
+func (r *replyCollector) addBody(body []byte) {
+	var completion chatCompletion
+	if sonic.Unmarshal(body, &completion) != nil {
+		r.malformed++
+		return
+	}
+	r.usage = completion.Usage
+	if len(completion.Choices) > 0 {
+		r.choices = true
+		r.content.WriteString(completion.Choices[0].Message.Content)
+		r.toolCalls = completion.Choices[0].Message.ToolCalls
+	}
+}
+
+func (r *replyCollector) addChunk(data string) {
+	r.chunks++
+	var chunk chatCompletion
+	if sonic.UnmarshalString(data, &chunk) != nil {
+		r.malformed++
+		return
+	}
+	if chunk.Usage != nil {
+		r.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return
+	}
+	r.choices = true
+	delta := chunk.Choices[0].Delta
+	r.content.WriteString(delta.Content)
+	for _, tc := range delta.ToolCalls {
+		i := slices.IndexFunc(r.toolCalls, func(c toolCall) bool { return c.Index == tc.Index })
+		if i < 0 {
+			r.toolCalls = append(r.toolCalls, tc)
+			continue
+		}
+		if tc.Function.Name != "" {
+			r.toolCalls[i].Function.Name = tc.Function.Name
+		}
+		r.toolCalls[i].Function.Arguments += tc.Function.Arguments
+	}
+}
+
+// validateResponse checks a 200 response for --validate. A chat completion
+// must parse, carry a choice with content or tool calls, and report usage
+// whose total adds up; a stream must consist of JSON chunks ending in
+// [DONE], and its usage is only checked when it sends one. Embeddings must
+// return one non-empty vector per input, and a Responses API reply must
+// contain output text. body is nil for streams, which reply has collected.
+func validateResponse(endpoint string, stream bool, inputs int, reply *replyCollector, body []byte) error {
+	if stream {
+		if reply.chunks == 0 {
+			return errors.New("empty stream")
+		}
+		if reply.malformed > 0 {
+			return fmt.Errorf("%d of %d stream chunks are not JSON", reply.malformed, reply.chunks)
+		}
+	}
+
+	switch endpoint {
+	case "embeddings":
+		return validateEmbeddings(inputs, body)
+	case "responses":
+		if stream {
+			return nil
+		}
+		return validateResponsesBody(body)
+	}
+
+	switch {
+	case !stream && reply.malformed > 0:
+		return errors.New("body is not JSON")
+	case stream && !reply.done:
+		return errors.New("stream ended without [DONE]")
+	case !reply.choices:
+		return errors.New("no choices")
+	case reply.content.Len() == 0 && len(reply.toolCalls) == 0:
+		return errors.New("empty content")
+	case reply.usage == nil:
+		if !stream {
+			return errors.New("no usage")
+		}
+		return nil
+	}
+	return checkUsage(reply.usage.PromptTokens, reply.usage.CompletionTokens, reply.usage.TotalTokens)
+}
+
+// checkUsage checks that a response used some input tokens and that its
+// total is the sum of input and output tokens.
+func checkUsage(input, output, total int) error {
+	switch {
+	case input <= 0:
+		return fmt.Errorf("usage reports %d input tokens", input)
+	case output < 0:
+		return fmt.Errorf("usage reports %d output tokens", output)
+	case total != input+output:
+		return fmt.Errorf("usage total %d is not input %d + output %d", total, input, output)
+	}
+	return nil
+}
+
+func validateEmbeddings(inputs int, body []byte) error {
+	var resp struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage *chatUsage `json:"usage"`
+	}
+	if err := sonic.Unmarshal(body, &resp); err != nil {
+		return errors.New("body is not an embeddings response")
+	}
+	if len(resp.Data) != inputs {
+		return fmt.Errorf("%d embeddings for %d inputs", len(resp.Data), inputs)
+	}
+	for i, d := range resp.Data {
+		if len(d.Embedding) == 0 {
+			return fmt.Errorf("embedding %d is empty", i)
+		}
+	}
+	if resp.Usage == nil {
+		return errors.New("no usage")
+	}
+	return checkUsage(resp.Usage.PromptTokens, 0, resp.Usage.TotalTokens)
+}
+
+func validateResponsesBody(body []byte) error {
+	var resp struct {
+		Output []struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"output"`
+		// OpenAI names the usage counters input and output tokens; some
+		// gateways keep the chat completion names.
+		Usage *struct {
+			chatUsage
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := sonic.Unmarshal(body, &resp); err != nil {
+		return errors.New("body is not a Responses API response")
+	}
+	text := false
+	for _, item := range resp.Output {
+		for _, c := range item.Content {
+			text = text || (c.Type == "output_text" && c.Text != "")
+		}
+	}
+	if !text {
+		return errors.New("no output text")
+	}
+	if resp.Usage == nil {
+		return errors.New("no usage")
+	}
+	u := resp.Usage
+	return checkUsage(u.InputTokens+u.PromptTokens, u.OutputTokens+u.CompletionTokens, u.TotalTokens)
 }
 
-func readStream(body io.Reader, verbose bool, reqNum int) error {
+// readStream reads an SSE stream to [DONE], timing each data chunk: the first
+// one from start (time to first token) and every later one from its
+// predecessor (inter-chunk gap). Timings are recorded only for streams that
+// complete without error, matching the end-to-end latency, as are the
+// stream's duration, chunk count and output tokens. When reply is set, the
+// chunks' deltas are collected into it. It returns the time to first token,
+// 0 if no chunk arrived.
+func readStream(body io.Reader, start time.Time, stats *Stats, reply *replyCollector) (time.Duration, error) {
+	var ttft time.Duration
+	gaps := sampleCounts{}
+	var chunks, contentChunks, usageTokens int64
+	last := start
 	scanner := bufio.NewScanner(body)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "data: ") {
 			data := strings.TrimPrefix(line, "data: ")
 			if data == "[DONE]" {
+				if reply != nil {
+					reply.done = true
+				}
 				break
 			}
-			if verbose {
-				// Optionally log stream chunks (can be verbose)
-				_ = data
+			now := time.Now()
+			if ttft == 0 {
+				ttft = now.Sub(start)
+			} else {
+				gaps.add(now.Sub(last))
+			}
+			last = now
+			chunks++
+			// Substring checks keep the common chunk from being decoded;
+			// only the usage frame, usually the last chunk, is parsed.
+			if strings.Contains(data, `"content":"`) && !strings.Contains(data, `"content":""`) {
+				contentChunks++
+			}
+			if strings.Contains(data, `"usage":{`) {
+				var chunk chatCompletion
+				if sonic.UnmarshalString(data, &chunk) == nil && chunk.Usage != nil {
+					usageTokens = int64(chunk.Usage.CompletionTokens)
+				}
+			}
+			if reply != nil {
+				reply.addChunk(data)
 			}
 		}
 	}
-	return scanner.Err()
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if ttft > 0 {
+		stats.ttft.record(ttft)
+		stats.interChunk.recordCounts(gaps)
+		stats.streamDuration.record(last.Sub(start) - ttft)
+		stats.streamChunks.record(chunks)
+		if usageTokens > 0 {
+			atomic.AddInt64(&stats.usageStreams, 1)
+			atomic.AddInt64(&stats.outputTokens, usageTokens)
+		} else {
+			atomic.AddInt64(&stats.outputTokens, contentChunks)
+		}
+	}
+	return ttft, nil
 }
 
-func printFinalStats(stats *Stats, duration time.Duration) {
+func printFinalStats(config *Config, stats *Stats, duration time.Duration) {
 	total := atomic.LoadInt64(&stats.totalRequests)
 	success := atomic.LoadInt64(&stats.successRequests)
 	errors := atomic.LoadInt64(&stats.errorRequests)
@@ -480,4 +5604,217 @@ func printFinalStats(stats *Stats, duration time.Duration) {
 	log.Printf("   Successful: %d (%.1f%%)", success, successRate)
 	log.Printf("   Errors: %d", errors)
 	log.Printf("   Average RPS: %.1f", avgRPS)
+	if config.Mode == "embeddings" {
+		// Every successful response was checked to hold one vector per input.
+		vectors := success * int64(config.EmbeddingBatch)
+		line := fmt.Sprintf("   Embeddings: %d vectors, %.1f vectors/s (%d inputs per request", vectors, float64(vectors)/duration.Seconds(), config.EmbeddingBatch)
+		if config.EmbeddingInputTokens > 0 {
+			line += fmt.Sprintf(", ~%d tokens each", config.EmbeddingInputTokens)
+		}
+		log.Print(line + ")")
+	}
+	if n := atomic.LoadInt64(&stats.drainInflight); n > 0 {
+		// After a second interrupt the drain is still running, so drainTime
+		// isn't set yet.
+		if u := atomic.LoadInt64(&stats.unfinished); u > 0 {
+			log.Printf("   Drain: %d in flight when sending stopped, cut short by a second interrupt with %d unfinished (neither successful nor errors)", n, u)
+		} else {
+			line := fmt.Sprintf("   Drain: %d in flight when sending stopped, finished in %s", n, stats.drainTime.Truncate(time.Millisecond))
+			if c := atomic.LoadInt64(&stats.drainCanceled); c > 0 {
+				line += fmt.Sprintf(" (%d cancelled at --drain-timeout)", c)
+			}
+			log.Print(line)
+		}
+	}
+	if l := stats.latency.summary(); l.count > 0 {
+		log.Printf("   Latency: %s", l)
+		if l.clamped > 0 {
+			log.Printf("   ⚠️  %d latencies above %s were recorded as %s, so the top quantiles and max are understated",
+				l.clamped, maxTrackedLatency, maxTrackedLatency)
+		}
+	}
+	if l := stats.correctedLatency.summary(); l.count > 0 {
+		log.Printf("   Corrected Latency: %s (from the scheduled send time)", l)
+	}
+	if b := stats.respBytes.summary(); b.count > 0 {
+		total := atomic.LoadInt64(&stats.respBytesTotal)
+		log.Printf("   Response Size: %s (%s total, %s/s)", b.bytesString(), formatBytes(total), formatBytes(int64(float64(total)/duration.Seconds())))
+		if g := atomic.LoadInt64(&stats.gzipResponses); g > 0 {
+			wire := atomic.LoadInt64(&stats.respWireBytes)
+			log.Printf("   Response Compression: %d of %d gzip-encoded | %s on the wire for %s decoded (%.1f%%)",
+				g, b.count, formatBytes(wire), formatBytes(total), float64(wire)/float64(total)*100)
+		}
+	}
+	if raw := atomic.LoadInt64(&stats.reqBytesRaw); config.RequestEncoding == "gzip" && raw > 0 {
+		wire := atomic.LoadInt64(&stats.reqBytesWire)
+		line := fmt.Sprintf("   Request Compression: %s gzip-encoded to %s (%.1f%%)", formatBytes(raw), formatBytes(wire), float64(wire)/float64(raw)*100)
+		// Prebuilt --pdf bodies are compressed once at startup instead.
+		if nanos := atomic.LoadInt64(&stats.compressNanos); nanos > 0 {
+			line += fmt.Sprintf(", %s per body to compress", (time.Duration(nanos) / time.Duration(atomic.LoadInt64(&stats.totalRequests))).Truncate(time.Microsecond))
+		}
+		log.Print(line)
+	}
+	if t := stats.ttft.summary(); t.count > 0 {
+		log.Printf("   TTFT: %s", t)
+	}
+	if c := stats.interChunk.summary(); c.count > 0 {
+		log.Printf("   Inter-chunk: %s (%d gaps)", c, c.count)
+	}
+	if c := stats.streamChunks.summary(); c.count > 0 {
+		tokens := atomic.LoadInt64(&stats.outputTokens)
+		log.Printf("   Stream Throughput: %d output tokens, %.1f tokens/s (%.1f per stream; usage frames on %.1f%% of streams, content chunks otherwise)",
+			tokens, float64(tokens)/duration.Seconds(), float64(tokens)/float64(c.count),
+			float64(atomic.LoadInt64(&stats.usageStreams))/float64(c.count)*100)
+		log.Printf("   Chunks per Stream: %s", c)
+		log.Printf("   Stream Duration: %s", stats.streamDuration.summary())
+	}
+	if c := stats.maxTokens.summary(); c.count > 0 && config.TokenDist.kind != "" {
+		log.Printf("   max_tokens Sent: %s (--max-tokens-dist %s)", c, &config.TokenDist)
+	}
+	if errors > 0 {
+		breakdown := stats.errorBreakdown()
+		classes := slices.Collect(maps.Keys(breakdown))
+		sort.Slice(classes, func(i, j int) bool {
+			if breakdown[classes[i]] != breakdown[classes[j]] {
+				return breakdown[classes[i]] > breakdown[classes[j]]
+			}
+			return classes[i] < classes[j]
+		})
+		log.Printf("   Error Breakdown:")
+		for _, class := range classes {
+			log.Printf("      %-20s %8d (%.1f%%)", class, breakdown[class], float64(breakdown[class])/float64(errors)*100)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(stats.endpoints)) {
+		es := stats.endpoints[name]
+		line := fmt.Sprintf("   Endpoint %s: %d requests, %d successful", name, atomic.LoadInt64(&es.total), atomic.LoadInt64(&es.success))
+		if l := es.latency.summary(); l.count > 0 {
+			line += fmt.Sprintf(" | p50 %s | p99 %s", l.p50, l.p99)
+		}
+		log.Print(line)
+	}
+	for _, t := range config.Targets {
+		ts := stats.targets[t.name]
+		if ts == nil {
+			continue
+		}
+		total := atomic.LoadInt64(&ts.total)
+		success := atomic.LoadInt64(&ts.success)
+		var rate float64
+		if total > 0 {
+			rate = float64(success) / float64(total) * 100
+		}
+		line := fmt.Sprintf("   Target %s: %d requests, %d successful (%.1f%%), %d errors", t.name, total, success, rate, atomic.LoadInt64(&ts.errors))
+		if l := ts.latency.summary(); l.count > 0 {
+			line += fmt.Sprintf(" | p50 %s | p90 %s | p99 %s", l.p50, l.p90, l.p99)
+		}
+		if l := ts.ttft.summary(); l.count > 0 {
+			line += fmt.Sprintf(" | TTFT p50 %s | p99 %s", l.p50, l.p99)
+		}
+		log.Print(line)
+	}
+	if len(stats.keys) > 0 {
+		fewest, most := int64(math.MaxInt64), int64(0)
+		var limited []int
+		for i, ks := range stats.keys {
+			n := atomic.LoadInt64(&ks.total)
+			fewest, most = min(fewest, n), max(most, n)
+			if atomic.LoadInt64(&ks.rateLimited) > 0 {
+				limited = append(limited, i)
+			}
+		}
+		line := fmt.Sprintf("   Virtual Keys: %d keys, %d-%d requests each", len(stats.keys), fewest, most)
+		if fewest == most {
+			line = fmt.Sprintf("   Virtual Keys: %d keys, %d requests each", len(stats.keys), most)
+		}
+		if len(limited) > 0 {
+			line += fmt.Sprintf(" | %d rate limited (HTTP 429)", len(limited))
+		}
+		log.Print(line)
+		// The most rate-limited keys, which per-key limits should single out.
+		sort.SliceStable(limited, func(i, j int) bool {
+			return atomic.LoadInt64(&stats.keys[limited[i]].rateLimited) > atomic.LoadInt64(&stats.keys[limited[j]].rateLimited)
+		})
+		for _, i := range limited[:min(len(limited), keyReportLimit)] {
+			ks := stats.keys[i]
+			log.Printf("      %-14s %8d requests, %d successful, %d rate limited",
+				keyLabel(config.VirtualKeys[i]), atomic.LoadInt64(&ks.total), atomic.LoadInt64(&ks.success), atomic.LoadInt64(&ks.rateLimited))
+		}
+		if len(limited) > keyReportLimit {
+			log.Printf("      ... and %d more", len(limited)-keyReportLimit)
+		}
+	}
+
+	if config.Users == 0 {
+		line := fmt.Sprintf("   Peak In-flight: %d", atomic.LoadInt64(&stats.peakInflight))
+		if skipped := atomic.LoadInt64(&stats.skipped); skipped > 0 {
+			line += fmt.Sprintf(" | Skipped Arrivals: %d (%.1f%% of schedule, --max-inflight %d)",
+				skipped, float64(skipped)/float64(skipped+total)*100, config.MaxInflight)
+		}
+		log.Print(line)
+		if l := stats.schedLag.summary(); l.count > 0 {
+			log.Printf("   Scheduler Lag: %s", l)
+			if l.p99 > maxSchedulerLag {
+				log.Printf("   ⚠️  The hitter fell behind its schedule (p99 lag %s over %s), so Latency understates the wait; "+
+					"trust Corrected Latency and raise --senders or give the hitter more CPU", l.p99, maxSchedulerLag)
+			}
+		}
+	}
+	if config.Retries > 0 {
+		attempts := atomic.LoadInt64(&stats.attempts)
+		var amplification float64
+		if total > 0 {
+			amplification = float64(attempts) / float64(total)
+		}
+		log.Printf("   Retries: %d attempts for %d requests (%.2fx) | %d retried: %d recovered, %d exhausted",
+			attempts, total, amplification, atomic.LoadInt64(&stats.retriedRequests),
+			atomic.LoadInt64(&stats.recoveredRequests), atomic.LoadInt64(&stats.exhaustedRequests))
+		if o := stats.retryOverhead.summary(); o.count > 0 {
+			log.Printf("   Retry Overhead: %s", o)
+		}
+	}
+	if config.CaptureDir != "" {
+		log.Printf("   Captured Failures: %d in %s", atomic.LoadInt64(&stats.captured), config.CaptureDir)
+	}
+	if config.Validate {
+		log.Printf("   Invalid Responses: %d (200 responses that failed --validate, counted as errors)", atomic.LoadInt64(&stats.invalidResponses))
+	} else if config.Mode == "embeddings" {
+		log.Printf("   Invalid Responses: %d (200 responses with the wrong vector count, empty vectors or no usage, counted as errors)", atomic.LoadInt64(&stats.invalidResponses))
+	}
+	if toolDefs != nil {
+		var pct float64
+		if success > 0 {
+			pct = float64(atomic.LoadInt64(&stats.toolResponses)) / float64(success) * 100
+		}
+		log.Printf("   Tool Calls: %d in %d responses (%.1f%% of successful) | %d invalid (counted as errors)",
+			atomic.LoadInt64(&stats.toolCalls), atomic.LoadInt64(&stats.toolResponses), pct,
+			atomic.LoadInt64(&stats.invalidToolCalls))
+	}
+
+	newConns := atomic.LoadInt64(&stats.newConns)
+	reused := atomic.LoadInt64(&stats.reusedConns)
+	if conns := newConns + reused; conns > 0 {
+		log.Printf("   Connections: %d new, %d reused (%.1f%% reuse)", newConns, reused, float64(reused)/float64(conns)*100)
+	}
+	if h1, h2 := atomic.LoadInt64(&stats.http1Resps), atomic.LoadInt64(&stats.http2Resps); h2 > 0 {
+		log.Printf("   Protocols: %d HTTP/2, %d HTTP/1.x responses", h2, h1)
+	}
+	if newConns > 0 {
+		log.Printf("   Avg Dial Time: %s", time.Duration(atomic.LoadInt64(&stats.dialTimeNanos)/newConns).Truncate(time.Microsecond))
+	}
+	lookups := atomic.LoadInt64(&stats.dnsLookups)
+	if lookups > 0 {
+		log.Printf("   DNS Lookups: %d (%d failed, avg %s)", lookups, atomic.LoadInt64(&stats.dnsErrors),
+			time.Duration(atomic.LoadInt64(&stats.dnsTimeNanos)/lookups).Truncate(time.Microsecond))
+	} else {
+		log.Printf("   DNS Lookups: 0")
+	}
+	if stats.phases[phaseTTFB].summary().count > 0 {
+		log.Printf("   Latency Phases (successful requests; DNS, Connect and TLS on new connections only):")
+		for i, name := range phaseNames {
+			if l := stats.phases[i].summary(); l.count > 0 {
+				log.Printf("      %-8s mean %s | p50 %s | p90 %s | p99 %s | max %s (%d)", name, l.mean, l.p50, l.p90, l.p99, l.max, l.count)
+			}
+		}
+	}
 }
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnTraceConcurrentDials(t *testing.T) {
+	stats := newStats(&Config{})
+	phases := &requestPhases{}
+	trace := connTrace(stats, phases)
+
+	// With several addresses to try, the transport dials them from
+	// concurrent goroutines; only the successful dial counts.
+	var wg sync.WaitGroup
+	for _, addr := range []string{"[::1]:443", "127.0.0.1:443"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trace.ConnectStart("tcp", addr)
+			time.Sleep(10 * time.Millisecond)
+			var err error
+			if addr == "[::1]:443" {
+				err = errors.New("connection refused")
+			}
+			trace.ConnectDone("tcp", addr, err)
+		}()
+	}
+	wg.Wait()
+
+	if d := time.Duration(stats.dialTimeNanos); d < 10*time.Millisecond || d > time.Second {
+		t.Errorf("dial time = %s, want the successful dial's 10ms or so", d)
+	}
+	start, end := phases.start[phaseConnect], phases.end[phaseConnect]
+	if start.IsZero() || end.Before(start) {
+		t.Errorf("connect phase = %s to %s, want a completed phase", start, end)
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []int
+	}{
+		{"0", []int{0}},
+		{"0-3,6", []int{0, 1, 2, 3, 6}},
+		{"3, 1, 1-2", []int{1, 2, 3}},
+		{"2-2", []int{2}},
+	}
+	for _, tc := range cases {
+		got, err := parseCPUList(tc.in)
+		if err != nil {
+			t.Fatalf("parseCPUList(%q): %v", tc.in, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseCPUList(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{"", " , ", "a", "3-1", "-1", "1-", "1-x"} {
+		if _, err := parseCPUList(in); err == nil {
+			t.Errorf("parseCPUList(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	l := newLatencyHistogram()
+	for ms := 1; ms <= 1000; ms++ {
+		l.record(time.Duration(ms) * time.Millisecond)
+	}
+	l.record(0, maxTrackedLatency+time.Minute)
+
+	s := l.summary()
+	if s.count != 1002 {
+		t.Fatalf("count = %d, want 1002", s.count)
+	}
+	if s.clamped != 1 {
+		t.Errorf("clamped = %d, want 1", s.clamped)
+	}
+	// Three significant digits: quantiles are within 0.1% of the exact value.
+	for _, tc := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"p50", s.p50, 500 * time.Millisecond},
+		{"p99", s.p99, 991 * time.Millisecond}, // the 992nd of 1002 samples
+		{"max", s.max, maxTrackedLatency},
+	} {
+		if diff := math.Abs(float64(tc.got-tc.want)) / float64(tc.want); diff > 0.001 {
+			t.Errorf("%s = %s, want %s within 0.1%%", tc.name, tc.got, tc.want)
+		}
+	}
+
+	if s := l.reset(); s.count != 1002 {
+		t.Errorf("reset returned count %d, want 1002", s.count)
+	}
+	if s := l.summary(); s.count != 0 || s.clamped != 0 {
+		t.Errorf("after reset: count %d, clamped %d, want 0 and 0", s.count, s.clamped)
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	start := time.Now()
+	go func(w *io.PipeWriter) {
+		for _, chunk := range []string{
+			": keep-alive\n\n",
+			`data: {"choices":[{"delta":{"content":"Hel"}}]}` + "\n\n",
+			`data: {"choices":[{"delta":{"content":"lo"}}]}` + "\n\n",
+			"data: [DONE]\n\n",
+			`data: {"choices":[{"delta":{"content":"!"}}]}` + "\n\n",
+		} {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := w.Write([]byte(chunk)); err != nil {
+				return
+			}
+		}
+		w.Close()
+	}(pw)
+
+	stats := newStats(&Config{})
+	var reply replyCollector
+	ttft, err := readStream(pr, start, stats, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reply.content.String(); got != "Hello" {
+		t.Errorf("reply = %q, want Hello", got)
+	}
+	// The comment line doesn't count as the first token, and nothing after
+	// [DONE] is read.
+	if s := stats.ttft.summary(); ttft < 40*time.Millisecond || s.count != 1 {
+		t.Errorf("TTFT = %s, recorded %d samples, max %s; want 1 sample of at least 40ms", ttft, s.count, s.max)
+	}
+	if n := stats.interChunk.summary().count; n != 1 {
+		t.Errorf("inter-chunk = %d samples, want 1 gap", n)
+	}
+
+	stats = newStats(&Config{})
+	pr, pw = io.Pipe()
+	go func() {
+		pw.Write([]byte("data: {\"n\":1}\n"))
+		pw.CloseWithError(errors.New("connection reset"))
+	}()
+	if _, err := readStream(pr, time.Now(), stats, nil); err == nil || err.Error() != "connection reset" {
+		t.Errorf("readStream of a broken stream = %v, want connection reset", err)
+	}
+	if n := stats.ttft.summary().count; n != 0 {
+		t.Errorf("broken stream recorded %d TTFT samples, want 0", n)
+	}
+}
+
+func TestParseLoadProfile(t *testing.T) {
+	cases := []struct {
+		spec string
+		want loadProfile
+	}{
+		{"ramp:0-500rps/1m", loadProfile{{duration: time.Minute, from: 0, to: 500}, {from: 500, to: 500}}},
+		{"ramp:100-50/10s", loadProfile{{duration: 10 * time.Second, from: 100, to: 50}, {from: 50, to: 50}}},
+		{"step:100,200rps/30s", loadProfile{
+			{duration: 30 * time.Second, from: 100, to: 100},
+			{duration: 30 * time.Second, from: 200, to: 200},
+			{from: 200, to: 200},
+		}},
+		{"spike", loadProfile{
+			{duration: 25 * time.Second, from: 100, to: 100},
+			{duration: 10 * time.Second, from: 500, to: 500},
+			{from: 100, to: 100},
+		}},
+		{"spike:1000rps/20s", loadProfile{
+			{duration: 20 * time.Second, from: 100, to: 100},
+			{duration: 20 * time.Second, from: 1000, to: 1000},
+			{from: 100, to: 100},
+		}},
+	}
+	for _, tc := range cases {
+		got, err := parseLoadProfile(tc.spec, 100, time.Minute)
+		if err != nil {
+			t.Fatalf("parseLoadProfile(%q): %v", tc.spec, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseLoadProfile(%q) = %+v, want %+v", tc.spec, got, tc.want)
+		}
+	}
+
+	ramp, _ := parseLoadProfile("ramp:0-500/1m", 100, time.Minute)
+	if got := ramp.rateAt(30 * time.Second); got != 250 {
+		t.Errorf("ramp rate at 30s = %g, want 250", got)
+	}
+	if got := ramp.arrivalsBy(time.Minute); got != 15000 {
+		t.Errorf("ramp arrivals by 1m = %g, want 15000", got)
+	}
+
+	for _, spec := range []string{"ramp:0-500", "ramp:500/1m", "ramp:0-x/1m", "step:10,x/1s", "step:10/0s", "spike:100/-1s", "wave:1/1s"} {
+		if _, err := parseLoadProfile(spec, 100, time.Minute); err == nil {
+			t.Errorf("parseLoadProfile(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestParseHeaderTemplate(t *testing.T) {
+	h, err := parseHeaderTemplate("x-trace:  {{request}}/{{ model }}/{{endpoint}}/{{pick:a}}-end ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.key != "X-Trace" {
+		t.Errorf("key = %q, want X-Trace", h.key)
+	}
+	// {{request}} is 1-based, like #{request_index}.
+	if got := h.render(rand.New(rand.NewSource(1)), 7, "gpt-4o", "chat"); got != "8/gpt-4o/chat/a-end" {
+		t.Errorf("render = %q, want 8/gpt-4o/chat/a-end", got)
+	}
+
+	h, err = parseHeaderTemplate("X-Id: {{uuid}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.render(rand.New(rand.NewSource(1)), 0, "", ""); len(got) != 36 || strings.Count(got, "-") != 4 {
+		t.Errorf("uuid render = %q, want a UUID", got)
+	}
+
+	for _, spec := range []string{"NoColon", ": value", "Bad Key: v", "X: {{nope}}", "X: {{uuid", "X: {{pick:}}", "X: {{pick: , }}"} {
+		if _, err := parseHeaderTemplate(spec); err == nil {
+			t.Errorf("parseHeaderTemplate(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestMakeRequestRetries(t *testing.T) {
+	setPromptCorpus(builtinPromptCorpus())
+	var bodies []string
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"choices": []}`))
+	}))
+	defer srv.Close()
+	targets, err := parseTargets([]string{srv.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Targets: targets, Models: []string{"gpt-4o"}, MaxTokens: 100,
+		Retries: 3, RetryBackoff: time.Millisecond, RetryMaxBackoff: time.Millisecond}
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = newHTTPClient(config)
+
+	stats := newStats(config)
+	makeRequest(context.Background(), config, stats, 0, 0, nil, time.Time{})
+	if len(bodies) != 3 {
+		t.Fatalf("server saw %d attempts, want 3", len(bodies))
+	}
+	// Retries rewind the body through GetBody rather than sending it empty.
+	for i, body := range bodies {
+		if body == "" || body != bodies[0] {
+			t.Errorf("attempt %d sent %q, want the first attempt's body %q", i+1, body, bodies[0])
+		}
+	}
+	for _, c := range []struct {
+		name      string
+		got, want int64
+	}{
+		{"success", stats.successRequests, 1},
+		{"errors", stats.errorRequests, 0},
+		{"attempts", stats.attempts, 3},
+		{"retried", stats.retriedRequests, 1},
+		{"recovered", stats.recoveredRequests, 1},
+		{"exhausted", stats.exhaustedRequests, 0},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %d, want %d", c.name, c.got, c.want)
+		}
+	}
+
+	// A request still failing after --retries counts as exhausted.
+	bodies, failures = nil, 10
+	config.Retries = 1
+	stats = newStats(config)
+	makeRequest(context.Background(), config, stats, 0, 0, nil, time.Time{})
+	if len(bodies) != 2 || stats.errorRequests != 1 || stats.exhaustedRequests != 1 || stats.recoveredRequests != 0 {
+		t.Errorf("after %d attempts: %d errors, %d exhausted, %d recovered; want 2 attempts, 1 error, 1 exhausted, 0 recovered",
+			len(bodies), stats.errorRequests, stats.exhaustedRequests, stats.recoveredRequests)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	const (
+		usage      = `"usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}`
+		completion = `{"choices": [{"message": {"content": "hi"}}], ` + usage + `}`
+	)
+	sse := func(chunks ...string) string {
+		return "data: " + strings.Join(chunks, "\n\ndata: ") + "\n\n"
+	}
+	delta := `{"choices": [{"delta": {"content": "hi"}}]}`
+	cases := []struct {
+		name     string
+		endpoint string
+		stream   bool
+		body     string
+		wantErr  string
+	}{
+		{"chat", "chat", false, completion, ""},
+		{"tool calls only", "chat", false, `{"choices": [{"message": {"tool_calls": [{"id": "c1"}]}}], ` + usage + `}`, ""},
+		{"not json", "chat", false, `<html>`, "body is not JSON"},
+		{"no choices", "chat", false, `{"choices": [], ` + usage + `}`, "no choices"},
+		{"empty content", "chat", false, `{"choices": [{"message": {"content": ""}}], ` + usage + `}`, "empty content"},
+		{"no usage", "chat", false, `{"choices": [{"message": {"content": "hi"}}]}`, "no usage"},
+		{"bad total", "chat", false, `{"choices": [{"message": {"content": "hi"}}], "usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 8}}`,
+			"usage total 8 is not input 5 + output 2"},
+		{"stream", "chat", true, sse(delta, delta, "[DONE]"), ""},
+		{"stream with usage", "chat", true, sse(delta, `{"choices": [], `+usage+`}`, "[DONE]"), ""},
+		{"empty stream", "chat", true, "", "empty stream"},
+		{"malformed chunk", "chat", true, sse(delta, "{", "[DONE]"), "1 of 2 stream chunks are not JSON"},
+		{"no [DONE]", "chat", true, sse(delta), "stream ended without [DONE]"},
+		{"embeddings", "embeddings", false, `{"data": [{"embedding": [0.1]}, {"embedding": [0.2]}], "usage": {"prompt_tokens": 4, "total_tokens": 4}}`, ""},
+		{"missing embedding", "embeddings", false, `{"data": [{"embedding": [0.1]}], "usage": {"prompt_tokens": 4, "total_tokens": 4}}`,
+			"1 embeddings for 2 inputs"},
+		{"empty embedding", "embeddings", false, `{"data": [{"embedding": [0.1]}, {"embedding": []}], "usage": {"prompt_tokens": 4, "total_tokens": 4}}`,
+			"embedding 1 is empty"},
+		{"responses", "responses", false, `{"output": [{"content": [{"type": "output_text", "text": "hi"}]}], "usage": {"input_tokens": 5, "output_tokens": 2, "total_tokens": 7}}`, ""},
+		{"responses without text", "responses", false, `{"output": [{"content": [{"type": "refusal"}]}], "usage": {"input_tokens": 5, "output_tokens": 2, "total_tokens": 7}}`,
+			"no output text"},
+	}
+	for _, tc := range cases {
+		reply := &replyCollector{}
+		var body []byte
+		if tc.stream {
+			if _, err := readStream(strings.NewReader(tc.body), time.Now(), newStats(&Config{}), reply); err != nil {
+				t.Fatalf("%s: readStream: %v", tc.name, err)
+			}
+		} else {
+			body = []byte(tc.body)
+			reply.addBody(body)
+		}
+		err := validateResponse(tc.endpoint, tc.stream, 2, reply, body)
+		if got := fmt.Sprint(err); tc.wantErr == "" && err != nil || tc.wantErr != "" && got != tc.wantErr {
+			t.Errorf("%s: validateResponse = %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestApplyScenario(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("hitter", flag.ContinueOnError)
+	rps := flag.Int("rps", 10, "")
+	models := flag.String("models", "", "")
+	mix := flag.String("mix", "", "")
+	sloP99 := flag.Duration("slo-p99", 0, "")
+	flag.String("providers", "", "")
+	flag.Duration("slo-ttft", 0, "")
+	var headers headerList
+	flag.Var(&headers, "header", "")
+	flag.String("config", "", "")
+	if err := flag.CommandLine.Parse([]string{"-rps", "50"}); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(yaml string) string {
+		path := filepath.Join(t.TempDir(), "scenario.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	err := applyScenario(write(`
+rps: 999
+models: [gpt-4o, claude-sonnet]
+mix: {chat: 70, embeddings: 30}
+slo:
+  p99: 500ms
+header:
+  - "X-Team: search"
+  - "X-Run: 1"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// --rps was given on the command line, so the scenario leaves it alone.
+	if *rps != 50 {
+		t.Errorf("rps = %d, want the command line's 50", *rps)
+	}
+	if *models != "gpt-4o,claude-sonnet" {
+		t.Errorf("models = %q, want the list joined with commas", *models)
+	}
+	if *mix != "chat=70,embeddings=30" {
+		t.Errorf("mix = %q, want key=value pairs", *mix)
+	}
+	if *sloP99 != 500*time.Millisecond {
+		t.Errorf("slo-p99 = %s, want 500ms from the nested slo map", *sloP99)
+	}
+	if want := (headerList{"X-Team: search", "X-Run: 1"}); !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %q, want %q", headers, want)
+	}
+
+	for yaml, wantErr := range map[string]string{
+		"- rps: 5":            "the top level must be a map of settings",
+		"rsp: 5":              `line 1: unknown setting "rsp"`,
+		"slo: {p42: 1s}":      `line 1: unknown setting "slo-p42"`,
+		"config: other.yaml":  "line 1: a scenario can't load another one",
+		"providers: [[a], b]": "line 1: providers: list items must be plain values",
+		"slo: {ttft: soon}":   `line 1: slo-ttft: invalid value "soon"`,
+	} {
+		err := applyScenario(write(yaml))
+		if err == nil || !strings.HasPrefix(err.Error(), wantErr) {
+			t.Errorf("applyScenario(%q) = %v, want %q", yaml, err, wantErr)
+		}
+	}
+	if err := applyScenario(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("applyScenario of a missing file succeeded")
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	cases := []struct {
+		in, want string
+	}{
+		{"no placeholders", "no placeholders"},
+		{"#{request_index} first", "1 first"},
+		{"a #{rand 1} b", "a 0 b"},
+		{`puts "#{name}"`, `puts "#{name}"`},
+		{"#{rand x} #{rand 0}", "#{rand x} #{rand 0}"},
+		{"#{request_index", "#{request_index"},
+	}
+	for _, tc := range cases {
+		if got := expandPlaceholders(tc.in, rng, 0); got != tc.want {
+			t.Errorf("expandPlaceholders(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	got := expandPlaceholders("#{timestamp}|#{uuid}", rng, 0)
+	ts, id, _ := strings.Cut(got, "|")
+	if _, err := time.Parse(time.RFC3339, ts); err != nil {
+		t.Errorf("#{timestamp} = %q, want RFC 3339: %v", ts, err)
+	}
+	if len(id) != 36 {
+		t.Errorf("#{uuid} = %q, want a UUID", id)
+	}
+}
+
+func TestMakeRequestHeaders(t *testing.T) {
+	setPromptCorpus(builtinPromptCorpus())
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"choices": []}`))
+	}))
+	defer srv.Close()
+	targets, err := parseTargets([]string{srv.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Targets: targets, Models: []string{"gpt-4o"}, MaxTokens: 100}
+	for _, spec := range []string{"X-Trace: {{request}}/#{request_index}", "X-Note: #{name} {{model}}"} {
+		h, err := parseHeaderTemplate(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Headers = append(config.Headers, h)
+	}
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = newHTTPClient(config)
+
+	makeRequest(context.Background(), config, newStats(config), 4, 0, nil, time.Time{})
+	if v := got.Get("X-Trace"); v != "5/5" {
+		t.Errorf("X-Trace = %q, want 5/5", v)
+	}
+	if v := got.Get("X-Note"); v != "#{name} gpt-4o" {
+		t.Errorf("X-Note = %q, want #{name} gpt-4o", v)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var (
+		stats *Stats
+		wg    sync.WaitGroup
+		ctx   context.Context
+	)
+	// start simulates a request in flight for d, or until it is cancelled.
+	start := func(d time.Duration) {
+		wg.Add(1)
+		atomic.AddInt64(&stats.inflight, 1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			defer atomic.AddInt64(&stats.inflight, -1)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		}(ctx)
+	}
+
+	// Requests that finish within the timeout are waited for.
+	config := &Config{DrainTimeout: time.Second}
+	stats = newStats(config)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	start(20 * time.Millisecond)
+	start(40 * time.Millisecond)
+	drain(config, stats, &wg, cancel)
+	if stats.drainInflight != 2 || stats.drainCanceled != 0 || ctx.Err() != nil {
+		t.Errorf("drained %d with %d canceled (ctx %v), want 2 with none canceled", stats.drainInflight, stats.drainCanceled, ctx.Err())
+	}
+	if n := atomic.LoadInt64(&stats.inflight); n != 0 {
+		t.Errorf("%d requests still in flight after the drain, want 0", n)
+	}
+	cancel(nil)
+
+	// The ones still running at the timeout are cancelled with errDrainTimeout.
+	config.DrainTimeout = 30 * time.Millisecond
+	stats = newStats(config)
+	ctx, cancel = context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	start(10 * time.Millisecond)
+	start(time.Hour)
+	drain(config, stats, &wg, cancel)
+	if stats.drainInflight != 2 || stats.drainCanceled != 1 {
+		t.Errorf("drained %d with %d canceled, want 2 with 1 canceled", stats.drainInflight, stats.drainCanceled)
+	}
+	if cause := context.Cause(ctx); cause != errDrainTimeout {
+		t.Errorf("requests canceled with %v, want errDrainTimeout", cause)
+	}
+	if stats.drainTime > 500*time.Millisecond {
+		t.Errorf("drain took %s, want about the 30ms timeout", stats.drainTime)
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	write := func(name string, p50, p99 float64, successful int64) string {
+		result := runResult{URL: "http://gateway", StartedAt: "2025-06-01T12:00:00Z", DurationSec: 11,
+			TotalRequests: 1000, Successful: successful, SuccessRate: float64(successful) / 10, AverageRPS: 100,
+			Latency: &latencyResult{Count: successful, P50Ms: p50, P99Ms: p99}}
+		// Ten full seconds with a little noise around the quantiles, and the
+		// partial last second, which compare leaves out.
+		for i := 0; i <= 10; i++ {
+			noise := float64(i%2*2 - 1)
+			result.TimeSeries = append(result.TimeSeries, timeSeriesPoint{Second: i, Started: 100, Success: 99,
+				P50Ms: p50 + noise, P99Ms: p99 + noise})
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := write("base.json", 100, 200, 1000)
+	next := write("new.json", 150, 200, 990)
+
+	var out bytes.Buffer
+	defer func(w io.Writer, flags int) { log.SetOutput(w); log.SetFlags(flags) }(log.Writer(), log.Flags())
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	compareResults([]string{base, next})
+
+	lines := strings.Split(out.String(), "\n")
+	for _, want := range [][]string{
+		{"p50 latency", "100.0ms", "150.0ms", "+50.0%", "worse (t="},
+		{"p99 latency", "200.0ms", "200.0ms", "+0.0%", "within noise (t=0.00)"},
+		{"Success rate", "100.00%", "99.00%", "-1.00pp", "worse (z=-3.17)"},
+		{"Throughput", "100.0 rps", "100.0 rps", "+0.0%", "within noise (t=0.00)"},
+	} {
+		i := slices.IndexFunc(lines, func(l string) bool { return strings.HasPrefix(strings.TrimSpace(l), want[0]) })
+		if i < 0 {
+			t.Errorf("no %s line in:\n%s", want[0], out.String())
+			continue
+		}
+		for _, field := range want[1:] {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("%s line %q lacks %q", want[0], lines[i], field)
+			}
+		}
+	}
+}
+
+func TestWelchT(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []float64
+		want float64
+		ok   bool
+	}{
+		{"too few seconds", []float64{1, 2, 3, 4}, []float64{1, 2, 3, 4, 5}, 0, false},
+		{"same values", []float64{1, 2, 3, 4, 5}, []float64{1, 2, 3, 4, 5}, 0, true},
+		{"shifted by one", []float64{1, 2, 3, 4, 5}, []float64{2, 3, 4, 5, 6}, 1, true},
+		{"shifted down", []float64{2, 3, 4, 5, 6}, []float64{1, 2, 3, 4, 5}, -1, true},
+		{"no noise", []float64{1, 1, 1, 1, 1}, []float64{2, 2, 2, 2, 2}, math.Inf(1), true},
+	}
+	for _, tc := range cases {
+		got, ok := welchT(tc.a, tc.b)
+		if ok != tc.ok || got != tc.want && math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: welchT = (%g, %v), want (%g, %v)", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestTokenDistSet(t *testing.T) {
+	cases := []struct {
+		spec string
+		want tokenDist
+	}{
+		{"uniform:10-20", tokenDist{spec: "uniform:10-20", kind: "uniform", lo: 10, hi: 20}},
+		{"uniform:5-5", tokenDist{spec: "uniform:5-5", kind: "uniform", lo: 5, hi: 5}},
+		{"normal:100,15.5", tokenDist{spec: "normal:100,15.5", kind: "normal", mean: 100, stddev: 15.5}},
+		{"weighted:64=3, 512=1", tokenDist{spec: "weighted:64=3, 512=1", kind: "weighted",
+			values: []int{64, 512}, weights: []int{3, 1}, totalWeight: 4}},
+	}
+	for _, tc := range cases {
+		var d tokenDist
+		if err := d.Set(tc.spec); err != nil {
+			t.Fatalf("Set(%q): %v", tc.spec, err)
+		}
+		if !reflect.DeepEqual(d, tc.want) {
+			t.Errorf("Set(%q) = %+v, want %+v", tc.spec, d, tc.want)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var d tokenDist
+	_ = d.Set("uniform:10-20")
+	for i := 0; i < 1000; i++ {
+		if n := d.sample(rng, 0); n < 10 || n > 20 {
+			t.Fatalf("uniform:10-20 sampled %d", n)
+		}
+	}
+
+	for _, spec := range []string{"uniform:0-5", "uniform:20-10", "uniform:10", "normal:0,1", "normal:100,-1", "normal:100",
+		"weighted:64=0", "weighted:64", "weighted:x=1", "poisson:5", ""} {
+		before := d
+		if err := d.Set(spec); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", spec)
+		}
+		if !reflect.DeepEqual(d, before) {
+			t.Errorf("failed Set(%q) changed the distribution to %+v", spec, d)
+		}
+	}
+}
+
+func TestLoadReplay(t *testing.T) {
+	write := func(lines ...string) string {
+		path := filepath.Join(t.TempDir(), "replay.jsonl")
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	records, err := loadReplay(write(
+		`{"offset_ms": 1500, "path": "/v1/embeddings", "body": {"model": "emb", "input": ["a", "b", "c"]}}`,
+		``,
+		`{"offset_ms": 1000, "path": "/v1/chat/completions?x=1", "headers": {"X-Team": "search", "content-length": "9"}, "body": "{\"model\": \"gpt-4o\", \"stream\": true}"}`,
+		`{"offset_ms": 1250.5, "body": {"model": "tok", "input": [1, 2, 3]}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []replayRecord{
+		{offset: 0, path: "/v1/chat/completions?x=1", header: http.Header{"X-Team": {"search"}},
+			body: []byte(`{"model": "gpt-4o", "stream": true}`), endpoint: "chat", model: "gpt-4o", stream: true, inputs: 1},
+		{offset: 250500 * time.Microsecond, header: http.Header{},
+			body: []byte(`{"model": "tok", "input": [1, 2, 3]}`), endpoint: "chat", model: "tok", inputs: 1},
+		{offset: 500 * time.Millisecond, path: "/v1/embeddings", header: http.Header{},
+			body: []byte(`{"model": "emb", "input": ["a", "b", "c"]}`), endpoint: "embeddings", model: "emb", inputs: 3},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("loaded %d records, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(records[i], want[i]) {
+			t.Errorf("record %d = %+v, want %+v", i, records[i], want[i])
+		}
+	}
+
+	records, err = loadReplay(write(
+		`{"timestamp": "2025-06-01T12:00:01Z", "body": {"model": "b"}}`,
+		`{"timestamp": "2025-06-01T12:00:00.250Z", "body": {"model": "a"}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].model != "a" || records[0].offset != 0 || records[1].model != "b" || records[1].offset != 750*time.Millisecond {
+		t.Errorf("timestamped records = %+v", records)
+	}
+
+	for name, lines := range map[string][]string{
+		"empty":           {"", "  "},
+		"offset and time": {`{"offset_ms": 0, "timestamp": "2025-06-01T12:00:00Z", "body": {}}`},
+		"mixed timing":    {`{"offset_ms": 0, "body": {}}`, `{"timestamp": "2025-06-01T12:00:00Z", "body": {}}`},
+		"negative offset": {`{"offset_ms": -1, "body": {}}`},
+		"no timing":       {`{"body": {}}`},
+		"bad timestamp":   {`{"timestamp": "yesterday", "body": {}}`},
+		"no body":         {`{"offset_ms": 0}`},
+		"array body":      {`{"offset_ms": 0, "body": [1]}`},
+		"relative path":   {`{"offset_ms": 0, "path": "v1/chat/completions", "body": {}}`},
+		"bad json":        {`{"offset_ms": 0,`},
+	} {
+		if _, err := loadReplay(write(lines...)); err == nil {
+			t.Errorf("%s: loadReplay succeeded, want error", name)
+		}
+	}
+	if _, err := loadReplay(filepath.Join(t.TempDir(), "missing.jsonl")); err == nil {
+		t.Error("loadReplay of a missing file succeeded")
+	}
+}
+
+func TestSampleCounts(t *testing.T) {
+	cases := []struct {
+		in, want time.Duration
+	}{
+		{0, time.Microsecond},
+		{500 * time.Nanosecond, time.Microsecond},
+		{2047 * time.Microsecond, 2047 * time.Microsecond},
+		{2049 * time.Microsecond, 2048 * time.Microsecond},
+		{1234567 * time.Microsecond, 1233920 * time.Microsecond},
+	}
+	for _, tc := range cases {
+		c := sampleCounts{}
+		c.add(tc.in)
+		c.add(tc.in)
+		if want := (sampleCounts{tc.want: 2}); !reflect.DeepEqual(c, want) {
+			t.Errorf("add(%s) twice = %v, want %v", tc.in, c, want)
+		}
+	}
+
+	// Buffered samples summarize like samples recorded one by one.
+	direct, buffered := newLatencyHistogram(), newLatencyHistogram()
+	counts := sampleCounts{}
+	for us := 1; us <= 100000; us += 7 {
+		d := time.Duration(us) * time.Microsecond
+		direct.record(d)
+		counts.add(d)
+	}
+	buffered.recordCounts(counts)
+	if a, b := direct.summary(), buffered.summary(); a != b {
+		t.Errorf("recordCounts summary = %+v, record summary = %+v", b, a)
+	}
+}
+
+func TestParsePhases(t *testing.T) {
+	config := &Config{Models: []string{"gpt-4o"}, Providers: []string{"openai"}, Stream: true}
+	phases, err := parsePhases([]string{
+		"1m:models=a, b",
+		"2m30s: stream-percent=50; mix=chat=50,embeddings=50",
+		"5m:providers=",
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mix := []endpointShare{{name: "chat", percent: 50}, {name: "embeddings", percent: 50}}
+	want := []trafficPhase{
+		{at: time.Minute, spec: "1m:models=a, b", models: []string{"a", "b"}, providers: []string{"openai"}, streamPercent: 100},
+		{at: 150 * time.Second, spec: "2m30s: stream-percent=50; mix=chat=50,embeddings=50", mix: mix,
+			models: []string{"a", "b"}, providers: []string{"openai"}, streamPercent: 50},
+		{at: 5 * time.Minute, spec: "5m:providers=", mix: mix, models: []string{"a", "b"}, streamPercent: 50},
+	}
+	if !reflect.DeepEqual(phases, want) {
+		t.Fatalf("parsePhases = %+v, want %+v", phases, want)
+	}
+	if ph := phaseAt(&Config{TrafficPhases: phases}, 2*time.Minute); ph == nil || ph.at != time.Minute {
+		t.Errorf("phaseAt(2m) = %+v, want the 1m phase", ph)
+	}
+
+	for _, specs := range [][]string{
+		{"models=a"},
+		{"0s:models=a"},
+		{"soon:models=a"},
+		{"2m:models=a", "1m:models=b"},
+		{"1m:models=a", "1m:models=b"},
+		{"1m:models"},
+		{"1m:models=,"},
+		{"1m:stream-percent=101"},
+		{"1m:mix=chat=90"},
+		{"1m:temperature=1"},
+	} {
+		if _, err := parsePhases(specs, &Config{Models: []string{"gpt-4o"}}); err == nil {
+			t.Errorf("parsePhases(%q) succeeded, want error", specs)
+		}
+	}
+}
@@ -2,16 +2,30 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bytedance/sonic"
 	"github.com/maximhq/bifrost/core/schemas"
@@ -19,14 +33,94 @@ import (
 )
 
 type OpenAIChatCompletionsResponse struct {
-	ID                string                          `json:"id"`                 // Unique identifier for the completion
-	Object            string                          `json:"object"`             // Type of completion (text.completion or chat.completion)
-	Choices           []schemas.BifrostResponseChoice `json:"choices"`            // Array of completion choices
-	Model             string                          `json:"model"`              // Model used for the completion
-	Created           int                             `json:"created"`            // Unix timestamp of completion creation
-	ServiceTier       *string                         `json:"service_tier"`       // Service tier used for the request
-	SystemFingerprint *string                         `json:"system_fingerprint"` // System fingerprint for the request
-	Usage             schemas.LLMUsage                `json:"usage"`              // Token usage statistics
+	ID                string             `json:"id"`                 // Unique identifier for the completion
+	Object            string             `json:"object"`             // Type of completion (text.completion or chat.completion)
+	Choices           []OpenAIChatChoice `json:"choices"`            // Array of completion choices
+	Model             string             `json:"model"`              // Model used for the completion
+	Created           int                `json:"created"`            // Unix timestamp of completion creation
+	ServiceTier       *string            `json:"service_tier"`       // Service tier used for the request
+	SystemFingerprint *string            `json:"system_fingerprint"` // System fingerprint for the request
+	Usage             ChatUsage          `json:"usage"`              // Token usage statistics
+	Provider          string             `json:"provider,omitempty"` // Upstream provider name (OpenRouter only)
+	QuirkFields                          // Provider-specific extras (-provider-quirks only)
+}
+
+// ChatUsage is chat completion usage plus the non-standard counters some
+// OpenAI-compatible providers add; the extras are only set by -provider-quirks.
+type ChatUsage struct {
+	schemas.LLMUsage
+	QueueTime         *float64 `json:"queue_time,omitempty"`          // Groq, seconds
+	PromptTime        *float64 `json:"prompt_time,omitempty"`         // Groq, seconds
+	CompletionTime    *float64 `json:"completion_time,omitempty"`     // Groq, seconds
+	TotalTime         *float64 `json:"total_time,omitempty"`          // Groq, seconds
+	CitationTokens    *int     `json:"citation_tokens,omitempty"`     // Perplexity
+	NumSearchQueries  *int     `json:"num_search_queries,omitempty"`  // Perplexity
+	SearchContextSize string   `json:"search_context_size,omitempty"` // Perplexity
+	NumSourcesUsed    *int     `json:"num_sources_used,omitempty"`    // xAI
+}
+
+// QuirkFields are the top-level fields providers add to otherwise
+// OpenAI-compatible chat completions and chunks.
+type QuirkFields struct {
+	XGroq            *GroqMetadata            `json:"x_groq,omitempty"`
+	Citations        []string                 `json:"citations,omitempty"`
+	SearchResults    []PerplexitySearchResult `json:"search_results,omitempty"`
+	PromptLogprobs   json.RawMessage          `json:"prompt_logprobs,omitempty"`    // vLLM
+	KVTransferParams json.RawMessage          `json:"kv_transfer_params,omitempty"` // vLLM
+}
+
+// PromptLogProb is one candidate in a vLLM prompt_logprobs entry, keyed by
+// token id.
+type PromptLogProb struct {
+	Logprob      float64 `json:"logprob"`
+	Rank         int     `json:"rank"`
+	DecodedToken string  `json:"decoded_token"`
+}
+
+// GroqMetadata is Groq's x_groq block.
+type GroqMetadata struct {
+	ID string `json:"id"`
+}
+
+// PerplexitySearchResult is one entry of Perplexity's search_results.
+type PerplexitySearchResult struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	Date  string `json:"date,omitempty"`
+}
+
+// OpenAIChatChoice is a chat completion choice. It mirrors
+// schemas.BifrostResponseChoice but serializes log probabilities under
+// OpenAI's "logprobs" key.
+type OpenAIChatChoice struct {
+	Index        int                                  `json:"index"`
+	Message      schemas.BifrostResponseChoiceMessage `json:"message"`
+	LogProbs     *ChatLogProbs                        `json:"logprobs,omitempty"`
+	FinishReason *string                              `json:"finish_reason,omitempty"`
+	StopReason   json.RawMessage                      `json:"stop_reason,omitempty"`  // vLLM: matched stop string/token id, or null
+	MatchedStop  *int                                 `json:"matched_stop,omitempty"` // SGLang: stop token id that ended generation
+}
+
+// ChatLogProbs is the logprobs block of a chat completion choice.
+type ChatLogProbs struct {
+	Content []TokenLogProb `json:"content,omitempty"`
+	Refusal []TokenLogProb `json:"refusal,omitempty"`
+}
+
+// TokenLogProb is the log probability of one output token and, when
+// top_logprobs was requested, of the most likely tokens at that position.
+type TokenLogProb struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogProb `json:"top_logprobs"`
+}
+
+// TopLogProb is one candidate token in top_logprobs.
+type TopLogProb struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
 }
 
 type OpenAIError struct {
@@ -43,8 +137,20 @@ type ErrorField struct {
 
 // GenericRequest represents any incoming request with a model field
 type GenericRequest struct {
-	Model  string `json:"model"`
-	Stream bool   `json:"stream"`
+	Model               string         `json:"model"`
+	Stream              bool           `json:"stream"`
+	StreamOptions       *StreamOptions `json:"stream_options,omitempty"`
+	MaxTokens           *int           `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int           `json:"max_completion_tokens,omitempty"`
+	ReasoningEffort     string         `json:"reasoning_effort,omitempty"`
+	Logprobs            bool           `json:"logprobs,omitempty"`
+	TopLogprobs         int            `json:"top_logprobs,omitempty"`
+	PromptLogprobs      *int           `json:"prompt_logprobs,omitempty"` // vLLM extension
+}
+
+// StreamOptions mirrors OpenAI's stream_options request field.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 // ProviderAliases maps provider aliases to canonical provider IDs.
@@ -93,36 +199,485 @@ func parseProviderAndModel(rawModel string) (provider string, model string) {
 	return "", model
 }
 
-// parseModelFromRequest extracts model and provider from the OpenAI-style request body.
-func parseModelFromRequest(ctx *fasthttp.RequestCtx) (provider string, model string, stream bool) {
+// bigPayloadBytes is the response size -big-payload stands for.
+const bigPayloadBytes = 10 * 1024
+
+// embeddingBytesPerDimension approximates how many bytes one float takes in a
+// JSON-encoded embedding, used to size vectors for -payload-bytes.
+const embeddingBytesPerDimension = 20
+
+// parseByteSize parses a size such as "512", "10KB", or "1MB" (1024-based;
+// a trailing "B" and the K/M-only forms are optional).
+func parseByteSize(spec string) (int, error) {
+	s := strings.ToUpper(strings.TrimSpace(spec))
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "MB"), strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(s, "KB"), strings.HasSuffix(s, "K"):
+		mult = 1024
+	}
+	s = strings.TrimRight(s, "KMB")
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", spec)
+	}
+	return n * mult, nil
+}
+
+// lengthBucket is one entry of -length-distribution: responses are sized to
+// bytes with probability weight/total weight.
+type lengthBucket struct {
+	weight int
+	bytes  int
+}
+
+// parseLengthDistribution parses "weight:size" pairs such as
+// "50:256,40:2KB,10:32KB"; weights are relative and need not sum to 100.
+func parseLengthDistribution(spec string) ([]lengthBucket, error) {
+	var buckets []lengthBucket
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		weightStr, sizeStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be weight:size", entry)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(weightStr))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight in %q", entry)
+		}
+		size, err := parseByteSize(sizeStr)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, lengthBucket{weight: weight, bytes: size})
+	}
+	total := 0
+	for _, b := range buckets {
+		total += b.weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weights must sum to more than 0")
+	}
+	return buckets, nil
+}
+
+// pickLength draws a response size from the configured distribution.
+func pickLength(buckets []lengthBucket) int {
+	total := 0
+	for _, b := range buckets {
+		total += b.weight
+	}
+	n := rand.Intn(total)
+	for _, b := range buckets {
+		if n < b.weight {
+			return b.bytes
+		}
+		n -= b.weight
+	}
+	return buckets[len(buckets)-1].bytes
+}
+
+// responseSize returns the response text size for this request: -payload-bytes,
+// or a size drawn from -length-distribution (0 = the base text as-is).
+func responseSize() int {
+	if len(lengthDistribution) > 0 {
+		return pickLength(lengthDistribution)
+	}
+	return payloadBytes
+}
+
+// mockResponseContent returns base as-is, or repeated and trimmed to
+// -payload-bytes (or a size drawn from -length-distribution) when one is
+// configured.
+func mockResponseContent(base string) string {
+	return mockContentOfSize(base, responseSize())
+}
+
+// templateData is what -response-template templates can reference.
+type templateData struct {
+	Model           string // Requested model as sent, provider prefix included
+	LastUserMessage string // Text of the last user message
+	MessageCount    int    // Number of messages in the conversation
+	Path            string // Request path
+}
+
+// templateMessage is one conversation turn in any of the supported request
+// shapes: OpenAI/Anthropic/Bedrock messages (string or block content) and
+// GenAI contents (parts).
+type templateMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+	Parts   any    `json:"parts"`
+}
+
+// templateRequest decodes the fields of a request body templates can use.
+// Responses API input may be a string or a list of messages.
+type templateRequest struct {
+	Model    string            `json:"model"`
+	Messages []templateMessage `json:"messages"`
+	Contents []templateMessage `json:"contents"`
+	Input    any               `json:"input"`
+	Prompt   any               `json:"prompt"`
+}
+
+// templateFuncs are the helpers available to -response-template templates.
+var templateFuncs = template.FuncMap{
+	"repeat": func(n int, s string) string { return strings.Repeat(s, max(n, 0)) },
+	"upper":  strings.ToUpper,
+	"lower":  strings.ToLower,
+	"words":  func(s string) int { return len(strings.Fields(s)) },
+}
+
+// loadResponseTemplate parses the -response-template file.
+func loadResponseTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Drop the newline editors add at the end of the file.
+	text := strings.TrimRight(string(data), "\r\n")
+	return template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(text)
+}
+
+// messageText flattens message content: a plain string, or the "text" fields
+// of a list of content blocks or parts.
+func messageText(content any) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []any:
+		var texts []string
+		for _, block := range c {
+			if m, ok := block.(map[string]any); ok {
+				if text, ok := m["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return strings.Join(texts, " ")
+	}
+	return ""
+}
+
+// newTemplateData extracts the template fields from the request body.
+func newTemplateData(ctx *fasthttp.RequestCtx) templateData {
+	var req templateRequest
+	_ = sonic.Unmarshal(ctx.Request.Body(), &req)
+	messages := req.Messages
+	if len(messages) == 0 {
+		messages = req.Contents
+	}
+	if len(messages) == 0 {
+		switch input := req.Input.(type) {
+		case string:
+			messages = []templateMessage{{Role: "user", Content: input}}
+		case []any:
+			for _, item := range input {
+				if m, ok := item.(map[string]any); ok {
+					role, _ := m["role"].(string)
+					messages = append(messages, templateMessage{Role: role, Content: m["content"]})
+				}
+			}
+		}
+	}
+	if len(messages) == 0 && req.Prompt != nil {
+		for _, prompt := range completionPrompts(req.Prompt) {
+			messages = append(messages, templateMessage{Role: "user", Content: prompt})
+		}
+	}
+	data := templateData{Model: req.Model, MessageCount: len(messages), Path: string(ctx.Path())}
+	// GenAI and Bedrock name the model in the path instead of the body.
+	if data.Model == "" {
+		if model, isConverse, _ := parseBedrockModelFromPath(data.Path); isConverse {
+			data.Model = model
+		} else if endpointName(data.Path) == "generateContent" {
+			_, data.Model = parseGenAIModelFromPath(data.Path)
+		}
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			data.LastUserMessage = messageText(messages[i].Content)
+			if data.LastUserMessage == "" {
+				data.LastUserMessage = messageText(messages[i].Parts)
+			}
+			break
+		}
+	}
+	return data
+}
+
+// responseBase returns the response text for the request: -response-template
+// rendered against it when one is loaded, base otherwise (or when rendering
+// fails). -payload-bytes/-length-distribution sizing applies on top.
+func responseBase(ctx *fasthttp.RequestCtx, base string) string {
+	if responseTemplate == nil {
+		return base
+	}
+	var sb strings.Builder
+	if err := responseTemplate.Execute(&sb, newTemplateData(ctx)); err != nil {
+		log.Printf("Error rendering -response-template: %v", err)
+		return base
+	}
+	return sb.String()
+}
+
+// contentKey identifies one generated response text in the response pool.
+type contentKey struct {
+	base string
+	size int
+}
+
+// pooledContents caches generated response texts by base and size when
+// -response-pool is on; strings are immutable, so every request can share one.
+// Rendered -response-template texts vary per request and aren't cached.
+var pooledContents sync.Map // contentKey -> string
+
+// mockContentOfSize returns base repeated and trimmed to size bytes (base
+// as-is for size <= 0). The cut backs up to a rune boundary so multi-byte
+// text from a -response-template stays valid UTF-8, which can leave the
+// result up to three bytes short.
+func mockContentOfSize(base string, size int) string {
+	if size <= 0 {
+		return base
+	}
+	pooled := responsePool && responseTemplate == nil
+	if pooled {
+		if content, ok := pooledContents.Load(contentKey{base, size}); ok {
+			return content.(string)
+		}
+	}
+	content := strings.Repeat(base+" ", size/(len(base)+1)+1)
+	end := size
+	for end > 0 && !utf8.RuneStart(content[end]) {
+		end--
+	}
+	content = content[:end]
+	if pooled {
+		pooledContents.Store(contentKey{base, size}, content)
+	}
+	return content
+}
+
+// maxPooledTemplates caps how many pre-rendered chat bodies the response pool
+// keeps, so clients sending arbitrary model names can't grow it without bound.
+const maxPooledTemplates = 1024
+
+// chatTemplateKey identifies one pre-rendered chat completion: everything in
+// the body except the created timestamp and usage depends only on these.
+type chatTemplateKey struct {
+	model  string
+	size   int
+	flavor string
+}
+
+// chatBodyTemplate is a serialized non-streaming chat completion split around
+// its per-request fields: head + created + mid + usage + tail.
+type chatBodyTemplate struct {
+	head, mid, tail []byte
+}
+
+var (
+	chatTemplates     sync.Map // chatTemplateKey -> *chatBodyTemplate
+	chatTemplateCount atomic.Int64
+)
+
+// renderChatTemplate serializes resp once with a zero timestamp and usage and
+// cuts it at those fields. It returns nil if the encoded body doesn't have the
+// expected shape, in which case the caller encodes the response itself.
+func renderChatTemplate(resp OpenAIChatCompletionsResponse) *chatBodyTemplate {
+	resp.Created, resp.Usage = 0, ChatUsage{}
+	body, err := sonic.Marshal(resp)
+	if err != nil {
+		return nil
+	}
+	zeroUsage, err := sonic.Marshal(resp.Usage)
+	if err != nil {
+		return nil
+	}
+	// Structural keys can't occur inside encoded strings, whose quotes are
+	// escaped, so the first match is the field itself.
+	createdField, usageField := []byte(`"created":0`), append([]byte(`"usage":`), zeroUsage...)
+	i := bytes.Index(body, createdField)
+	j := bytes.Index(body, usageField)
+	if i < 0 || j < i {
+		return nil
+	}
+	return &chatBodyTemplate{
+		head: body[:i+len(createdField)-1],
+		mid:  body[i+len(createdField) : j+len(`"usage":`)],
+		tail: append(body[j+len(usageField):], '\n'),
+	}
+}
+
+// pooledChatTemplate returns the pre-rendered body for resp, rendering and
+// caching it on first use; nil means encode resp normally.
+func pooledChatTemplate(resp OpenAIChatCompletionsResponse, size int, flavor string) *chatBodyTemplate {
+	key := chatTemplateKey{model: resp.Model, size: size, flavor: flavor}
+	if tmpl, ok := chatTemplates.Load(key); ok {
+		return tmpl.(*chatBodyTemplate)
+	}
+	tmpl := renderChatTemplate(resp)
+	if tmpl == nil || chatTemplateCount.Load() >= maxPooledTemplates {
+		return tmpl
+	}
+	if _, loaded := chatTemplates.LoadOrStore(key, tmpl); !loaded {
+		chatTemplateCount.Add(1)
+	}
+	return tmpl
+}
+
+// write sends the template with this request's timestamp and usage spliced in.
+func (t *chatBodyTemplate) write(ctx *fasthttp.RequestCtx, created int, usage ChatUsage) error {
+	usageJSON, err := sonic.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	ctx.Write(t.head)
+	var digits [20]byte
+	ctx.Write(strconv.AppendInt(digits[:0], int64(created), 10))
+	ctx.Write(t.mid)
+	ctx.Write(usageJSON)
+	ctx.Write(t.tail)
+	return nil
+}
+
+// parseGenericRequest decodes the OpenAI-style request body; an undecodable
+// body yields the zero request, which maps to the default model.
+func parseGenericRequest(ctx *fasthttp.RequestCtx) GenericRequest {
 	var req GenericRequest
 	if err := sonic.Unmarshal(ctx.Request.Body(), &req); err != nil {
-		return "", "gpt-4o-mini", false
+		return GenericRequest{}
 	}
+	return req
+}
+
+// parseModelFromRequest extracts model and provider from the OpenAI-style request body.
+func parseModelFromRequest(ctx *fasthttp.RequestCtx) (provider string, model string, stream bool) {
+	req := parseGenericRequest(ctx)
 	provider, model = parseProviderAndModel(req.Model)
 	return provider, model, req.Stream
 }
 
+// openRouterRoute describes how OpenRouter would decorate a completion: a
+// generation id, the upstream provider that served it, and the vendor-prefixed
+// model slug echoed back as the response model.
+type openRouterRoute struct {
+	GenerationID string
+	Provider     string
+	Model        string
+}
+
+// openRouterProviderNames maps OpenRouter model vendor prefixes to the provider
+// display names OpenRouter reports in the "provider" field.
+var openRouterProviderNames = map[string]string{
+	"openai":    "OpenAI",
+	"anthropic": "Anthropic",
+	"google":    "Google",
+	"mistralai": "Mistral",
+	"deepseek":  "DeepSeek",
+	"x-ai":      "xAI",
+	"qwen":      "Alibaba",
+	"cohere":    "Cohere",
+}
+
+// resolveOpenRouterRoute reports whether the request is OpenRouter-routed,
+// either because it arrived on OpenRouter's /api/v1/ path prefix or because
+// its model carries an "openrouter/" prefix, and if so how to decorate it.
+func resolveOpenRouterRoute(path, rawModel string) (openRouterRoute, bool) {
+	slug := strings.TrimSpace(rawModel)
+	viaModel := strings.HasPrefix(strings.ToLower(slug), "openrouter/")
+	if !viaModel && !strings.HasPrefix(path, "/api/v1/") {
+		return openRouterRoute{}, false
+	}
+	if viaModel {
+		slug = slug[len("openrouter/"):]
+	}
+	if slug == "" {
+		slug = "openai/gpt-4o-mini"
+	}
+	vendor, _, _ := strings.Cut(slug, "/")
+	name, ok := openRouterProviderNames[strings.ToLower(vendor)]
+	if !ok {
+		name = vendor
+	}
+	return openRouterRoute{
+		GenerationID: fmt.Sprintf("gen-%d-%s", time.Now().Unix(), randomAlphanumeric(20)),
+		Provider:     name,
+		Model:        slug,
+	}, true
+}
+
+// azureAIInferencePaths are the Azure AI Inference (Azure AI Foundry models
+// endpoint) routes. They share the OpenAI request and response bodies but
+// require ?api-version= and echo Azure's request-tracking headers.
+var azureAIInferencePaths = map[string]string{
+	"/models/chat/completions": "chat/completions",
+	"/models/embeddings":       "embeddings",
+	"/models/info":             "models",
+	"/info":                    "models",
+}
+
+// checkAzureAIInference applies Azure AI Inference route handling to the
+// request: a missing api-version gets Azure's 400 (reported as false), and
+// successful requests get apim-request-id and their x-ms-client-request-id
+// echoed back. Other routes pass through untouched.
+func checkAzureAIInference(ctx *fasthttp.RequestCtx) bool {
+	if _, ok := azureAIInferencePaths[string(ctx.Path())]; !ok {
+		return true
+	}
+	if len(ctx.QueryArgs().Peek("api-version")) == 0 {
+		sendProviderErrorVariant(ctx, "azure", providerErrorVariant{Status: fasthttp.StatusBadRequest, Body: map[string]interface{}{"error": map[string]interface{}{
+			"code":    "MissingApiVersionParameter",
+			"message": "The api-version query parameter (?api-version=) is required for all requests.",
+		}}})
+		return false
+	}
+	ctx.Response.Header.Set("apim-request-id", mockUUID())
+	if id := ctx.Request.Header.Peek("x-ms-client-request-id"); len(id) > 0 {
+		ctx.Response.Header.SetBytesV("x-ms-client-request-id", id)
+	}
+	return true
+}
+
+// randomAlphanumeric returns n random characters from [A-Za-z0-9].
+func randomAlphanumeric(n int) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
 // ChatStreamResponseChoiceDelta represents partial message information in streaming
 type ChatStreamResponseChoiceDelta struct {
 	Role    *string `json:"role,omitempty"`
 	Content *string `json:"content,omitempty"`
+	Refusal *string `json:"refusal,omitempty"`
 }
 
 // ChatStreamResponseChoice represents a choice in the stream response
 type ChatStreamResponseChoice struct {
 	Index        int                            `json:"index"`
 	Delta        *ChatStreamResponseChoiceDelta `json:"delta,omitempty"`
+	LogProbs     *ChatLogProbs                  `json:"logprobs,omitempty"`
 	FinishReason *string                        `json:"finish_reason"`
 }
 
 // ChatCompletionStreamResponse represents a chunk in the streaming response
 type ChatCompletionStreamResponse struct {
-	ID      string                     `json:"id"`
-	Object  string                     `json:"object"`
-	Created int                        `json:"created"`
-	Model   string                     `json:"model"`
-	Choices []ChatStreamResponseChoice `json:"choices"`
+	ID       string                     `json:"id"`
+	Provider string                     `json:"provider,omitempty"`
+	Object   string                     `json:"object"`
+	Created  int                        `json:"created"`
+	Model    string                     `json:"model"`
+	Choices  []ChatStreamResponseChoice `json:"choices"`
+	Usage    *schemas.LLMUsage          `json:"usage,omitempty"`
+	QuirkFields
 }
 
 type AnthropicStreamMessage struct {
@@ -172,6 +727,67 @@ type OpenAIResponsesResponse struct {
 	Usage   schemas.LLMUsage            `json:"usage"`
 }
 
+// Legacy OpenAI text completions (/v1/completions) structures
+type OpenAICompletionsRequest struct {
+	Model         string         `json:"model"`
+	Prompt        any            `json:"prompt"` // string, []string, or token ids
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Echo          bool           `json:"echo,omitempty"`
+}
+
+type OpenAICompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"` // always null
+	FinishReason *string `json:"finish_reason"`
+}
+
+type OpenAICompletionsResponse struct {
+	ID                string                   `json:"id"`
+	Object            string                   `json:"object"` // "text_completion"
+	Created           int                      `json:"created"`
+	Model             string                   `json:"model"`
+	SystemFingerprint *string                  `json:"system_fingerprint,omitempty"`
+	Choices           []OpenAICompletionChoice `json:"choices"`
+	Usage             *schemas.LLMUsage        `json:"usage,omitempty"` // null on stream chunks
+}
+
+// completionPrompts returns the prompts of a text completion request. A list
+// of strings is a batch that gets one choice per prompt; a string or a list of
+// token ids is a single prompt.
+func completionPrompts(prompt any) []string {
+	switch p := prompt.(type) {
+	case string:
+		return []string{p}
+	case []any:
+		prompts := make([]string, 0, len(p))
+		for _, item := range p {
+			s, ok := item.(string)
+			if !ok {
+				return []string{""}
+			}
+			prompts = append(prompts, s)
+		}
+		if len(prompts) > 0 {
+			return prompts
+		}
+	}
+	return []string{""}
+}
+
+// embeddingInputCount returns how many vectors an embeddings request asks
+// for: one per item of a list of strings or of token-id lists, and one for a
+// string or a single list of token ids.
+func embeddingInputCount(input any) int {
+	if list, ok := input.([]any); ok && len(list) > 0 {
+		if _, tokenIDs := list[0].(float64); !tokenIDs {
+			return len(list)
+		}
+	}
+	return 1
+}
+
 // OpenAI List Models API structures
 type OpenAIModel struct {
 	ID      string `json:"id"`
@@ -285,18 +901,46 @@ type BedrockConverseResponse struct {
 var (
 	host               string
 	port               int
+	portsSpec          string
+	listenPorts        []int
+	portProfilesPath   string
+	unixSocket         string
+	listenSpec         string
+	corsOrigins        string
+	corsHeaders        string
 	latency            int
 	jitter             int
 	latencyAuthKeys    string
+	keyProfilesPath    string
 	tokensPerChunk     int
 	fixedInputTokens   int
 	fixedOutputTokens  int
 	bigPayload         bool
+	payloadBytesSpec   string
+	payloadBytes       int
+	lengthDistSpec     string
+	lengthDistribution []lengthBucket
+	responsePool       bool
+	templatePath       string
+	responseTemplate   *template.Template
+	providerQuirks     bool
+	quirkAbortPercent  int
 	auth               string
+	authScheme         string
+	apiFlavor          string
 	withErrors         bool
 	failurePercent     int
 	failureJitter      int
 	failureAuthKeys    string
+	failureMode        string
+	refusalPercent     int
+	cacheHitPercent    int
+	cachedTokenPercent int
+	reasoningBudget    int
+	reasoningTPS       int
+	reasoningModels    string
+	logprobsDepth      int
+	refusalMode        string
 	tpm                int
 	tpmDuration        int
 	tpmAuthKeys        string
@@ -306,6 +950,17 @@ var (
 	rateLimitedKeyMap  map[string]bool
 	startTime          time.Time
 	tpmTriggeredLogged bool
+	shutdownTimeout    int
+	latencyReportPath  string
+	readTimeout        int
+	writeTimeout       int
+	idleTimeout        int
+	maxConnRequests    int
+	maxInflight        int
+	rateLimitRequests  int
+	rateLimitTokens    int
+	quotaTokens        int
+	quotaKeys          string
 
 	// Dynamic per-key latency behaviors:
 	// spikes = sparse latency outliers, ramp = gradual base drift, step = abrupt base change.
@@ -315,6 +970,14 @@ var (
 	spikeMap         = map[string]spikeSpec{}
 	rampMap          = map[string]int{}
 	stepMap          = map[string]stepSpec{}
+
+	// Sticky degraded mode: a fixed share of connections or keys is always slow.
+	degradedPercent int
+	degradedBy      string
+	degradedLatency int
+
+	// headerDelay holds back response headers, separately from body latency.
+	headerDelay int
 )
 
 // spikeSpec injects a latency outlier into pct% of requests by multiplying the
@@ -332,6 +995,36 @@ type stepSpec struct {
 	toMs  int
 }
 
+// isDegraded reports whether the request's connection (or API key, with
+// -degraded-by key) falls in the -degraded-percent share. Membership is a hash
+// of the identity rather than a dice roll, so a degraded connection stays
+// degraded for its whole lifetime — like a gateway pinned to a bad upstream AZ.
+func isDegraded(ctx *fasthttp.RequestCtx) bool {
+	if degradedPercent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	if degradedBy == "key" {
+		_, _ = h.Write([]byte(strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")))
+	} else {
+		var id [8]byte
+		binary.LittleEndian.PutUint64(id[:], ctx.ConnID())
+		_, _ = h.Write(id[:])
+	}
+	return int(h.Sum32()%100) < degradedPercent
+}
+
+// degradedDelay returns the extra latency owed by a degraded request, marking
+// the response with x-mock-degraded so clients can tell which requests hit it.
+func degradedDelay(ctx *fasthttp.RequestCtx) time.Duration {
+	if !isDegraded(ctx) {
+		return 0
+	}
+	served.inject("degraded")
+	ctx.Response.Header.Set("x-mock-degraded", "true")
+	return time.Duration(degradedLatency) * time.Millisecond
+}
+
 // parseKVInt parses a "key=a:b" CSV into per-token (a,b) ints (b optional).
 func parseKVList(csv string, fn func(token string, a int, b string)) {
 	if csv == "" {
@@ -356,18 +1049,42 @@ func parseKVList(csv string, fn func(token string, a int, b string)) {
 func init() {
 	flag.StringVar(&host, "host", getEnvString("MOCKER_HOST", "localhost"), "Host address to bind the mock server")
 	flag.IntVar(&port, "port", getEnvInt("MOCKER_PORT", 8000), "Port for the mock server to listen on")
+	flag.StringVar(&portsSpec, "ports", getEnvString("MOCKER_PORTS", ""), "Comma-separated ports to listen on at once, e.g. '8000,8001,8002'; each acts as a separate upstream and overrides -port (empty = -port only)")
+	flag.StringVar(&listenSpec, "listen", getEnvString("MOCKER_LISTEN", ""), "Comma-separated addresses to serve on, replacing -host/-port/-ports: host:port, [ipv6]:port, or unix:/path (e.g. '[::1]:8000,unix:/tmp/mocker.sock')")
+	flag.StringVar(&unixSocket, "unix-socket", getEnvString("MOCKER_UNIX_SOCKET", ""), "Path of a Unix domain socket to serve on in addition to the other addresses; shorthand for a unix:/path entry in -listen (empty = none)")
+	flag.StringVar(&portProfilesPath, "port-profiles", getEnvString("MOCKER_PORT_PROFILES", ""), "Path to a JSON file mapping -ports entries to latency/failure profiles (same schema as -key-profiles, plus api_flavor to override -api-flavor per port); -key-profiles still wins for profiled keys")
+	flag.StringVar(&corsOrigins, "cors-origins", getEnvString("MOCKER_CORS_ORIGINS", ""), "Comma-separated browser origins allowed to call the mocker via CORS, or '*' for any; OPTIONS preflights are answered with 204 (empty = CORS disabled)")
+	flag.StringVar(&corsHeaders, "cors-headers", getEnvString("MOCKER_CORS_HEADERS", ""), "Access-Control-Allow-Headers sent on preflights, e.g. 'Authorization,Content-Type,x-api-key' (empty = echo the headers the browser asks for)")
 	flag.IntVar(&latency, "latency", getEnvInt("MOCKER_LATENCY", 0), "Latency in milliseconds to simulate")
 	flag.IntVar(&jitter, "jitter", getEnvInt("MOCKER_JITTER", 0), "Maximum jitter in milliseconds to add to latency (±jitter)")
+	flag.StringVar(&keyProfilesPath, "key-profiles", getEnvString("MOCKER_KEY_PROFILES", ""), "Path to a JSON file mapping Authorization keys to latency/failure profiles; profiled keys ignore -latency-auth-keys/-failure-auth-keys and the globals")
 	flag.StringVar(&latencyAuthKeys, "latency-auth-keys", getEnvString("MOCKER_LATENCY_AUTH_KEYS", ""), "Comma-separated Authorization header values that get latency; entries may override the global config per key as key=latencyMs, key=latencyMs:jitterMs, or a percentile distribution key=p50:p90:p95:p99; other keys respond instantly (empty = all requests)")
 	flag.IntVar(&tokensPerChunk, "tokens-per-chunk", getEnvInt("MOCKER_TOKENS_PER_CHUNK", 5), "Words batched into each SSE delta when streaming (must be >=1)")
 	flag.IntVar(&fixedInputTokens, "input-tokens", getEnvInt("MOCKER_INPUT_TOKENS", -1), "Fixed input/prompt token count to report in usage (negative = random/derived per request)")
 	flag.IntVar(&fixedOutputTokens, "output-tokens", getEnvInt("MOCKER_OUTPUT_TOKENS", -1), "Fixed output/completion token count to report in usage (negative = random/derived per request)")
-	flag.BoolVar(&bigPayload, "big-payload", getEnvBool("MOCKER_BIG_PAYLOAD", false), "Use big payload")
+	flag.StringVar(&payloadBytesSpec, "payload-bytes", getEnvString("MOCKER_PAYLOAD_BYTES", ""), "Target size of generated response text, in bytes or with a KB/MB suffix (e.g. 1KB, 100KB, 1MB); embeddings scale their dimensions to match (empty = small default response)")
+	flag.StringVar(&lengthDistSpec, "length-distribution", getEnvString("MOCKER_LENGTH_DISTRIBUTION", ""), "Weighted response text sizes as weight:size pairs (e.g. '50:256,40:2KB,10:32KB'); each response draws one. Mutually exclusive with -payload-bytes/-big-payload (empty = fixed size)")
+	flag.StringVar(&templatePath, "response-template", getEnvString("MOCKER_RESPONSE_TEMPLATE", ""), "Path to a Go text/template file rendered as the response text of every text endpoint, with .Model, .LastUserMessage, .MessageCount and .Path from the request (empty = fixed mock sentence)")
+	flag.BoolVar(&responsePool, "response-pool", getEnvBool("MOCKER_RESPONSE_POOL", true), "Reuse pre-rendered response text and chat completion bodies per model and size instead of building and encoding them on every request (false = encode every response)")
+	flag.BoolVar(&providerQuirks, "provider-quirks", getEnvBool("MOCKER_PROVIDER_QUIRKS", false), "Add provider-specific chat completion extras selected by model prefix: groq/ (x_groq, x-groq-* headers, queue/prompt/completion times), perplexity/ or sonar* (citations, search_results), xai/ or grok-* (system_fingerprint, num_sources_used), vllm/ (stop_reason, prompt_logprobs, kv_transfer_params), sgl/ or sglang/ (matched_stop)")
+	flag.IntVar(&quirkAbortPercent, "quirk-abort-percent", getEnvInt("MOCKER_QUIRK_ABORT_PERCENT", 0), "Percentage of vllm/ and sgl/ chat completions (0-100) that finish with the non-standard finish_reason 'abort' under -provider-quirks")
+	flag.BoolVar(&bigPayload, "big-payload", getEnvBool("MOCKER_BIG_PAYLOAD", false), "Alias of -payload-bytes 10KB (embeddings use 4096 dimensions)")
 	flag.StringVar(&auth, "auth", getEnvString("MOCKER_AUTH", ""), "Add authentication header key")
+	flag.StringVar(&authScheme, "auth-scheme", getEnvString("MOCKER_AUTH_SCHEME", "authorization"), "How -auth is checked: 'authorization' (exact Authorization header on every path) or 'provider' (each path's native scheme: Bearer/api-key, x-api-key, x-goog-api-key or ?key=, SigV4)")
+	flag.StringVar(&apiFlavor, "api-flavor", getEnvString("MOCKER_API_FLAVOR", "compat"), "OpenAI chat completions API version to emulate: 'compat' (accept max_tokens and max_completion_tokens), 'legacy' (pre-o1: reject max_completion_tokens) or 'current' (reject max_tokens, add service_tier, system_fingerprint and usage details); -port-profiles api_flavor overrides it per port")
 	flag.BoolVar(&withErrors, "with-errors", getEnvBool("MOCKER_WITH_ERRORS", false), "Enable provider-specific random error responses")
 	flag.BoolVar(&withErrors, "witherrors", getEnvBool("MOCKER_WITH_ERRORS", false), "Alias of -with-errors")
 	flag.IntVar(&failurePercent, "failure-percent", getEnvInt("MOCKER_FAILURE_PERCENT", 0), "Base failure percentage (0-100)")
 	flag.IntVar(&failureJitter, "failure-jitter", getEnvInt("MOCKER_FAILURE_JITTER", 0), "Maximum jitter in percentage points to add to failure rate (±failure-jitter)")
+	flag.StringVar(&failureMode, "failure-mode", getEnvString("MOCKER_FAILURE_MODE", "error"), "Response sent for -failure-percent failures: 'error' (OpenAI-style 500) or 'overload' (provider-accurate overload: OpenAI 503, Anthropic 529, Bedrock ThrottlingException, Gemini RESOURCE_EXHAUSTED)")
+	flag.IntVar(&cacheHitPercent, "cache-hit-percent", getEnvInt("MOCKER_CACHE_HIT_PERCENT", 0), "Percentage of chat completions (0-100) reported as prompt-cache hits via usage.prompt_tokens_details.cached_tokens")
+	flag.IntVar(&cachedTokenPercent, "cached-token-percent", getEnvInt("MOCKER_CACHED_TOKEN_PERCENT", 50), "Share of prompt tokens (0-100) reported as cached on a prompt-cache hit")
+	flag.IntVar(&reasoningBudget, "reasoning-budget", getEnvInt("MOCKER_REASONING_BUDGET", 0), "Reasoning tokens per chat completion for reasoning models, sampled between half and all of the budget and scaled by reasoning_effort (0 = disabled)")
+	flag.IntVar(&reasoningTPS, "reasoning-tps", getEnvInt("MOCKER_REASONING_TPS", 200), "Reasoning tokens per second; each reasoning token adds 1/reasoning-tps seconds of latency before the answer")
+	flag.StringVar(&reasoningModels, "reasoning-models", getEnvString("MOCKER_REASONING_MODELS", "o1,o3,o4,gpt-5"), "Comma-separated model name prefixes treated as reasoning models by -reasoning-budget")
+	flag.IntVar(&logprobsDepth, "logprobs-depth", getEnvInt("MOCKER_LOGPROBS_DEPTH", -1), "top_logprobs alternatives returned per token when a request asks for logprobs, overriding the request's top_logprobs (-1 = honor the request)")
+	flag.IntVar(&refusalPercent, "refusal-percent", getEnvInt("MOCKER_REFUSAL_PERCENT", 0), "Percentage of chat completions (0-100) answered with a policy response instead of content")
+	flag.StringVar(&refusalMode, "refusal-mode", getEnvString("MOCKER_REFUSAL_MODE", "refusal"), "Policy response sent for -refusal-percent: 'refusal' (200 with empty content and a refusal field) or 'content_filter' (Azure-style 400 content_filter error)")
 	flag.StringVar(&failureAuthKeys, "failure-auth-keys", getEnvString("MOCKER_FAILURE_AUTH_KEYS", ""), "Comma-separated Authorization header values subject to the failure percentage; entries may override the global config per key as key=percent or key=percent:jitter; other keys always succeed (empty = all requests)")
 	flag.IntVar(&tpm, "tpm", getEnvInt("MOCKER_TPM", 0), "Seconds after which to trigger TPM (429) scenarios (0 = disabled)")
 	flag.IntVar(&tpmDuration, "tpm-duration", getEnvInt("MOCKER_TPM_DURATION", 0), "Duration in seconds for TPM window, i.e. tpm to tpm+tpm-duration (0 = until server stop)")
@@ -378,6 +1095,21 @@ func init() {
 	flag.StringVar(&latencySpikeKeys, "latency-spike-keys", getEnvString("MOCKER_LATENCY_SPIKE_KEYS", ""), "Per-key sparse latency spikes as key=pct:mult (e.g. 'slow-key=10:5' → 10% of requests get 5x latency). Tests outlier rejection.")
 	flag.StringVar(&latencyRampKeys, "latency-ramp-keys", getEnvString("MOCKER_LATENCY_RAMP_KEYS", ""), "Per-key linear base-latency drift in ms added per minute elapsed (e.g. 'slow-key=2000'). Tests gradual-drift tracking.")
 	flag.StringVar(&latencyStepKeys, "latency-step-keys", getEnvString("MOCKER_LATENCY_STEP_KEYS", ""), "Per-key abrupt base-latency step as key=atSec:toMs (e.g. 'slow-key=30:8000' → at 30s base jumps to 8000ms). Tests abrupt-change handling.")
+	flag.IntVar(&degradedPercent, "degraded-percent", getEnvInt("MOCKER_DEGRADED_PERCENT", 0), "Percentage of distinct connections (or keys, see -degraded-by) that consistently get -degraded-latency on top of their normal latency, simulating a bad upstream AZ (0 = disabled)")
+	flag.StringVar(&degradedBy, "degraded-by", getEnvString("MOCKER_DEGRADED_BY", "conn"), "What -degraded-percent selects: conn (client connections) or key (API keys)")
+	flag.IntVar(&degradedLatency, "degraded-latency", getEnvInt("MOCKER_DEGRADED_LATENCY", 1000), "Extra latency in ms for requests on degraded connections or keys")
+	flag.IntVar(&headerDelay, "header-delay", getEnvInt("MOCKER_HEADER_DELAY", 0), "Delay in ms before response headers are sent; -latency then applies to the body, so time-to-headers and total latency can be set independently (0 = disabled)")
+	flag.IntVar(&rateLimitRequests, "ratelimit-requests", getEnvInt("MOCKER_RATELIMIT_REQUESTS", 0), "Per-key requests-per-minute budget reported via x-ratelimit-*-requests headers; exhausted keys get 429 (0 = disabled)")
+	flag.IntVar(&quotaTokens, "quota-tokens", getEnvInt("MOCKER_QUOTA_TOKENS", 0), "Cumulative per-key token budget for the server's lifetime; exhausted keys get 429 insufficient_quota (0 = unlimited)")
+	flag.StringVar(&quotaKeys, "quota-keys", getEnvString("MOCKER_QUOTA_KEYS", ""), "Per-key cumulative token budgets as key=tokens, overriding -quota-tokens for those keys (e.g. 'key-a=50000,key-b=200000')")
+	flag.IntVar(&rateLimitTokens, "ratelimit-tokens", getEnvInt("MOCKER_RATELIMIT_TOKENS", 0), "Per-key tokens-per-minute budget reported via x-ratelimit-*-tokens headers; exhausted keys get 429 (0 = disabled)")
+	flag.IntVar(&maxInflight, "max-inflight", getEnvInt("MOCKER_MAX_INFLIGHT", 0), "Maximum requests served concurrently; beyond this the mocker returns 503 overloaded (0 = unlimited)")
+	flag.IntVar(&readTimeout, "read-timeout", getEnvInt("MOCKER_READ_TIMEOUT", 300), "Seconds allowed to read a full request, including the body (0 = unlimited)")
+	flag.IntVar(&writeTimeout, "write-timeout", getEnvInt("MOCKER_WRITE_TIMEOUT", 300), "Seconds allowed to write a full response, including streams (0 = unlimited)")
+	flag.IntVar(&idleTimeout, "idle-timeout", getEnvInt("MOCKER_IDLE_TIMEOUT", 60), "Seconds a keep-alive connection may sit idle between requests before the server closes it (0 = use -read-timeout)")
+	flag.IntVar(&maxConnRequests, "max-keepalive-requests", getEnvInt("MOCKER_MAX_KEEPALIVE_REQUESTS", 0), "Requests served on one connection before the server closes it (0 = unlimited, 1 = no keep-alive)")
+	flag.IntVar(&shutdownTimeout, "shutdown-timeout", getEnvInt("MOCKER_SHUTDOWN_TIMEOUT", 30), "Seconds to wait for in-flight responses to finish after SIGINT/SIGTERM before exiting")
+	flag.StringVar(&latencyReportPath, "latency-report", getEnvString("MOCKER_LATENCY_REPORT", ""), "Path to write the served-latency histogram to as JSON on shutdown (empty = only print it)")
 }
 
 // Helper functions to read environment variables with defaults
@@ -592,13 +1324,280 @@ func parseLatencyEntry(entry string) (key string, spec latencySpec, hasSpec bool
 	}
 }
 
+// keyProfile is one entry of the -key-profiles file. Latency is either
+// latency_ms (+ jitter_ms) or latency_percentiles [p50, p90, p95, p99]; omitted
+// latency or failure settings fall back to the flag-based configuration.
+// api_flavor is only honored in -port-profiles, where it overrides -api-flavor.
+type keyProfile struct {
+	LatencyMs          *int   `json:"latency_ms"`
+	JitterMs           int    `json:"jitter_ms"`
+	LatencyPercentiles []int  `json:"latency_percentiles"`
+	FailurePercent     *int   `json:"failure_percent"`
+	FailureJitter      int    `json:"failure_jitter"`
+	APIFlavor          string `json:"api_flavor"`
+}
+
+// resolvedProfile is a keyProfile compiled into the specs the request path
+// uses; a nil spec or empty flavor means "not set by the profile".
+type resolvedProfile struct {
+	latency *latencySpec
+	failure *failureSpec
+	flavor  string
+}
+
+// keyProfiles holds the compiled -key-profiles file, keyed by raw token.
+var keyProfiles map[string]resolvedProfile
+
+// portProfiles holds the compiled -port-profiles file, keyed by listener port.
+var portProfiles map[int]resolvedProfile
+
+// loadPortProfiles reads a -port-profiles file, which uses the -key-profiles
+// schema with ports in place of tokens: {"8001": {"latency_ms": 500}, ...}.
+func loadPortProfiles(path string, ports []int) (map[int]resolvedProfile, error) {
+	byName, err := loadKeyProfiles(path)
+	if err != nil {
+		return nil, err
+	}
+	listening := make(map[int]bool, len(ports))
+	for _, p := range ports {
+		listening[p] = true
+	}
+	profiles := make(map[int]resolvedProfile, len(byName))
+	for name, rp := range byName {
+		p, err := strconv.Atoi(name)
+		if err != nil || !listening[p] {
+			return nil, fmt.Errorf("%q is not one of the ports being listened on", name)
+		}
+		profiles[p] = rp
+	}
+	return profiles, nil
+}
+
+// parsePorts parses the -ports list.
+func parsePorts(spec string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		p, err := strconv.Atoi(entry)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q", entry)
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("port %d listed twice", p)
+		}
+		seen[p] = true
+		ports = append(ports, p)
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports in %q", spec)
+	}
+	return ports, nil
+}
+
+// listenAddr is one address the mocker serves on: a TCP host:port or a Unix
+// domain socket path.
+type listenAddr struct {
+	network string // "tcp4", "tcp" (IPv6 literals) or "unix"
+	address string
+	port    int // TCP only
+}
+
+func (a listenAddr) String() string {
+	if a.network == "unix" {
+		return "unix:" + a.address
+	}
+	return a.address
+}
+
+// tcpListenAddr returns the listener for host and port. Hostnames and IPv4
+// addresses bind IPv4 only, as fasthttp does by default; IPv6 literals bind
+// IPv6, and "::" accepts both families where the OS allows it.
+func tcpListenAddr(host string, port int) listenAddr {
+	network := "tcp4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "tcp"
+	}
+	return listenAddr{network: network, address: net.JoinHostPort(host, strconv.Itoa(port)), port: port}
+}
+
+// parseListenAddrs parses the -listen list: host:port, [ipv6]:port, or
+// unix:/path entries.
+func parseListenAddrs(spec string) ([]listenAddr, error) {
+	var addrs []listenAddr
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var a listenAddr
+		if path, ok := strings.CutPrefix(entry, "unix:"); ok {
+			if path == "" {
+				return nil, fmt.Errorf("%q has no socket path", entry)
+			}
+			a = listenAddr{network: "unix", address: path}
+		} else {
+			host, portStr, err := net.SplitHostPort(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %v", entry, err)
+			}
+			p, err := strconv.Atoi(portStr)
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid port in %q", entry)
+			}
+			a = tcpListenAddr(host, p)
+		}
+		if seen[a.String()] {
+			return nil, fmt.Errorf("%s listed twice", a)
+		}
+		seen[a.String()] = true
+		addrs = append(addrs, a)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses in %q", spec)
+	}
+	return addrs, nil
+}
+
+// listen binds a. An existing socket file at a Unix path, such as one left by
+// a previous run, is removed first, and closing the listener on shutdown
+// removes it again. Any other file at the path is an error rather than being
+// deleted.
+func (a listenAddr) listen() (net.Listener, error) {
+	if a.network != "unix" {
+		return net.Listen(a.network, a.address)
+	}
+	if fi, err := os.Lstat(a.address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", a.address)
+		}
+		if err := os.Remove(a.address); err != nil {
+			return nil, fmt.Errorf("cannot remove stale socket %s: %w", a.address, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", a.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(a.address, 0666); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// localPort returns the TCP port a request arrived on, and 0 for a Unix
+// socket.
+func localPort(ctx *fasthttp.RequestCtx) int {
+	if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// listenerPort returns the local port a request arrived on when the mocker
+// listens on several ports, and 0 otherwise, so /stats only breaks requests
+// down by port when there is more than one.
+func listenerPort(ctx *fasthttp.RequestCtx) int {
+	if len(listenPorts) < 2 {
+		return 0
+	}
+	return localPort(ctx)
+}
+
+// listenerProfile returns the -port-profiles entry for the port ctx arrived
+// on, for the parts of the profile not already set by the key's -key-profiles
+// entry (which takes precedence).
+func listenerProfile(ctx *fasthttp.RequestCtx) resolvedProfile {
+	if len(portProfiles) == 0 {
+		return resolvedProfile{}
+	}
+	rp := portProfiles[localPort(ctx)]
+	kp := keyProfiles[strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")]
+	if kp.latency != nil {
+		rp.latency = nil
+	}
+	if kp.failure != nil {
+		rp.failure = nil
+	}
+	return rp
+}
+
+// requestAPIFlavor returns the -api-flavor to emulate for ctx: the api_flavor
+// of the -port-profiles entry for the port it arrived on, or the flag.
+func requestAPIFlavor(ctx *fasthttp.RequestCtx) string {
+	if f := portProfiles[localPort(ctx)].flavor; f != "" {
+		return f
+	}
+	return apiFlavor
+}
+
+// validAPIFlavor reports whether f is an -api-flavor value.
+func validAPIFlavor(f string) bool {
+	return f == "compat" || f == "legacy" || f == "current"
+}
+
+// loadKeyProfiles reads and validates a -key-profiles JSON file of the form
+// {"<token>": {"latency_ms": 50, "jitter_ms": 10, "failure_percent": 1}, ...}.
+func loadKeyProfiles(path string) (map[string]resolvedProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]keyProfile
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	profiles := make(map[string]resolvedProfile, len(raw))
+	for key, p := range raw {
+		var rp resolvedProfile
+		switch {
+		case p.LatencyMs != nil && p.LatencyPercentiles != nil:
+			return nil, fmt.Errorf("key %q: latency_ms and latency_percentiles are mutually exclusive", key)
+		case p.LatencyPercentiles != nil:
+			q := p.LatencyPercentiles
+			if len(q) != 4 || q[0] < 0 || q[0] > q[1] || q[1] > q[2] || q[2] > q[3] {
+				return nil, fmt.Errorf("key %q: latency_percentiles must be 4 ascending values [p50, p90, p95, p99]", key)
+			}
+			rp.latency = &latencySpec{latencyMs: q[0], pctl: &percentileSpec{p50: q[0], p90: q[1], p95: q[2], p99: q[3]}}
+		case p.LatencyMs != nil:
+			if *p.LatencyMs < 0 || p.JitterMs < 0 {
+				return nil, fmt.Errorf("key %q: latency_ms and jitter_ms must be >= 0", key)
+			}
+			rp.latency = &latencySpec{latencyMs: *p.LatencyMs, jitterMs: p.JitterMs}
+		}
+		if p.FailurePercent != nil {
+			if *p.FailurePercent < 0 || *p.FailurePercent > 100 || p.FailureJitter < 0 {
+				return nil, fmt.Errorf("key %q: failure_percent must be 0-100 and failure_jitter >= 0", key)
+			}
+			rp.failure = &failureSpec{percent: *p.FailurePercent, jitter: p.FailureJitter}
+		}
+		if p.APIFlavor != "" && !validAPIFlavor(p.APIFlavor) {
+			return nil, fmt.Errorf("key %q: api_flavor must be 'compat', 'legacy' or 'current'", key)
+		}
+		rp.flavor = p.APIFlavor
+		profiles[strings.TrimPrefix(key, "Bearer ")] = rp
+	}
+	return profiles, nil
+}
+
 // resolveLatencySpec returns the latency/jitter configuration for the request's
 // Authorization header and whether the request is subject to latency at all.
 // An empty key list matches every request with the global -latency/-jitter.
 // Listed keys may be bare ("key-A", globals apply) or carry a per-key override
 // ("key-A=200" or "key-A=200:50"); non-listed keys get no latency. The
 // "Bearer " prefix is stripped before comparison, same as authKeyMatches.
+// A -key-profiles latency setting for the token takes precedence over all of it.
 func resolveLatencySpec(keysCSV string, authHeader string) (latencySpec, bool) {
+	if p, ok := keyProfiles[strings.TrimPrefix(authHeader, "Bearer ")]; ok && p.latency != nil {
+		return *p.latency, true
+	}
 	if keysCSV == "" {
 		return latencySpec{latencyMs: latency, jitterMs: jitter}, true
 	}
@@ -616,18 +1615,35 @@ func resolveLatencySpec(keysCSV string, authHeader string) (latencySpec, bool) {
 	return latencySpec{}, false
 }
 
-// simulateLatency handles latency simulation with optional jitter. When
-// -latency-auth-keys is set, only requests carrying one of those keys sleep
-// (each for its per-key override when given, otherwise the global config);
-// everything else responds instantly.
-func simulateLatency(authHeader string) {
-	spec, ok := resolveLatencySpec(latencyAuthKeys, authHeader)
-	if !ok {
+// requestLatency draws the latency for one non-streaming request. When
+// -latency-auth-keys is set, only requests carrying one of those keys get any
+// (each its per-key override when given, otherwise the global config); the
+// -port-profiles latency of the port the request arrived on wins over both,
+// and -degraded-percent adds on top. Dynamic per-key behaviors are included.
+func requestLatency(ctx *fasthttp.RequestCtx) time.Duration {
+	d := degradedDelay(ctx)
+	authHeader := string(ctx.Request.Header.Peek("Authorization"))
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if lp := listenerProfile(ctx); lp.latency != nil {
+		return d + time.Duration(computeLatencyMs(token, *lp.latency))*time.Millisecond
+	}
+	if spec, ok := resolveLatencySpec(latencyAuthKeys, authHeader); ok {
+		d += time.Duration(computeLatencyMs(token, spec)) * time.Millisecond
+	}
+	return d
+}
+
+// simulateRequestLatency sleeps for the request's latency. With -header-delay
+// the latency is owed by the body instead, so it is recorded for
+// delayBodyAfterHeaders rather than slept here.
+func simulateRequestLatency(ctx *fasthttp.RequestCtx) {
+	d := requestLatency(ctx)
+	if headerDelay > 0 {
+		ctx.SetUserValue(bodyDelayKey, d)
 		return
 	}
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	if actual := computeLatencyMs(token, spec); actual > 0 {
-		time.Sleep(time.Duration(actual) * time.Millisecond)
+	if d > 0 {
+		time.Sleep(d)
 	}
 }
 
@@ -683,8 +1699,12 @@ func parseFailureEntry(entry string) (key string, spec failureSpec, hasSpec bool
 // -failure-percent/-failure-jitter. Listed keys may be bare ("key-A", globals
 // apply) or carry a per-key override ("key-A=10" or "key-A=10:5"); non-listed
 // keys always succeed. The "Bearer " prefix is stripped before comparison, same
-// as authKeyMatches.
+// as authKeyMatches. A -key-profiles failure setting for the token takes
+// precedence over all of it.
 func resolveFailureSpec(keysCSV string, authHeader string) (failureSpec, bool) {
+	if p, ok := keyProfiles[strings.TrimPrefix(authHeader, "Bearer ")]; ok && p.failure != nil {
+		return *p.failure, true
+	}
 	if keysCSV == "" {
 		return failureSpec{percent: failurePercent, jitter: failureJitter}, true
 	}
@@ -719,6 +1739,15 @@ func shouldFail(authHeader string) bool {
 	return spec.shouldFailNow()
 }
 
+// shouldFailRequest is shouldFail for a request, honoring the -port-profiles
+// failure rate of the port it arrived on.
+func shouldFailRequest(ctx *fasthttp.RequestCtx) bool {
+	if lp := listenerProfile(ctx); lp.failure != nil && !withErrors {
+		return lp.failure.shouldFailNow()
+	}
+	return shouldFail(string(ctx.Request.Header.Peek("Authorization")))
+}
+
 func effectiveFailurePercent() int {
 	actualFailurePercent := failurePercent
 	if withErrors && actualFailurePercent == 0 {
@@ -751,6 +1780,9 @@ type providerErrorVariant struct {
 }
 
 func inferProviderFromPath(path string) string {
+	if _, ok := azureAIInferencePaths[path]; ok {
+		return "azure"
+	}
 	switch {
 	case strings.HasPrefix(path, "/anthropic/") || path == "/v1/messages":
 		return "anthropic"
@@ -771,6 +1803,7 @@ func providerErrorCatalog(provider string) []providerErrorVariant {
 		{Status: fasthttp.StatusUnauthorized, Body: map[string]interface{}{"error": map[string]interface{}{"type": "authentication_error", "code": "invalid_api_key", "message": "Incorrect API key provided"}}},
 		{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"error": map[string]interface{}{"type": "rate_limit_error", "code": "rate_limit_exceeded", "message": "Rate limit exceeded"}}},
 		{Status: fasthttp.StatusInternalServerError, Body: map[string]interface{}{"error": map[string]interface{}{"type": "server_error", "code": "internal_server_error", "message": "Internal server error"}}},
+		providerOverloadVariant("openai"),
 	}
 
 	switch provider {
@@ -780,6 +1813,7 @@ func providerErrorCatalog(provider string) []providerErrorVariant {
 			{Status: fasthttp.StatusUnauthorized, Body: map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": "authentication_error", "message": "Invalid API key"}}},
 			{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": "rate_limit_error", "message": "Rate limit exceeded"}}},
 			{Status: fasthttp.StatusInternalServerError, Body: map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": "api_error", "message": "Internal server error"}}},
+			providerOverloadVariant("anthropic"),
 		}
 	case "bedrock":
 		return []providerErrorVariant{
@@ -794,6 +1828,22 @@ func providerErrorCatalog(provider string) []providerErrorVariant {
 			{Status: fasthttp.StatusUnauthorized, Body: map[string]interface{}{"error": map[string]interface{}{"code": 401, "message": "Request had invalid authentication credentials", "status": "UNAUTHENTICATED"}}},
 			{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"error": map[string]interface{}{"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED"}}},
 			{Status: fasthttp.StatusInternalServerError, Body: map[string]interface{}{"error": map[string]interface{}{"code": 500, "message": "Internal error", "status": "INTERNAL"}}},
+			{Status: fasthttp.StatusServiceUnavailable, Body: map[string]interface{}{"error": map[string]interface{}{"code": 503, "message": "The model is overloaded. Please try again later.", "status": "UNAVAILABLE"}}},
+		}
+	case "mistral":
+		return []providerErrorVariant{
+			{Status: fasthttp.StatusBadRequest, Body: map[string]interface{}{"object": "error", "message": "Invalid model", "type": "invalid_model", "param": nil, "code": "1500"}},
+			{Status: fasthttp.StatusUnauthorized, Body: map[string]interface{}{"message": "Unauthorized", "request_id": mockHexID(32)}},
+			{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"message": "Requests rate limit exceeded"}},
+			{Status: fasthttp.StatusInternalServerError, Body: map[string]interface{}{"object": "error", "message": "Internal server error", "type": "internal_server_error", "param": nil, "code": nil}},
+			providerOverloadVariant("mistral"),
+		}
+	case "azure":
+		return []providerErrorVariant{
+			{Status: fasthttp.StatusBadRequest, Body: map[string]interface{}{"error": map[string]interface{}{"code": "Invalid input", "message": "The request body is invalid", "status": 400}}},
+			{Status: fasthttp.StatusUnauthorized, Body: map[string]interface{}{"error": map[string]interface{}{"code": "401", "message": "Access denied due to invalid subscription key or wrong API endpoint."}}},
+			{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"error": map[string]interface{}{"code": "429", "message": "Rate limit is exceeded. Try again in 5 seconds."}}},
+			{Status: fasthttp.StatusInternalServerError, Body: map[string]interface{}{"error": map[string]interface{}{"code": "InternalServerError", "message": "Internal server error", "status": 500}}},
 		}
 	case "cohere":
 		return []providerErrorVariant{
@@ -814,6 +1864,250 @@ func providerErrorCatalog(provider string) []providerErrorVariant {
 	}
 }
 
+// providerOverloadVariant returns the status and body a provider sends when it
+// is out of capacity, as opposed to a generic internal error.
+func providerOverloadVariant(provider string) providerErrorVariant {
+	switch provider {
+	case "anthropic":
+		return providerErrorVariant{Status: 529, Body: map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": "overloaded_error", "message": "Overloaded"}}}
+	case "bedrock":
+		return providerErrorVariant{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"__type": "ThrottlingException", "message": "Too many requests, please wait before trying again."}}
+	case "gemini", "vertex":
+		return providerErrorVariant{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"error": map[string]interface{}{"code": 429, "message": "Resource has been exhausted (e.g. check quota).", "status": "RESOURCE_EXHAUSTED"}}}
+	case "mistral":
+		return providerErrorVariant{Status: fasthttp.StatusTooManyRequests, Body: map[string]interface{}{"object": "error", "message": "Service tier capacity exceeded for this model.", "type": "service_tier_capacity_exceeded", "param": nil, "code": "3505"}}
+	default:
+		return providerErrorVariant{Status: fasthttp.StatusServiceUnavailable, Body: map[string]interface{}{"error": map[string]interface{}{"type": "server_error", "code": "overloaded", "message": "The engine is currently overloaded, please try again later"}}}
+	}
+}
+
+// sendProviderErrorVariant writes a catalog variant as the JSON response.
+func sendProviderErrorVariant(ctx *fasthttp.RequestCtx, provider string, v providerErrorVariant) {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(v.Status)
+	if provider == "bedrock" {
+		// The AWS SDKs classify errors by this header rather than the body.
+		if t, ok := v.Body["__type"].(string); ok {
+			ctx.Response.Header.Set("x-amzn-ErrorType", t)
+		}
+	}
+	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(v.Body); err != nil {
+		log.Printf("Error encoding provider error response: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to encode error response")
+	}
+}
+
+// sendFailureResponse answers a request picked by -failure-percent. The default
+// "error" mode keeps the OpenAI-style 500 on every endpoint; "overload" sends
+// the overload shape of the provider whose API the endpoint emulates.
+func sendFailureResponse(ctx *fasthttp.RequestCtx, provider string) {
+	served.inject("failure")
+	if failureMode == "overload" {
+		sendProviderErrorVariant(ctx, provider, providerOverloadVariant(provider))
+		return
+	}
+	sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+}
+
+// apiFlavorRejection returns the 400 an OpenAI API of the given -api-flavor
+// sends for req's token limit parameter, if it would reject it. Older API
+// versions don't know max_completion_tokens; newer models refuse max_tokens.
+func apiFlavorRejection(flavor string, req GenericRequest) (providerErrorVariant, bool) {
+	switch {
+	case flavor == "legacy" && req.MaxCompletionTokens != nil:
+		return providerErrorVariant{Status: fasthttp.StatusBadRequest, Body: map[string]interface{}{"error": map[string]interface{}{
+			"message": "Unrecognized request argument supplied: max_completion_tokens",
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    nil,
+		}}}, true
+	case flavor == "current" && req.MaxTokens != nil:
+		return providerErrorVariant{Status: fasthttp.StatusBadRequest, Body: map[string]interface{}{"error": map[string]interface{}{
+			"message": "Unsupported parameter: 'max_tokens' is not supported with this model. Use 'max_completion_tokens' instead.",
+			"type":    "invalid_request_error",
+			"param":   "max_tokens",
+			"code":    "unsupported_parameter",
+		}}}, true
+	}
+	return providerErrorVariant{}, false
+}
+
+// applyPromptCache marks a -cache-hit-percent share of requests as prompt-cache
+// hits by reporting -cached-token-percent of their prompt tokens as cached.
+func applyPromptCache(usage *schemas.LLMUsage) {
+	if cacheHitPercent <= 0 || rand.Intn(100) >= cacheHitPercent {
+		return
+	}
+	cached := usage.PromptTokens * cachedTokenPercent / 100
+	if cached == 0 {
+		return
+	}
+	if usage.TokenDetails == nil {
+		usage.TokenDetails = &schemas.TokenDetails{}
+	}
+	usage.TokenDetails.CachedTokens = cached
+}
+
+// reasoningEffortScale scales -reasoning-budget by the request's reasoning_effort.
+var reasoningEffortScale = map[string]float64{
+	"minimal": 0.1,
+	"low":     0.5,
+	"medium":  1,
+	"high":    2,
+}
+
+// resolveReasoningTokens returns how many hidden reasoning tokens a reasoning
+// model spends on this request: between half and all of -reasoning-budget,
+// scaled by reasoning_effort. Non-reasoning models get 0.
+func resolveReasoningTokens(model, effort string) int {
+	if reasoningBudget <= 0 {
+		return 0
+	}
+	// OpenRouter slugs keep the vendor prefix ("openai/o3-mini").
+	model = model[strings.LastIndex(model, "/")+1:]
+	isReasoning := false
+	for _, prefix := range strings.Split(reasoningModels, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(model, prefix) {
+			isReasoning = true
+			break
+		}
+	}
+	if !isReasoning {
+		return 0
+	}
+	budget := reasoningBudget
+	if scale, ok := reasoningEffortScale[effort]; ok {
+		budget = int(float64(budget) * scale)
+	}
+	if budget < 2 {
+		return budget
+	}
+	return budget/2 + rand.Intn(budget-budget/2+1)
+}
+
+// reasoningDelay is the time a model generating at -reasoning-tps spends on
+// tokens reasoning tokens before its first visible token.
+func reasoningDelay(tokens int) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens) * time.Second / time.Duration(reasoningTPS)
+}
+
+// addReasoningUsage folds reasoning tokens into usage the way OpenAI reports
+// them: counted in completion_tokens and broken out in completion_tokens_details.
+func addReasoningUsage(usage *schemas.LLMUsage, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	usage.CompletionTokens += tokens
+	usage.TotalTokens += tokens
+	if usage.CompletionTokensDetails == nil {
+		usage.CompletionTokensDetails = &schemas.CompletionTokensDetails{}
+	}
+	usage.CompletionTokensDetails.ReasoningTokens = tokens
+}
+
+// logprobAlternatives are the candidate tokens listed after the sampled one in
+// top_logprobs.
+var logprobAlternatives = []string{" the", " a", " and", " of", " to", " in", " is", " that", " for", " it", " with", " as", " on", " this", " be", " at", " by", " from", " or", " an"}
+
+// resolveLogprobsDepth returns how many top_logprobs alternatives to send, or -1
+// when the request did not ask for logprobs.
+func resolveLogprobsDepth(req GenericRequest) int {
+	if !req.Logprobs {
+		return -1
+	}
+	if logprobsDepth >= 0 {
+		return logprobsDepth
+	}
+	return req.TopLogprobs
+}
+
+// splitLogprobTokens cuts text into word-level pseudo-tokens, each carrying its
+// leading space the way BPE tokens do.
+func splitLogprobTokens(text string) []string {
+	var tokens []string
+	start := 0
+	for i := 1; i < len(text); i++ {
+		if text[i] == ' ' && text[i-1] != ' ' {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// tokenBytes returns the UTF-8 bytes of token as OpenAI's integer array.
+func tokenBytes(token string) []int {
+	b := make([]int, len(token))
+	for i := 0; i < len(token); i++ {
+		b[i] = int(token[i])
+	}
+	return b
+}
+
+// buildLogProbs returns a logprobs entry for every pseudo-token of text, each
+// with depth top_logprobs candidates (the sampled token first, then
+// alternatives in decreasing probability). refusal files them under "refusal".
+func buildLogProbs(text string, depth int, refusal bool) *ChatLogProbs {
+	tokens := splitLogprobTokens(text)
+	entries := make([]TokenLogProb, len(tokens))
+	for i, token := range tokens {
+		logprob := -rand.Float64() * 2
+		top := make([]TopLogProb, 0, depth)
+		for j := 0; j < depth; j++ {
+			candidate, candidateLogprob := token, logprob
+			if j > 0 {
+				candidate = logprobAlternatives[(i+j)%len(logprobAlternatives)]
+				candidateLogprob = logprob - float64(j) - rand.Float64()
+			}
+			top = append(top, TopLogProb{Token: candidate, Logprob: candidateLogprob, Bytes: tokenBytes(candidate)})
+		}
+		entries[i] = TokenLogProb{Token: token, Logprob: logprob, Bytes: tokenBytes(token), TopLogprobs: top}
+	}
+	if refusal {
+		return &ChatLogProbs{Refusal: entries}
+	}
+	return &ChatLogProbs{Content: entries}
+}
+
+// mockRefusalText is the refusal message sent for -refusal-percent refusals.
+const mockRefusalText = "I'm sorry, but I can't help with that request."
+
+// shouldRefuse reports whether a chat completion should get a policy response.
+func shouldRefuse() bool {
+	return refusalPercent > 0 && rand.Intn(100) < refusalPercent
+}
+
+// contentFilterVariant is Azure OpenAI's response to a prompt blocked by its
+// content management policy.
+func contentFilterVariant() providerErrorVariant {
+	filtered := func(hit bool, severity string) map[string]interface{} {
+		return map[string]interface{}{"filtered": hit, "severity": severity}
+	}
+	return providerErrorVariant{Status: fasthttp.StatusBadRequest, Body: map[string]interface{}{"error": map[string]interface{}{
+		"message": "The response was filtered due to the prompt triggering Azure OpenAI's content management policy. Please modify your prompt and retry.",
+		"type":    nil,
+		"param":   "prompt",
+		"code":    "content_filter",
+		"status":  400,
+		"innererror": map[string]interface{}{
+			"code": "ResponsibleAIPolicyViolation",
+			"content_filter_result": map[string]interface{}{
+				"hate":      filtered(false, "safe"),
+				"self_harm": filtered(false, "safe"),
+				"sexual":    filtered(false, "safe"),
+				"violence":  filtered(true, "medium"),
+			},
+		},
+	}}}
+}
+
 func maybeSendRandomProviderError(ctx *fasthttp.RequestCtx, provider string) bool {
 	if !withErrors {
 		return false
@@ -829,14 +2123,8 @@ func maybeSendRandomProviderError(ctx *fasthttp.RequestCtx, provider string) boo
 	if len(variants) == 0 {
 		return false
 	}
-	chosen := variants[rand.Intn(len(variants))]
-	ctx.SetContentType("application/json")
-	ctx.SetStatusCode(chosen.Status)
-	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(chosen.Body); err != nil {
-		log.Printf("Error encoding provider error response: %v", err)
-		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-		ctx.SetBodyString("Failed to encode error response")
-	}
+	served.inject("provider_error")
+	sendProviderErrorVariant(ctx, provider, variants[rand.Intn(len(variants))])
 	return true
 }
 
@@ -913,6 +2201,64 @@ func setSSEHeaders(ctx *fasthttp.RequestCtx) {
 	ctx.SetConnectionClose()
 }
 
+// streamingKey marks a request whose response is written by a body stream
+// writer, so the router leaves releasing its in-flight slot to that writer.
+const streamingKey = "mocker.streaming"
+
+// bodyDelayKey holds the latency a non-streaming response owes after its
+// headers have gone out, set when -header-delay is on.
+const bodyDelayKey = "mocker.bodyDelay"
+
+// delayedBody is a fixed-size response body whose first byte is held back by
+// delay. It stands in for the streaming bookkeeping of setStreamBody: the
+// request stays in flight until fasthttp closes the body.
+type delayedBody struct {
+	body  *bytes.Reader // a field, not embedded: io.Copy would use its WriteTo and skip Read
+	delay time.Duration
+	start time.Time
+}
+
+func (b *delayedBody) Read(p []byte) (int, error) {
+	if b.delay > 0 {
+		time.Sleep(b.delay)
+		b.delay = 0
+	}
+	return b.body.Read(p)
+}
+
+func (b *delayedBody) Close() error {
+	inflight.Add(-1)
+	served.recordLatency(time.Since(b.start))
+	return nil
+}
+
+// delayBodyAfterHeaders sends a non-streaming response's headers right away
+// and its body once the latency recorded by simulateRequestLatency has
+// passed, so time-to-headers (-header-delay) and total latency are set
+// independently. Streams already flush headers before their first chunk.
+func delayBodyAfterHeaders(ctx *fasthttp.RequestCtx) {
+	d, _ := ctx.UserValue(bodyDelayKey).(time.Duration)
+	if d <= 0 || ctx.UserValue(streamingKey) != nil {
+		return
+	}
+	body := append([]byte(nil), ctx.Response.Body()...)
+	ctx.SetUserValue(streamingKey, true)
+	ctx.Response.ImmediateHeaderFlush = true
+	ctx.Response.SetBodyStream(&delayedBody{body: bytes.NewReader(body), delay: d, start: ctx.Time()}, len(body))
+}
+
+// setStreamBody installs fn as the response body writer and keeps the request
+// counted as in flight until fn returns, since streams outlive their handler.
+func setStreamBody(ctx *fasthttp.RequestCtx, fn func(w *bufio.Writer)) {
+	ctx.SetUserValue(streamingKey, true)
+	start := ctx.Time()
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer inflight.Add(-1)
+		fn(w)
+		served.recordLatency(time.Since(start))
+	})
+}
+
 func getStreamWords(content string) []string {
 	words := strings.Fields(content)
 	if len(words) == 0 {
@@ -1042,6 +2388,7 @@ func sendErrorResponse(ctx *fasthttp.RequestCtx, statusCode int, message string)
 
 // sendRateLimitResponse sends a 429 rate_limit_error response
 func sendRateLimitResponse(ctx *fasthttp.RequestCtx) {
+	served.inject("rate_limit")
 	errorResp := OpenAIError{
 		EventID: StrPtr("evt_mock_ratelimit_12345"),
 		Error: &ErrorField{
@@ -1057,6 +2404,190 @@ func sendRateLimitResponse(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// sendOverloadedResponse sends a 503 rejecting a request over -max-inflight.
+func sendOverloadedResponse(ctx *fasthttp.RequestCtx) {
+	served.inject("max_inflight")
+	errorResp := OpenAIError{
+		EventID: StrPtr("evt_mock_overloaded_12345"),
+		Error: &ErrorField{
+			Type:    StrPtr("server_error"),
+			Code:    StrPtr("overloaded"),
+			Message: "The server is currently overloaded with other requests. Please retry after some time.",
+		},
+	}
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(errorResp); err != nil {
+		log.Printf("Error encoding overloaded response: %v", err)
+	}
+}
+
+// rateLimitBucket is the per-key budget behind the x-ratelimit-* headers. Both
+// budgets refill continuously at their per-minute limit, the way OpenAI's do,
+// so remaining counts drain under load and recover when traffic backs off.
+type rateLimitBucket struct {
+	requests float64
+	tokens   float64
+	last     time.Time
+}
+
+var (
+	rateLimitMu      sync.Mutex
+	rateLimitBuckets = map[string]*rateLimitBucket{}
+)
+
+// rateLimitState is a snapshot of one key's budgets after a request.
+type rateLimitState struct {
+	allowed           bool
+	remainingRequests int
+	remainingTokens   int
+	resetRequests     time.Duration
+	resetTokens       time.Duration
+}
+
+// take refills the bucket for the time elapsed since its last use, then spends
+// one request and cost tokens if both budgets can cover it. Disabled budgets
+// (limit <= 0) never block.
+func (b *rateLimitBucket) take(now time.Time, cost float64, reqLimit, tokLimit int) rateLimitState {
+	elapsed := now.Sub(b.last).Minutes()
+	b.last = now
+	b.requests = math.Min(float64(reqLimit), b.requests+elapsed*float64(reqLimit))
+	b.tokens = math.Min(float64(tokLimit), b.tokens+elapsed*float64(tokLimit))
+
+	st := rateLimitState{allowed: (reqLimit <= 0 || b.requests >= 1) && (tokLimit <= 0 || b.tokens >= cost)}
+	if st.allowed {
+		if reqLimit > 0 {
+			b.requests--
+		}
+		if tokLimit > 0 {
+			b.tokens -= cost
+		}
+	}
+	st.remainingRequests = int(b.requests)
+	st.remainingTokens = int(b.tokens)
+	if reqLimit > 0 {
+		st.resetRequests = time.Duration((float64(reqLimit) - b.requests) / float64(reqLimit) * float64(time.Minute))
+	}
+	if tokLimit > 0 {
+		st.resetTokens = time.Duration((float64(tokLimit) - b.tokens) / float64(tokLimit) * float64(time.Minute))
+	}
+	return st
+}
+
+// applyRateLimitHeaders charges the request against its key's budgets and sets
+// the OpenAI-style x-ratelimit-* headers. It returns false when a budget is
+// exhausted, in which case the caller should respond 429. Tokens are estimated
+// from the request body size (~4 bytes per token).
+func applyRateLimitHeaders(ctx *fasthttp.RequestCtx) bool {
+	if rateLimitRequests <= 0 && rateLimitTokens <= 0 {
+		return true
+	}
+	key := strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")
+	cost := float64(len(ctx.Request.Body())/4 + 1)
+
+	rateLimitMu.Lock()
+	b, ok := rateLimitBuckets[key]
+	if !ok {
+		b = &rateLimitBucket{requests: float64(rateLimitRequests), tokens: float64(rateLimitTokens), last: time.Now()}
+		rateLimitBuckets[key] = b
+	}
+	st := b.take(time.Now(), cost, rateLimitRequests, rateLimitTokens)
+	rateLimitMu.Unlock()
+
+	h := &ctx.Response.Header
+	if rateLimitRequests > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(rateLimitRequests))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(st.remainingRequests))
+		h.Set("x-ratelimit-reset-requests", st.resetRequests.Round(time.Millisecond).String())
+	}
+	if rateLimitTokens > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(rateLimitTokens))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(st.remainingTokens))
+		h.Set("x-ratelimit-reset-tokens", st.resetTokens.Round(time.Millisecond).String())
+	}
+	if !st.allowed {
+		// Seconds until one more request's worth of budget has refilled.
+		h.Set("retry-after", "1")
+		if rateLimitRequests > 0 && st.remainingRequests < 1 {
+			h.Set("retry-after", strconv.Itoa(int(math.Ceil(60/float64(rateLimitRequests)))))
+		}
+	}
+	return st.allowed
+}
+
+// quotaLimits holds -quota-keys budgets by raw token value.
+var (
+	quotaMu     sync.Mutex
+	quotaLimits = map[string]int{}
+	quotaUsed   = map[string]int{}
+)
+
+// quotaLimit returns key's cumulative budget (0 = unlimited).
+func quotaLimit(key string) int {
+	if limit, ok := quotaLimits[key]; ok {
+		return limit
+	}
+	return quotaTokens
+}
+
+// quotaEnabled reports whether any key has a -quota-tokens or -quota-keys
+// budget.
+func quotaEnabled() bool {
+	return quotaTokens > 0 || len(quotaLimits) > 0
+}
+
+// hasQuota reports whether the request's key still has budget left. Unlike
+// the per-minute rate limits, a spent budget never refills.
+func hasQuota(ctx *fasthttp.RequestCtx) bool {
+	if !quotaEnabled() {
+		return true
+	}
+	key := requestAPIKey(ctx)
+	limit := quotaLimit(key)
+	if limit <= 0 {
+		return true
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	return quotaUsed[key] < limit
+}
+
+// chargeQuota charges the prompt and completion tokens of a response's usage
+// against key's budget, so the budget runs out where a gateway adding up the
+// same usage would expect it to.
+func chargeQuota(key string, usage schemas.LLMUsage) {
+	limit := quotaLimit(key)
+	if limit <= 0 {
+		return
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	before := quotaUsed[key]
+	quotaUsed[key] += usage.PromptTokens + usage.CompletionTokens
+	if before < limit && quotaUsed[key] >= limit {
+		log.Printf("Quota of %d tokens exhausted for key %q", limit, key)
+	}
+}
+
+// sendInsufficientQuotaResponse sends the 429 OpenAI returns once an account
+// runs out of credit. Unlike rate_limit_exceeded, retrying does not help.
+func sendInsufficientQuotaResponse(ctx *fasthttp.RequestCtx) {
+	served.inject("insufficient_quota")
+	errorResp := OpenAIError{
+		EventID: StrPtr("evt_mock_quota_12345"),
+		Error: &ErrorField{
+			Type:    StrPtr("insufficient_quota"),
+			Code:    StrPtr("insufficient_quota"),
+			Message: "You exceeded your current quota, please check your plan and billing details.",
+		},
+	}
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(errorResp); err != nil {
+		log.Printf("Error encoding insufficient quota response: %v", err)
+	}
+}
+
 // isKeyRateLimited returns true if the request's Authorization header is in the rate-limited set
 func isKeyRateLimited(ctx *fasthttp.RequestCtx) bool {
 	if len(rateLimitedKeyMap) == 0 {
@@ -1068,6 +2599,9 @@ func isKeyRateLimited(ctx *fasthttp.RequestCtx) bool {
 
 // checkAuth validates authorization header
 func checkAuth(ctx *fasthttp.RequestCtx) bool {
+	if auth != "" && authScheme == "provider" {
+		return checkProviderAuth(ctx)
+	}
 	if auth != "" {
 		authorizationHeader := string(ctx.Request.Header.Peek("Authorization"))
 		if authorizationHeader == "" {
@@ -1085,6 +2619,97 @@ func checkAuth(ctx *fasthttp.RequestCtx) bool {
 	return true
 }
 
+// rejectAuth writes the 403 used for every authentication failure.
+func rejectAuth(ctx *fasthttp.RequestCtx, problem, credential string) bool {
+	ctx.SetStatusCode(fasthttp.StatusForbidden)
+	ctx.SetBodyString(fmt.Sprintf("Forbidden: %s authentication %s", problem, credential))
+	return false
+}
+
+// requestAPIKey returns the key a request is made with, read the way
+// checkAuth reads it: the Authorization token, or under -auth-scheme provider
+// the credential of the emulated provider. SigV4-signed Bedrock requests are
+// keyed by the access key ID of their signature.
+func requestAPIKey(ctx *fasthttp.RequestCtx) string {
+	if authScheme != "provider" {
+		return strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")
+	}
+	_, key, signed := providerCredential(ctx)
+	if signed {
+		_, credential, _ := strings.Cut(string(ctx.Request.Header.Peek("Authorization")), "Credential=")
+		key, _, _ = strings.Cut(credential, "/")
+	}
+	return key
+}
+
+// providerCredential returns the credential the emulated provider expects for
+// the request path, named for error messages, and its value: Anthropic
+// x-api-key, Gemini x-goog-api-key or ?key=, a Bedrock API key as a Bearer
+// token, and OpenAI-style paths Authorization: Bearer or Azure's api-key.
+// signed reports a Bedrock request that carries no Bearer token and so must
+// be SigV4-signed instead.
+func providerCredential(ctx *fasthttp.RequestCtx) (credential, got string, signed bool) {
+	header := func(name string) string { return string(ctx.Request.Header.Peek(name)) }
+	switch inferProviderFromPath(string(ctx.Path())) {
+	case "anthropic":
+		return "header 'x-api-key'", header("x-api-key"), false
+	case "gemini":
+		if got = header("x-goog-api-key"); got == "" {
+			if q := ctx.QueryArgs().Peek("key"); len(q) > 0 {
+				return "query parameter 'key'", string(q), false
+			}
+		}
+		return "header 'x-goog-api-key'", got, false
+	case "bedrock":
+		authorization := header("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return "", "", true
+		}
+		return "header 'Authorization'", strings.TrimPrefix(authorization, "Bearer "), false
+	default:
+		if got = header("api-key"); got != "" {
+			return "header 'api-key'", got, false
+		}
+		return "header 'Authorization'", strings.TrimPrefix(header("Authorization"), "Bearer "), false
+	}
+}
+
+// checkProviderAuth validates the -auth key using the credential the emulated
+// provider expects for the request path (see providerCredential), so gateways'
+// auth translation is exercised. A SigV4 signature is only checked for
+// presence, as it cannot be verified. -auth may be given with or without the
+// "Bearer " prefix.
+func checkProviderAuth(ctx *fasthttp.RequestCtx) bool {
+	key := strings.TrimPrefix(auth, "Bearer ")
+	credential, got, signed := providerCredential(ctx)
+	if signed {
+		authorization := string(ctx.Request.Header.Peek("Authorization"))
+		if !hasSigV4Signature(authorization) || len(ctx.Request.Header.Peek("X-Amz-Date")) == 0 {
+			log.Printf("Missing or malformed SigV4 signature: %q", authorization)
+			return rejectAuth(ctx, "Missing", "signature (AWS4-HMAC-SHA256 Authorization with X-Amz-Date)")
+		}
+		return true
+	}
+
+	if got == "" {
+		return rejectAuth(ctx, "Missing", credential)
+	}
+	if got != key {
+		log.Printf("Invalid authentication %s: %s", credential, got)
+		return rejectAuth(ctx, "Invalid", credential)
+	}
+	return true
+}
+
+// hasSigV4Signature reports whether an Authorization header has the shape of
+// an AWS Signature Version 4 signature.
+func hasSigV4Signature(authorization string) bool {
+	return strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") &&
+		strings.Contains(authorization, "Credential=") &&
+		strings.Contains(authorization, "SignedHeaders=") &&
+		strings.Contains(authorization, "Signature=")
+}
+
 // checkMethod validates HTTP method is POST
 func checkMethod(ctx *fasthttp.RequestCtx) bool {
 	if !ctx.IsPost() {
@@ -1095,35 +2720,61 @@ func checkMethod(ctx *fasthttp.RequestCtx) bool {
 	return true
 }
 
+// openAIStreamOptions carries the request-dependent knobs of an OpenAI stream.
+type openAIStreamOptions struct {
+	IncludeUsage    bool   // stream_options.include_usage: send a final usage chunk
+	Refusal         bool   // stream the text in delta.refusal instead of delta.content
+	ReasoningTokens int    // hidden reasoning: delays the first chunk and counts in usage
+	LogprobsDepth   int    // top_logprobs per token; -1 = logprobs not requested
+	Quirk           string // -provider-quirks provider whose extras to add
+}
+
 // sendStreamingResponse sends a streaming chat completion response in SSE format
-func sendOpenAIStreamingResponse(ctx *fasthttp.RequestCtx, model string, mockContent string) {
+// sendOpenAIStreamingResponse streams mockContent as chat.completion.chunk
+// events. With includeUsage (stream_options.include_usage), a final chunk with
+// empty choices and the usage totals is sent before [DONE], as OpenAI does.
+//
+// See openAIStreamOptions for the per-request variations.
+func sendOpenAIStreamingResponse(ctx *fasthttp.RequestCtx, id, upstream, model, mockContent string, opts openAIStreamOptions) {
 	setSSEHeaders(ctx)
-	tokens := buildStreamChunks(getStreamWords(mockContent))
+	words := getStreamWords(mockContent)
+	tokens := buildStreamChunks(words)
 	gaps := len(tokens) - 1
-	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization")))
+	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization"))) + degradedDelay(ctx)
+	quirks := streamQuirkFields(ctx, opts.Quirk)
+	quotaKey := requestAPIKey(ctx)
 
-	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+	setStreamBody(ctx, func(w *bufio.Writer) {
+		time.Sleep(reasoningDelay(opts.ReasoningTokens))
 		start := time.Now()
 		for i, token := range tokens {
 			role := (*string)(nil)
 			if i == 0 {
 				role = StrPtr("assistant")
 			}
+			delta := &ChatStreamResponseChoiceDelta{Role: role, Content: StrPtr(token)}
+			if opts.Refusal {
+				delta.Content, delta.Refusal = nil, StrPtr(token)
+			}
+			var logprobs *ChatLogProbs
+			if opts.LogprobsDepth >= 0 {
+				logprobs = buildLogProbs(token, opts.LogprobsDepth, opts.Refusal)
+			}
 			chunk := ChatCompletionStreamResponse{
-				ID:      "cmpl-mock12345",
-				Object:  "chat.completion.chunk",
-				Created: int(time.Now().Unix()),
-				Model:   model,
+				ID:       id,
+				Provider: upstream,
+				Object:   "chat.completion.chunk",
+				Created:  int(time.Now().Unix()),
+				Model:    model,
 				Choices: []ChatStreamResponseChoice{
 					{
-						Index: 0,
-						Delta: &ChatStreamResponseChoiceDelta{
-							Role:    role,
-							Content: StrPtr(token),
-						},
+						Index:        0,
+						Delta:        delta,
+						LogProbs:     logprobs,
 						FinishReason: nil,
 					},
 				},
+				QuirkFields: quirks.chunk(i),
 			}
 			writeSSEJSON(w, "", chunk)
 			if i < gaps {
@@ -1131,11 +2782,24 @@ func sendOpenAIStreamingResponse(ctx *fasthttp.RequestCtx, model string, mockCon
 			}
 		}
 
+		// The key is charged the stream's usage whether or not it is reported.
+		inputTokens := resolveInputTokens(rand.Intn(1000))
+		outputTokens := resolveOutputTokens(len(words))
+		usage := &schemas.LLMUsage{
+			PromptTokens:     inputTokens,
+			CompletionTokens: outputTokens,
+			TotalTokens:      inputTokens + outputTokens,
+		}
+		addReasoningUsage(usage, opts.ReasoningTokens)
+		applyPromptCache(usage)
+		chargeQuota(quotaKey, *usage)
+
 		finalChunk := ChatCompletionStreamResponse{
-			ID:      "cmpl-mock12345",
-			Object:  "chat.completion.chunk",
-			Created: int(time.Now().Unix()),
-			Model:   model,
+			ID:       id,
+			Provider: upstream,
+			Object:   "chat.completion.chunk",
+			Created:  int(time.Now().Unix()),
+			Model:    model,
 			Choices: []ChatStreamResponseChoice{
 				{
 					Index:        0,
@@ -1144,7 +2808,79 @@ func sendOpenAIStreamingResponse(ctx *fasthttp.RequestCtx, model string, mockCon
 				},
 			},
 		}
+		// Mistral always reports usage, on the chunk that finishes the choice
+		// rather than in a separate one.
+		if opts.Quirk == "mistral" {
+			finalChunk.Usage = usage
+		}
 		writeSSEJSON(w, "", finalChunk)
+
+		if opts.IncludeUsage && finalChunk.Usage == nil {
+			writeSSEJSON(w, "", ChatCompletionStreamResponse{
+				ID:       id,
+				Provider: upstream,
+				Object:   "chat.completion.chunk",
+				Created:  int(time.Now().Unix()),
+				Model:    model,
+				Choices:  []ChatStreamResponseChoice{},
+				Usage:    usage,
+			})
+		}
+		writeSSEDataLine(w, "[DONE]")
+	})
+}
+
+// sendCompletionsStreamingResponse streams mockContent as text_completion
+// chunks for each prompt in turn (echoing the prompt first when asked),
+// then one chunk per prompt carrying its finish_reason, and the usage chunk
+// requested by stream_options.include_usage before [DONE].
+func sendCompletionsStreamingResponse(ctx *fasthttp.RequestCtx, model, mockContent string, prompts []string, req OpenAICompletionsRequest) {
+	setSSEHeaders(ctx)
+	words := getStreamWords(mockContent)
+	tokens := buildStreamChunks(words)
+	gaps := len(prompts)*len(tokens) - 1
+	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization"))) + degradedDelay(ctx)
+	quotaKey := requestAPIKey(ctx)
+
+	setStreamBody(ctx, func(w *bufio.Writer) {
+		chunk := func(choices []OpenAICompletionChoice, usage *schemas.LLMUsage) OpenAICompletionsResponse {
+			return OpenAICompletionsResponse{
+				ID:      "cmpl-mock12345",
+				Object:  "text_completion",
+				Created: int(time.Now().Unix()),
+				Model:   model,
+				Choices: choices,
+				Usage:   usage,
+			}
+		}
+		start := time.Now()
+		for p, prompt := range prompts {
+			if req.Echo && prompt != "" {
+				writeSSEJSON(w, "", chunk([]OpenAICompletionChoice{{Text: prompt, Index: p}}, nil))
+			}
+			for i, token := range tokens {
+				writeSSEJSON(w, "", chunk([]OpenAICompletionChoice{{Text: token, Index: p}}, nil))
+				if n := p*len(tokens) + i; n < gaps {
+					sleepUntilStreamDeadline(start, totalLatency, n, gaps)
+				}
+			}
+		}
+		for p := range prompts {
+			writeSSEJSON(w, "", chunk([]OpenAICompletionChoice{{Index: p, FinishReason: StrPtr("stop")}}, nil))
+		}
+
+		// The key is charged the stream's usage whether or not it is reported.
+		inputTokens := resolveInputTokens(rand.Intn(1000))
+		outputTokens := resolveOutputTokens(len(prompts) * len(words))
+		usage := &schemas.LLMUsage{
+			PromptTokens:     inputTokens,
+			CompletionTokens: outputTokens,
+			TotalTokens:      inputTokens + outputTokens,
+		}
+		chargeQuota(quotaKey, *usage)
+		if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+			writeSSEJSON(w, "", chunk([]OpenAICompletionChoice{}, usage))
+		}
 		writeSSEDataLine(w, "[DONE]")
 	})
 }
@@ -1154,22 +2890,26 @@ func sendAnthropicStreamingResponse(ctx *fasthttp.RequestCtx, model string, mock
 	words := getStreamWords(mockContent)
 	tokens := buildStreamChunks(words)
 	gaps := len(tokens) - 1
-	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization")))
-
-	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
-		startMsg := map[string]any{
-			"type": "message_start",
-			"message": AnthropicStreamMessage{
-				ID:           "msg_mock12345",
-				Type:         "message",
-				Role:         "assistant",
-				Model:        model,
-				Content:      []any{},
-				StopReason:   nil,
-				StopSequence: nil,
-			},
+	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization"))) + degradedDelay(ctx)
+	quotaKey := requestAPIKey(ctx)
+
+	setStreamBody(ctx, func(w *bufio.Writer) {
+		// Anthropic reports the input tokens in message_start and the output
+		// tokens in message_delta; the key is charged both.
+		message := AnthropicStreamMessage{
+			ID:           "msg_mock12345",
+			Type:         "message",
+			Role:         "assistant",
+			Model:        model,
+			Content:      []any{},
+			StopReason:   nil,
+			StopSequence: nil,
 		}
-		writeSSEJSON(w, "message_start", startMsg)
+		message.Usage.InputTokens = resolveInputTokens(rand.Intn(1000))
+		writeSSEJSON(w, "message_start", map[string]any{
+			"type":    "message_start",
+			"message": message,
+		})
 		writeSSEJSON(w, "content_block_start", map[string]any{
 			"type":          "content_block_start",
 			"index":         0,
@@ -1195,6 +2935,8 @@ func sendAnthropicStreamingResponse(ctx *fasthttp.RequestCtx, model string, mock
 			"type":  "content_block_stop",
 			"index": 0,
 		})
+		outputTokens := resolveOutputTokens(len(words))
+		chargeQuota(quotaKey, schemas.LLMUsage{PromptTokens: message.Usage.InputTokens, CompletionTokens: outputTokens})
 		writeSSEJSON(w, "message_delta", map[string]any{
 			"type": "message_delta",
 			"delta": map[string]any{
@@ -1202,7 +2944,7 @@ func sendAnthropicStreamingResponse(ctx *fasthttp.RequestCtx, model string, mock
 				"stop_sequence": nil,
 			},
 			"usage": map[string]any{
-				"output_tokens": resolveOutputTokens(len(words)),
+				"output_tokens": outputTokens,
 			},
 		})
 		writeSSEJSON(w, "message_stop", map[string]any{
@@ -1214,11 +2956,13 @@ func sendAnthropicStreamingResponse(ctx *fasthttp.RequestCtx, model string, mock
 
 func sendGenAIStreamingResponse(ctx *fasthttp.RequestCtx, model string, mockContent string) {
 	setSSEHeaders(ctx)
-	tokens := buildStreamChunks(getStreamWords(mockContent))
+	words := getStreamWords(mockContent)
+	tokens := buildStreamChunks(words)
 	gaps := len(tokens) - 1
-	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization")))
+	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization"))) + degradedDelay(ctx)
+	quotaKey := requestAPIKey(ctx)
 
-	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+	setStreamBody(ctx, func(w *bufio.Writer) {
 		start := time.Now()
 		for i, token := range tokens {
 			chunk := map[string]any{
@@ -1240,6 +2984,9 @@ func sendGenAIStreamingResponse(ctx *fasthttp.RequestCtx, model string, mockCont
 			}
 		}
 
+		inputTokens := resolveInputTokens(rand.Intn(1000))
+		outputTokens := resolveOutputTokens(len(words))
+		chargeQuota(quotaKey, schemas.LLMUsage{PromptTokens: inputTokens, CompletionTokens: outputTokens})
 		finalChunk := map[string]any{
 			"candidates": []map[string]any{
 				{
@@ -1251,6 +2998,11 @@ func sendGenAIStreamingResponse(ctx *fasthttp.RequestCtx, model string, mockCont
 					"finishReason": "STOP",
 				},
 			},
+			"usageMetadata": GenAIUsageMetadata{
+				PromptTokenCount:     inputTokens,
+				CandidatesTokenCount: outputTokens,
+				TotalTokenCount:      inputTokens + outputTokens,
+			},
 			"modelVersion": model,
 		}
 		writeSSEJSON(w, "", finalChunk)
@@ -1263,9 +3015,10 @@ func sendBedrockConverseStreamingResponse(ctx *fasthttp.RequestCtx, model string
 	words := getStreamWords(mockContent)
 	tokens := buildStreamChunks(words)
 	gaps := len(tokens) - 1
-	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization")))
+	totalLatency := getStreamTotalLatency(string(ctx.Request.Header.Peek("Authorization"))) + degradedDelay(ctx)
+	quotaKey := requestAPIKey(ctx)
 
-	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+	setStreamBody(ctx, func(w *bufio.Writer) {
 		writeSSEJSON(w, "", map[string]any{
 			"messageStart": map[string]any{
 				"role":  "assistant",
@@ -1300,6 +3053,7 @@ func sendBedrockConverseStreamingResponse(ctx *fasthttp.RequestCtx, model string
 		})
 		streamInputTokens := resolveInputTokens(rand.Intn(1000))
 		streamOutputTokens := resolveOutputTokens(len(words))
+		chargeQuota(quotaKey, schemas.LLMUsage{PromptTokens: streamInputTokens, CompletionTokens: streamOutputTokens})
 		writeSSEJSON(w, "", map[string]any{
 			"metadata": map[string]any{
 				"usage": map[string]any{
@@ -1313,22 +3067,226 @@ func sendBedrockConverseStreamingResponse(ctx *fasthttp.RequestCtx, model string
 	})
 }
 
-func mockChatCompletionsHandler(ctx *fasthttp.RequestCtx) {
-	if !checkAuth(ctx) || !checkMethod(ctx) {
-		return
-	}
-	provider, model, stream := parseModelFromRequest(ctx)
+// quirkModelPrefixes map bare model name prefixes to the provider whose quirks
+// they get; Groq serves open models with generic names, so it is only picked
+// by the "groq/" provider prefix.
+var quirkModelPrefixes = map[string]string{
+	"grok-":        "xai",
+	"sonar":        "perplexity",
+	"mistral-":     "mistral",
+	"open-mistral": "mistral",
+	"open-mixtral": "mistral",
+	"codestral":    "mistral",
+	"ministral":    "mistral",
+	"pixtral":      "mistral",
+	"magistral":    "mistral",
+	"devstral":     "mistral",
+}
 
-	if isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendRateLimitResponse(ctx)
-		return
+// resolveQuirkProvider returns the provider whose non-standard response fields
+// a chat completion gets under -provider-quirks, or "" for plain OpenAI.
+func resolveQuirkProvider(provider, model string) string {
+	if !providerQuirks {
+		return ""
 	}
-	if maybeSendRandomProviderError(ctx, provider) {
-		return
-	}
-
-	if shouldFail(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+	switch provider {
+	case "groq", "perplexity", "xai", "mistral", "vllm", "sgl":
+		return provider
+	case "":
+		for prefix, p := range quirkModelPrefixes {
+			if strings.HasPrefix(strings.ToLower(model), prefix) {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// mockCitations are the sources Perplexity-style responses cite.
+var mockCitations = []PerplexitySearchResult{
+	{Title: "Mock Source One", URL: "https://example.com/mock-source-1", Date: "2025-01-15"},
+	{Title: "Mock Source Two", URL: "https://example.org/mock-source-2", Date: "2025-03-02"},
+	{Title: "Mock Source Three", URL: "https://example.net/mock-source-3"},
+}
+
+// mockCitationURLs lists mockCitations' URLs for the citations array.
+func mockCitationURLs() []string {
+	urls := make([]string, len(mockCitations))
+	for i, c := range mockCitations {
+		urls[i] = c.URL
+	}
+	return urls
+}
+
+// llamaEOSTokenID is the end-of-turn token id self-hosted servers report as
+// the stop that ended generation.
+const llamaEOSTokenID = 128009
+
+// maxPromptLogprobs caps how many prompt positions get prompt_logprobs entries,
+// so a huge reported prompt doesn't balloon the response.
+const maxPromptLogprobs = 256
+
+// buildPromptLogprobs renders vLLM's prompt_logprobs for promptTokens prompt
+// positions with depth alternatives each: null for the first position, then
+// a map from token id to logprob, rank and decoded token.
+func buildPromptLogprobs(promptTokens, depth int) json.RawMessage {
+	entries := make([]map[string]PromptLogProb, min(promptTokens, maxPromptLogprobs))
+	for i := 1; i < len(entries); i++ {
+		entry := make(map[string]PromptLogProb, depth+1)
+		logprob := -rand.Float64() * 4
+		entry[strconv.Itoa(1000+i)] = PromptLogProb{Logprob: logprob, Rank: 1, DecodedToken: logprobAlternatives[i%len(logprobAlternatives)]}
+		for j := 1; j <= depth; j++ {
+			alt := logprobAlternatives[(i+j)%len(logprobAlternatives)]
+			entry[strconv.Itoa(100000+j)] = PromptLogProb{Logprob: logprob - float64(j), Rank: j + 1, DecodedToken: alt}
+		}
+		entries[i] = entry
+	}
+	raw, err := sonic.Marshal(entries)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return raw
+}
+
+// setQuirkHeaders adds the response headers quirk's provider sends.
+func setQuirkHeaders(ctx *fasthttp.RequestCtx, quirk string) {
+	switch quirk {
+	case "groq":
+		ctx.Response.Header.Set("x-groq-region", "us-east-1")
+		ctx.Response.Header.Set("x-request-id", "req_"+randomAlphanumeric(26))
+	case "mistral":
+		ctx.Response.Header.Set("mistral-correlation-id", mockUUID())
+		ctx.Response.Header.Set("x-ratelimitbysize-limit-minute", strconv.Itoa(mistralTokensPerMinute))
+		ctx.Response.Header.Set("x-ratelimitbysize-remaining-minute", strconv.Itoa(mistralTokensPerMinute-rand.Intn(10000)))
+	}
+}
+
+// mistralTokensPerMinute is the token budget Mistral-style rate limit headers
+// report.
+const mistralTokensPerMinute = 500000
+
+// mockUUID returns a random version 4 UUID string.
+func mockUUID() string {
+	return fmt.Sprintf("%08x-%04x-4%03x-%04x-%012x", rand.Uint32(), rand.Intn(1<<16), rand.Intn(1<<12), 0x8000|rand.Intn(1<<14), rand.Int63n(1<<48))
+}
+
+// mockHexID returns n random lowercase hex digits, the id format Mistral uses.
+func mockHexID(n int) string {
+	const alphabet = "0123456789abcdef"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// applyChatQuirks decorates a non-streaming chat completion the way quirk's
+// provider does: Groq adds x_groq and timing fields in usage, Perplexity adds
+// citations, search_results and search usage, xAI adds a system fingerprint
+// and num_sources_used. vLLM adds stop_reason, prompt_logprobs (as requested)
+// and kv_transfer_params; SGLang adds matched_stop. Both finish
+// -quirk-abort-percent of completions with the non-standard "abort" reason.
+// Mistral changes only the id (set by the handler) and headers.
+func applyChatQuirks(ctx *fasthttp.RequestCtx, quirk string, req GenericRequest, resp *OpenAIChatCompletionsResponse) {
+	setQuirkHeaders(ctx, quirk)
+	switch quirk {
+	case "vllm", "sgl":
+		choice := &resp.Choices[0]
+		if quirkAbortPercent > 0 && rand.Intn(100) < quirkAbortPercent {
+			choice.FinishReason = StrPtr("abort")
+		}
+		if quirk == "sgl" {
+			if *choice.FinishReason == "stop" {
+				choice.MatchedStop = new(int)
+				*choice.MatchedStop = llamaEOSTokenID
+			}
+			break
+		}
+		choice.StopReason = json.RawMessage("null")
+		resp.PromptLogprobs, resp.KVTransferParams = json.RawMessage("null"), json.RawMessage("null")
+		if req.PromptLogprobs != nil && *req.PromptLogprobs >= 0 {
+			resp.PromptLogprobs = buildPromptLogprobs(resp.Usage.PromptTokens, *req.PromptLogprobs)
+		}
+	case "groq":
+		resp.XGroq = &GroqMetadata{ID: "req_" + randomAlphanumeric(26)}
+		queue, prompt, completion := rand.Float64()*0.05, rand.Float64()*0.01, rand.Float64()*0.5
+		total := queue + prompt + completion
+		resp.Usage.QueueTime, resp.Usage.PromptTime, resp.Usage.CompletionTime, resp.Usage.TotalTime = &queue, &prompt, &completion, &total
+	case "perplexity":
+		resp.Citations, resp.SearchResults = mockCitationURLs(), mockCitations
+		citationTokens, searchQueries := rand.Intn(2000), 1
+		resp.Usage.CitationTokens, resp.Usage.NumSearchQueries, resp.Usage.SearchContextSize = &citationTokens, &searchQueries, "low"
+	case "xai":
+		resp.SystemFingerprint = StrPtr("fp_" + strings.ToLower(randomAlphanumeric(10)))
+		sources := 0
+		resp.Usage.NumSourcesUsed = &sources
+	}
+}
+
+// streamQuirks are the provider extras added to streamed chunks.
+type streamQuirks struct {
+	first QuirkFields // first chunk only
+	every QuirkFields // every content chunk
+}
+
+func (q streamQuirks) chunk(i int) QuirkFields {
+	if i == 0 {
+		return q.first
+	}
+	return q.every
+}
+
+// streamQuirkFields sets quirk's headers and returns the fields its provider
+// adds to chunks: Groq's x_groq on the first chunk, Perplexity's citations on
+// every chunk.
+func streamQuirkFields(ctx *fasthttp.RequestCtx, quirk string) streamQuirks {
+	setQuirkHeaders(ctx, quirk)
+	var q streamQuirks
+	switch quirk {
+	case "groq":
+		q.first.XGroq = &GroqMetadata{ID: "req_" + randomAlphanumeric(26)}
+	case "perplexity":
+		q.every = QuirkFields{Citations: mockCitationURLs(), SearchResults: mockCitations}
+		q.first = q.every
+	}
+	return q
+}
+
+func mockChatCompletionsHandler(ctx *fasthttp.RequestCtx) {
+	if !checkAuth(ctx) || !checkMethod(ctx) || !checkAzureAIInference(ctx) {
+		return
+	}
+	req := parseGenericRequest(ctx)
+	provider, model := parseProviderAndModel(req.Model)
+	stream := req.Stream
+	flavor := requestAPIFlavor(ctx)
+	if v, rejected := apiFlavorRejection(flavor, req); rejected {
+		sendProviderErrorVariant(ctx, "openai", v)
+		return
+	}
+
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
+	if !applyRateLimitHeaders(ctx) || isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+		sendRateLimitResponse(ctx)
+		return
+	}
+	if maybeSendRandomProviderError(ctx, provider) {
+		return
+	}
+
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "openai")
+		return
+	}
+	refuse := shouldRefuse()
+	if refuse {
+		served.inject(refusalMode)
+	}
+	if refuse && refusalMode == "content_filter" {
+		sendProviderErrorVariant(ctx, "openai", contentFilterVariant())
 		return
 	}
 	if provider != "" {
@@ -1337,9 +3295,27 @@ func mockChatCompletionsHandler(ctx *fasthttp.RequestCtx) {
 		log.Printf("[chat/completions] model=%s stream=%v", model, stream)
 	}
 
-	mockContent := "This is a mocked response from the OpenAI mocker server."
-	if bigPayload {
-		mockContent = strings.Repeat(mockContent, 182)
+	size := responseSize()
+	mockContent := mockContentOfSize(responseBase(ctx, "This is a mocked response from the OpenAI mocker server."), size)
+	if refuse {
+		mockContent = mockRefusalText
+	}
+
+	// OpenRouter-routed traffic gets a generation id, the upstream provider
+	// name, and the vendor-prefixed model slug, in the body and x-openrouter-*
+	// headers.
+	id, upstream := "cmpl-mock12345", ""
+	if route, ok := resolveOpenRouterRoute(string(ctx.Path()), req.Model); ok {
+		id, upstream, model = route.GenerationID, route.Provider, route.Model
+		ctx.Response.Header.Set("x-openrouter-generation-id", route.GenerationID)
+		ctx.Response.Header.Set("x-openrouter-provider", route.Provider)
+		provider = ""
+	}
+
+	reasoningTokens := resolveReasoningTokens(model, req.ReasoningEffort)
+	quirk := resolveQuirkProvider(provider, model)
+	if quirk == "mistral" {
+		id = "cmpl-" + mockHexID(32)
 	}
 
 	// Check if streaming is requested
@@ -1347,43 +3323,78 @@ func mockChatCompletionsHandler(ctx *fasthttp.RequestCtx) {
 		if provider == "anthropic" {
 			sendAnthropicStreamingResponse(ctx, model, mockContent)
 		} else {
-			sendOpenAIStreamingResponse(ctx, model, mockContent)
+			sendOpenAIStreamingResponse(ctx, id, upstream, model, mockContent, openAIStreamOptions{
+				IncludeUsage:    req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+				Refusal:         refuse,
+				ReasoningTokens: reasoningTokens,
+				LogprobsDepth:   resolveLogprobsDepth(req),
+				Quirk:           quirk,
+			})
 		}
 		return
 	}
 
 	// Non-streaming requests get the full latency upfront
-	simulateLatency(string(ctx.Request.Header.Peek("Authorization")))
+	simulateRequestLatency(ctx)
+	time.Sleep(reasoningDelay(reasoningTokens))
 
 	// Non-streaming response
 	mockChoiceMessage := schemas.BifrostResponseChoiceMessage{
 		Role:    schemas.ModelChatMessageRole("assistant"),
 		Content: StrPtr(mockContent),
 	}
-	mockChoice := schemas.BifrostResponseChoice{
+	if refuse {
+		mockChoiceMessage.Content, mockChoiceMessage.Refusal = nil, StrPtr(mockContent)
+	}
+	mockChoice := OpenAIChatChoice{
 		Index:        0,
 		Message:      mockChoiceMessage,
 		FinishReason: StrPtr("stop"),
 	}
+	if depth := resolveLogprobsDepth(req); depth >= 0 {
+		mockChoice.LogProbs = buildLogProbs(mockContent, depth, refuse)
+	}
 
 	randomInputTokens := resolveInputTokens(rand.Intn(1000))
 	randomOutputTokens := resolveOutputTokens(rand.Intn(1000))
 
 	mockResp := OpenAIChatCompletionsResponse{
-		ID:      "cmpl-mock12345",
+		ID:      id,
 		Object:  "chat.completion",
 		Created: int(time.Now().Unix()),
 		Model:   model,
-		Choices: []schemas.BifrostResponseChoice{mockChoice},
-		Usage: schemas.LLMUsage{
+		Choices: []OpenAIChatChoice{mockChoice},
+		Usage: ChatUsage{LLMUsage: schemas.LLMUsage{
 			PromptTokens:     randomInputTokens,
 			CompletionTokens: randomOutputTokens,
 			TotalTokens:      randomInputTokens + randomOutputTokens,
-		},
+		}},
+		Provider: upstream,
+	}
+	if flavor == "current" {
+		mockResp.ServiceTier = StrPtr("default")
+		mockResp.SystemFingerprint = StrPtr("fp_mock")
+		mockResp.Usage.TokenDetails = &schemas.TokenDetails{}
+		mockResp.Usage.CompletionTokensDetails = &schemas.CompletionTokensDetails{}
 	}
+	addReasoningUsage(&mockResp.Usage.LLMUsage, reasoningTokens)
+	applyPromptCache(&mockResp.Usage.LLMUsage)
+	applyChatQuirks(ctx, quirk, req, &mockResp)
+	chargeQuota(requestAPIKey(ctx), mockResp.Usage.LLMUsage)
 
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
+	// Only the timestamp and usage vary between plain completions of the same
+	// model and size, so the pool splices them into a pre-rendered body
+	// instead of encoding the (possibly large) content on every request.
+	if responsePool && responseTemplate == nil && !refuse && upstream == "" && quirk == "" && mockChoice.LogProbs == nil {
+		if tmpl := pooledChatTemplate(mockResp, size, flavor); tmpl != nil {
+			if err := tmpl.write(ctx, mockResp.Created, mockResp.Usage); err == nil {
+				return
+			}
+			ctx.ResetBody()
+		}
+	}
 	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(mockResp); err != nil {
 		log.Printf("Error encoding mock response: %v", err)
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
@@ -1397,7 +3408,11 @@ func mockResponsesHandler(ctx *fasthttp.RequestCtx) {
 	}
 	provider, model, _ := parseModelFromRequest(ctx)
 
-	if isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
+	if !applyRateLimitHeaders(ctx) || isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
 		sendRateLimitResponse(ctx)
 		return
 	}
@@ -1405,8 +3420,8 @@ func mockResponsesHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if shouldFail(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "openai")
 		return
 	}
 
@@ -1416,12 +3431,9 @@ func mockResponsesHandler(ctx *fasthttp.RequestCtx) {
 		log.Printf("[responses] model=%s", model)
 	}
 
-	simulateLatency(string(ctx.Request.Header.Peek("Authorization")))
+	simulateRequestLatency(ctx)
 
-	mockContent := "This is a mocked response from the OpenAI mocker server."
-	if bigPayload {
-		mockContent = strings.Repeat(mockContent, 182)
-	}
+	mockContent := mockResponseContent(responseBase(ctx, "This is a mocked response from the OpenAI mocker server."))
 
 	randomInputTokens := resolveInputTokens(rand.Intn(1000))
 	randomOutputTokens := resolveOutputTokens(rand.Intn(1000))
@@ -1451,6 +3463,7 @@ func mockResponsesHandler(ctx *fasthttp.RequestCtx) {
 			TotalTokens:      randomInputTokens + randomOutputTokens,
 		},
 	}
+	chargeQuota(requestAPIKey(ctx), resp.Usage)
 
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
@@ -1461,13 +3474,98 @@ func mockResponsesHandler(ctx *fasthttp.RequestCtx) {
 	}
 }
 
-func mockEmbeddingsHandler(ctx *fasthttp.RequestCtx) {
+// mockCompletionsHandler serves the legacy text completions API: a prompt in,
+// "text" choices out, one per prompt when prompt is a batch.
+func mockCompletionsHandler(ctx *fasthttp.RequestCtx) {
 	if !checkAuth(ctx) || !checkMethod(ctx) {
 		return
 	}
+	var req OpenAICompletionsRequest
+	_ = sonic.Unmarshal(ctx.Request.Body(), &req)
+	provider, model := parseProviderAndModel(req.Model)
+
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
+	if !applyRateLimitHeaders(ctx) || isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+		sendRateLimitResponse(ctx)
+		return
+	}
+	if maybeSendRandomProviderError(ctx, provider) {
+		return
+	}
+
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "openai")
+		return
+	}
+
+	if model == "gpt-4o-mini" {
+		// Default for completions if no model specified
+		model = "gpt-3.5-turbo-instruct"
+	}
+	if provider != "" {
+		log.Printf("[completions] provider=%s model=%s stream=%v", provider, model, req.Stream)
+	} else {
+		log.Printf("[completions] model=%s stream=%v", model, req.Stream)
+	}
+
+	mockContent := mockResponseContent(responseBase(ctx, "This is a mocked completion from the OpenAI mocker server."))
+	prompts := completionPrompts(req.Prompt)
+
+	if req.Stream {
+		sendCompletionsStreamingResponse(ctx, model, mockContent, prompts, req)
+		return
+	}
+
+	simulateRequestLatency(ctx)
+
+	choices := make([]OpenAICompletionChoice, len(prompts))
+	for i, prompt := range prompts {
+		text := mockContent
+		if req.Echo {
+			text = prompt + text
+		}
+		choices[i] = OpenAICompletionChoice{Text: text, Index: i, FinishReason: StrPtr("stop")}
+	}
+	randomInputTokens := resolveInputTokens(rand.Intn(1000))
+	randomOutputTokens := resolveOutputTokens(rand.Intn(1000))
+
+	resp := OpenAICompletionsResponse{
+		ID:      "cmpl-mock12345",
+		Object:  "text_completion",
+		Created: int(time.Now().Unix()),
+		Model:   model,
+		Choices: choices,
+		Usage: &schemas.LLMUsage{
+			PromptTokens:     randomInputTokens,
+			CompletionTokens: randomOutputTokens,
+			TotalTokens:      randomInputTokens + randomOutputTokens,
+		},
+	}
+	chargeQuota(requestAPIKey(ctx), *resp.Usage)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(resp); err != nil {
+		log.Printf("Error encoding mock response: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to encode response")
+	}
+}
+
+func mockEmbeddingsHandler(ctx *fasthttp.RequestCtx) {
+	if !checkAuth(ctx) || !checkMethod(ctx) || !checkAzureAIInference(ctx) {
+		return
+	}
 	provider, model, _ := parseModelFromRequest(ctx)
 
-	if isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
+	if !applyRateLimitHeaders(ctx) || isKeyRateLimited(ctx) || shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
 		sendRateLimitResponse(ctx)
 		return
 	}
@@ -1475,8 +3573,8 @@ func mockEmbeddingsHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if shouldFail(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "openai")
 		return
 	}
 
@@ -1490,11 +3588,13 @@ func mockEmbeddingsHandler(ctx *fasthttp.RequestCtx) {
 		log.Printf("[embeddings] model=%s", model)
 	}
 
-	simulateLatency(string(ctx.Request.Header.Peek("Authorization")))
+	simulateRequestLatency(ctx)
 
 	embeddingDimensions := 1536
-	if bigPayload {
+	if bigPayload && payloadBytesSpec == "" {
 		embeddingDimensions = 4096
+	} else if payloadBytes > 0 {
+		embeddingDimensions = max(payloadBytes/embeddingBytesPerDimension, 1)
 	}
 
 	embedding := make([]float64, embeddingDimensions)
@@ -1502,7 +3602,11 @@ func mockEmbeddingsHandler(ctx *fasthttp.RequestCtx) {
 		embedding[i] = rand.Float64()*2 - 1
 	}
 
-	numInputs := 1
+	var req struct {
+		Input any `json:"input"`
+	}
+	_ = sonic.Unmarshal(ctx.Request.Body(), &req)
+	numInputs := embeddingInputCount(req.Input)
 	embeddingData := make([]OpenAIEmbeddingData, numInputs)
 	for i := 0; i < numInputs; i++ {
 		embeddingData[i] = OpenAIEmbeddingData{
@@ -1523,6 +3627,7 @@ func mockEmbeddingsHandler(ctx *fasthttp.RequestCtx) {
 			TotalTokens:  randomPromptTokens,
 		},
 	}
+	chargeQuota(requestAPIKey(ctx), resp.Usage)
 
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
@@ -1539,7 +3644,12 @@ func mockAnthropicMessagesHandler(ctx *fasthttp.RequestCtx) {
 	}
 	provider, model, stream := parseAnthropicModelFromRequest(ctx)
 
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
 	if shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+		served.inject("rate_limit")
 		sendErrorResponse(ctx, fasthttp.StatusTooManyRequests, "Rate limit exceeded. Please retry after some time.")
 		return
 	}
@@ -1547,8 +3657,8 @@ func mockAnthropicMessagesHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if shouldFail(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "anthropic")
 		return
 	}
 
@@ -1558,17 +3668,14 @@ func mockAnthropicMessagesHandler(ctx *fasthttp.RequestCtx) {
 		log.Printf("[anthropic/messages] model=%s stream=%v", model, stream)
 	}
 
-	mockContent := "This is a mocked response from the Bifrost mocker server."
-	if bigPayload {
-		mockContent = strings.Repeat(mockContent, 182)
-	}
+	mockContent := mockResponseContent(responseBase(ctx, "This is a mocked response from the Bifrost mocker server."))
 
 	if stream {
 		sendAnthropicStreamingResponse(ctx, model, mockContent)
 		return
 	}
 
-	simulateLatency(string(ctx.Request.Header.Peek("Authorization")))
+	simulateRequestLatency(ctx)
 
 	randomInputTokens := resolveInputTokens(rand.Intn(1000))
 	randomOutputTokens := resolveOutputTokens(rand.Intn(1000))
@@ -1586,6 +3693,7 @@ func mockAnthropicMessagesHandler(ctx *fasthttp.RequestCtx) {
 			OutputTokens: randomOutputTokens,
 		},
 	}
+	chargeQuota(requestAPIKey(ctx), schemas.LLMUsage{PromptTokens: randomInputTokens, CompletionTokens: randomOutputTokens})
 
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
@@ -1603,7 +3711,12 @@ func mockGenAIGenerateContentHandler(ctx *fasthttp.RequestCtx) {
 	provider, model := parseGenAIModelFromPath(string(ctx.Path()))
 	isStreamPath := strings.Contains(string(ctx.Path()), ":streamGenerateContent")
 
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
 	if shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+		served.inject("rate_limit")
 		sendErrorResponse(ctx, fasthttp.StatusTooManyRequests, "Rate limit exceeded. Please retry after some time.")
 		return
 	}
@@ -1611,8 +3724,8 @@ func mockGenAIGenerateContentHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if shouldFail(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "gemini")
 		return
 	}
 
@@ -1622,17 +3735,14 @@ func mockGenAIGenerateContentHandler(ctx *fasthttp.RequestCtx) {
 		log.Printf("[genai/generateContent] model=%s stream=%v", model, isStreamPath)
 	}
 
-	mockContent := "This is a mocked response from the Bifrost mocker server."
-	if bigPayload {
-		mockContent = strings.Repeat(mockContent, 182)
-	}
+	mockContent := mockResponseContent(responseBase(ctx, "This is a mocked response from the Bifrost mocker server."))
 
 	if isStreamPath {
 		sendGenAIStreamingResponse(ctx, model, mockContent)
 		return
 	}
 
-	simulateLatency(string(ctx.Request.Header.Peek("Authorization")))
+	simulateRequestLatency(ctx)
 
 	randomInputTokens := resolveInputTokens(rand.Intn(1000))
 	randomOutputTokens := resolveOutputTokens(rand.Intn(1000))
@@ -1655,6 +3765,7 @@ func mockGenAIGenerateContentHandler(ctx *fasthttp.RequestCtx) {
 		},
 		ModelVersion: model,
 	}
+	chargeQuota(requestAPIKey(ctx), schemas.LLMUsage{PromptTokens: randomInputTokens, CompletionTokens: randomOutputTokens})
 
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
@@ -1671,15 +3782,20 @@ func mockBedrockConverseHandler(ctx *fasthttp.RequestCtx) {
 	}
 	model, isConverse, isStream := parseBedrockModelFromPath(string(ctx.Path()))
 
+	if !hasQuota(ctx) {
+		sendInsufficientQuotaResponse(ctx)
+		return
+	}
 	if shouldTriggerTPM(string(ctx.Request.Header.Peek("Authorization"))) {
+		served.inject("rate_limit")
 		sendErrorResponse(ctx, fasthttp.StatusTooManyRequests, "Rate limit exceeded. Please retry after some time.")
 		return
 	}
 	if maybeSendRandomProviderError(ctx, "bedrock") {
 		return
 	}
-	if shouldFail(string(ctx.Request.Header.Peek("Authorization"))) {
-		sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "The server had an error while processing your request. Sorry about that!")
+	if shouldFailRequest(ctx) {
+		sendFailureResponse(ctx, "bedrock")
 		return
 	}
 	if !isConverse {
@@ -1692,16 +3808,13 @@ func mockBedrockConverseHandler(ctx *fasthttp.RequestCtx) {
 	}
 
 	log.Printf("[bedrock/converse] model=%s stream=%v", model, isStream)
-	mockContent := "This is a mocked response from the Bifrost mocker server."
-	if bigPayload {
-		mockContent = strings.Repeat(mockContent, 182)
-	}
+	mockContent := mockResponseContent(responseBase(ctx, "This is a mocked response from the Bifrost mocker server."))
 	if isStream {
 		sendBedrockConverseStreamingResponse(ctx, model, mockContent)
 		return
 	}
 
-	simulateLatency(string(ctx.Request.Header.Peek("Authorization")))
+	simulateRequestLatency(ctx)
 	randomInputTokens := resolveInputTokens(rand.Intn(1000))
 	randomOutputTokens := resolveOutputTokens(rand.Intn(1000))
 	resp := BedrockConverseResponse{
@@ -1719,6 +3832,7 @@ func mockBedrockConverseHandler(ctx *fasthttp.RequestCtx) {
 		},
 		Metrics: BedrockMetrics{LatencyMs: latency},
 	}
+	chargeQuota(requestAPIKey(ctx), schemas.LLMUsage{PromptTokens: randomInputTokens, CompletionTokens: randomOutputTokens})
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(resp); err != nil {
@@ -1785,6 +3899,42 @@ type OpenAIModelsListResponse struct {
 // -models. It validates auth but deliberately skips latency, failure, and TPM
 // simulation: those flags shape inference behavior, while model discovery
 // should stay deterministic so gateway-side model catalogs can always populate.
+// AzureModelInfo is Azure AI Inference's GET /info response.
+type AzureModelInfo struct {
+	ModelName         string `json:"model_name"`
+	ModelType         string `json:"model_type"`
+	ModelProviderName string `json:"model_provider_name"`
+}
+
+// azureModelInfoHandler answers Azure AI Inference's GET /info with the first
+// -models entry, which is how gateways probe a serverless deployment.
+func azureModelInfoHandler(ctx *fasthttp.RequestCtx) {
+	if !checkAuth(ctx) {
+		return
+	}
+	if !ctx.IsGet() {
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		ctx.SetBodyString("Only GET method is allowed")
+		return
+	}
+	if !checkAzureAIInference(ctx) {
+		return
+	}
+
+	name, _, _ := strings.Cut(modelsList, ",")
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(AzureModelInfo{
+		ModelName:         strings.TrimSpace(name),
+		ModelType:         "chat-completion",
+		ModelProviderName: "Mocker",
+	}); err != nil {
+		log.Printf("Error encoding model info response: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to encode response")
+	}
+}
+
 func mockListModelsHandler(ctx *fasthttp.RequestCtx) {
 	if !checkAuth(ctx) {
 		return
@@ -1865,40 +4015,512 @@ func logRawResponse(ctx *fasthttp.RequestCtx) {
 	log.Printf("--- End Response ---")
 }
 
+// latencyBucketGrowth is the width ratio between consecutive latency histogram
+// buckets; percentiles read from the histogram are accurate to within 5%.
+const latencyBucketGrowth = 1.05
+
+// latencyBuckets covers latencies up to about an hour at latencyBucketGrowth.
+const latencyBuckets = 460
+
+// latencyHistogram is a fixed-size log-bucketed histogram of served latencies,
+// cheap enough to update on every request for the life of the server.
+type latencyHistogram struct {
+	counts   [latencyBuckets]int64
+	count    int64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+// latencyBucket returns the bucket d falls in; bucket i holds latencies up to
+// latencyBucketUpper(i).
+func latencyBucket(d time.Duration) int {
+	us := float64(d.Microseconds())
+	if us <= 1 {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(us) / math.Log(latencyBucketGrowth)))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+// latencyBucketUpper returns the upper bound of bucket i.
+func latencyBucketUpper(i int) time.Duration {
+	return time.Duration(math.Pow(latencyBucketGrowth, float64(i))) * time.Microsecond
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[latencyBucket(d)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// quantile estimates the q-th quantile (0-1) as the upper bound of the bucket
+// it falls in, capped at the exact maximum.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if upper := latencyBucketUpper(i); upper < h.max {
+				return upper
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// latencySummary is the JSON latency block of /stats, in milliseconds.
+type latencySummary struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func (h *latencyHistogram) summary() latencySummary {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	s := latencySummary{Count: h.count}
+	if h.count == 0 {
+		return s
+	}
+	s.Min, s.Max = ms(h.min), ms(h.max)
+	s.Mean = ms(h.sum / time.Duration(h.count))
+	s.P50, s.P90, s.P99 = ms(h.quantile(0.50)), ms(h.quantile(0.90)), ms(h.quantile(0.99))
+	return s
+}
+
+// latencyReportBounds are the upper bounds of the bins in the shutdown latency
+// report; anything slower lands in a final "+Inf" bin.
+var latencyReportBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// latencyBin is one bin of the shutdown latency report; counts are per bin,
+// not cumulative.
+type latencyBin struct {
+	Le    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// bins folds the fine histogram buckets into latencyReportBounds. A bucket is
+// placed by its upper bound, so counts near a bin edge may shift by up to one
+// bucket width (5%).
+func (h *latencyHistogram) bins() []latencyBin {
+	bins := make([]latencyBin, len(latencyReportBounds)+1)
+	for i, bound := range latencyReportBounds {
+		bins[i].Le = bound.String()
+	}
+	bins[len(latencyReportBounds)].Le = "+Inf"
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		upper := latencyBucketUpper(i)
+		j := sort.Search(len(latencyReportBounds), func(j int) bool { return latencyReportBounds[j] >= upper })
+		bins[j].Count += c
+	}
+	return bins
+}
+
+// latencyReport is the shutdown latency report written by -latency-report.
+// The configured values are echoed so the observed distribution can be checked
+// against the latency model the run was started with.
+type latencyReport struct {
+	UptimeSeconds       float64        `json:"uptime_seconds"`
+	ConfiguredLatencyMs int            `json:"configured_latency_ms"`
+	ConfiguredJitterMs  int            `json:"configured_jitter_ms"`
+	Latency             latencySummary `json:"latency"`
+	Histogram           []latencyBin   `json:"histogram"`
+}
+
+// serveStats counts what the server actually served, for /stats and the
+// summary printed on shutdown. Status codes are recorded once the handler
+// returns; for streaming responses that is when headers are committed, not
+// when the stream ends. Latencies of streams run to their last chunk.
+type serveStats struct {
+	mu         sync.Mutex
+	since      time.Time
+	total      int64
+	byStatus   map[int]int64
+	byEndpoint map[string]int64
+	byPort     map[int]int64
+	injected   map[string]int64
+	latency    latencyHistogram
+}
+
+func newServeStats() *serveStats {
+	return &serveStats{
+		since:      time.Now(),
+		byStatus:   make(map[int]int64),
+		byEndpoint: make(map[string]int64),
+		byPort:     make(map[int]int64),
+		injected:   make(map[string]int64),
+	}
+}
+
+var served = newServeStats()
+
+// inflight counts requests currently being served, streams included.
+var inflight atomic.Int64
+
+// requestSeq numbers requests for x-mock-request-id.
+var requestSeq atomic.Uint64
+
+// setDebugHeaders tags the response with x-mock-request-id and
+// x-mock-processing-ms, the time from reading the request to sending the
+// headers. That includes injected latency for regular responses; streams send
+// their headers before the injected latency, which is spread between chunks.
+// Clients can subtract it from their own latency to get transport and gateway
+// overhead per request.
+func setDebugHeaders(ctx *fasthttp.RequestCtx, id uint64) {
+	ctx.Response.Header.Set("x-mock-request-id", "mock-"+strconv.FormatUint(id, 10))
+	ms := float64(time.Since(ctx.Time())) / float64(time.Millisecond)
+	ctx.Response.Header.Set("x-mock-processing-ms", strconv.FormatFloat(ms, 'f', 3, 64))
+}
+
+// record counts one response; port is the listener it was served on, or 0
+// when only one port is open.
+func (s *serveStats) record(endpoint string, port, status int) {
+	s.mu.Lock()
+	s.total++
+	s.byStatus[status]++
+	s.byEndpoint[endpoint]++
+	if port > 0 {
+		s.byPort[port]++
+	}
+	s.mu.Unlock()
+}
+
+// recordLatency adds one served latency, injected delays included.
+func (s *serveStats) recordLatency(d time.Duration) {
+	s.mu.Lock()
+	s.latency.record(d)
+	s.mu.Unlock()
+}
+
+// inject counts a simulated fault of the given kind, e.g. "failure" or "rate_limit".
+func (s *serveStats) inject(kind string) {
+	s.mu.Lock()
+	s.injected[kind]++
+	s.mu.Unlock()
+}
+
+// reset zeroes every counter, starting a new /stats window.
+func (s *serveStats) reset() {
+	fresh := newServeStats()
+	s.mu.Lock()
+	s.since, s.total = fresh.since, 0
+	s.byStatus, s.byEndpoint, s.byPort, s.injected = fresh.byStatus, fresh.byEndpoint, fresh.byPort, fresh.injected
+	s.latency = latencyHistogram{}
+	s.mu.Unlock()
+}
+
+// statsResponse is the body of GET /stats.
+type statsResponse struct {
+	UptimeSeconds float64          `json:"uptime_seconds"`
+	Total         int64            `json:"total"`
+	Inflight      int64            `json:"inflight"`
+	ByEndpoint    map[string]int64 `json:"by_endpoint"`
+	ByStatus      map[string]int64 `json:"by_status"`
+	ByPort        map[string]int64 `json:"by_port,omitempty"`
+	Injected      map[string]int64 `json:"injected"`
+	Latency       latencySummary   `json:"latency"`
+}
+
+func (s *serveStats) snapshot() statsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := statsResponse{
+		UptimeSeconds: time.Since(s.since).Seconds(),
+		Total:         s.total,
+		Inflight:      inflight.Load(),
+		ByEndpoint:    make(map[string]int64, len(s.byEndpoint)),
+		ByStatus:      make(map[string]int64, len(s.byStatus)),
+		Injected:      make(map[string]int64, len(s.injected)),
+		Latency:       s.latency.summary(),
+	}
+	for endpoint, n := range s.byEndpoint {
+		resp.ByEndpoint[endpoint] = n
+	}
+	for code, n := range s.byStatus {
+		resp.ByStatus[strconv.Itoa(code)] = n
+	}
+	if len(s.byPort) > 0 {
+		resp.ByPort = make(map[string]int64, len(s.byPort))
+		for p, n := range s.byPort {
+			resp.ByPort[strconv.Itoa(p)] = n
+		}
+	}
+	for kind, n := range s.injected {
+		resp.Injected[kind] = n
+	}
+	return resp
+}
+
+// statsHandler reports what the mocker served since startup (or the last
+// ?reset=true), so a benchmark harness can cross-check gateway-reported numbers
+// against what the upstream actually saw.
+func statsHandler(ctx *fasthttp.RequestCtx) {
+	snapshot := served.snapshot()
+	if string(ctx.QueryArgs().Peek("reset")) == "true" {
+		served.reset()
+	}
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	if err := sonic.ConfigDefault.NewEncoder(ctx).Encode(snapshot); err != nil {
+		log.Printf("Error encoding stats response: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	}
+}
+
+// latencyReport snapshots the served-latency distribution.
+func (s *serveStats) latencyReport(uptime time.Duration) latencyReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return latencyReport{
+		UptimeSeconds:       uptime.Seconds(),
+		ConfiguredLatencyMs: latency,
+		ConfiguredJitterMs:  jitter,
+		Latency:             s.latency.summary(),
+		Histogram:           s.latency.bins(),
+	}
+}
+
+// logSummary prints the served-request totals, per-status breakdown, and the
+// served-latency histogram.
+func (s *serveStats) logSummary(uptime time.Duration) {
+	s.mu.Lock()
+	log.Printf("Served %d request(s) in %s", s.total, uptime.Truncate(time.Millisecond))
+	codes := make([]int, 0, len(s.byStatus))
+	for code := range s.byStatus {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		log.Printf("  %d %s: %d", code, fasthttp.StatusMessage(code), s.byStatus[code])
+	}
+	ports := make([]int, 0, len(s.byPort))
+	for p := range s.byPort {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	for _, p := range ports {
+		log.Printf("  port %d: %d", p, s.byPort[p])
+	}
+	s.mu.Unlock()
+
+	report := s.latencyReport(uptime)
+	if report.Latency.Count == 0 {
+		return
+	}
+	l := report.Latency
+	log.Printf("Latency (ms): min %.2f, mean %.2f, p50 %.2f, p90 %.2f, p99 %.2f, max %.2f",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.Max)
+
+	// Print from the first to the last non-empty bin, with bars scaled to the fullest.
+	first, last := -1, 0
+	var peak int64
+	for i, bin := range report.Histogram {
+		if bin.Count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		peak = max(peak, bin.Count)
+	}
+	for _, bin := range report.Histogram[first : last+1] {
+		bar := strings.Repeat("#", int(math.Ceil(40*float64(bin.Count)/float64(peak))))
+		log.Printf("  <= %-6s %8d %s", bin.Le, bin.Count, bar)
+	}
+}
+
+// writeLatencyReport writes the served-latency report to path as JSON.
+func writeLatencyReport(path string, report latencyReport) error {
+	data, err := sonic.ConfigDefault.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// endpointName labels a request path for /stats, folding model-bearing paths
+// (Bedrock, GenAI) and route aliases into one name per API.
+func endpointName(path string) string {
+	if name, ok := azureAIInferencePaths[path]; ok {
+		return name
+	}
+	switch path {
+	case "/health":
+		return "health"
+	case "/models", "/openai/models", "/openai/v1/models", "/api/v1/models", "/v1/models":
+		return "models"
+	case "/chat/completions", "/v1/chat/completions", "/openai/chat/completions", "/openai/v1/chat/completions", "/api/v1/chat/completions":
+		return "chat/completions"
+	case "/responses", "/v1/responses", "/openai/responses", "/openai/v1/responses":
+		return "responses"
+	case "/embeddings", "/v1/embeddings", "/openai/embeddings", "/openai/v1/embeddings":
+		return "embeddings"
+	case "/completions", "/v1/completions", "/openai/completions", "/openai/v1/completions":
+		return "completions"
+	case "/anthropic/v1/messages", "/anthropic/messages", "/v1/messages":
+		return "messages"
+	}
+	if _, isConverse, _ := parseBedrockModelFromPath(path); isConverse {
+		return "converse"
+	}
+	if (strings.HasPrefix(path, "/models/") ||
+		strings.HasPrefix(path, "/v1beta/models/") ||
+		strings.HasPrefix(path, "/v1/models/") ||
+		strings.HasPrefix(path, "/genai/v1beta/models/") ||
+		strings.HasPrefix(path, "/genai/v1/models/")) &&
+		(strings.Contains(path, ":generateContent") || strings.Contains(path, ":streamGenerateContent")) {
+		return "generateContent"
+	}
+	return "other"
+}
+
+// corsPreflightMaxAge is how long browsers may cache a preflight answer.
+const corsPreflightMaxAge = "600"
+
+// corsOriginAllowed reports whether origin is in -cors-origins ("*" allows any).
+func corsOriginAllowed(origin string) bool {
+	for _, o := range strings.Split(corsOrigins, ",") {
+		if o = strings.TrimSpace(o); o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCORS adds CORS headers for allowed browser origins and answers
+// preflight OPTIONS requests, reporting whether the request was handled.
+// Preflights are answered before stats are recorded, so dashboards don't
+// double their own request counts.
+func applyCORS(ctx *fasthttp.RequestCtx) bool {
+	if corsOrigins == "" {
+		return false
+	}
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	if origin == "" || !corsOriginAllowed(origin) {
+		return false
+	}
+	h := &ctx.Response.Header
+	if strings.TrimSpace(corsOrigins) == "*" {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	// Lets browser code read x-ratelimit-*, retry-after and friends.
+	h.Set("Access-Control-Expose-Headers", "*")
+
+	if !ctx.IsOptions() || len(ctx.Request.Header.Peek("Access-Control-Request-Method")) == 0 {
+		return false
+	}
+	allowHeaders := corsHeaders
+	if allowHeaders == "" {
+		allowHeaders = string(ctx.Request.Header.Peek("Access-Control-Request-Headers"))
+	}
+	h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", allowHeaders)
+	}
+	h.Set("Access-Control-Max-Age", corsPreflightMaxAge)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+	return true
+}
+
 // router handles routing requests to appropriate handlers
 func router(ctx *fasthttp.RequestCtx) {
+	defer setDebugHeaders(ctx, requestSeq.Add(1))
 	logRawRequest(ctx)
+	if applyCORS(ctx) {
+		return
+	}
 	path := string(ctx.Path())
+	if path == "/stats" {
+		// Not counted, so polling it doesn't skew the numbers it reports.
+		statsHandler(ctx)
+		return
+	}
+	endpoint := endpointName(path)
+	defer func() {
+		served.record(endpoint, listenerPort(ctx), ctx.Response.StatusCode())
+		if ctx.UserValue(streamingKey) == nil {
+			served.recordLatency(time.Since(ctx.Time()))
+		}
+	}()
 
-	switch path {
-	case "/health":
+	// Simulate a capacity-limited upstream: past -max-inflight concurrent
+	// requests, shed load with 503 instead of queueing. /health is exempt.
+	if n := inflight.Add(1); maxInflight > 0 && n > int64(maxInflight) && path != "/health" {
+		inflight.Add(-1)
+		sendOverloadedResponse(ctx)
+		return
+	}
+	defer func() {
+		if ctx.UserValue(streamingKey) == nil {
+			inflight.Add(-1)
+		}
+	}()
+
+	if headerDelay > 0 && endpoint != "health" && endpoint != "models" && endpoint != "other" {
+		time.Sleep(time.Duration(headerDelay) * time.Millisecond)
+		defer delayBodyAfterHeaders(ctx)
+	}
+
+	switch endpoint {
+	case "health":
 		healthCheckHandler(ctx)
-	case "/models", "/openai/models", "/openai/v1/models":
-		mockListModelsHandler(ctx)
-	case "/chat/completions", "/v1/chat/completions", "/openai/chat/completions", "/openai/v1/chat/completions":
+	case "models":
+		switch path {
+		case "/v1/models":
+			mockModelsHandler(ctx)
+		case "/models/info", "/info":
+			azureModelInfoHandler(ctx)
+		default:
+			mockListModelsHandler(ctx)
+		}
+	case "chat/completions":
 		mockChatCompletionsHandler(ctx)
-	case "/responses", "/v1/responses", "/openai/responses", "/openai/v1/responses":
+	case "responses":
 		mockResponsesHandler(ctx)
-	case "/embeddings", "/v1/embeddings", "/openai/embeddings", "/openai/v1/embeddings":
+	case "completions":
+		mockCompletionsHandler(ctx)
+	case "embeddings":
 		mockEmbeddingsHandler(ctx)
-	case "/anthropic/v1/messages", "/anthropic/messages", "/v1/messages":
+	case "messages":
 		mockAnthropicMessagesHandler(ctx)
-	case "/v1/models":
-		mockModelsHandler(ctx)
+	case "converse":
+		mockBedrockConverseHandler(ctx)
+	case "generateContent":
+		mockGenAIGenerateContentHandler(ctx)
 	default:
-		if _, isConverse, _ := parseBedrockModelFromPath(path); isConverse {
-			mockBedrockConverseHandler(ctx)
-			return
-		}
-		if (strings.HasPrefix(path, "/models/") ||
-			strings.HasPrefix(path, "/v1beta/models/") ||
-			strings.HasPrefix(path, "/v1/models/") ||
-			strings.HasPrefix(path, "/genai/v1beta/models/") ||
-			strings.HasPrefix(path, "/genai/v1/models/")) &&
-			(strings.Contains(path, ":generateContent") || strings.Contains(path, ":streamGenerateContent")) {
-			mockGenAIGenerateContentHandler(ctx)
-			return
-		}
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		ctx.SetBodyString("Not found")
 	}
@@ -1907,8 +4529,84 @@ func router(ctx *fasthttp.RequestCtx) {
 func main() {
 	flag.Parse()
 
+	if authScheme != "authorization" && authScheme != "provider" {
+		log.Fatalf("Invalid -auth-scheme %q: must be 'authorization' or 'provider'", authScheme)
+	}
+	if failureMode != "error" && failureMode != "overload" {
+		log.Fatalf("Invalid -failure-mode %q: must be 'error' or 'overload'", failureMode)
+	}
+	if !validAPIFlavor(apiFlavor) {
+		log.Fatalf("Invalid -api-flavor %q: must be 'compat', 'legacy' or 'current'", apiFlavor)
+	}
+	if cacheHitPercent < 0 || cacheHitPercent > 100 {
+		log.Fatalf("Invalid -cache-hit-percent %d: must be between 0 and 100", cacheHitPercent)
+	}
+	if cachedTokenPercent < 0 || cachedTokenPercent > 100 {
+		log.Fatalf("Invalid -cached-token-percent %d: must be between 0 and 100", cachedTokenPercent)
+	}
+	if reasoningBudget < 0 {
+		log.Fatalf("Invalid -reasoning-budget %d: must not be negative", reasoningBudget)
+	}
+	if reasoningTPS <= 0 {
+		log.Fatalf("Invalid -reasoning-tps %d: must be greater than 0", reasoningTPS)
+	}
+	if readTimeout < 0 || writeTimeout < 0 || idleTimeout < 0 || maxConnRequests < 0 {
+		log.Fatalf("Invalid connection settings: -read-timeout, -write-timeout, -idle-timeout and -max-keepalive-requests must not be negative")
+	}
+	if refusalPercent < 0 || refusalPercent > 100 {
+		log.Fatalf("Invalid -refusal-percent %d: must be between 0 and 100", refusalPercent)
+	}
+	if quirkAbortPercent < 0 || quirkAbortPercent > 100 {
+		log.Fatalf("Invalid -quirk-abort-percent %d: must be between 0 and 100", quirkAbortPercent)
+	}
+	if refusalMode != "refusal" && refusalMode != "content_filter" {
+		log.Fatalf("Invalid -refusal-mode %q: must be 'refusal' or 'content_filter'", refusalMode)
+	}
+	if payloadBytesSpec != "" {
+		n, err := parseByteSize(payloadBytesSpec)
+		if err != nil {
+			log.Fatalf("Invalid -payload-bytes: %v", err)
+		}
+		payloadBytes = n
+	} else if bigPayload {
+		payloadBytes = bigPayloadBytes
+	}
+	if lengthDistSpec != "" {
+		if payloadBytes > 0 {
+			log.Fatalf("-length-distribution cannot be combined with -payload-bytes or -big-payload")
+		}
+		buckets, err := parseLengthDistribution(lengthDistSpec)
+		if err != nil {
+			log.Fatalf("Invalid -length-distribution: %v", err)
+		}
+		lengthDistribution = buckets
+	}
+
+	if templatePath != "" {
+		tmpl, err := loadResponseTemplate(templatePath)
+		if err != nil {
+			log.Fatalf("Invalid -response-template: %v", err)
+		}
+		responseTemplate = tmpl
+		log.Printf("Response text rendered from template %s", templatePath)
+	}
+
 	startTime = time.Now()
 
+	if keyProfilesPath != "" {
+		profiles, err := loadKeyProfiles(keyProfilesPath)
+		if err != nil {
+			log.Fatalf("Invalid -key-profiles: %v", err)
+		}
+		for key, rp := range profiles {
+			if rp.flavor != "" {
+				log.Fatalf("Invalid -key-profiles: key %q: api_flavor is only supported in -port-profiles", key)
+			}
+		}
+		keyProfiles = profiles
+		log.Printf("Loaded latency/failure profiles for %d key(s) from %s", len(keyProfiles), keyProfilesPath)
+	}
+
 	rateLimitedKeyMap = make(map[string]bool)
 	if rateLimitedKeys != "" {
 		for _, k := range strings.Split(rateLimitedKeys, ",") {
@@ -1919,6 +4617,13 @@ func main() {
 		log.Printf("Per-key rate limiting enabled for %d key(s)", len(rateLimitedKeyMap))
 	}
 
+	parseKVList(quotaKeys, func(token string, tokens int, _ string) {
+		quotaLimits[token] = tokens
+	})
+	if quotaTokens > 0 || len(quotaLimits) > 0 {
+		log.Printf("Token quota enabled: %d tokens per key (0 = unlimited), %d key-specific budget(s); exhausted keys get 429 insufficient_quota", quotaTokens, len(quotaLimits))
+	}
+
 	// Parse dynamic per-key latency behaviors.
 	parseKVList(latencySpikeKeys, func(token string, pct int, b string) {
 		mult := 5.0
@@ -1940,7 +4645,65 @@ func main() {
 		log.Printf("Latency step for %q: at %ds base -> %dms", token, atSec, toMs)
 	})
 
-	addr := fmt.Sprintf("%s:%d", host, port)
+	if degradedPercent > 0 {
+		if degradedPercent > 100 {
+			log.Fatalf("-degraded-percent must be between 0 and 100, got %d", degradedPercent)
+		}
+		if degradedBy != "conn" && degradedBy != "key" {
+			log.Fatalf("-degraded-by must be conn or key, got %q", degradedBy)
+		}
+		unit := "connections"
+		if degradedBy == "key" {
+			unit = "API keys"
+		}
+		log.Printf("Degraded mode: %d%% of %s get +%dms latency", degradedPercent, unit, degradedLatency)
+	}
+
+	// Without -listen, -host with -port or -ports make up the list, and
+	// -unix-socket is shorthand for one more unix: entry.
+	spec := listenSpec
+	if spec != "" && portsSpec != "" {
+		log.Fatalf("-listen and -ports cannot be combined; list every address in -listen")
+	}
+	if spec == "" {
+		ports := []int{port}
+		if portsSpec != "" {
+			var err error
+			if ports, err = parsePorts(portsSpec); err != nil {
+				log.Fatalf("Invalid -ports: %v", err)
+			}
+		}
+		entries := make([]string, len(ports))
+		for i, p := range ports {
+			entries[i] = net.JoinHostPort(host, strconv.Itoa(p))
+		}
+		spec = strings.Join(entries, ",")
+	}
+	if unixSocket != "" {
+		spec += ",unix:" + unixSocket
+	}
+	listenAddrs, err := parseListenAddrs(spec)
+	if err != nil {
+		log.Fatalf("Invalid -listen: %v", err)
+	}
+	for _, a := range listenAddrs {
+		if a.network != "unix" {
+			listenPorts = append(listenPorts, a.port)
+		}
+	}
+	if portProfilesPath != "" {
+		profiles, err := loadPortProfiles(portProfilesPath, listenPorts)
+		if err != nil {
+			log.Fatalf("Failed to load -port-profiles: %v", err)
+		}
+		portProfiles = profiles
+		log.Printf("Loaded latency/failure profiles for %d port(s) from %s", len(portProfiles), portProfilesPath)
+	}
+	addrs := make([]string, len(listenAddrs))
+	for i, a := range listenAddrs {
+		addrs[i] = a.String()
+	}
+	addr := strings.Join(addrs, ", ")
 	if jitter > 0 {
 		log.Printf("Mock LLM server (fasthttp) starting on %s with latency %dms ±%dms jitter...\n", addr, latency, jitter)
 	} else {
@@ -1949,9 +4712,49 @@ func main() {
 	if latencyAuthKeys != "" {
 		log.Printf("Latency will only apply to requests with auth keys: %s", latencyAuthKeys)
 	}
+	if failureMode == "overload" {
+		log.Printf("Failure simulation will send provider-specific overload responses (503/529/429)")
+	}
+	if apiFlavor != "compat" {
+		log.Printf("Emulating the %s OpenAI chat completions API", apiFlavor)
+	}
+	if cacheHitPercent > 0 {
+		log.Printf("Prompt-cache simulation enabled: %d%% of chat completions report %d%% of prompt tokens as cached", cacheHitPercent, cachedTokenPercent)
+	}
+	if readTimeout != 300 || writeTimeout != 300 || idleTimeout != 60 || maxConnRequests != 0 {
+		log.Printf("Connection settings: read timeout %ds, write timeout %ds, idle timeout %ds, max requests per connection %d (0 = unlimited)",
+			readTimeout, writeTimeout, idleTimeout, maxConnRequests)
+	}
+	if reasoningBudget > 0 {
+		log.Printf("Reasoning simulation enabled: up to %d reasoning tokens at %d tokens/s for models prefixed %s", reasoningBudget, reasoningTPS, reasoningModels)
+	}
+	if refusalPercent > 0 {
+		log.Printf("Refusal simulation enabled: %d%% of chat completions get a %s response", refusalPercent, refusalMode)
+	}
 	if failureAuthKeys != "" {
 		log.Printf("Failure simulation will only apply to requests with auth keys: %s", failureAuthKeys)
 	}
+	if payloadBytes > 0 {
+		log.Printf("Response payloads sized to %d bytes", payloadBytes)
+	}
+	if len(lengthDistribution) > 0 {
+		log.Printf("Response payloads sized by distribution: %s", lengthDistSpec)
+	}
+	if providerQuirks {
+		log.Printf("Provider quirks enabled for groq/, perplexity/ (sonar*), xai/ (grok-*), vllm/ and sgl/ chat completions")
+	}
+	if corsOrigins != "" {
+		log.Printf("CORS enabled for origins: %s", corsOrigins)
+	}
+	if !responsePool {
+		log.Printf("Response pool disabled: every response is built and encoded per request")
+	}
+	if rateLimitRequests > 0 || rateLimitTokens > 0 {
+		log.Printf("x-ratelimit-* headers enabled: %d requests/min, %d tokens/min per key (0 = not tracked)", rateLimitRequests, rateLimitTokens)
+	}
+	if maxInflight > 0 {
+		log.Printf("Concurrency limit: requests beyond %d in flight receive 503 overloaded", maxInflight)
+	}
 	if fixedInputTokens >= 0 {
 		log.Printf("Reporting a fixed input token count of %d in usage", fixedInputTokens)
 	}
@@ -1975,12 +4778,54 @@ func main() {
 		Handler:            router,
 		MaxRequestBodySize: 50 * 1024 * 1024, // 50MB
 		ReadBufferSize:     1024 * 16,        // 16KB read buffer
-		ReadTimeout:        300 * time.Second,
-		WriteTimeout:       300 * time.Second,
-		IdleTimeout:        60 * time.Second,
+		ReadTimeout:        time.Duration(readTimeout) * time.Second,
+		WriteTimeout:       time.Duration(writeTimeout) * time.Second,
+		IdleTimeout:        time.Duration(idleTimeout) * time.Second,
+		MaxRequestsPerConn: maxConnRequests,
 	}
 
-	if err := server.ListenAndServe(addr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	// One server serves every address, so shutdown drains them all together.
+	listeners := make([]net.Listener, len(listenAddrs))
+	for i, a := range listenAddrs {
+		ln, err := a.listen()
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", a, err)
+		}
+		listeners[i] = ln
+	}
+	serveErr := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			serveErr <- server.Serve(ln)
+		}(ln)
+	}
+
+	// On SIGINT/SIGTERM stop accepting connections and let in-flight responses
+	// (including open streams) finish, so the tail of a benchmark run isn't
+	// skewed by connections reset mid-response.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	case sig := <-sigChan:
+		log.Printf("Received %s, draining in-flight requests (timeout %ds)...", sig, shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeout)*time.Second)
+		if err := server.ShutdownWithContext(ctx); err != nil {
+			log.Printf("Shutdown did not drain cleanly: %v", err)
+		}
+		cancel()
+	}
+	uptime := time.Since(startTime)
+	served.logSummary(uptime)
+	if latencyReportPath != "" {
+		if err := writeLatencyReport(latencyReportPath, served.latencyReport(uptime)); err != nil {
+			log.Printf("Failed to write latency report: %v", err)
+		} else {
+			log.Printf("Latency report written to %s", latencyReportPath)
+		}
 	}
 }
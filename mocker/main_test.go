@@ -1,9 +1,19 @@
 package main
 
 import (
+	"net"
+	"os"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/bytedance/sonic"
+	"github.com/maximhq/bifrost/core/schemas"
+	"github.com/valyala/fasthttp"
 )
 
 func TestProviderAliasesCoverConfiguredProviders(t *testing.T) {
@@ -429,3 +439,1211 @@ func TestStreamLatencyPerKeyOverride(t *testing.T) {
 		t.Fatalf("getStreamTotalLatency(fast-key) = %v, want 0", got)
 	}
 }
+
+func TestRouterShedsLoadPastMaxInflight(t *testing.T) {
+	prevMaxInflight := maxInflight
+	defer func() {
+		maxInflight = prevMaxInflight
+		inflight.Store(0)
+	}()
+
+	maxInflight = 1
+	inflight.Store(1) // one request already being served
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/chat/completions")
+	ctx.Request.SetBodyString(`{"model":"gpt-4o-mini"}`)
+	router(&ctx)
+	if got := ctx.Response.StatusCode(); got != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("router() over -max-inflight = %d, want 503", got)
+	}
+	if got := inflight.Load(); got != 1 {
+		t.Fatalf("inflight after rejected request = %d, want 1", got)
+	}
+
+	var health fasthttp.RequestCtx
+	health.Request.SetRequestURI("/health")
+	router(&health)
+	if got := health.Response.StatusCode(); got != fasthttp.StatusOK {
+		t.Fatalf("router(/health) over -max-inflight = %d, want 200", got)
+	}
+}
+
+func TestRateLimitBucketDrainsAndRefills(t *testing.T) {
+	start := time.Now()
+	b := &rateLimitBucket{requests: 2, tokens: 1000, last: start}
+
+	for i, want := range []int{1, 0} {
+		st := b.take(start, 100, 2, 1000)
+		if !st.allowed || st.remainingRequests != want {
+			t.Fatalf("take #%d = allowed %v, remaining %d; want allowed, remaining %d", i+1, st.allowed, st.remainingRequests, want)
+		}
+	}
+	if st := b.take(start, 100, 2, 1000); st.allowed {
+		t.Fatalf("take over the request budget was allowed")
+	} else if st.resetRequests != time.Minute {
+		t.Fatalf("resetRequests with empty bucket = %v, want 1m", st.resetRequests)
+	}
+
+	// Half a minute refills one of the two requests and tops tokens back up.
+	st := b.take(start.Add(30*time.Second), 100, 2, 1000)
+	if !st.allowed || st.remainingRequests != 0 {
+		t.Fatalf("take after 30s = allowed %v, remaining %d; want allowed, remaining 0", st.allowed, st.remainingRequests)
+	}
+	if st.remainingTokens != 900 {
+		t.Fatalf("remainingTokens = %d, want 900", st.remainingTokens)
+	}
+}
+
+func TestSendFailureResponseOverloadMode(t *testing.T) {
+	prevMode := failureMode
+	defer func() { failureMode = prevMode }()
+
+	cases := []struct {
+		provider string
+		status   int
+		marker   string
+	}{
+		{"openai", fasthttp.StatusServiceUnavailable, `"code":"overloaded"`},
+		{"anthropic", 529, `"type":"overloaded_error"`},
+		{"bedrock", fasthttp.StatusTooManyRequests, `"__type":"ThrottlingException"`},
+		{"gemini", fasthttp.StatusTooManyRequests, `"status":"RESOURCE_EXHAUSTED"`},
+	}
+
+	failureMode = "overload"
+	for _, tc := range cases {
+		var ctx fasthttp.RequestCtx
+		sendFailureResponse(&ctx, tc.provider)
+		if got := ctx.Response.StatusCode(); got != tc.status {
+			t.Errorf("sendFailureResponse(%s) status = %d, want %d", tc.provider, got, tc.status)
+		}
+		if body := string(ctx.Response.Body()); !strings.Contains(body, tc.marker) {
+			t.Errorf("sendFailureResponse(%s) body = %s, want it to contain %s", tc.provider, body, tc.marker)
+		}
+	}
+
+	failureMode = "error"
+	var ctx fasthttp.RequestCtx
+	sendFailureResponse(&ctx, "anthropic")
+	if got := ctx.Response.StatusCode(); got != fasthttp.StatusInternalServerError {
+		t.Errorf("sendFailureResponse in error mode = %d, want 500", got)
+	}
+}
+
+func TestResolveOpenRouterRoute(t *testing.T) {
+	if _, ok := resolveOpenRouterRoute("/v1/chat/completions", "openai/gpt-4o"); ok {
+		t.Fatalf("plain /v1 request with a provider prefix treated as OpenRouter")
+	}
+
+	route, ok := resolveOpenRouterRoute("/api/v1/chat/completions", "anthropic/claude-3.5-sonnet")
+	if !ok {
+		t.Fatalf("/api/v1 request not treated as OpenRouter")
+	}
+	if route.Provider != "Anthropic" || route.Model != "anthropic/claude-3.5-sonnet" {
+		t.Fatalf("route = %+v, want provider Anthropic and model anthropic/claude-3.5-sonnet", route)
+	}
+	if !strings.HasPrefix(route.GenerationID, "gen-") {
+		t.Fatalf("GenerationID = %q, want gen- prefix", route.GenerationID)
+	}
+
+	route, ok = resolveOpenRouterRoute("/v1/chat/completions", "openrouter/openai/gpt-4o")
+	if !ok || route.Provider != "OpenAI" || route.Model != "openai/gpt-4o" {
+		t.Fatalf("openrouter/ model prefix: route = %+v, ok = %v", route, ok)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int{
+		"512":   512,
+		"1KB":   1024,
+		"10kb":  10 * 1024,
+		"100K":  100 * 1024,
+		"1MB":   1024 * 1024,
+		" 2M ":  2 * 1024 * 1024,
+		"2048B": 2048,
+	}
+	for spec, want := range cases {
+		got, err := parseByteSize(spec)
+		if err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"", "KB", "ten", "-1"} {
+		if _, err := parseByteSize(spec); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestMockResponseContentHonorsPayloadBytes(t *testing.T) {
+	prev := payloadBytes
+	defer func() { payloadBytes = prev }()
+
+	payloadBytes = 0
+	if got := mockResponseContent("hello"); got != "hello" {
+		t.Fatalf("mockResponseContent with no size = %q, want base text", got)
+	}
+	for _, size := range []int{3, 1024, 100 * 1024} {
+		payloadBytes = size
+		if got := len(mockResponseContent("This is a mocked response.")); got != size {
+			t.Errorf("len(mockResponseContent) with -payload-bytes %d = %d", size, got)
+		}
+	}
+
+	// Multi-byte text is cut at a rune boundary, never inside a rune.
+	for size := 1; size <= 12; size++ {
+		payloadBytes = size
+		got := mockResponseContent("héllo wörld")
+		if !utf8.ValidString(got) || len(got) > size || len(got) < size-3 {
+			t.Errorf("mockResponseContent with -payload-bytes %d = %q (%d bytes), want valid UTF-8 within 3 bytes of the size", size, got, len(got))
+		}
+	}
+}
+
+func TestChatStreamIncludeUsageSendsFinalUsageChunk(t *testing.T) {
+	defer inflight.Store(0)
+
+	stream := func(body string) string {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(body)
+		router(&ctx)
+		return string(ctx.Response.Body())
+	}
+
+	withUsage := stream(`{"model":"gpt-4o-mini","stream":true,"stream_options":{"include_usage":true}}`)
+	events := strings.Split(strings.TrimSpace(withUsage), "\n\n")
+	if len(events) < 3 || events[len(events)-1] != "data: [DONE]" {
+		t.Fatalf("stream does not end with [DONE]: %q", withUsage)
+	}
+	usageChunk := events[len(events)-2]
+	if !strings.Contains(usageChunk, `"choices":[]`) || !strings.Contains(usageChunk, `"total_tokens"`) {
+		t.Fatalf("chunk before [DONE] = %q, want empty choices with usage", usageChunk)
+	}
+
+	if without := stream(`{"model":"gpt-4o-mini","stream":true}`); strings.Contains(without, `"usage"`) {
+		t.Fatalf("stream without include_usage carries usage: %q", without)
+	}
+}
+
+func TestChatRefusalModes(t *testing.T) {
+	prevPercent, prevMode := refusalPercent, refusalMode
+	defer func() { refusalPercent, refusalMode = prevPercent, prevMode; inflight.Store(0) }()
+
+	chat := func(body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(body)
+		router(ctx)
+		return ctx
+	}
+
+	refusalPercent, refusalMode = 100, "refusal"
+	ctx := chat(`{"model":"gpt-4o-mini"}`)
+	body := string(ctx.Response.Body())
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || !strings.Contains(body, `"refusal":"`+mockRefusalText+`"`) || strings.Contains(body, `"content"`) {
+		t.Fatalf("refusal response = %d %s, want 200 with refusal and no content", ctx.Response.StatusCode(), body)
+	}
+	streamed := string(chat(`{"model":"gpt-4o-mini","stream":true}`).Response.Body())
+	if !strings.Contains(streamed, `"refusal":"`) || strings.Contains(streamed, `"content":"`) {
+		t.Fatalf("refusal stream = %q, want refusal deltas only", streamed)
+	}
+
+	refusalMode = "content_filter"
+	ctx = chat(`{"model":"gpt-4o-mini"}`)
+	if body := string(ctx.Response.Body()); ctx.Response.StatusCode() != fasthttp.StatusBadRequest || !strings.Contains(body, `"code":"content_filter"`) {
+		t.Fatalf("content_filter response = %d %s, want 400 content_filter", ctx.Response.StatusCode(), body)
+	}
+
+	refusalPercent = 0
+	if body := string(chat(`{"model":"gpt-4o-mini"}`).Response.Body()); strings.Contains(body, "refusal") {
+		t.Fatalf("refusal sent with -refusal-percent 0: %s", body)
+	}
+}
+
+func TestAPIFlavorTokenLimitParameters(t *testing.T) {
+	prev := apiFlavor
+	defer func() { apiFlavor = prev; inflight.Store(0) }()
+
+	chat := func(body string) (int, string) {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(body)
+		router(&ctx)
+		return ctx.Response.StatusCode(), string(ctx.Response.Body())
+	}
+	maxTokens := `{"model":"gpt-4o-mini","max_tokens":64}`
+	maxCompletionTokens := `{"model":"gpt-4o-mini","max_completion_tokens":64}`
+
+	cases := []struct {
+		flavor string
+		body   string
+		status int
+	}{
+		{"compat", maxTokens, fasthttp.StatusOK},
+		{"compat", maxCompletionTokens, fasthttp.StatusOK},
+		{"legacy", maxTokens, fasthttp.StatusOK},
+		{"legacy", maxCompletionTokens, fasthttp.StatusBadRequest},
+		{"current", maxTokens, fasthttp.StatusBadRequest},
+		{"current", maxCompletionTokens, fasthttp.StatusOK},
+	}
+	for _, tc := range cases {
+		apiFlavor = tc.flavor
+		if status, body := chat(tc.body); status != tc.status {
+			t.Errorf("%s flavor with %s = %d %s, want %d", tc.flavor, tc.body, status, body, tc.status)
+		}
+	}
+
+	apiFlavor = "current"
+	if _, body := chat(maxCompletionTokens); !strings.Contains(body, `"system_fingerprint":"fp_mock"`) || !strings.Contains(body, `"completion_tokens_details"`) {
+		t.Errorf("current flavor response lacks newer fields: %s", body)
+	}
+
+	// A -port-profiles api_flavor overrides the flag for its listener.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	prevProfiles := portProfiles
+	defer func() { portProfiles = prevProfiles }()
+	portProfiles = map[int]resolvedProfile{port: {flavor: "legacy"}}
+	srv := &fasthttp.Server{Handler: router}
+	go srv.Serve(ln)
+	defer srv.Shutdown()
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{maxTokens, fasthttp.StatusOK},
+		{maxCompletionTokens, fasthttp.StatusBadRequest},
+	} {
+		req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("http://" + ln.Addr().String() + "/v1/chat/completions")
+		req.SetBodyString(tc.body)
+		if err := fasthttp.Do(req, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode() != tc.status {
+			t.Errorf("legacy port with %s = %d %s, want %d", tc.body, resp.StatusCode(), resp.Body(), tc.status)
+		}
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}
+}
+
+func TestKeyProfilesOverrideFlagConfig(t *testing.T) {
+	path := t.TempDir() + "/profiles.json"
+	profileJSON := `{
+		"fast-key": {"latency_ms": 20, "jitter_ms": 5},
+		"slow-key": {"latency_percentiles": [200, 400, 600, 1200], "failure_percent": 10, "failure_jitter": 2},
+		"Bearer flaky-key": {"failure_percent": 50}
+	}`
+	if err := os.WriteFile(path, []byte(profileJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := loadKeyProfiles(path)
+	if err != nil {
+		t.Fatalf("loadKeyProfiles: %v", err)
+	}
+
+	prev := keyProfiles
+	defer func() { keyProfiles = prev }()
+	keyProfiles = profiles
+
+	// Profiles win even when the key is not in the flag-based key list.
+	if spec, ok := resolveLatencySpec("other-key", "Bearer fast-key"); !ok || spec.latencyMs != 20 || spec.jitterMs != 5 {
+		t.Errorf("fast-key latency = %+v, %v; want 20ms ±5", spec, ok)
+	}
+	if spec, ok := resolveLatencySpec("", "Bearer slow-key"); !ok || spec.pctl == nil || spec.pctl.p99 != 1200 {
+		t.Errorf("slow-key latency = %+v, %v; want percentile spec with p99 1200", spec, ok)
+	}
+	if spec, ok := resolveFailureSpec("other-key", "Bearer slow-key"); !ok || spec.percent != 10 || spec.jitter != 2 {
+		t.Errorf("slow-key failure = %+v, %v; want 10%% ±2", spec, ok)
+	}
+	if spec, ok := resolveFailureSpec("other-key", "Bearer flaky-key"); !ok || spec.percent != 50 {
+		t.Errorf("flaky-key failure = %+v, %v; want 50%%", spec, ok)
+	}
+	// Settings a profile omits fall back to the flag-based configuration.
+	if _, ok := resolveLatencySpec("other-key", "Bearer flaky-key"); ok {
+		t.Errorf("flaky-key has no latency profile and is not listed, want no latency")
+	}
+	if _, ok := resolveFailureSpec("other-key", "Bearer fast-key"); ok {
+		t.Errorf("fast-key has no failure profile and is not listed, want no failures")
+	}
+}
+
+func TestLoadKeyProfilesRejectsInvalidEntries(t *testing.T) {
+	for _, body := range []string{
+		`{"k": {"latency_ms": 10, "latency_percentiles": [1, 2, 3, 4]}}`,
+		`{"k": {"latency_percentiles": [400, 200, 600, 1200]}}`,
+		`{"k": {"latency_percentiles": [1, 2, 3]}}`,
+		`{"k": {"failure_percent": 150}}`,
+		`{"k": {"api_flavor": "beta"}}`,
+		`not json`,
+	} {
+		path := t.TempDir() + "/profiles.json"
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadKeyProfiles(path); err == nil {
+			t.Errorf("loadKeyProfiles(%s) succeeded, want error", body)
+		}
+	}
+}
+
+func TestCheckAuthProviderScheme(t *testing.T) {
+	prevAuth, prevScheme := auth, authScheme
+	defer func() { auth, authScheme = prevAuth, prevScheme }()
+	auth, authScheme = "Bearer secret", "provider"
+
+	const sigV4 = "AWS4-HMAC-SHA256 Credential=AKID/20250101/us-east-1/bedrock/aws4_request, SignedHeaders=host;x-amz-date, Signature=abc"
+	cases := []struct {
+		name    string
+		uri     string
+		headers map[string]string
+		want    bool
+	}{
+		{"openai bearer", "/v1/chat/completions", map[string]string{"Authorization": "Bearer secret"}, true},
+		{"openai azure api-key", "/v1/chat/completions", map[string]string{"api-key": "secret"}, true},
+		{"openai wrong key", "/v1/chat/completions", map[string]string{"Authorization": "Bearer nope"}, false},
+		{"anthropic x-api-key", "/v1/messages", map[string]string{"x-api-key": "secret"}, true},
+		{"anthropic bearer only", "/v1/messages", map[string]string{"Authorization": "Bearer secret"}, false},
+		{"gemini header", "/v1beta/models/gemini-2.0-flash:generateContent", map[string]string{"x-goog-api-key": "secret"}, true},
+		{"gemini query key", "/v1beta/models/gemini-2.0-flash:generateContent?key=secret", nil, true},
+		{"gemini wrong query key", "/v1beta/models/gemini-2.0-flash:generateContent?key=nope", nil, false},
+		{"bedrock sigv4", "/model/claude/converse", map[string]string{"Authorization": sigV4, "X-Amz-Date": "20250101T000000Z"}, true},
+		{"bedrock sigv4 without date", "/model/claude/converse", map[string]string{"Authorization": sigV4}, false},
+		{"bedrock api key", "/model/claude/converse", map[string]string{"Authorization": "Bearer secret"}, true},
+		{"bedrock unsigned", "/model/claude/converse", nil, false},
+	}
+	for _, tc := range cases {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(tc.uri)
+		for k, v := range tc.headers {
+			ctx.Request.Header.Set(k, v)
+		}
+		if got := checkAuth(&ctx); got != tc.want {
+			t.Errorf("%s: checkAuth = %v, want %v (body %q)", tc.name, got, tc.want, ctx.Response.Body())
+		}
+		if !tc.want && ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", tc.name, ctx.Response.StatusCode())
+		}
+	}
+}
+
+func TestApplyPromptCache(t *testing.T) {
+	prevHit, prevShare := cacheHitPercent, cachedTokenPercent
+	defer func() { cacheHitPercent, cachedTokenPercent = prevHit, prevShare }()
+
+	cacheHitPercent, cachedTokenPercent = 100, 75
+	usage := schemas.LLMUsage{PromptTokens: 1000}
+	applyPromptCache(&usage)
+	if usage.TokenDetails == nil || usage.TokenDetails.CachedTokens != 750 {
+		t.Fatalf("cached tokens = %+v, want 750", usage.TokenDetails)
+	}
+
+	cacheHitPercent = 0
+	usage = schemas.LLMUsage{PromptTokens: 1000}
+	applyPromptCache(&usage)
+	if usage.TokenDetails != nil {
+		t.Fatalf("cache hit reported with -cache-hit-percent 0: %+v", usage.TokenDetails)
+	}
+}
+
+func TestReasoningTokens(t *testing.T) {
+	prevBudget, prevTPS, prevModels := reasoningBudget, reasoningTPS, reasoningModels
+	defer func() { reasoningBudget, reasoningTPS, reasoningModels = prevBudget, prevTPS, prevModels }()
+	reasoningBudget, reasoningTPS, reasoningModels = 1000, 500, "o1,o3"
+
+	for i := 0; i < 50; i++ {
+		if got := resolveReasoningTokens("o3-mini", ""); got < 500 || got > 1000 {
+			t.Fatalf("o3-mini reasoning tokens = %d, want 500-1000", got)
+		}
+		if got := resolveReasoningTokens("openai/o1", "high"); got < 1000 || got > 2000 {
+			t.Fatalf("high-effort reasoning tokens = %d, want 1000-2000", got)
+		}
+	}
+	if got := resolveReasoningTokens("gpt-4o", "high"); got != 0 {
+		t.Fatalf("gpt-4o reasoning tokens = %d, want 0", got)
+	}
+	if got := reasoningDelay(1000); got != 2*time.Second {
+		t.Fatalf("reasoningDelay(1000) at 500 tok/s = %s, want 2s", got)
+	}
+
+	usage := schemas.LLMUsage{PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30}
+	addReasoningUsage(&usage, 100)
+	if usage.CompletionTokens != 120 || usage.TotalTokens != 130 || usage.CompletionTokensDetails.ReasoningTokens != 100 {
+		t.Fatalf("usage after reasoning = %+v (%+v)", usage, usage.CompletionTokensDetails)
+	}
+}
+
+func TestChatLogprobs(t *testing.T) {
+	prev := logprobsDepth
+	defer func() { logprobsDepth = prev; inflight.Store(0) }()
+
+	chat := func(body string) string {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(body)
+		router(&ctx)
+		return string(ctx.Response.Body())
+	}
+
+	logprobsDepth = -1
+	var resp OpenAIChatCompletionsResponse
+	if err := sonic.UnmarshalString(chat(`{"model":"gpt-4o-mini","logprobs":true,"top_logprobs":3}`), &resp); err != nil {
+		t.Fatal(err)
+	}
+	lp := resp.Choices[0].LogProbs
+	content := *resp.Choices[0].Message.Content
+	if lp == nil || len(lp.Content) != len(strings.Fields(content)) {
+		t.Fatalf("logprobs = %+v, want one entry per word of %q", lp, content)
+	}
+	var joined strings.Builder
+	for _, entry := range lp.Content {
+		joined.WriteString(entry.Token)
+		if len(entry.TopLogprobs) != 3 || entry.TopLogprobs[0].Token != entry.Token || entry.Logprob > 0 {
+			t.Fatalf("entry = %+v, want 3 top_logprobs led by the sampled token", entry)
+		}
+	}
+	if joined.String() != content {
+		t.Fatalf("logprob tokens join to %q, want %q", joined.String(), content)
+	}
+
+	if body := chat(`{"model":"gpt-4o-mini"}`); strings.Contains(body, "logprobs") {
+		t.Fatalf("logprobs sent without being requested: %s", body)
+	}
+
+	logprobsDepth = 5
+	stream := chat(`{"model":"gpt-4o-mini","stream":true,"logprobs":true}`)
+	if !strings.Contains(stream, `"logprobs":{"content":[`) || strings.Count(stream, `"top_logprobs":[{`) == 0 {
+		t.Fatalf("stream lacks per-chunk logprobs: %q", stream)
+	}
+}
+
+func TestLatencyHistogramQuantiles(t *testing.T) {
+	var h latencyHistogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 500 * time.Millisecond}, {0.9, 900 * time.Millisecond}, {0.99, 990 * time.Millisecond}} {
+		got := h.quantile(tc.q)
+		if got < tc.want || float64(got) > float64(tc.want)*latencyBucketGrowth {
+			t.Errorf("quantile(%.2f) = %s, want within 5%% above %s", tc.q, got, tc.want)
+		}
+	}
+	if got := h.quantile(1); got != time.Second {
+		t.Errorf("quantile(1) = %s, want the exact max 1s", got)
+	}
+	if s := h.summary(); s.Count != 1000 || s.Min != 1 || s.Max != 1000 || s.Mean != 500.5 {
+		t.Errorf("summary = %+v", s)
+	}
+}
+
+func TestLatencyHistogramBins(t *testing.T) {
+	var h latencyHistogram
+	for _, d := range []time.Duration{3 * time.Millisecond, 40 * time.Millisecond, 45 * time.Millisecond, 150 * time.Millisecond, 2 * time.Minute} {
+		h.record(d)
+	}
+	got := make(map[string]int64)
+	var total int64
+	for _, bin := range h.bins() {
+		if bin.Count > 0 {
+			got[bin.Le] = bin.Count
+		}
+		total += bin.Count
+	}
+	want := map[string]int64{"5ms": 1, "50ms": 2, "200ms": 1, "+Inf": 1}
+	if total != 5 || len(got) != len(want) {
+		t.Fatalf("bins = %v, want %v", got, want)
+	}
+	for le, n := range want {
+		if got[le] != n {
+			t.Errorf("bin <= %s = %d, want %d", le, got[le], n)
+		}
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	prevFailure := failurePercent
+	defer func() { failurePercent = prevFailure; inflight.Store(0); served.reset() }()
+	served.reset()
+
+	do := func(method, uri, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.SetBodyString(body)
+		router(ctx)
+		return ctx
+	}
+	do("POST", "/v1/chat/completions", `{"model":"gpt-4o-mini"}`)
+	do("POST", "/v1/embeddings", `{"model":"text-embedding-3-small","input":"hi"}`)
+	failurePercent = 100
+	do("POST", "/v1/chat/completions", `{"model":"gpt-4o-mini"}`)
+
+	var stats statsResponse
+	if err := sonic.Unmarshal(do("GET", "/stats?reset=true", "").Response.Body(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 3 || stats.ByEndpoint["chat/completions"] != 2 || stats.ByEndpoint["embeddings"] != 1 {
+		t.Errorf("counts = total %d, by endpoint %v; want 3 with 2 chat and 1 embeddings", stats.Total, stats.ByEndpoint)
+	}
+	if stats.ByStatus["200"] != 2 || stats.ByStatus["500"] != 1 || stats.Injected["failure"] != 1 {
+		t.Errorf("by status %v, injected %v; want 2x200, 1x500, 1 injected failure", stats.ByStatus, stats.Injected)
+	}
+	if stats.Latency.Count != 3 {
+		t.Errorf("latency count = %d, want 3", stats.Latency.Count)
+	}
+
+	if err := sonic.Unmarshal(do("GET", "/stats", "").Response.Body(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 0 {
+		t.Errorf("total after reset = %d, want 0 (and /stats itself uncounted)", stats.Total)
+	}
+}
+
+func TestLengthDistribution(t *testing.T) {
+	for _, bad := range []string{"50", "x:1KB", "50:big", "0:1KB", ""} {
+		if _, err := parseLengthDistribution(bad); err == nil {
+			t.Errorf("parseLengthDistribution(%q) succeeded, want error", bad)
+		}
+	}
+	buckets, err := parseLengthDistribution("50:256, 40:2KB, 10:32KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := lengthDistribution
+	defer func() { lengthDistribution = prev }()
+	lengthDistribution = buckets
+
+	counts := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		counts[len(mockResponseContent("mock"))]++
+	}
+	for size, want := range map[int]int{256: 5000, 2048: 4000, 32768: 1000} {
+		if got := counts[size]; got < want*8/10 || got > want*12/10 {
+			t.Errorf("%d-byte responses: %d of 10000, want about %d", size, got, want)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("response sizes = %v, want only 256, 2048, and 32768", counts)
+	}
+}
+
+func TestInsufficientQuota(t *testing.T) {
+	prevTokens, prevLimits, prevUsed := quotaTokens, quotaLimits, quotaUsed
+	prevIn, prevOut, prevScheme := fixedInputTokens, fixedOutputTokens, authScheme
+	defer func() {
+		quotaTokens, quotaLimits, quotaUsed = prevTokens, prevLimits, prevUsed
+		fixedInputTokens, fixedOutputTokens, authScheme = prevIn, prevOut, prevScheme
+	}()
+	// Each request below reports, and is charged, 4 prompt + 7 completion tokens.
+	fixedInputTokens, fixedOutputTokens = 4, 7
+	quotaTokens = 20
+	quotaLimits = map[string]int{"big": 1000}
+	quotaUsed = map[string]int{}
+
+	do := func(header, key string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.Header.Set(header, key)
+		ctx.Request.SetBodyString(`{"model":"gpt-4o-mini","messages":[],"n":1}`)
+		mockChatCompletionsHandler(ctx)
+		return ctx
+	}
+	for i, want := range []int{200, 200, 429, 429} {
+		if got := do("Authorization", "Bearer small").Response.StatusCode(); got != want {
+			t.Fatalf("request %d on small key: status %d, want %d", i+1, got, want)
+		}
+	}
+	if got := quotaUsed["small"]; got != 22 {
+		t.Errorf("small key charged %d tokens, want 22 (2 x 11 tokens of usage)", got)
+	}
+	var errResp OpenAIError
+	if err := sonic.Unmarshal(do("Authorization", "Bearer small").Response.Body(), &errResp); err != nil {
+		t.Fatal(err)
+	}
+	if errResp.Error == nil || errResp.Error.Code == nil || *errResp.Error.Code != "insufficient_quota" {
+		t.Errorf("error body = %+v, want code insufficient_quota", errResp.Error)
+	}
+	if got := do("Authorization", "Bearer big").Response.StatusCode(); got != 200 {
+		t.Errorf("key with its own budget: status %d, want 200", got)
+	}
+
+	// Under -auth-scheme provider, keys sent as Azure's api-key get budgets
+	// of their own instead of sharing the empty Authorization token's.
+	authScheme = "provider"
+	for i, want := range []int{200, 200, 429} {
+		if got := do("api-key", "azure-a").Response.StatusCode(); got != want {
+			t.Fatalf("request %d on api-key azure-a: status %d, want %d", i+1, got, want)
+		}
+	}
+	if got := do("api-key", "azure-b").Response.StatusCode(); got != 200 {
+		t.Errorf("second api-key: status %d, want 200", got)
+	}
+	if _, ok := quotaUsed[""]; ok {
+		t.Errorf("api-key requests were charged to the empty key")
+	}
+
+	// The other providers' endpoints, streamed or not, are gated and charged
+	// both their prompt and completion tokens too.
+	authScheme = prevScheme
+	for _, tc := range []struct {
+		name    string
+		handler fasthttp.RequestHandler
+		path    string
+		body    string
+	}{
+		{"anthropic", mockAnthropicMessagesHandler, "/anthropic/v1/messages", `{"model":"claude-sonnet-4"}`},
+		{"anthropic-stream", mockAnthropicMessagesHandler, "/anthropic/v1/messages", `{"model":"claude-sonnet-4","stream":true}`},
+		{"chat-anthropic-stream", mockChatCompletionsHandler, "/v1/chat/completions", `{"model":"anthropic/claude-sonnet-4","messages":[],"stream":true}`},
+		{"genai", mockGenAIGenerateContentHandler, "/genai/v1beta/models/gemini-2.5-flash:generateContent", `{}`},
+		{"genai-stream", mockGenAIGenerateContentHandler, "/genai/v1beta/models/gemini-2.5-flash:streamGenerateContent", `{}`},
+		{"bedrock", mockBedrockConverseHandler, "/bedrock/model/amazon.nova-micro-v1:0/converse", `{}`},
+		{"bedrock-stream", mockBedrockConverseHandler, "/bedrock/model/amazon.nova-micro-v1:0/converse-stream", `{}`},
+	} {
+		for i, want := range []int{200, 200, 429} {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.SetRequestURI(tc.path)
+			ctx.Request.Header.Set("Authorization", "Bearer "+tc.name)
+			ctx.Request.SetBodyString(tc.body)
+			tc.handler(ctx)
+			ctx.Response.Body() // runs a stream's writer, which charges the key
+			if got := ctx.Response.StatusCode(); got != want {
+				t.Fatalf("%s request %d: status %d, want %d", tc.name, i+1, got, want)
+			}
+		}
+		if got := quotaUsed[tc.name]; got != 22 {
+			t.Errorf("%s key charged %d tokens, want 22 (2 x 11 tokens of usage)", tc.name, got)
+		}
+	}
+}
+
+func TestPortProfiles(t *testing.T) {
+	if _, err := parsePorts("8000,x"); err == nil {
+		t.Error("parsePorts accepted a non-numeric port")
+	}
+	if _, err := parsePorts("8000,8000"); err == nil {
+		t.Error("parsePorts accepted a duplicate port")
+	}
+	ports, err := parsePorts(" 8000, 8001 ,8002")
+	if err != nil || len(ports) != 3 || ports[1] != 8001 {
+		t.Fatalf("parsePorts = %v, %v", ports, err)
+	}
+
+	path := t.TempDir() + "/ports.json"
+	if err := os.WriteFile(path, []byte(`{"8001": {"latency_ms": 250}, "8002": {"failure_percent": 100}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := loadPortProfiles(path, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := profiles[8001]; p.latency == nil || p.latency.latencyMs != 250 || p.failure != nil {
+		t.Errorf("port 8001 profile = %+v, want latency 250ms only", p)
+	}
+	if p := profiles[8002]; p.failure == nil || p.failure.percent != 100 {
+		t.Errorf("port 8002 profile = %+v, want 100%% failures", p)
+	}
+	if _, err := loadPortProfiles(path, []int{8000, 8001}); err == nil {
+		t.Error("loadPortProfiles accepted a profile for a port not being listened on")
+	}
+
+	// A single listener's profile applies too.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	prevPorts, prevProfiles := listenPorts, portProfiles
+	defer func() { listenPorts, portProfiles = prevPorts, prevProfiles }()
+	listenPorts = []int{port}
+	portProfiles = map[int]resolvedProfile{port: profiles[8001]}
+	got := make(chan resolvedProfile, 1)
+	srv := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) { got <- listenerProfile(ctx) }}
+	go srv.Serve(ln)
+	defer srv.Shutdown()
+	if _, _, err := fasthttp.Get(nil, "http://"+ln.Addr().String()+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-got; p.latency == nil || p.latency.latencyMs != 250 {
+		t.Errorf("single-port profile = %+v, want latency 250ms", p)
+	}
+}
+
+func TestResponsePoolMatchesEncodedResponse(t *testing.T) {
+	prevPool, prevSize, prevIn, prevOut, prevFlavor := responsePool, payloadBytes, fixedInputTokens, fixedOutputTokens, apiFlavor
+	defer func() {
+		responsePool, payloadBytes, fixedInputTokens, fixedOutputTokens, apiFlavor = prevPool, prevSize, prevIn, prevOut, prevFlavor
+		inflight.Store(0)
+	}()
+	payloadBytes, fixedInputTokens, fixedOutputTokens = 2048, 12, 34
+
+	chat := func(pool bool) map[string]any {
+		responsePool = pool
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(`{"model":"gpt-4o-mini"}`)
+		router(&ctx)
+		var body map[string]any
+		if err := sonic.Unmarshal(ctx.Response.Body(), &body); err != nil {
+			t.Fatalf("pool=%v: invalid JSON body %q: %v", pool, ctx.Response.Body(), err)
+		}
+		if _, ok := body["created"].(float64); !ok {
+			t.Fatalf("pool=%v: body has no numeric created: %v", pool, body)
+		}
+		delete(body, "created")
+		return body
+	}
+
+	for _, flavor := range []string{"compat", "current"} {
+		apiFlavor = flavor
+		encoded := chat(false)
+		for i := 0; i < 2; i++ { // the second pooled request is served from the cached template
+			if pooled := chat(true); !reflect.DeepEqual(pooled, encoded) {
+				t.Fatalf("api-flavor %s: pooled body %v, want %v", flavor, pooled, encoded)
+			}
+		}
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := parseListenAddrs(" 127.0.0.1:8000, [::1]:8001 ,localhost:8002,unix:/tmp/mocker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []listenAddr{
+		{network: "tcp4", address: "127.0.0.1:8000", port: 8000},
+		{network: "tcp", address: "[::1]:8001", port: 8001},
+		{network: "tcp4", address: "localhost:8002", port: 8002},
+		{network: "unix", address: "/tmp/mocker.sock"},
+	}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("parseListenAddrs = %+v, want %+v", addrs, want)
+	}
+	if got := tcpListenAddr("::", 8000).address; got != "[::]:8000" {
+		t.Errorf("tcpListenAddr(::) address = %q, want [::]:8000", got)
+	}
+	for _, spec := range []string{"8000", "::1:8000", "localhost:0", "unix:", "a:1,a:1", " , "} {
+		if _, err := parseListenAddrs(spec); err == nil {
+			t.Errorf("parseListenAddrs(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestUnixListenReplacesOnlySockets(t *testing.T) {
+	dir := t.TempDir()
+	a := listenAddr{network: "unix", address: dir + "/mocker.sock"}
+
+	// A socket left behind by a previous run is replaced
+	stale, err := a.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := a.listen()
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	// Any other file is left alone
+	file := listenAddr{network: "unix", address: dir + "/data.txt"}
+	if err := os.WriteFile(file.address, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := file.listen(); err == nil {
+		ln.Close()
+		t.Fatal("listen replaced a regular file")
+	}
+	if data, err := os.ReadFile(file.address); err != nil || string(data) != "keep" {
+		t.Errorf("regular file after listen = %q, %v", data, err)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	prevOrigins, prevHeaders := corsOrigins, corsHeaders
+	defer func() { corsOrigins, corsHeaders = prevOrigins, prevHeaders; inflight.Store(0) }()
+
+	request := func(method, origin string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		if origin != "" {
+			ctx.Request.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			ctx.Request.Header.Set("Access-Control-Request-Method", "POST")
+			ctx.Request.Header.Set("Access-Control-Request-Headers", "authorization,content-type")
+		}
+		ctx.Request.SetBodyString(`{"model":"gpt-4o-mini"}`)
+		router(ctx)
+		return ctx
+	}
+
+	corsOrigins = ""
+	if ctx := request("OPTIONS", "http://dash.local"); ctx.Response.StatusCode() != fasthttp.StatusMethodNotAllowed {
+		t.Fatalf("preflight with CORS disabled = %d, want 405", ctx.Response.StatusCode())
+	}
+
+	corsOrigins = "http://dash.local, http://other.local"
+	ctx := request("OPTIONS", "http://dash.local")
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent ||
+		string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "http://dash.local" ||
+		string(ctx.Response.Header.Peek("Access-Control-Allow-Headers")) != "authorization,content-type" {
+		t.Fatalf("preflight = %d %s, want 204 allowing the origin and requested headers", ctx.Response.StatusCode(), ctx.Response.Header.String())
+	}
+	ctx = request("POST", "http://dash.local")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "http://dash.local" {
+		t.Fatalf("POST = %d %s, want 200 with Access-Control-Allow-Origin", ctx.Response.StatusCode(), ctx.Response.Header.String())
+	}
+	if ctx := request("POST", "http://evil.local"); len(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != 0 {
+		t.Fatalf("disallowed origin got CORS headers: %s", ctx.Response.Header.String())
+	}
+
+	corsOrigins, corsHeaders = "*", "Authorization"
+	ctx = request("OPTIONS", "http://any.local")
+	if string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "*" || string(ctx.Response.Header.Peek("Access-Control-Allow-Headers")) != "Authorization" {
+		t.Fatalf("wildcard preflight headers = %s", ctx.Response.Header.String())
+	}
+}
+
+func TestProviderQuirks(t *testing.T) {
+	prev := providerQuirks
+	defer func() { providerQuirks = prev; inflight.Store(0) }()
+
+	chat := func(model string) (*fasthttp.RequestCtx, map[string]any) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(`{"model":"` + model + `"}`)
+		router(ctx)
+		var body map[string]any
+		if err := sonic.Unmarshal(ctx.Response.Body(), &body); err != nil {
+			t.Fatalf("%s: invalid body %q", model, ctx.Response.Body())
+		}
+		return ctx, body
+	}
+
+	providerQuirks = false
+	if _, body := chat("groq/llama-3.3-70b-versatile"); body["x_groq"] != nil {
+		t.Fatalf("x_groq sent without -provider-quirks: %v", body)
+	}
+
+	providerQuirks = true
+	ctx, body := chat("groq/llama-3.3-70b-versatile")
+	usage := body["usage"].(map[string]any)
+	if body["x_groq"] == nil || usage["queue_time"] == nil || len(ctx.Response.Header.Peek("x-groq-region")) == 0 {
+		t.Errorf("groq response = %v, want x_groq, usage.queue_time and x-groq-region", body)
+	}
+	if _, body := chat("sonar-pro"); len(body["citations"].([]any)) == 0 || body["search_results"] == nil {
+		t.Errorf("sonar response = %v, want citations and search_results", body)
+	}
+	_, body = chat("xai/grok-3")
+	if body["system_fingerprint"] == nil || body["usage"].(map[string]any)["num_sources_used"] == nil {
+		t.Errorf("xai response = %v, want system_fingerprint and num_sources_used", body)
+	}
+	if _, body := chat("gpt-4o-mini"); body["x_groq"] != nil || body["citations"] != nil || body["usage"].(map[string]any)["num_sources_used"] != nil {
+		t.Errorf("plain OpenAI response got quirks: %v", body)
+	}
+}
+
+func TestSelfHostedQuirks(t *testing.T) {
+	prevQuirks, prevAbort := providerQuirks, quirkAbortPercent
+	defer func() { providerQuirks, quirkAbortPercent = prevQuirks, prevAbort; inflight.Store(0) }()
+	providerQuirks = true
+
+	chat := func(body string) map[string]any {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(body)
+		router(&ctx)
+		var resp map[string]any
+		if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+			t.Fatalf("invalid body %q", ctx.Response.Body())
+		}
+		return resp
+	}
+
+	quirkAbortPercent = 0
+	resp := chat(`{"model":"vllm/meta-llama/Llama-3.1-8B-Instruct","prompt_logprobs":2}`)
+	choice := resp["choices"].([]any)[0].(map[string]any)
+	if resp["model"] != "meta-llama/Llama-3.1-8B-Instruct" {
+		t.Errorf("model = %v, want the served model name echoed", resp["model"])
+	}
+	if v, ok := choice["stop_reason"]; !ok || v != nil || choice["finish_reason"] != "stop" {
+		t.Errorf("vllm choice = %v, want finish_reason stop and stop_reason null", choice)
+	}
+	logprobs, _ := resp["prompt_logprobs"].([]any)
+	if len(logprobs) < 2 || logprobs[0] != nil || len(logprobs[1].(map[string]any)) != 3 {
+		t.Errorf("prompt_logprobs = %v, want null then entries with the token and 2 alternatives", resp["prompt_logprobs"])
+	}
+	if v, ok := resp["kv_transfer_params"]; !ok || v != nil {
+		t.Errorf("kv_transfer_params missing from vllm response: %v", resp)
+	}
+	if resp := chat(`{"model":"vllm/qwen"}`); resp["prompt_logprobs"] != nil {
+		t.Errorf("prompt_logprobs = %v without being requested, want null", resp["prompt_logprobs"])
+	}
+
+	choice = chat(`{"model":"sglang/qwen2.5-7b"}`)["choices"].([]any)[0].(map[string]any)
+	if choice["matched_stop"] != float64(llamaEOSTokenID) {
+		t.Errorf("sglang choice = %v, want matched_stop %d", choice, llamaEOSTokenID)
+	}
+
+	quirkAbortPercent = 100
+	for _, model := range []string{"vllm/qwen", "sgl/qwen"} {
+		choice := chat(`{"model":"` + model + `"}`)["choices"].([]any)[0].(map[string]any)
+		if choice["finish_reason"] != "abort" || choice["matched_stop"] != nil {
+			t.Errorf("%s choice = %v, want finish_reason abort without matched_stop", model, choice)
+		}
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	prev := latency
+	defer func() { latency = prev; inflight.Store(0) }()
+	latency = 20
+
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/v1/chat/completions")
+		ctx.Request.SetBodyString(`{"model":"gpt-4o-mini"}`)
+		router(&ctx)
+		id := string(ctx.Response.Header.Peek("x-mock-request-id"))
+		if !strings.HasPrefix(id, "mock-") || ids[id] {
+			t.Fatalf("x-mock-request-id = %q, want a new mock-<n> id", id)
+		}
+		ids[id] = true
+		ms, err := strconv.ParseFloat(string(ctx.Response.Header.Peek("x-mock-processing-ms")), 64)
+		if err != nil || ms < 20 {
+			t.Fatalf("x-mock-processing-ms = %q, want at least the 20ms injected latency", ctx.Response.Header.Peek("x-mock-processing-ms"))
+		}
+	}
+}
+
+func TestResponseTemplate(t *testing.T) {
+	defer func() { responseTemplate = nil; inflight.Store(0) }()
+
+	path := t.TempDir() + "/reply.tmpl"
+	if err := os.WriteFile(path, []byte(`{{.Model}}|{{.MessageCount}}|{{.LastUserMessage}}|{{repeat 2 "ab"}}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := loadResponseTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseTemplate = tmpl
+
+	render := func(uri, body string) string {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.SetBodyString(body)
+		return responseBase(&ctx, "base")
+	}
+	cases := []struct{ uri, body, want string }{
+		{"/v1/chat/completions", `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"first"},{"role":"assistant","content":"ok"},{"role":"user","content":"second"}]}`, "openai/gpt-4o|3|second|abab"},
+		{"/v1/messages", `{"model":"claude","messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"text","text":"there"}]}]}`, "claude|1|hi there|abab"},
+		{"/v1beta/models/gemini-2.0-flash:generateContent", `{"contents":[{"role":"user","parts":[{"text":"gem"}]}]}`, "gemini-2.0-flash|1|gem|abab"},
+		{"/v1/responses", `{"model":"gpt-4o","input":"plain input"}`, "gpt-4o|1|plain input|abab"},
+	}
+	for _, tc := range cases {
+		if got := render(tc.uri, tc.body); got != tc.want {
+			t.Errorf("%s: rendered %q, want %q", tc.uri, got, tc.want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{{.Missing}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if responseTemplate, err = loadResponseTemplate(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := render("/v1/chat/completions", `{}`); got != "base" {
+		t.Errorf("failed render = %q, want the base text", got)
+	}
+}
+
+func TestDegradedKeys(t *testing.T) {
+	defer func() { degradedPercent, degradedBy = 0, "conn" }()
+	degradedPercent, degradedBy = 30, "key"
+
+	degraded := 0
+	for i := 0; i < 1000; i++ {
+		key := "Bearer sk-" + strconv.Itoa(i)
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.Set("Authorization", key)
+		first := isDegraded(&ctx)
+		for j := 0; j < 3; j++ {
+			if isDegraded(&ctx) != first {
+				t.Fatalf("key %s changed degraded state between requests", key)
+			}
+		}
+		if first {
+			degraded++
+		}
+	}
+	if degraded < 250 || degraded > 350 {
+		t.Errorf("%d of 1000 keys degraded, want about 300", degraded)
+	}
+
+	degradedPercent = 0
+	var ctx fasthttp.RequestCtx
+	if degradedDelay(&ctx) != 0 {
+		t.Error("degraded mode applied with -degraded-percent 0")
+	}
+}
+
+func TestHeaderDelay(t *testing.T) {
+	prevLatency, prevDelay := latency, headerDelay
+	defer func() { latency, headerDelay = prevLatency, prevDelay; inflight.Store(0) }()
+	latency, headerDelay = 60, 10
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/chat/completions")
+	ctx.Request.SetBodyString(`{"model":"gpt-4o-mini"}`)
+	start := time.Now()
+	router(&ctx)
+	if headers := time.Since(start); headers < 10*time.Millisecond || headers >= 60*time.Millisecond {
+		t.Fatalf("headers ready after %v, want the 10ms header delay without the 60ms latency", headers)
+	}
+	if !ctx.Response.IsBodyStream() || !ctx.Response.ImmediateHeaderFlush {
+		t.Fatal("non-streaming response body is not held back behind its headers")
+	}
+	var resp OpenAIChatCompletionsResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatalf("delayed body is not a chat completion: %v", err)
+	}
+	if total := time.Since(start); total < 70*time.Millisecond {
+		t.Errorf("body ready after %v, want header delay plus latency", total)
+	}
+	if n := inflight.Load(); n != 0 {
+		t.Errorf("inflight = %d after the body was written, want 0", n)
+	}
+}
+
+func TestCompletionsEndpoint(t *testing.T) {
+	defer inflight.Store(0)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/completions")
+	ctx.Request.SetBodyString(`{"model":"openai/gpt-3.5-turbo-instruct","prompt":["a ","b "],"echo":true}`)
+	router(&ctx)
+	var resp OpenAICompletionsResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatalf("decode: %v (%s)", err, ctx.Response.Body())
+	}
+	if resp.Object != "text_completion" || resp.Model != "gpt-3.5-turbo-instruct" || len(resp.Choices) != 2 || resp.Usage == nil {
+		t.Fatalf("unexpected completion: %s", ctx.Response.Body())
+	}
+	for i, prefix := range []string{"a ", "b "} {
+		c := resp.Choices[i]
+		if c.Index != i || !strings.HasPrefix(c.Text, prefix) || c.FinishReason == nil || *c.FinishReason != "stop" {
+			t.Errorf("choice %d = %+v, want the echoed prompt %q and finish_reason stop", i, c, prefix)
+		}
+	}
+
+	for prompt, want := range map[string]int{`"one"`: 1, `[1, 2, 3]`: 1, `["x", "y", "z"]`: 3} {
+		var p any
+		_ = sonic.UnmarshalString(prompt, &p)
+		if got := len(completionPrompts(p)); got != want {
+			t.Errorf("completionPrompts(%s) = %d prompts, want %d", prompt, got, want)
+		}
+	}
+}
+
+func TestEmbeddingsBatch(t *testing.T) {
+	defer inflight.Store(0)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/embeddings")
+	ctx.Request.SetBodyString(`{"model":"openai/text-embedding-3-small","input":["a","b","c"]}`)
+	router(&ctx)
+	var resp OpenAIEmbeddingsResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatalf("decode: %v (%s)", err, ctx.Response.Body())
+	}
+	if len(resp.Data) != 3 {
+		t.Fatalf("got %d embeddings for 3 inputs", len(resp.Data))
+	}
+	for i, d := range resp.Data {
+		if d.Index != i || len(d.Embedding) == 0 {
+			t.Errorf("embedding %d = index %d with %d dimensions", i, d.Index, len(d.Embedding))
+		}
+	}
+
+	for input, want := range map[string]int{`"one"`: 1, `[1, 2, 3]`: 1, `["x", "y"]`: 2, `[[1, 2], [3]]`: 2} {
+		var in any
+		_ = sonic.UnmarshalString(input, &in)
+		if got := embeddingInputCount(in); got != want {
+			t.Errorf("embeddingInputCount(%s) = %d, want %d", input, got, want)
+		}
+	}
+}
+
+func TestMistralAndAzureAIInference(t *testing.T) {
+	defer func() { providerQuirks = false; inflight.Store(0) }()
+	providerQuirks = true
+
+	post := func(uri, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.Set("x-ms-client-request-id", "client-1")
+		ctx.Request.SetBodyString(body)
+		router(ctx)
+		return ctx
+	}
+
+	ctx := post("/v1/chat/completions", `{"model":"mistral-large-latest","messages":[{"role":"user","content":"hi"}]}`)
+	var resp OpenAIChatCompletionsResponse
+	if err := sonic.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.ID, "cmpl-") || len(resp.ID) != len("cmpl-")+32 || resp.ID == "cmpl-mock12345" {
+		t.Errorf("mistral id = %q, want cmpl-<32 hex>", resp.ID)
+	}
+	if len(ctx.Response.Header.Peek("mistral-correlation-id")) == 0 || len(ctx.Response.Header.Peek("x-ratelimitbysize-remaining-minute")) == 0 {
+		t.Error("mistral response is missing its correlation id or rate limit headers")
+	}
+	if got := resolveQuirkProvider("", "open-mixtral-8x22b"); got != "mistral" {
+		t.Errorf("open-mixtral quirk provider = %q, want mistral", got)
+	}
+
+	if ctx := post("/models/chat/completions", `{"model":"Phi-4"}`); ctx.Response.StatusCode() != fasthttp.StatusBadRequest ||
+		!strings.Contains(string(ctx.Response.Body()), "MissingApiVersionParameter") {
+		t.Errorf("azure route without api-version = %d %s, want 400 MissingApiVersionParameter", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	ctx = post("/models/chat/completions?api-version=2024-05-01-preview", `{"model":"Phi-4"}`)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || string(ctx.Response.Header.Peek("x-ms-client-request-id")) != "client-1" ||
+		len(ctx.Response.Header.Peek("apim-request-id")) == 0 {
+		t.Errorf("azure chat = %d with headers %s, want 200 with apim-request-id and the echoed client id", ctx.Response.StatusCode(), ctx.Response.Header.Header())
+	}
+	if got := endpointName("/models/embeddings"); got != "embeddings" {
+		t.Errorf("endpointName(/models/embeddings) = %q, want embeddings", got)
+	}
+	if got := inferProviderFromPath("/models/chat/completions"); got != "azure" {
+		t.Errorf("inferProviderFromPath(/models/chat/completions) = %q, want azure", got)
+	}
+}
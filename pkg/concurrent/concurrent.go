@@ -3,12 +3,19 @@
 package concurrent
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/http/httptrace"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,53 +27,154 @@ type Request struct {
 	Body    []byte
 }
 
+// GenContext identifies the request a generator is asked to build.
+type GenContext struct {
+	// Seq is the 0-based global sequence number of the request, unique within
+	// a run and assigned in dispatch order.
+	Seq uint64
+	// WorkerID is the 0-based index of the worker that dispatched the request,
+	// in [0, numUsers). Useful for deterministic sharding, e.g. of API keys.
+	WorkerID int
+}
+
+// GenFunc builds the request described by gc.
+type GenFunc func(gc GenContext) (Request, error)
+
+// Phases breaks a request's latency down by stage, as observed through httptrace.
+// Stages that did not happen for a request (DNS, connect, and TLS on a reused
+// connection) are zero.
+type Phases struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	TTFB    time.Duration // From sending the request to the first response byte
+}
+
 // Result represents the outcome of a single request.
 type Result struct {
 	StatusCode int
 	Latency    time.Duration
 	Error      string
 	Success    bool
+	Phases     Phases
+	ConnReused bool
+	BytesIn    int64 // Response body bytes read
+	BytesOut   int64 // Request body bytes sent
 }
 
 // Metrics holds aggregated metrics from a concurrent benchmark run.
 type Metrics struct {
-	TotalRequests  int
-	SuccessCount   int
-	FailureCount   int
-	SuccessRate    float64
-	Results        []Result
-	TotalLatency    time.Duration
-	MinLatency      time.Duration
-	MaxLatency      time.Duration
+	TotalRequests int
+	SuccessCount  int
+	FailureCount  int
+	SuccessRate   float64
+	Results       []Result
+	TotalLatency  time.Duration
+	MinLatency    time.Duration
+	MaxLatency    time.Duration
+	// TotalPhases sums Phases over TracedRequests, the requests that got a
+	// response; see MeanPhases.
+	TotalPhases    Phases
+	TracedRequests int
+	ReusedConns    int
+	// TotalBytesIn and TotalBytesOut sum response and request body bytes.
+	TotalBytesIn  int64
+	TotalBytesOut int64
+	// StatusCodes counts responses by status code. FailureReasons counts failed
+	// requests as "HTTP <code>" or, when there was no response, the error.
+	StatusCodes    map[int]int
+	FailureReasons map[string]int
+	// SuccessStatuses lists the status codes counted as success for this run,
+	// in ascending order. Empty means the default: any 2xx.
+	SuccessStatuses []int
+	// SpooledSeconds is the number of per-second buckets written to the spool
+	// (WithSpool only); SpoolErr is the first error writing them.
+	SpooledSeconds int
+	SpoolErr       error
 	mu             sync.Mutex
 }
 
+// SecondBucket aggregates the results that completed within one wall-clock
+// second. WithSpool writes one bucket per line as JSON.
+type SecondBucket struct {
+	Second        int64       `json:"second"` // Unix time
+	Requests      int         `json:"requests"`
+	Successes     int         `json:"successes"`
+	Failures      int         `json:"failures"`
+	MeanLatencyMs float64     `json:"mean_latency_ms"`
+	MinLatencyMs  float64     `json:"min_latency_ms"`
+	MaxLatencyMs  float64     `json:"max_latency_ms"`
+	StatusCodes   map[int]int `json:"status_codes,omitempty"`
+	Samples       []Sample    `json:"samples"`
+
+	totalLatency time.Duration
+}
+
+// Sample is the spooled form of a single Result.
+type Sample struct {
+	LatencyMs  float64 `json:"latency_ms"`
+	StatusCode int     `json:"status_code,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// MeanPhases returns the average per-request latency breakdown. Connection
+// setup is amortized over all traced requests, so a high reuse rate shows up
+// as small DNS/connect/TLS means relative to TTFB.
+func (m *Metrics) MeanPhases() Phases {
+	if m.TracedRequests == 0 {
+		return Phases{}
+	}
+	n := time.Duration(m.TracedRequests)
+	return Phases{
+		DNS:     m.TotalPhases.DNS / n,
+		Connect: m.TotalPhases.Connect / n,
+		TLS:     m.TotalPhases.TLS / n,
+		TTFB:    m.TotalPhases.TTFB / n,
+	}
+}
+
 // Runner executes requests concurrently while maintaining a fixed number of in-flight requests.
 type Runner struct {
 	client         *http.Client
 	numUsers       int
 	duration       time.Duration
-	requestGen     func() (Request, error)
+	requestGen     GenFunc
+	seq            atomic.Uint64
 	metrics        *Metrics
 	semaphore      chan struct{}
-	wg             sync.WaitGroup
+	wg             sync.WaitGroup // Workers
+	inflight       sync.WaitGroup // Requests started by workers
 	rampUp         bool
 	rampUpDuration time.Duration
 	debug          bool
+	successCodes   map[int]bool
+
+	// Soak mode (WithSpool): completed seconds go to spool instead of memory.
+	spool      *bufio.Writer
+	maxResults int
+	buckets    map[int64]*SecondBucket
 }
 
 // NewRunner creates a new concurrent request runner.
 func NewRunner(client *http.Client, numUsers int, duration time.Duration, requestGen func() (Request, error), debug bool) *Runner {
+	return NewGenRunner(client, numUsers, duration, func(GenContext) (Request, error) { return requestGen() }, debug)
+}
+
+// NewGenRunner creates a runner whose generator receives each request's
+// sequence number and worker ID, so callers don't need their own counters.
+func NewGenRunner(client *http.Client, numUsers int, duration time.Duration, requestGen GenFunc, debug bool) *Runner {
 	return &Runner{
 		client:     client,
 		numUsers:   numUsers,
 		duration:   duration,
 		requestGen: requestGen,
 		metrics: &Metrics{
-			Results: make([]Result, 0),
+			Results:        make([]Result, 0),
+			StatusCodes:    make(map[int]int),
+			FailureReasons: make(map[string]int),
 		},
 		semaphore: make(chan struct{}, numUsers),
-		debug:      debug,
+		debug:     debug,
 	}
 }
 
@@ -77,6 +185,42 @@ func (r *Runner) WithRampUp(rampUpDuration time.Duration) *Runner {
 	return r
 }
 
+// WithSuccessStatuses replaces the default 2xx success check with an explicit
+// set of status codes, e.g. 200 and 429 for throttling experiments where a
+// rate-limited response is the expected outcome.
+func (r *Runner) WithSuccessStatuses(codes ...int) *Runner {
+	r.successCodes = make(map[int]bool, len(codes))
+	for _, code := range codes {
+		r.successCodes[code] = true
+	}
+	r.metrics.SuccessStatuses = make([]int, 0, len(r.successCodes))
+	for code := range r.successCodes {
+		r.metrics.SuccessStatuses = append(r.metrics.SuccessStatuses, code)
+	}
+	sort.Ints(r.metrics.SuccessStatuses)
+	return r
+}
+
+// WithSpool enables soak mode for multi-hour runs. Results are grouped into
+// per-second buckets, and every completed second is written to w as one JSON
+// SecondBucket line, samples included, then dropped from memory. Metrics
+// totals still cover the whole run, but Results keeps only a uniform random
+// sample of at most maxResults results, enough for percentiles.
+func (r *Runner) WithSpool(w io.Writer, maxResults int) *Runner {
+	r.spool = bufio.NewWriter(w)
+	r.maxResults = maxResults
+	r.buckets = make(map[int64]*SecondBucket)
+	return r
+}
+
+// isSuccess reports whether statusCode satisfies the runner's success criteria.
+func (r *Runner) isSuccess(statusCode int) bool {
+	if len(r.successCodes) > 0 {
+		return r.successCodes[statusCode]
+	}
+	return statusCode >= 200 && statusCode < 300
+}
+
 // Run executes the concurrent request benchmark and returns metrics.
 func (r *Runner) Run(ctx context.Context) *Metrics {
 	ctx, cancel := context.WithTimeout(ctx, r.duration)
@@ -87,6 +231,14 @@ func (r *Runner) Run(ctx context.Context) *Metrics {
 		go r.reportStatusPeriodically(ctx)
 	}
 
+	// Rotate completed seconds to the spool while the run is going
+	rotatorDone := make(chan struct{})
+	if r.spool != nil {
+		go r.rotateSpool(ctx, rotatorDone)
+	} else {
+		close(rotatorDone)
+	}
+
 	if r.rampUp {
 		// Run with ramp-up: gradually increase workers over ramp-up duration
 		r.runWithRampUp(ctx)
@@ -94,12 +246,18 @@ func (r *Runner) Run(ctx context.Context) *Metrics {
 		// Run with all workers immediately
 		for i := 0; i < r.numUsers; i++ {
 			r.wg.Add(1)
-			go r.worker(ctx)
+			go r.worker(ctx, i)
 		}
 	}
 
-	// Wait for all workers to complete
+	// Wait for all workers to complete, then for the requests they started,
+	// so every result is counted and spooled before metrics are returned
 	r.wg.Wait()
+	r.inflight.Wait()
+	<-rotatorDone
+	if r.spool != nil {
+		r.flushSpool(time.Now().Unix() + 1)
+	}
 
 	// Calculate success rate
 	if r.metrics.TotalRequests > 0 {
@@ -109,6 +267,60 @@ func (r *Runner) Run(ctx context.Context) *Metrics {
 	return r.metrics
 }
 
+// rotateSpool flushes every completed second to the spool once a second
+// until ctx is done.
+func (r *Runner) rotateSpool(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.flushSpool(now.Unix())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushSpool writes and forgets all buckets for seconds before cutoff. Results
+// are bucketed by the second they are recorded in, so those are complete.
+func (r *Runner) flushSpool(cutoff int64) {
+	r.metrics.mu.Lock()
+	var ready []*SecondBucket
+	for second, b := range r.buckets {
+		if second < cutoff {
+			ready = append(ready, b)
+			delete(r.buckets, second)
+		}
+	}
+	r.metrics.mu.Unlock()
+
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Second < ready[j].Second })
+	enc := json.NewEncoder(r.spool)
+	for _, b := range ready {
+		if b.Requests > 0 {
+			b.MeanLatencyMs = float64(b.totalLatency) / float64(b.Requests) / float64(time.Millisecond)
+		}
+		err := enc.Encode(b)
+		r.metrics.mu.Lock()
+		if err != nil && r.metrics.SpoolErr == nil {
+			r.metrics.SpoolErr = err
+		}
+		r.metrics.SpooledSeconds++
+		r.metrics.mu.Unlock()
+	}
+	// Keep the file current, so a long run that dies loses at most a second
+	if err := r.spool.Flush(); err != nil {
+		r.metrics.mu.Lock()
+		if r.metrics.SpoolErr == nil {
+			r.metrics.SpoolErr = err
+		}
+		r.metrics.mu.Unlock()
+	}
+}
+
 // reportStatusPeriodically reports metrics every 30 seconds in debug mode.
 func (r *Runner) reportStatusPeriodically(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
@@ -153,7 +365,7 @@ func (r *Runner) runWithRampUp(ctx context.Context) {
 				rampUpStarted = true
 				// Start first worker immediately
 				r.wg.Add(1)
-				go r.worker(ctx)
+				go r.worker(ctx, 0)
 				workersStarted = 1
 				if r.debug {
 					fmt.Printf("[DEBUG] [%.2fs] Started initial worker (total: %d)\n", elapsed.Seconds(), workersStarted)
@@ -172,7 +384,7 @@ func (r *Runner) runWithRampUp(ctx context.Context) {
 					previousWorkers := workersStarted
 					for workersStarted < targetWorkers && workersStarted < r.numUsers {
 						r.wg.Add(1)
-						go r.worker(ctx)
+						go r.worker(ctx, workersStarted)
 						workersStarted++
 					}
 					if r.debug {
@@ -185,7 +397,7 @@ func (r *Runner) runWithRampUp(ctx context.Context) {
 					previousWorkers := workersStarted
 					for workersStarted < r.numUsers {
 						r.wg.Add(1)
-						go r.worker(ctx)
+						go r.worker(ctx, workersStarted)
 						workersStarted++
 					}
 					if r.debug {
@@ -203,7 +415,8 @@ func (r *Runner) runWithRampUp(ctx context.Context) {
 }
 
 // worker is a worker goroutine that continuously makes requests while semaphore slots are available.
-func (r *Runner) worker(ctx context.Context) {
+// id is reported to the generator as GenContext.WorkerID.
+func (r *Runner) worker(ctx context.Context, id int) {
 	defer r.wg.Done()
 
 	for {
@@ -218,7 +431,8 @@ func (r *Runner) worker(ctx context.Context) {
 		select {
 		case r.semaphore <- struct{}{}:
 			// Slot acquired, make request in background
-			go r.makeRequest()
+			r.inflight.Add(1)
+			go r.makeRequest(GenContext{Seq: r.seq.Add(1) - 1, WorkerID: id})
 		case <-ctx.Done():
 			return
 		}
@@ -226,11 +440,12 @@ func (r *Runner) worker(ctx context.Context) {
 }
 
 // makeRequest makes a single HTTP request and releases the semaphore slot.
-func (r *Runner) makeRequest() {
+func (r *Runner) makeRequest(gc GenContext) {
+	defer r.inflight.Done()
 	defer func() { <-r.semaphore }() // Always release the slot
 
 	// Generate request
-	req, err := r.requestGen()
+	req, err := r.requestGen(gc)
 	if err != nil {
 		r.recordResult(Result{
 			Success: false,
@@ -260,6 +475,10 @@ func (r *Runner) makeRequest() {
 		httpReq.ContentLength = int64(len(req.Body))
 	}
 
+	// Trace connection setup and time to first byte
+	rt := &requestTrace{}
+	httpReq = httpReq.WithContext(httptrace.WithClientTrace(httpReq.Context(), rt.clientTrace()))
+
 	// Make request and measure latency
 	start := time.Now()
 	resp, err := r.client.Do(httpReq)
@@ -276,15 +495,74 @@ func (r *Runner) makeRequest() {
 	}
 	defer resp.Body.Close()
 
+	// Drain the body to count it; this also lets the connection be reused
+	bytesIn, _ := io.Copy(io.Discard, resp.Body)
+
 	// Record result
-	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+	success := r.isSuccess(resp.StatusCode)
+	phases, reused := rt.snapshot()
 	r.recordResult(Result{
 		StatusCode: resp.StatusCode,
 		Latency:    latency,
 		Success:    success,
+		Phases:     phases,
+		ConnReused: reused,
+		BytesIn:    bytesIn,
+		BytesOut:   int64(len(req.Body)),
 	})
 }
 
+// requestTrace collects the httptrace timings of one request. net/http calls
+// the DNS and connect hooks from its dialing goroutine, possibly for several
+// racing dials, and a dial may finish after the request took another idle
+// connection, hence the lock.
+type requestTrace struct {
+	mu                                        sync.Mutex
+	phases                                    Phases
+	reused                                    bool
+	dnsStart, connectStart, tlsStart, wroteAt time.Time
+}
+
+// clientTrace returns the hooks that fill t.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.set(func() { t.dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.set(func() { t.phases.DNS = time.Since(t.dnsStart) }) },
+		ConnectStart: func(string, string) {
+			t.set(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			t.set(func() { t.phases.Connect = time.Since(t.connectStart) })
+		},
+		TLSHandshakeStart: func() { t.set(func() { t.tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.set(func() { t.phases.TLS = time.Since(t.tlsStart) })
+		},
+		GotConn:      func(info httptrace.GotConnInfo) { t.set(func() { t.reused = info.Reused }) },
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.set(func() { t.wroteAt = time.Now() }) },
+		GotFirstResponseByte: func() {
+			t.set(func() {
+				if !t.wroteAt.IsZero() {
+					t.phases.TTFB = time.Since(t.wroteAt)
+				}
+			})
+		},
+	}
+}
+
+func (t *requestTrace) set(update func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	update()
+}
+
+// snapshot returns the phases and connection reuse recorded so far.
+func (t *requestTrace) snapshot() (Phases, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.phases, t.reused
+}
+
 // recordResult safely records a result and updates metrics.
 func (r *Runner) recordResult(result Result) {
 	r.metrics.mu.Lock()
@@ -306,5 +584,72 @@ func (r *Runner) recordResult(result Result) {
 		r.metrics.MinLatency = result.Latency
 	}
 
-	r.metrics.Results = append(r.metrics.Results, result)
+	r.metrics.TotalBytesIn += result.BytesIn
+	r.metrics.TotalBytesOut += result.BytesOut
+
+	if result.StatusCode > 0 {
+		r.metrics.StatusCodes[result.StatusCode]++
+	}
+	if !result.Success {
+		if result.StatusCode > 0 {
+			r.metrics.FailureReasons[fmt.Sprintf("HTTP %d", result.StatusCode)]++
+		} else {
+			r.metrics.FailureReasons[result.Error]++
+		}
+	}
+
+	// Track latency breakdown for requests that got a response
+	if result.StatusCode > 0 {
+		r.metrics.TracedRequests++
+		r.metrics.TotalPhases.DNS += result.Phases.DNS
+		r.metrics.TotalPhases.Connect += result.Phases.Connect
+		r.metrics.TotalPhases.TLS += result.Phases.TLS
+		r.metrics.TotalPhases.TTFB += result.Phases.TTFB
+		if result.ConnReused {
+			r.metrics.ReusedConns++
+		}
+	}
+
+	if r.spool == nil {
+		r.metrics.Results = append(r.metrics.Results, result)
+		return
+	}
+
+	// Soak mode: bucket by second for the spool, and keep a bounded uniform
+	// sample in Results (reservoir sampling)
+	r.addToBucket(result)
+	if len(r.metrics.Results) < r.maxResults {
+		r.metrics.Results = append(r.metrics.Results, result)
+	} else if i := rand.Intn(r.metrics.TotalRequests); i < r.maxResults {
+		r.metrics.Results[i] = result
+	}
+}
+
+// addToBucket adds result to the bucket of the current second. Callers hold
+// metrics.mu.
+func (r *Runner) addToBucket(result Result) {
+	second := time.Now().Unix()
+	b, ok := r.buckets[second]
+	if !ok {
+		b = &SecondBucket{Second: second, StatusCodes: make(map[int]int)}
+		r.buckets[second] = b
+	}
+	ms := float64(result.Latency) / float64(time.Millisecond)
+	b.Requests++
+	if result.Success {
+		b.Successes++
+	} else {
+		b.Failures++
+	}
+	if b.Requests == 1 || ms < b.MinLatencyMs {
+		b.MinLatencyMs = ms
+	}
+	if ms > b.MaxLatencyMs {
+		b.MaxLatencyMs = ms
+	}
+	b.totalLatency += result.Latency
+	if result.StatusCode > 0 {
+		b.StatusCodes[result.StatusCode]++
+	}
+	b.Samples = append(b.Samples, Sample{LatencyMs: ms, StatusCode: result.StatusCode, Error: result.Error})
 }
@@ -0,0 +1,114 @@
+package concurrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunSpoolsInFlightRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	gen := func() (Request, error) { return Request{Method: http.MethodGet, URL: server.URL}, nil }
+	var spool bytes.Buffer
+	metrics := NewRunner(server.Client(), 4, 120*time.Millisecond, gen, false).
+		WithSpool(&spool, 1000).
+		Run(context.Background())
+
+	if metrics.SpoolErr != nil {
+		t.Fatalf("spool error: %v", metrics.SpoolErr)
+	}
+	spooled := 0
+	scanner := bufio.NewScanner(&spool)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var b SecondBucket
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			t.Fatalf("bad spool line %q: %v", scanner.Text(), err)
+		}
+		spooled += b.Requests
+	}
+	// Anything still in flight after Run would be counted late and never spooled
+	time.Sleep(100 * time.Millisecond)
+	metrics.mu.Lock()
+	total := metrics.TotalRequests
+	metrics.mu.Unlock()
+	if total == 0 || spooled != total {
+		t.Fatalf("spooled %d requests, metrics counted %d", spooled, total)
+	}
+}
+
+func TestRunSuccessStatusesAndPhases(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		switch r.URL.Path {
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// Fresh connections for every request, so the dial hooks run for each
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	paths := []string{"/", "/limited", "/missing"}
+	gen := func(gc GenContext) (Request, error) {
+		return Request{Method: http.MethodGet, URL: server.URL + paths[gc.Seq%3]}, nil
+	}
+	metrics := NewGenRunner(client, 8, 150*time.Millisecond, gen, false).
+		WithSuccessStatuses(429, 200, 200).
+		Run(context.Background())
+
+	if want := []int{200, 429}; !reflect.DeepEqual(metrics.SuccessStatuses, want) {
+		t.Fatalf("SuccessStatuses = %v, want %v", metrics.SuccessStatuses, want)
+	}
+	if metrics.StatusCodes[429] == 0 || metrics.StatusCodes[404] == 0 {
+		t.Fatalf("expected 429 and 404 responses, got %v", metrics.StatusCodes)
+	}
+	if metrics.SuccessCount != metrics.StatusCodes[200]+metrics.StatusCodes[429] {
+		t.Fatalf("SuccessCount = %d, status codes %v", metrics.SuccessCount, metrics.StatusCodes)
+	}
+
+	mean := metrics.MeanPhases()
+	if metrics.TracedRequests != metrics.TotalRequests {
+		t.Fatalf("traced %d of %d requests", metrics.TracedRequests, metrics.TotalRequests)
+	}
+	if mean.Connect <= 0 || mean.TTFB <= 0 || mean.TLS != 0 {
+		t.Fatalf("unexpected mean phases %+v", mean)
+	}
+	if metrics.ReusedConns != 0 {
+		t.Fatalf("ReusedConns = %d with keep-alives disabled", metrics.ReusedConns)
+	}
+}
+
+func TestMeanPhases(t *testing.T) {
+	cases := []struct {
+		name   string
+		traced int
+		total  Phases
+		want   Phases
+	}{
+		{"no traced requests", 0, Phases{TTFB: time.Second}, Phases{}},
+		{
+			"averaged over traced requests", 4,
+			Phases{DNS: 4 * time.Millisecond, Connect: 8 * time.Millisecond, TTFB: 40 * time.Millisecond},
+			Phases{DNS: time.Millisecond, Connect: 2 * time.Millisecond, TTFB: 10 * time.Millisecond},
+		},
+	}
+	for _, tc := range cases {
+		m := &Metrics{TracedRequests: tc.traced, TotalPhases: tc.total}
+		if got := m.MeanPhases(); got != tc.want {
+			t.Fatalf("%s: MeanPhases() = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}